@@ -3,14 +3,21 @@
 package nftlib
 
 import (
+	"fmt"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
+	"strconv"
+	"strings"
 )
 
 const (
-	ChainHookInput   chainHook = "input"
-	ChainHookOutput  chainHook = "output"
-	ChainHookForward chainHook = "forward"
+	ChainHookPrerouting  chainHook = "prerouting"
+	ChainHookInput       chainHook = "input"
+	ChainHookOutput      chainHook = "output"
+	ChainHookForward     chainHook = "forward"
+	ChainHookPostrouting chainHook = "postrouting"
+	ChainHookIngress     chainHook = "ingress"
+	ChainHookEgress      chainHook = "egress"
 
 	ChainTypeFilter chainType = "filter"
 	ChainTypeRoute  chainType = "route"
@@ -18,6 +25,20 @@ const (
 
 	ChainPolicyAccept chainPolicy = "accept"
 	ChainPolicyDrop   chainPolicy = "drop"
+
+	// ip/ip6/inet/arp/netdev协议族的标准优先级
+	ChainPriorityRaw      int32 = -300
+	ChainPriorityMangle   int32 = -150
+	ChainPriorityDstNat   int32 = -100
+	ChainPriorityFilter   int32 = 0
+	ChainPrioritySecurity int32 = 50
+	ChainPrioritySrcNat   int32 = 100
+
+	// bridge协议族的标准优先级
+	ChainPriorityBridgeDstNat int32 = -300
+	ChainPriorityBridgeFilter int32 = -200
+	ChainPriorityBridgeOut    int32 = 100
+	ChainPriorityBridgeSrcNat int32 = 300
 )
 
 type Chain struct {
@@ -28,6 +49,8 @@ type Chain struct {
 	Hook     chainHook   `json:"hook,omitempty"`
 	Type     chainType   `json:"type,omitempty"`
 	Policy   chainPolicy `json:"policy,omitempty"`
+	// Device netdev表ingress/egress链及inet表ingress链绑定的网卡
+	Device string `json:"device,omitempty"`
 }
 
 type (
@@ -36,12 +59,202 @@ type (
 	chainPolicy string
 )
 
+var (
+	// inetHooks ip/ip6/inet/bridge协议族的钩子编号
+	inetHooks = map[chainHook]nftables.ChainHook{
+		ChainHookPrerouting:  *nftables.ChainHookPrerouting,
+		ChainHookInput:       *nftables.ChainHookInput,
+		ChainHookForward:     *nftables.ChainHookForward,
+		ChainHookOutput:      *nftables.ChainHookOutput,
+		ChainHookPostrouting: *nftables.ChainHookPostrouting,
+	}
+	// familyHooks 各协议族支持的钩子及编号, 不同协议族中相同编号对应不同钩子
+	familyHooks = map[tableFamily]map[chainHook]nftables.ChainHook{
+		TableFamilyIpv4:   inetHooks,
+		TableFamilyIpv6:   inetHooks,
+		TableFamilyBridge: inetHooks,
+		TableFamilyInet: {
+			ChainHookPrerouting:  *nftables.ChainHookPrerouting,
+			ChainHookInput:       *nftables.ChainHookInput,
+			ChainHookForward:     *nftables.ChainHookForward,
+			ChainHookOutput:      *nftables.ChainHookOutput,
+			ChainHookPostrouting: *nftables.ChainHookPostrouting,
+			// NF_INET_INGRESS
+			ChainHookIngress: 5,
+		},
+		// NF_ARP_IN, NF_ARP_OUT
+		TableFamilyArp: {
+			ChainHookInput:  0,
+			ChainHookOutput: 1,
+		},
+		TableFamilyNetdev: {
+			ChainHookIngress: *nftables.ChainHookIngress,
+			ChainHookEgress:  *nftables.ChainHookEgress,
+		},
+	}
+	// typeFamilies typeHooks nat与route链支持的协议族与钩子, filter链不限制
+	typeFamilies = map[chainType][]tableFamily{
+		ChainTypeNat:   {TableFamilyIpv4, TableFamilyIpv6, TableFamilyInet},
+		ChainTypeRoute: {TableFamilyIpv4, TableFamilyIpv6, TableFamilyInet},
+	}
+	typeHooks = map[chainType][]chainHook{
+		ChainTypeNat:   {ChainHookPrerouting, ChainHookInput, ChainHookOutput, ChainHookPostrouting},
+		ChainTypeRoute: {ChainHookOutput},
+	}
+	// priorityNames 优先级关键字对应的数值, bridge协议族使用不同的取值
+	priorityNames = map[string]int32{
+		"raw":      ChainPriorityRaw,
+		"mangle":   ChainPriorityMangle,
+		"dstnat":   ChainPriorityDstNat,
+		"filter":   ChainPriorityFilter,
+		"security": ChainPrioritySecurity,
+		"srcnat":   ChainPrioritySrcNat,
+	}
+	bridgePriorityNames = map[string]int32{
+		"dstnat": ChainPriorityBridgeDstNat,
+		"filter": ChainPriorityBridgeFilter,
+		"out":    ChainPriorityBridgeOut,
+		"srcnat": ChainPriorityBridgeSrcNat,
+	}
+)
+
+// ParsePriority 解析链优先级, 支持数字、关键字及关键字加减偏移, 如 -150, mangle, filter + 10, dstnat-5
+// 关键字的取值与协议族相关, bridge协议族中filter为-200
+func ParsePriority(family tableFamily, prio string) (int32, error) {
+	var (
+		s     = strings.Join(strings.Fields(prio), "")
+		names = priorityNames
+	)
+	if family == TableFamilyBridge {
+		names = bridgePriorityNames
+	}
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return int32(n), nil
+	}
+	name, offset := s, ""
+	if i := strings.IndexAny(s, "+-"); i > 0 {
+		name, offset = s[:i], s[i:]
+	}
+	base, ok := names[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown priority %q for %s family", ErrInvalidChain, prio, family)
+	}
+	if offset == "" {
+		return base, nil
+	}
+	n, err := strconv.ParseInt(offset, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid priority offset %q", ErrInvalidChain, prio)
+	}
+	return base + int32(n), nil
+}
+
+// priorityHooks 仅可用于部分钩子的优先级关键字
+var priorityHooks = map[string][]chainHook{
+	"dstnat": {ChainHookPrerouting, ChainHookOutput},
+	"srcnat": {ChainHookPostrouting, ChainHookInput},
+}
+
+// PriorityString 以nft list ruleset的格式输出链优先级, 与协议族及钩子可用的关键字相差不超过10时
+// 输出为关键字加减偏移, 如 filter, dstnat - 5, 否则输出为数字
+func PriorityString(family tableFamily, hook chainHook, prio int32) string {
+	names, hooks := priorityNames, priorityHooks
+	if family == TableFamilyBridge {
+		names = bridgePriorityNames
+		hooks = map[string][]chainHook{
+			"dstnat": {ChainHookPrerouting},
+			"out":    {ChainHookOutput},
+			"srcnat": {ChainHookPostrouting},
+		}
+	}
+	for name, base := range names {
+		if family == TableFamilyNetdev && name != "filter" {
+			continue
+		}
+		if hs, ok := hooks[name]; ok && !inHooks(hs, hook) {
+			continue
+		}
+		switch offset := prio - base; {
+		case offset == 0:
+			return name
+		case offset > 0 && offset <= 10:
+			return fmt.Sprintf("%s + %d", name, offset)
+		case offset < 0 && offset >= -10:
+			return fmt.Sprintf("%s - %d", name, -offset)
+		}
+	}
+	return strconv.Itoa(int(prio))
+}
+
+// Validate 检查基础链的类型、钩子、网卡与表协议族的组合是否被内核支持, 普通链总是有效
+func (d *Chain) Validate() error {
+	if d.Hook == "" {
+		if d.Type != "" || d.Device != "" {
+			return fmt.Errorf("%w: regular chain %s with type or device", ErrInvalidChain, d.Name)
+		}
+		return nil
+	}
+	var family tableFamily
+	if d.Table != nil {
+		family = d.Table.Family
+	}
+	hooks, ok := familyHooks[family]
+	if !ok {
+		return fmt.Errorf("%w: unknown table family %q", ErrInvalidChain, family)
+	}
+	if _, ok = hooks[d.Hook]; !ok {
+		return fmt.Errorf("%w: hook %s not supported by %s family", ErrInvalidChain, d.Hook, family)
+	}
+	switch d.Type {
+	case ChainTypeFilter:
+	case ChainTypeNat, ChainTypeRoute:
+		if !inFamilies(typeFamilies[d.Type], family) {
+			return fmt.Errorf("%w: %s chain not supported by %s family", ErrInvalidChain, d.Type, family)
+		}
+		if !inHooks(typeHooks[d.Type], d.Hook) {
+			return fmt.Errorf("%w: %s chain not supported on %s hook", ErrInvalidChain, d.Type, d.Hook)
+		}
+	default:
+		return fmt.Errorf("%w: unknown chain type %q", ErrInvalidChain, d.Type)
+	}
+	// ingress/egress钩子需要绑定网卡
+	needDevice := d.Hook == ChainHookIngress || d.Hook == ChainHookEgress
+	if needDevice && d.Device == "" {
+		return fmt.Errorf("%w: %s hook requires a device", ErrInvalidChain, d.Hook)
+	}
+	if !needDevice && d.Device != "" {
+		return fmt.Errorf("%w: device not supported on %s hook", ErrInvalidChain, d.Hook)
+	}
+	return nil
+}
+
+func inFamilies(l []tableFamily, family tableFamily) bool {
+	for _, v := range l {
+		if v == family {
+			return true
+		}
+	}
+	return false
+}
+
+func inHooks(l []chainHook, hook chainHook) bool {
+	for _, v := range l {
+		if v == hook {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Chain) NewRule() *Rule {
 	return &Rule{Chain: d, conn: d.Conn}
 }
 
 func (d *Chain) ClearRule() {
 	d.Conn.FlushChain(d.toNch())
+	c := d.Table.change(ChangeFlush, ObjChain)
+	c.Name = d.Name
+	d.Conn.record(c)
 }
 
 func (d *Chain) AddRule(rule *Rule, handle ...uint64) error {
@@ -49,9 +262,13 @@ func (d *Chain) AddRule(rule *Rule, handle ...uint64) error {
 	rule.Chain = d
 	nrule, err := rule.toNRule(handle...)
 	if err != nil {
-		return err
+		return d.ruleErr("add", rule, err)
+	}
+	if err = d.addAnonSets(rule); err != nil {
+		return d.ruleErr("add", rule, err)
 	}
 	d.Conn.AddRule(nrule)
+	d.recordRule(ChangeAdd, rule)
 	return nil
 }
 
@@ -60,9 +277,13 @@ func (d *Chain) InsertRule(rule *Rule, handle ...uint64) error {
 	rule.Chain = d
 	nrule, err := rule.toNRule(handle...)
 	if err != nil {
-		return err
+		return d.ruleErr("insert", rule, err)
+	}
+	if err = d.addAnonSets(rule); err != nil {
+		return d.ruleErr("insert", rule, err)
 	}
 	d.Conn.InsertRule(nrule)
+	d.recordRule(ChangeAdd, rule)
 	return nil
 }
 
@@ -71,12 +292,13 @@ func (d *Chain) DelRule(rule *Rule) error {
 	rule.Chain = d
 	nrule, err := rule.toNRule()
 	if err != nil {
-		return err
+		return d.ruleErr("delete", rule, err)
 	}
 	err = d.Conn.DelRule(nrule)
 	if err != nil {
-		return err
+		return d.ruleErr("delete", rule, err)
 	}
+	d.recordRule(ChangeDelete, rule)
 	return nil
 }
 
@@ -85,9 +307,24 @@ func (d *Chain) ReplaceRule(rule *Rule) error {
 	rule.Chain = d
 	nrule, err := rule.toNRule()
 	if err != nil {
-		return err
+		return d.ruleErr("replace", rule, err)
+	}
+	if err = d.addAnonSets(rule); err != nil {
+		return d.ruleErr("replace", rule, err)
 	}
 	d.Conn.ReplaceRule(nrule)
+	d.recordRule(ChangeReplace, rule)
+	return nil
+}
+
+// addAnonSets 将规则引用的匿名集合加入当前批次, 并回填规则中lookup的集合名与ID
+func (d *Chain) addAnonSets(rule *Rule) error {
+	for _, as := range rule.anonSets {
+		if err := d.Conn.AddSet(as.set, as.elems); err != nil {
+			return err
+		}
+		as.lookup.SetName, as.lookup.SetID = as.set.Name, as.set.ID
+	}
 	return nil
 }
 
@@ -95,13 +332,13 @@ func (d *Chain) ListRule() ([]*Rule, error) {
 	var r []*Rule
 	nrlist, err := d.Conn.GetRule(d.Table.toNTable(), d.toNch())
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("list", ObjChain, err).table(d.Table.Name).name(d.Name)
 	}
 	for _, nr := range nrlist {
 		rule := &Rule{Chain: d, conn: d.Conn}
 		err = rule.toRule(*nr)
 		if err != nil {
-			return nil, err
+			return nil, d.ruleErr("list", rule, err)
 		}
 		r = append(r, rule)
 	}
@@ -112,6 +349,21 @@ func (d *Chain) Commit() error {
 	return d.Conn.Commit()
 }
 
+func (d *Chain) recordRule(op changeOp, rule *Rule) {
+	c := d.Table.change(op, ObjRule)
+	c.Chain, c.Handle = d.Name, rule.Handle
+	if op == ChangeDelete {
+		c.Old = rule.String()
+	} else {
+		c.New = rule.String()
+	}
+	d.Conn.record(c)
+}
+
+func (d *Chain) ruleErr(op string, rule *Rule, err error) error {
+	return newObjErr(op, ObjRule, err).table(d.Table.Name).chain(d.Name).handle(rule.Handle)
+}
+
 func (d *Chain) toCh(nch nftables.Chain) {
 	d.Name = nch.Name
 	switch nch.Type {
@@ -123,13 +375,16 @@ func (d *Chain) toCh(nch nftables.Chain) {
 		d.Type = ChainTypeNat
 	}
 
-	switch nch.Hooknum {
-	case nftables.ChainHookInput:
-		d.Hook = ChainHookInput
-	case nftables.ChainHookOutput:
-		d.Hook = ChainHookOutput
-	case nftables.ChainHookForward:
-		d.Hook = ChainHookForward
+	if nch.Hooknum != nil && d.Table != nil {
+		for hook, num := range familyHooks[d.Table.Family] {
+			if num == *nch.Hooknum {
+				d.Hook = hook
+			}
+		}
+	}
+	d.Device = nch.Device
+	if nch.Priority != nil {
+		d.Priority = int32(*nch.Priority)
 	}
 
 	if nch.Policy != nil {
@@ -157,14 +412,12 @@ func (d *Chain) toNch() *nftables.Chain {
 	case ChainTypeNat:
 		nch.Type = nftables.ChainTypeNAT
 	}
-	switch d.Hook {
-	case ChainHookOutput:
-		nch.Hooknum = nftables.ChainHookOutput
-	case ChainHookInput:
-		nch.Hooknum = nftables.ChainHookInput
-	case ChainHookForward:
-		nch.Hooknum = nftables.ChainHookForward
+	// 钩子与优先级需同时设置, 否则内核创建的是普通链
+	if num, ok := familyHooks[d.Table.Family][d.Hook]; ok {
+		nch.Hooknum = nftables.ChainHookRef(num)
+		nch.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(d.Priority))
 	}
+	nch.Device = d.Device
 	switch d.Policy {
 	case ChainPolicyAccept:
 		plc := nftables.ChainPolicyAccept
@@ -0,0 +1,135 @@
+// +build linux
+
+package nftlib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChain_Validate(t *testing.T) {
+	var (
+		inet   = &Table{Name: "filter", Family: TableFamilyInet}
+		ip     = &Table{Name: "nat", Family: TableFamilyIpv4}
+		bridge = &Table{Name: "br", Family: TableFamilyBridge}
+		arp    = &Table{Name: "arp", Family: TableFamilyArp}
+		netdev = &Table{Name: "ddos", Family: TableFamilyNetdev}
+	)
+	cases := []struct {
+		ch *Chain
+		ok bool
+	}{
+		{&Chain{Table: ip, Type: ChainTypeNat, Hook: ChainHookPrerouting}, true},
+		{&Chain{Table: ip, Type: ChainTypeNat, Hook: ChainHookForward}, false},
+		{&Chain{Table: bridge, Type: ChainTypeNat, Hook: ChainHookPostrouting}, false},
+		{&Chain{Table: inet, Type: ChainTypeRoute, Hook: ChainHookOutput}, true},
+		{&Chain{Table: inet, Type: ChainTypeRoute, Hook: ChainHookInput}, false},
+		{&Chain{Table: inet, Type: ChainTypeFilter, Hook: ChainHookIngress, Device: "eth0"}, true},
+		{&Chain{Table: inet, Type: ChainTypeFilter, Hook: ChainHookEgress, Device: "eth0"}, false},
+		{&Chain{Table: arp, Type: ChainTypeFilter, Hook: ChainHookInput}, true},
+		{&Chain{Table: arp, Type: ChainTypeFilter, Hook: ChainHookForward}, false},
+		{&Chain{Table: netdev, Type: ChainTypeFilter, Hook: ChainHookIngress, Device: "eth0"}, true},
+		{&Chain{Table: netdev, Type: ChainTypeFilter, Hook: ChainHookIngress}, false},
+		{&Chain{Table: netdev, Type: ChainTypeFilter, Hook: ChainHookInput}, false},
+		{&Chain{Table: ip, Type: ChainTypeFilter, Hook: ChainHookInput, Device: "eth0"}, false},
+		{&Chain{Table: ip}, true},
+	}
+	for _, c := range cases {
+		err := c.ch.Validate()
+		if c.ok && err != nil {
+			t.Errorf("%s %s %s: unexpected error %v", c.ch.Table.Family, c.ch.Type, c.ch.Hook, err)
+		}
+		if !c.ok && !errors.Is(err, ErrInvalidChain) {
+			t.Errorf("%s %s %s: expect ErrInvalidChain, got %v", c.ch.Table.Family, c.ch.Type, c.ch.Hook, err)
+		}
+	}
+}
+
+func TestChain_Hook(t *testing.T) {
+	for _, ch := range []*Chain{
+		{Table: &Table{Family: TableFamilyNetdev}, Name: "ingress", Type: ChainTypeFilter, Hook: ChainHookIngress, Device: "eth0"},
+		{Table: &Table{Family: TableFamilyNetdev}, Name: "egress", Type: ChainTypeFilter, Hook: ChainHookEgress, Device: "eth0"},
+		{Table: &Table{Family: TableFamilyArp}, Name: "output", Type: ChainTypeFilter, Hook: ChainHookOutput},
+		{Table: &Table{Family: TableFamilyIpv4}, Name: "postrouting", Type: ChainTypeNat, Hook: ChainHookPostrouting,
+			Priority: ChainPrioritySrcNat},
+		{Table: &Table{Family: TableFamilyInet}, Name: "raw", Type: ChainTypeFilter, Hook: ChainHookPrerouting,
+			Priority: ChainPriorityRaw - 10},
+	} {
+		back := &Chain{Table: ch.Table}
+		back.toCh(*ch.toNch())
+		if back.String() != ch.String() {
+			t.Errorf("got %s, want %s", back, ch)
+		}
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	cases := []struct {
+		family tableFamily
+		prio   string
+		want   int32
+	}{
+		{TableFamilyInet, "-150", -150},
+		{TableFamilyInet, "mangle", ChainPriorityMangle},
+		{TableFamilyInet, "filter + 10", 10},
+		{TableFamilyIpv4, "dstnat-5", -105},
+		{TableFamilyIpv6, "srcnat +1", 101},
+		{TableFamilyBridge, "filter", ChainPriorityBridgeFilter},
+		{TableFamilyBridge, "out", ChainPriorityBridgeOut},
+	}
+	for _, c := range cases {
+		got, err := ParsePriority(c.family, c.prio)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s %q: got %d, want %d", c.family, c.prio, got, c.want)
+		}
+	}
+	for _, prio := range []string{"out", "filter + x", "first"} {
+		if _, err := ParsePriority(TableFamilyInet, prio); !errors.Is(err, ErrInvalidChain) {
+			t.Errorf("%q: expect ErrInvalidChain, got %v", prio, err)
+		}
+	}
+
+	rs, err := ParseRuleset(`table bridge br {
+	chain pre {
+		type filter hook prerouting priority dstnat; policy accept;
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.Tables[0].Chains[0].Chain.Priority; got != ChainPriorityBridgeDstNat {
+		t.Fatalf("got priority %d, want %d", got, ChainPriorityBridgeDstNat)
+	}
+}
+
+func TestPriorityString(t *testing.T) {
+	cases := []struct {
+		family tableFamily
+		hook   chainHook
+		prio   int32
+		want   string
+	}{
+		{TableFamilyInet, ChainHookInput, 0, "filter"},
+		{TableFamilyInet, ChainHookInput, 10, "filter + 10"},
+		{TableFamilyIpv4, ChainHookPrerouting, -105, "dstnat - 5"},
+		{TableFamilyIpv4, ChainHookForward, -100, "-100"},
+		{TableFamilyIpv4, ChainHookForward, -90, "-90"},
+		{TableFamilyIpv6, ChainHookPostrouting, 100, "srcnat"},
+		{TableFamilyIpv6, ChainHookForward, 100, "100"},
+		{TableFamilyBridge, ChainHookInput, -200, "filter"},
+		{TableFamilyBridge, ChainHookOutput, 100, "out"},
+		{TableFamilyNetdev, ChainHookIngress, -300, "-300"},
+		{TableFamilyInet, ChainHookInput, 11, "11"},
+	}
+	for _, c := range cases {
+		if got := PriorityString(c.family, c.hook, c.prio); got != c.want {
+			t.Errorf("%s %s %d: got %q, want %q", c.family, c.hook, c.prio, got, c.want)
+		}
+		if got, err := ParsePriority(c.family, c.want); err != nil || got != c.prio {
+			t.Errorf("%s %q: got %d, %v, want %d", c.family, c.want, got, err, c.prio)
+		}
+	}
+}
@@ -3,7 +3,6 @@
 package nftlib
 
 import (
-	"errors"
 	"github.com/google/nftables"
 	"github.com/vishvananda/netns"
 )
@@ -29,12 +28,17 @@ func New(namespace ...string) (*Conn, error) {
 
 type Conn struct {
 	*nftables.Conn
+	// tx 事务连接所属的事务, 用于记录加入批次的操作
+	tx *Tx
+	// StrictDecode 读取规则时遇到无法解析的表达式返回DecodeError, 否则保留在Rule.Raw中
+	StrictDecode bool
 }
 
 func (d *Conn) ADDTable(table *Table) *Table {
 	table.conn = d
 	ntbl := table.toNTable()
 	d.AddTable(ntbl)
+	d.record(table.change(ChangeAdd, ObjTable))
 	return table
 }
 
@@ -42,7 +46,7 @@ func (d *Conn) ShowTables() ([]*Table, error) {
 	var tbl []*Table
 	ntbl, err := d.ListTables()
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("list", ObjTable, err)
 	}
 	for _, ntb := range ntbl {
 		t := &Table{conn: d}
@@ -58,7 +62,7 @@ func (d *Conn) ShowTables() ([]*Table, error) {
 func (d *Conn) GetTableByName(tableName string) (*Table, error) {
 	ntbl, err := d.Conn.ListTables()
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("get", ObjTable, err).name(tableName)
 	}
 	for _, ntb := range ntbl {
 		if ntb.Name == tableName {
@@ -70,18 +74,40 @@ func (d *Conn) GetTableByName(tableName string) (*Table, error) {
 			return t, nil
 		}
 	}
-	return nil, errors.New("not found")
+	return nil, newObjErr("get", ObjTable, ErrTableNotFound).name(tableName)
 }
 
 func (d *Conn) ClearAll() {
 	d.FlushRuleset()
+	d.record(&Change{Op: ChangeFlush, Kind: ObjRuleset})
 }
 
 func (d *Conn) Commit() error {
+	if d.tx != nil {
+		return d.tx.Commit()
+	}
 	err := d.Flush()
-	return err
+	if err != nil {
+		return newObjErr("commit", ObjRuleset, err)
+	}
+	return nil
 }
 
 func (d *Conn) Discard() {
 	d.Conn = &nftables.Conn{NetNS: d.NetNS}
+	if d.tx != nil {
+		d.tx.discard()
+	}
+}
+
+// newConn 创建同一网络命名空间中批次独立的连接, 用于读取快照与恢复
+func (d *Conn) newConn() *Conn {
+	return &Conn{Conn: &nftables.Conn{NetNS: d.NetNS}}
+}
+
+// record 事务连接中记录加入批次的操作
+func (d *Conn) record(c *Change) {
+	if d.tx != nil {
+		d.tx.record(c)
+	}
 }
@@ -0,0 +1,150 @@
+// +build linux
+
+package nftlib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Plan 两个规则集之间的差异, 按下发顺序排列
+// 可通过String输出nft格式的变更行, 或通过IndentJson输出结构化JSON
+type Plan struct {
+	Changes []*Change `json:"changes,omitempty"`
+}
+
+// Diff 对比from与to两个规则集, 返回由from变为to所需的变更
+// 表按协议族与名称匹配, 集合与链按名称匹配, 规则按匹配条件与动作匹配而不依赖Handle
+func Diff(from, to *Ruleset) *Plan {
+	var (
+		plan      = new(Plan)
+		fromSpecs = make(map[string]*TableSpec)
+		toSpecs   = make(map[string]bool)
+	)
+	key := func(t *Table) string {
+		return string(t.Family) + " " + t.Name
+	}
+	for _, ts := range from.Tables {
+		fromSpecs[key(ts.Table)] = ts
+	}
+	for _, ts := range to.Tables {
+		toSpecs[key(ts.Table)] = true
+		plan.Changes = append(plan.Changes, diffTable(fromSpecs[key(ts.Table)], ts)...)
+	}
+	for _, ts := range from.Tables {
+		if !toSpecs[key(ts.Table)] {
+			plan.Changes = append(plan.Changes, &Change{Op: ChangeDelete, Kind: ObjTable, Family: ts.Table.Family,
+				Table: ts.Table.Name, Old: ts.String()})
+		}
+	}
+	return plan
+}
+
+// PlanTable 对比内核中的表与desired, 返回Reconcile将要执行的变更
+func (d *Conn) PlanTable(desired *TableSpec) (*Plan, error) {
+	live, err := d.liveTableSpec(desired.Table)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{Changes: diffTable(live, desired)}, nil
+}
+
+// String 以nft格式逐行输出变更, +为新增, -为删除, ~为修改
+func (d *Plan) String() string {
+	return renderChanges(d.Changes)
+}
+
+// String 以nft格式逐行输出已执行的变更
+func (d *ChangeReport) String() string {
+	return renderChanges(d.Changes)
+}
+
+// String 输出单个变更, 如 + rule inet filter input tcp dport 22 accept
+func (d *Change) String() string {
+	var (
+		sign = map[changeOp]string{ChangeAdd: "+", ChangeDelete: "-", ChangeReplace: "~", ChangeUpdate: "~"}[d.Op]
+		fam  = (&Table{Family: d.Family}).familyKeyword()
+		obj  = fmt.Sprintf("%s %s %s", d.Kind, fam, d.Table)
+	)
+	// 清空操作只记录于事务中, 不产生新旧对比
+	if d.Op == ChangeFlush {
+		if d.Kind == ObjRuleset {
+			return "flush ruleset"
+		}
+		return fmt.Sprintf("flush %s %s", obj, d.Name)
+	}
+	switch d.Kind {
+	case ObjTable:
+		return fmt.Sprintf("%s %s", sign, obj)
+	case ObjElement:
+		elem := d.New
+		if d.Op == ChangeDelete {
+			elem = d.Old
+		}
+		return fmt.Sprintf("%s %s %s { %s }", sign, obj, d.Name, elem)
+	case ObjRule:
+		obj += " " + d.Chain
+		if d.Handle != 0 {
+			obj += fmt.Sprintf(" handle %d", d.Handle)
+		}
+		switch d.Op {
+		case ChangeAdd:
+			return fmt.Sprintf("%s %s %s", sign, obj, d.New)
+		case ChangeDelete:
+			return fmt.Sprintf("%s %s %s", sign, obj, d.Old)
+		}
+		return fmt.Sprintf("%s %s %s -> %s", sign, obj, d.Old, d.New)
+	}
+	// 集合与链以单行块格式输出
+	obj += " " + d.Name
+	switch d.Op {
+	case ChangeAdd:
+		return fmt.Sprintf("%s %s %s", sign, obj, oneLineBody(d.New))
+	case ChangeDelete:
+		return fmt.Sprintf("%s %s", sign, obj)
+	}
+	return fmt.Sprintf("%s %s %s -> %s", sign, obj, oneLineBody(d.Old), oneLineBody(d.New))
+}
+
+func renderChanges(changes []*Change) string {
+	var (
+		lines               []string
+		adds, mods, deletes int
+	)
+	for _, c := range changes {
+		lines = append(lines, c.String())
+		switch c.Op {
+		case ChangeAdd:
+			adds++
+		case ChangeDelete:
+			deletes++
+		default:
+			mods++
+		}
+	}
+	lines = append(lines, fmt.Sprintf("Plan: %d to add, %d to change, %d to delete.", adds, mods, deletes))
+	return strings.Join(lines, "\n")
+}
+
+// oneLineBody 将renderBlock输出的块转换为单行的 { a; b; } 格式
+func oneLineBody(block string) string {
+	var stmts []string
+	lines := strings.Split(block, "\n")
+	if len(lines) < 2 {
+		return "{ }"
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, ";") {
+			line += ";"
+		}
+		stmts = append(stmts, line)
+	}
+	if len(stmts) == 0 {
+		return "{ }"
+	}
+	return "{ " + strings.Join(stmts, " ") + " }"
+}
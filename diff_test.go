@@ -0,0 +1,70 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	from, err := ParseRuleset(`table inet filter {
+	set allow {
+		type ipv4_addr
+		elements = { 1.1.1.1, 2.2.2.2 }
+	}
+	chain input {
+		type filter hook input priority filter; policy accept;
+		ip saddr @allow accept
+		tcp dport 23 accept
+	}
+}
+table ip legacy {
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := ParseRuleset(`table inet filter {
+	set allow {
+		type ipv4_addr
+		elements = { 2.2.2.2, 3.3.3.3 }
+	}
+	chain input {
+		type filter hook input priority filter; policy drop;
+		ct state established,related accept
+		ip saddr @allow accept
+		tcp dport 22 accept
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟从内核读取的规则句柄
+	for i, rule := range from.Tables[0].Chains[0].Rules {
+		rule.Handle = uint64(i + 2)
+	}
+	plan := Diff(from, to)
+	want := `+ element inet filter allow { 3.3.3.3 }
+- element inet filter allow { 1.1.1.1 }
+~ chain inet filter input { type filter hook input priority filter; policy accept; } -> { type filter hook input priority filter; policy drop; }
++ rule inet filter input ct state established,related accept
+~ rule inet filter input handle 3 tcp dport 23 accept -> tcp dport 22 accept
+- table ip legacy
+Plan: 2 to add, 2 to change, 2 to delete.`
+	if got := plan.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	b, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `{"op":"replace","kind":"rule","family":"inet","table":"filter","chain":"input","handle":3,"old":"tcp dport 23 accept","new":"tcp dport 22 accept"}`) {
+		t.Fatalf("unexpected json %s", b)
+	}
+
+	if plan = Diff(to, to); len(plan.Changes) != 0 {
+		t.Fatalf("expect empty plan, got:\n%s", plan)
+	}
+}
@@ -2,6 +2,168 @@
 
 package nftlib
 
+import (
+	"errors"
+	"fmt"
+	"github.com/google/nftables/expr"
+	"strings"
+	"syscall"
+)
+
 const (
-	ErrNotFound = "Receive: netlink receive: no such file or directory"
+	ObjTable   ObjKind = "table"
+	ObjChain   ObjKind = "chain"
+	ObjSet     ObjKind = "set"
+	ObjMap     ObjKind = "map"
+	ObjRule    ObjKind = "rule"
+	ObjElement ObjKind = "element"
+	ObjRuleset ObjKind = "ruleset"
+)
+
+var (
+	// Deprecated: ErrNotFound 匹配任意对象不存在的错误, 请使用ErrTableNotFound等具体错误
+	ErrNotFound        = errors.New("object not found")
+	ErrTableNotFound   = errors.New("table not found")
+	ErrChainNotFound   = errors.New("chain not found")
+	ErrSetNotFound     = errors.New("set not found")
+	ErrMapNotFound     = errors.New("map not found")
+	ErrRuleNotFound    = errors.New("rule not found")
+	ErrAlreadyExists   = errors.New("object already exists")
+	ErrUnsupportedExpr = errors.New("unsupported expression")
+	ErrInvalidChain    = errors.New("invalid chain")
+	ErrTxDone          = errors.New("transaction already committed or rolled back")
+	ErrConfirmTimeout  = errors.New("commit not confirmed in time, ruleset restored")
+
+	// notFoundErrs 对象类型对应的不存在错误
+	notFoundErrs = map[ObjKind]error{
+		ObjTable: ErrTableNotFound,
+		ObjChain: ErrChainNotFound,
+		ObjSet:   ErrSetNotFound,
+		ObjMap:   ErrMapNotFound,
+		ObjRule:  ErrRuleNotFound,
+	}
 )
+
+// ObjKind ObjectError中的对象类型
+type ObjKind string
+
+// ObjectError 对表、链、集合、映射、规则操作失败时返回的错误
+// 可通过errors.Is匹配ErrXXXNotFound/ErrAlreadyExists, 通过errors.As获取对象信息
+type ObjectError struct {
+	Op     string  `json:"op"`
+	Kind   ObjKind `json:"kind"`
+	Table  string  `json:"table,omitempty"`
+	Chain  string  `json:"chain,omitempty"`
+	Name   string  `json:"name,omitempty"`
+	Handle uint64  `json:"handle,omitempty"`
+	// Errno netlink返回的错误码, 非netlink错误时为0
+	Errno syscall.Errno `json:"errno,omitempty"`
+	Err   error         `json:"-"`
+}
+
+func (e *ObjectError) Error() string {
+	var obj []string
+	for _, v := range []string{e.Table, e.Chain, e.Name} {
+		if v != "" {
+			obj = append(obj, v)
+		}
+	}
+	s := fmt.Sprintf("%s %s", e.Op, e.Kind)
+	if len(obj) > 0 {
+		s += " " + strings.Join(obj, "/")
+	}
+	if e.Handle != 0 {
+		s += fmt.Sprintf(" handle %d", e.Handle)
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ObjectError) Is(target error) bool {
+	if target == ErrNotFound {
+		for _, v := range notFoundErrs {
+			if errors.Is(e.Err, v) {
+				return true
+			}
+		}
+	}
+	switch e.Errno {
+	case syscall.ENOENT:
+		return target == ErrNotFound || notFoundErrs[e.Kind] == target
+	case syscall.EEXIST:
+		return target == ErrAlreadyExists
+	}
+	return false
+}
+
+// DecodeError 严格模式下读取的规则包含无法解析的表达式时返回的错误, 可通过errors.Is匹配ErrUnsupportedExpr
+type DecodeError struct {
+	Exprs []expr.Any `json:"-"`
+}
+
+func (e *DecodeError) Error() string {
+	var names []string
+	for _, v := range e.Exprs {
+		names = append(names, exprName(v))
+	}
+	return fmt.Sprintf("%s: %s", ErrUnsupportedExpr, strings.Join(names, ","))
+}
+
+func (e *DecodeError) Unwrap() error {
+	return ErrUnsupportedExpr
+}
+
+// exprName 表达式的名称, 如 meta, cmp
+func exprName(e expr.Any) string {
+	return strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", e), "*expr."))
+}
+
+// newObjErr 包装底层错误, 并从中提取netlink错误码
+func newObjErr(op string, kind ObjKind, err error) *ObjectError {
+	return &ObjectError{Op: op, Kind: kind, Err: err, Errno: errnoOf(err)}
+}
+
+func (e *ObjectError) table(name string) *ObjectError {
+	e.Table = name
+	return e
+}
+
+func (e *ObjectError) chain(name string) *ObjectError {
+	e.Chain = name
+	return e
+}
+
+func (e *ObjectError) name(name string) *ObjectError {
+	e.Name = name
+	return e
+}
+
+func (e *ObjectError) handle(handle uint64) *ObjectError {
+	e.Handle = handle
+	return e
+}
+
+// errnoOf 提取错误中的netlink错误码
+// google/nftables部分接口使用%v包装错误, 此时只能通过错误信息匹配
+func errnoOf(err error) syscall.Errno {
+	var errno syscall.Errno
+	if err == nil {
+		return 0
+	}
+	if errors.As(err, &errno) {
+		return errno
+	}
+	for _, v := range []syscall.Errno{syscall.ENOENT, syscall.EEXIST, syscall.EBUSY, syscall.EINVAL,
+		syscall.EOPNOTSUPP, syscall.EPERM} {
+		if strings.HasSuffix(err.Error(), v.Error()) {
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+// +build linux
+
+package nftlib
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestObjectError_Is(t *testing.T) {
+	err := newObjErr("get", ObjSet, fmt.Errorf("receiveAckAware: %v", syscall.ENOENT)).table("mytable").name("set1")
+	if !errors.Is(err, ErrSetNotFound) {
+		t.Fatalf("expect ErrSetNotFound, got %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect deprecated ErrNotFound, got %v", err)
+	}
+	if errors.Is(err, ErrChainNotFound) {
+		t.Fatalf("unexpected ErrChainNotFound, got %v", err)
+	}
+	var oe *ObjectError
+	if !errors.As(err, &oe) || oe.Errno != syscall.ENOENT || oe.Table != "mytable" || oe.Name != "set1" {
+		t.Fatalf("unexpected object error %#v", oe)
+	}
+
+	err = newObjErr("get", ObjTable, ErrTableNotFound).name("mytable")
+	if !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("expect ErrTableNotFound, got %v", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect deprecated ErrNotFound, got %v", err)
+	}
+	if err.Error() != "get table mytable: table not found" {
+		t.Fatalf("unexpected error message %q", err.Error())
+	}
+
+	err = newObjErr("commit", ObjRuleset, fmt.Errorf("conn.Receive: %w", syscall.EEXIST))
+	if !errors.Is(err, ErrAlreadyExists) || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect ErrAlreadyExists, got %v", err)
+	}
+}
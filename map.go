@@ -0,0 +1,474 @@
+// +build linux
+
+package nftlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"sort"
+	"strings"
+)
+
+const (
+	// MapDtypeVerdict verdict map的值类型, 值为 accept/drop/continue/return/jump <chain>/goto <chain>
+	MapDtypeVerdict = "verdict"
+)
+
+var (
+	// verdictKinds verdict map支持的动作
+	verdictKinds = map[string]expr.VerdictKind{
+		RuleActAccept: expr.VerdictAccept,
+		RuleActDrop:   expr.VerdictDrop,
+		"continue":    expr.VerdictContinue,
+		"return":      expr.VerdictReturn,
+		RuleActJump:   expr.VerdictJump,
+		RuleActGoto:   expr.VerdictGoto,
+	}
+)
+
+// MapElement 映射元素, Key格式同集合元素, Value为动作或地址、端口等数据
+type MapElement struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Map 键值映射, DataType为verdict时用于vmap分发, 其他类型用于nat等语句的数据查找
+type Map struct {
+	conn  *Conn
+	Table *Table `json:"table"`
+	Name  string `json:"name,omitempty"`
+	// KeyType DataType 键与值的类型, 取值同集合数据类型, DataType还可以为verdict
+	KeyType   string       `json:"key_type,omitempty"`
+	DataType  string       `json:"data_type,omitempty"`
+	ElemRange bool         `json:"elemrange"`
+	Elements  []MapElement `json:"elements,omitempty"`
+}
+
+func (d *Map) AddElements(elems ...MapElement) error {
+	nset, _, err := d.toNMap()
+	if err != nil {
+		return d.mapErr("add elements", err)
+	}
+	nelems, err := mapElemToNElem(d.KeyType, d.DataType, d.ElemRange, elems, true)
+	if err != nil {
+		return d.mapErr("add elements", err)
+	}
+	if err = d.conn.SetAddElements(nset, nelems); err != nil {
+		return d.mapErr("add elements", err)
+	}
+	d.recordElements(ChangeAdd, elems)
+	return nil
+}
+
+// DelElements 按键删除元素, 元素的值可以为空
+func (d *Map) DelElements(elems ...MapElement) error {
+	nset, _, err := d.toNMap()
+	if err != nil {
+		return d.mapErr("delete elements", err)
+	}
+	nelems, err := mapElemToNElem(d.KeyType, d.DataType, d.ElemRange, elems, false)
+	if err != nil {
+		return d.mapErr("delete elements", err)
+	}
+	if err = d.conn.SetDeleteElements(nset, nelems); err != nil {
+		return d.mapErr("delete elements", err)
+	}
+	d.recordElements(ChangeDelete, elems)
+	return nil
+}
+
+func (d *Map) Commit() error {
+	return d.conn.Commit()
+}
+
+func (d *Map) Flush() error {
+	nset, _, err := d.toNMap()
+	if err != nil {
+		return d.mapErr("flush", err)
+	}
+	d.conn.FlushSet(nset)
+	c := d.Table.change(ChangeFlush, ObjMap)
+	c.Name = d.Name
+	d.conn.record(c)
+	return nil
+}
+
+func (d *Map) recordElements(op changeOp, elems []MapElement) {
+	c := d.Table.change(op, ObjElement)
+	c.Name = d.Name
+	s := strings.Join(mapElemStrings(d.KeyType, elems), ", ")
+	if op == ChangeDelete {
+		c.Old = s
+	} else {
+		c.New = s
+	}
+	d.conn.record(c)
+}
+
+func (d *Map) mapErr(op string, err error) error {
+	e := newObjErr(op, ObjMap, err).name(d.Name)
+	if d.Table != nil {
+		e.table(d.Table.Name)
+	}
+	return e
+}
+
+func (d *Map) toNMap() (*nftables.Set, []nftables.SetElement, error) {
+	var nset = &nftables.Set{Name: d.Name, IsMap: true, Interval: d.ElemRange}
+	nset.Table = d.Table.toNTable()
+	ktype, ok := setNDatatype(d.KeyType)
+	if !ok {
+		return nil, nil, errors.New("unsupport key data type")
+	}
+	nset.KeyType = ktype
+	nset.Concatenation = d.ElemRange && concatDtypes(d.KeyType) != nil
+	dtype, err := mapNDataType(d.DataType)
+	if err != nil {
+		return nil, nil, err
+	}
+	nset.DataType = dtype
+	if d.ElemRange && d.KeyType == SetDtypeIfname {
+		return nil, nil, errors.New("ifname map does not support interval flag")
+	}
+	if len(d.Elements) == 0 {
+		return nset, nil, nil
+	}
+	nelems, err := mapElemToNElem(d.KeyType, d.DataType, d.ElemRange, d.Elements, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nset, nelems, nil
+}
+
+// toMap 解析内核中的映射
+// google/nftables读取verdict map时以verdict覆盖了键类型, 此时由元素键的长度推断键类型, 空映射的键类型为空
+func (d *Map) toMap(nset nftables.Set, nelems ...nftables.SetElement) error {
+	d.Name = nset.Name
+	d.ElemRange = nset.Interval
+	verdict := nftables.TypeVerdict.GetNFTMagic()
+	if nset.KeyType.GetNFTMagic() == verdict || nset.DataType.GetNFTMagic() == verdict {
+		d.DataType = MapDtypeVerdict
+		d.KeyType = mapKeyType(nelems)
+		if nset.KeyType.GetNFTMagic() != verdict {
+			d.KeyType = dtypeName(nset.KeyType)
+		}
+	} else {
+		d.KeyType = dtypeName(nset.KeyType)
+		d.DataType = dtypeName(nset.DataType)
+	}
+	if d.DataType == "" {
+		return errors.New("unsupport map data type")
+	}
+	if len(nelems) == 0 {
+		return nil
+	}
+	if d.KeyType == "" {
+		return errors.New("unsupport key data type")
+	}
+	elems, err := nelemToMapElem(d.KeyType, d.DataType, d.ElemRange, nelems)
+	if err != nil {
+		return err
+	}
+	d.Elements = elems
+	return nil
+}
+
+// dtypeName 内核数据类型对应的集合数据类型, 拼接类型按每6位拆分, 不支持时返回空
+func dtypeName(t nftables.SetDatatype) string {
+	var (
+		r     []string
+		magic = t.GetNFTMagic()
+	)
+	for ; magic != 0; magic >>= nftables.SetConcatTypeBits {
+		name := ""
+		for k, v := range dtypeList {
+			if v.GetNFTMagic() == magic&nftables.SetConcatTypeMask {
+				name = k
+			}
+		}
+		if name == "" {
+			return ""
+		}
+		r = append([]string{name}, r...)
+	}
+	return strings.Join(r, " . ")
+}
+
+func mapNDataType(dataType string) (nftables.SetDatatype, error) {
+	if dataType == MapDtypeVerdict {
+		return nftables.TypeVerdict, nil
+	}
+	if v, ok := dtypeList[dataType]; ok {
+		return v, nil
+	}
+	return nftables.TypeInvalid, errors.New("unsupport map data type")
+}
+
+// mapKeyType 由元素键的长度推断verdict map的键类型, 16字节的键由内容区分接口名与IPv6地址
+func mapKeyType(nelems []nftables.SetElement) string {
+	for _, v := range nelems {
+		switch len(v.Key) {
+		case 2:
+			return SetDtypePort
+		case 4:
+			return SetDtypeIpv4
+		case unix.IFNAMSIZ:
+			if isIfnameKey(v.Key) {
+				return SetDtypeIfname
+			}
+			return SetDtypeIpv6
+		}
+	}
+	return ""
+}
+
+// isIfnameKey 键是否为补零的可打印接口名
+func isIfnameKey(key []byte) bool {
+	i := bytes.IndexByte(key, 0)
+	if i <= 0 {
+		return false
+	}
+	for _, c := range key[:i] {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return len(bytes.Trim(key[i:], "\x00")) == 0
+}
+
+// mapElemToNElem 映射元素转换为内核元素, 区间键的值附加在区间起始元素上, withData为false时只转换键
+func mapElemToNElem(keyType, dataType string, interval bool, elems []MapElement, withData bool) ([]nftables.SetElement, error) {
+	var r []nftables.SetElement
+	for _, e := range elems {
+		nkeys, err := setElemToNElem(keyType, interval, []string{e.Key})
+		if err != nil {
+			return nil, err
+		}
+		if len(nkeys) == 0 {
+			return nil, errors.New(fmt.Sprintf("parse map nelem failed, wrong key format,key=%s", e.Key))
+		}
+		if !withData {
+			r = append(r, nkeys...)
+			continue
+		}
+		if dataType == MapDtypeVerdict {
+			vd, err := parseMapVerdict(e.Value)
+			if err != nil {
+				return nil, err
+			}
+			nkeys[0].VerdictData = vd
+		} else {
+			nvals, err := setElemToNElem(dataType, false, []string{e.Value})
+			if err != nil {
+				return nil, err
+			}
+			if len(nvals) != 1 {
+				return nil, errors.New(fmt.Sprintf("parse map nelem failed, wrong value format,value=%s", e.Value))
+			}
+			nkeys[0].Val = nvals[0].Key
+		}
+		r = append(r, nkeys...)
+	}
+	return r, nil
+}
+
+// nelemToMapElem 解析内核返回的映射元素
+// 区间映射按键排序后将区间起始元素与其后的结束元素配对, 缺少结束元素的区间延伸到最大值
+func nelemToMapElem(keyType, dataType string, interval bool, nelems []nftables.SetElement) ([]MapElement, error) {
+	var r []MapElement
+	// 拼接键的区间元素自带KeyEnd, 无需配对
+	if dtypes := concatDtypes(keyType); dtypes != nil {
+		for i := len(nelems) - 1; i >= 0; i-- {
+			keys, err := setElemConcat(dtypes, nelems[i:i+1])
+			if err != nil {
+				return nil, err
+			}
+			e, err := mapElem(keyType, dataType, nelems[i], keys)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, e)
+		}
+		return r, nil
+	}
+	if !interval {
+		for i := len(nelems) - 1; i >= 0; i-- {
+			e, err := mapElem(keyType, dataType, nelems[i], []string{nelemString(keyType, nelems[i].Key)})
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, e)
+		}
+		return r, nil
+	}
+	sorted := append([]nftables.SetElement{}, nelems...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+	for i, v := range sorted {
+		if v.IntervalEnd {
+			continue
+		}
+		end := nftables.SetElement{Key: make([]byte, len(v.Key)), IntervalEnd: true}
+		if i+1 < len(sorted) && sorted[i+1].IntervalEnd {
+			end = sorted[i+1]
+		}
+		var keys []string
+		switch keyType {
+		case SetDtypeIpv4, SetDtypeIpv6:
+			keys = setElemIpRange([]nftables.SetElement{end, v, {}})
+		case SetDtypePort:
+			keys = setElemPortRange([]nftables.SetElement{end, v, {}})
+		default:
+			if c, ok := dtypeCodecs[keyType]; ok {
+				keys = setElemCodec(c, true, []nftables.SetElement{end, v, {}})
+			}
+		}
+		e, err := mapElem(keyType, dataType, v, keys)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, e)
+	}
+	return r, nil
+}
+
+func mapElem(keyType, dataType string, nelem nftables.SetElement, keys []string) (MapElement, error) {
+	if len(keys) != 1 || keys[0] == "" {
+		return MapElement{}, fmt.Errorf("invalid %s map key %x", keyType, nelem.Key)
+	}
+	if dataType == MapDtypeVerdict {
+		v, err := mapVerdictValue(nelem.Val)
+		if err != nil {
+			return MapElement{}, err
+		}
+		return MapElement{Key: keys[0], Value: v}, nil
+	}
+	return MapElement{Key: keys[0], Value: nelemString(dataType, nelem.Val)}, nil
+}
+
+// nelemString 单个非区间键或值的字符串形式
+func nelemString(dtype string, data []byte) string {
+	var r []string
+	switch dtype {
+	case SetDtypeIpv4, SetDtypeIpv6:
+		r = setElemIp([]nftables.SetElement{{Key: data}})
+	case SetDtypePort:
+		if len(data) == 2 {
+			r = setElemPort([]nftables.SetElement{{Key: data}})
+		}
+	case SetDtypeIfname:
+		r = setElemIfname([]nftables.SetElement{{Key: data}})
+	default:
+		if c, ok := dtypeCodecs[dtype]; ok {
+			r = setElemCodec(c, false, []nftables.SetElement{{Key: data}})
+		}
+	}
+	if len(r) != 1 {
+		return ""
+	}
+	return r[0]
+}
+
+// parseMapVerdict 解析verdict map的值, 如 accept 或 jump ssh
+func parseMapVerdict(v string) (*expr.Verdict, error) {
+	l := strings.Fields(v)
+	if len(l) == 0 {
+		return nil, errors.New("empty verdict")
+	}
+	kind, ok := verdictKinds[l[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: verdict %s", ErrUnsupportedExpr, v)
+	}
+	withChain := kind == expr.VerdictJump || kind == expr.VerdictGoto
+	if (withChain && len(l) != 2) || (!withChain && len(l) != 1) {
+		return nil, fmt.Errorf("invalid verdict %q", v)
+	}
+	vd := &expr.Verdict{Kind: kind}
+	if withChain {
+		vd.Chain = l[1]
+	}
+	return vd, nil
+}
+
+// mapVerdictValue 解析内核返回的verdict数据, 由NFTA_VERDICT_CODE与NFTA_VERDICT_CHAIN属性组成
+func mapVerdictValue(data []byte) (string, error) {
+	var (
+		code  *expr.VerdictKind
+		chain string
+	)
+	for len(data) >= 4 {
+		alen := int(binaryutil.NativeEndian.Uint16(data[0:2]))
+		typ := binaryutil.NativeEndian.Uint16(data[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if alen < 4 || alen > len(data) {
+			return "", fmt.Errorf("invalid verdict data %x", data)
+		}
+		payload := data[4:alen]
+		switch typ {
+		case unix.NFTA_VERDICT_CODE:
+			if len(payload) != 4 {
+				return "", fmt.Errorf("invalid verdict code %x", payload)
+			}
+			kind := expr.VerdictKind(int32(binary.BigEndian.Uint32(payload)))
+			code = &kind
+		case unix.NFTA_VERDICT_CHAIN:
+			chain = strings.TrimRight(string(payload), "\x00")
+		}
+		// 属性按4字节对齐
+		alen = (alen + 3) &^ 3
+		if alen >= len(data) {
+			break
+		}
+		data = data[alen:]
+	}
+	if code == nil {
+		return "", errors.New("missing verdict code")
+	}
+	for k, v := range verdictKinds {
+		if v != *code {
+			continue
+		}
+		if chain != "" {
+			return k + " " + chain, nil
+		}
+		return k, nil
+	}
+	return "", fmt.Errorf("%w: verdict code %d", ErrUnsupportedExpr, *code)
+}
+
+// mapElemStrings 以nft格式输出映射元素, 如 22 : jump ssh, 接口名键加引号
+func mapElemStrings(keyType string, elems []MapElement) []string {
+	var r []string
+	for _, e := range elems {
+		r = append(r, quoteElems(keyType, []string{e.Key})[0]+" : "+e.Value)
+	}
+	return r
+}
+
+// parseMapElement 解析 key : value 格式的映射元素, 键两侧的引号被去除
+func parseMapElement(s string) (MapElement, error) {
+	l := strings.SplitN(s, " : ", 2)
+	if len(l) != 2 {
+		return MapElement{}, fmt.Errorf("invalid map element %q", s)
+	}
+	return MapElement{Key: unquoteElem(strings.TrimSpace(l[0])), Value: strings.TrimSpace(l[1])}, nil
+}
+
+// unquoteElem 去除元素及拼接元素各字段两侧的引号
+func unquoteElem(v string) string {
+	v, opts := splitElemOpts(v)
+	fields := strings.Split(v, " . ")
+	for i := range fields {
+		fields[i] = strings.Trim(fields[i], `"`)
+	}
+	return strings.Join(fields, " . ") + opts
+}
@@ -0,0 +1,177 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nlVerdict 按内核返回的格式编码verdict数据
+func nlVerdict(vd *expr.Verdict) []byte {
+	attr := func(typ uint16, payload []byte) []byte {
+		b := binaryutil.NativeEndian.PutUint16(uint16(4 + len(payload)))
+		b = append(b, binaryutil.NativeEndian.PutUint16(typ)...)
+		b = append(b, payload...)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	code := make([]byte, 4)
+	binary.BigEndian.PutUint32(code, uint32(int32(vd.Kind)))
+	r := attr(unix.NFTA_VERDICT_CODE, code)
+	if vd.Chain != "" {
+		r = append(r, attr(unix.NFTA_VERDICT_CHAIN, append([]byte(vd.Chain), 0))...)
+	}
+	return r
+}
+
+func TestMap_Conv(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	cases := []*Map{
+		{Table: tbl, Name: "svc", KeyType: SetDtypePort, DataType: MapDtypeVerdict,
+			Elements: []MapElement{{"22", "jump ssh"}, {"80", "accept"}, {"8080", "drop"}}},
+		{Table: tbl, Name: "blk", KeyType: SetDtypeIpv4, DataType: MapDtypeVerdict, ElemRange: true,
+			Elements: []MapElement{{"10.0.0.0/8", "drop"}, {"192.168.1.1-192.168.1.9", "goto lan"}}},
+		{Table: tbl, Name: "ifs", KeyType: SetDtypeIfname, DataType: MapDtypeVerdict,
+			Elements: []MapElement{{"eth0", "return"}}},
+		{Table: tbl, Name: "fwd", KeyType: SetDtypePort, DataType: SetDtypeIpv4, ElemRange: true,
+			Elements: []MapElement{{"80", "10.0.0.2"}, {"8000-8100", "10.0.0.3"}}},
+		{Table: tbl, Name: "fwd6", KeyType: SetDtypeIpv6, DataType: SetDtypeIpv6,
+			Elements: []MapElement{{"fd00::1", "fd00::2"}}},
+	}
+	for _, m := range cases {
+		nset, nelems, err := m.toNMap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nset.IsMap {
+			t.Fatalf("%s: expect map", m.Name)
+		}
+		if m.ElemRange {
+			nelems = padIntervalElems(m.KeyType, nelems)
+		}
+		// 模拟内核返回: verdict map的键类型被覆盖, 值为netlink属性, 元素逆序返回
+		if m.DataType == MapDtypeVerdict {
+			nset.KeyType = nftables.TypeVerdict
+			for i := range nelems {
+				if nelems[i].VerdictData != nil {
+					nelems[i].Val = nlVerdict(nelems[i].VerdictData)
+					nelems[i].VerdictData = nil
+				}
+			}
+		}
+		for i, j := 0, len(nelems)-1; i < j; i, j = i+1, j-1 {
+			nelems[i], nelems[j] = nelems[j], nelems[i]
+		}
+		back := new(Map)
+		if err = back.toMap(*nset, nelems...); err != nil {
+			t.Fatal(err)
+		}
+		back.Table = tbl
+		if got, want := back.String(), m.String(); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	}
+
+	want := "map svc {\n\ttype inet_service : verdict\n\telements = { 22 : jump ssh, 80 : accept, 8080 : drop }\n}"
+	if got := cases[0].String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for _, m := range []*Map{
+		{Table: tbl, KeyType: SetDtypePort, DataType: MapDtypeVerdict, Elements: []MapElement{{"22", "jump"}}},
+		{Table: tbl, KeyType: SetDtypePort, DataType: MapDtypeVerdict, Elements: []MapElement{{"22", "reject"}}},
+		{Table: tbl, KeyType: SetDtypePort, DataType: SetDtypeIpv4, Elements: []MapElement{{"22", "abc"}}},
+		{Table: tbl, KeyType: SetDtypeIfname, DataType: MapDtypeVerdict, ElemRange: true},
+	} {
+		if _, _, err := m.toNMap(); err == nil {
+			t.Fatalf("expect error for map %+v", m)
+		}
+	}
+}
+
+func TestMap_Ruleset(t *testing.T) {
+	const text = `table inet filter {
+	map svc {
+		type inet_service : verdict
+		elements = { 22 : jump ssh, 80 : accept }
+	}
+
+	map fwd {
+		type ipv4_addr : ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/24 : 192.168.0.1 }
+	}
+
+	chain ssh {
+		accept
+	}
+
+	chain input {
+		type filter hook input priority filter; policy drop;
+		tcp dport vmap @svc
+		iifname vmap { "lo" : accept, "eth0" : jump ssh }
+	}
+}`
+	rs, err := ParseRuleset(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.String(); got != text {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, text)
+	}
+	data, err := rs.EncodeNftJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeNftJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.String(); got != text {
+		t.Fatalf("json: got:\n%s\nwant:\n%s", got, text)
+	}
+
+	// 映射元素的值变化时先删除旧元素
+	to, err := ParseRuleset(`table inet filter {
+	map svc {
+		type inet_service : verdict
+		elements = { 22 : drop, 443 : accept }
+	}
+	chain ssh {
+		accept
+	}
+	chain input {
+		type filter hook input priority filter; policy drop;
+		tcp dport vmap @svc
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `- element inet filter svc { 22 : jump ssh }
+- element inet filter svc { 80 : accept }
++ element inet filter svc { 22 : drop }
++ element inet filter svc { 443 : accept }
+- rule inet filter input iifname vmap { "lo" : accept, "eth0" : jump ssh }
+- map inet filter fwd
+Plan: 2 to add, 0 to change, 4 to delete.`
+	if got := Diff(rs, to).String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	for _, text := range []string{
+		"table inet filter {\n\tmap m {\n\t\ttype inet_service\n\t}\n}",
+		"table inet filter {\n\tmap m {\n\t\ttype inet_service : counter\n\t}\n}",
+		"table inet filter {\n\tmap m {\n\t\ttype inet_service : verdict\n\t\telements = { 22 }\n\t}\n}",
+	} {
+		if _, err := ParseRuleset(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+}
@@ -41,7 +41,7 @@ func (d *NftTest) Test02_AddChain() {
 		Type:   ChainTypeFilter,
 		Policy: ChainPolicyAccept,
 	}
-	err := d.table.AddBaseChain(ch)
+	_, err := d.table.AddBaseChain(ch)
 	if err != nil {
 		panic(err)
 	}
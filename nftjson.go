@@ -0,0 +1,1540 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nftJsonSchemaVersion libnftables JSON格式版本, 见 libnftables-json(5)
+const nftJsonSchemaVersion = 1
+
+type nftJsonDoc struct {
+	Nftables []map[string]json.RawMessage `json:"nftables"`
+}
+
+type nftJsonTable struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+	Handle uint64 `json:"handle,omitempty"`
+}
+
+type nftJsonChain struct {
+	Family string `json:"family"`
+	Table  string `json:"table"`
+	Name   string `json:"name"`
+	Handle uint64 `json:"handle,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Hook   string `json:"hook,omitempty"`
+	// Prio 数字或优先级关键字
+	Prio   interface{} `json:"prio,omitempty"`
+	Dev    string      `json:"dev,omitempty"`
+	Policy string      `json:"policy,omitempty"`
+}
+
+type nftJsonSet struct {
+	Family string      `json:"family"`
+	Table  string      `json:"table"`
+	Name   string      `json:"name"`
+	Handle uint64      `json:"handle,omitempty"`
+	Type   interface{} `json:"type"`
+	Flags  []string    `json:"flags,omitempty"`
+	// Timeout GcInterval 单位为秒
+	Timeout    uint64        `json:"timeout,omitempty"`
+	GcInterval uint64        `json:"gc-interval,omitempty"`
+	Size       uint32        `json:"size,omitempty"`
+	Elem       []interface{} `json:"elem,omitempty"`
+}
+
+type nftJsonMap struct {
+	Family string        `json:"family"`
+	Table  string        `json:"table"`
+	Name   string        `json:"name"`
+	Handle uint64        `json:"handle,omitempty"`
+	Type   interface{}   `json:"type"`
+	Map    string        `json:"map"`
+	Flags  []string      `json:"flags,omitempty"`
+	Elem   []interface{} `json:"elem,omitempty"`
+}
+
+type nftJsonRule struct {
+	Family string                   `json:"family"`
+	Table  string                   `json:"table"`
+	Chain  string                   `json:"chain"`
+	Handle uint64                   `json:"handle,omitempty"`
+	Expr   []map[string]interface{} `json:"expr"`
+}
+
+// EncodeNftJson 按libnftables JSON格式(nft -j list ruleset)编码规则集
+func (d *Ruleset) EncodeNftJson() ([]byte, error) {
+	var objs = []interface{}{
+		map[string]interface{}{"metainfo": map[string]interface{}{"json_schema_version": nftJsonSchemaVersion}},
+	}
+	for _, ts := range d.Tables {
+		fam := ts.Table.familyKeyword()
+		objs = append(objs, map[string]interface{}{"table": nftJsonTable{Family: fam, Name: ts.Table.Name}})
+		for _, set := range ts.Sets {
+			jset, err := set.nftJson(fam)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, map[string]interface{}{"set": jset})
+		}
+		for _, cs := range ts.Chains {
+			ch := cs.Chain
+			jch := nftJsonChain{Family: fam, Table: ts.Table.Name, Name: ch.Name}
+			if ch.Hook != "" {
+				jch.Type, jch.Hook, jch.Prio, jch.Dev = string(ch.Type), string(ch.Hook), ch.Priority, ch.Device
+			}
+			jch.Policy = string(ch.Policy)
+			objs = append(objs, map[string]interface{}{"chain": jch})
+		}
+		// 映射在链之后输出, 以便verdict map的元素引用链
+		for _, m := range ts.Maps {
+			jm, err := m.nftJson(fam)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, map[string]interface{}{"map": jm})
+		}
+		for _, cs := range ts.Chains {
+			for _, rule := range cs.Rules {
+				exprs, err := rule.nftJsonExprs()
+				if err != nil {
+					return nil, err
+				}
+				jr := nftJsonRule{Family: fam, Table: ts.Table.Name, Chain: cs.Chain.Name, Handle: rule.Handle, Expr: exprs}
+				objs = append(objs, map[string]interface{}{"rule": jr})
+			}
+		}
+	}
+	return json.Marshal(map[string]interface{}{"nftables": objs})
+}
+
+// DecodeNftJson 解析libnftables JSON格式(nft -j list ruleset的输出)为规则集
+func DecodeNftJson(data []byte) (*Ruleset, error) {
+	var (
+		doc    nftJsonDoc
+		rs     = new(Ruleset)
+		tables = make(map[string]*TableSpec)
+		chains = make(map[string]*ChainSpec)
+	)
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	findTable := func(fam, name string) (*TableSpec, error) {
+		if ts, ok := tables[fam+" "+name]; ok {
+			return ts, nil
+		}
+		return nil, fmt.Errorf("%w: %s %s", ErrTableNotFound, fam, name)
+	}
+	for _, obj := range doc.Nftables {
+		for kind, raw := range obj {
+			switch kind {
+			case "metainfo":
+			case "table":
+				var jt nftJsonTable
+				if err := json.Unmarshal(raw, &jt); err != nil {
+					return nil, err
+				}
+				tbl := &Table{Name: jt.Name}
+				for k, v := range familyKeyword {
+					if v == jt.Family {
+						tbl.Family = k
+					}
+				}
+				if tbl.Family == "" {
+					return nil, fmt.Errorf("unknown table family %q", jt.Family)
+				}
+				ts := &TableSpec{Table: tbl}
+				tables[jt.Family+" "+jt.Name] = ts
+				rs.Tables = append(rs.Tables, ts)
+			case "set":
+				var js nftJsonSet
+				if err := json.Unmarshal(raw, &js); err != nil {
+					return nil, err
+				}
+				ts, err := findTable(js.Family, js.Table)
+				if err != nil {
+					return nil, err
+				}
+				set, err := js.toSet(ts.Table)
+				if err != nil {
+					return nil, err
+				}
+				ts.Sets = append(ts.Sets, set)
+			case "map":
+				var jm nftJsonMap
+				if err := json.Unmarshal(raw, &jm); err != nil {
+					return nil, err
+				}
+				ts, err := findTable(jm.Family, jm.Table)
+				if err != nil {
+					return nil, err
+				}
+				m, err := jm.toMap(ts.Table)
+				if err != nil {
+					return nil, err
+				}
+				ts.Maps = append(ts.Maps, m)
+			case "chain":
+				var jc nftJsonChain
+				if err := json.Unmarshal(raw, &jc); err != nil {
+					return nil, err
+				}
+				ts, err := findTable(jc.Family, jc.Table)
+				if err != nil {
+					return nil, err
+				}
+				ch := &Chain{Table: ts.Table, Name: jc.Name, Type: chainType(jc.Type), Hook: chainHook(jc.Hook),
+					Policy: chainPolicy(jc.Policy), Device: jc.Dev}
+				if err = ch.Validate(); err != nil {
+					return nil, fmt.Errorf("chain %s %s %s: %w", jc.Family, jc.Table, jc.Name, err)
+				}
+				switch prio := jc.Prio.(type) {
+				case float64:
+					ch.Priority = int32(prio)
+				case string:
+					if ch.Priority, err = ParsePriority(ts.Table.Family, prio); err != nil {
+						return nil, fmt.Errorf("chain %s %s %s: %w", jc.Family, jc.Table, jc.Name, err)
+					}
+				}
+				cs := &ChainSpec{Chain: ch}
+				chains[jc.Family+" "+jc.Table+" "+jc.Name] = cs
+				ts.Chains = append(ts.Chains, cs)
+			case "rule":
+				var jr nftJsonRule
+				if err := json.Unmarshal(raw, &jr); err != nil {
+					return nil, err
+				}
+				cs, ok := chains[jr.Family+" "+jr.Table+" "+jr.Chain]
+				if !ok {
+					return nil, fmt.Errorf("%w: %s %s %s", ErrChainNotFound, jr.Family, jr.Table, jr.Chain)
+				}
+				rule := &Rule{Chain: cs.Chain, Handle: jr.Handle}
+				if err := rule.fromNftJson(jr.Expr); err != nil {
+					return nil, fmt.Errorf("rule %s %s %s handle %d: %w", jr.Family, jr.Table, jr.Chain, jr.Handle, err)
+				}
+				cs.Rules = append(cs.Rules, rule)
+			default:
+				return nil, fmt.Errorf("%w: json object %s", ErrUnsupportedExpr, kind)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (d *Set) nftJson(fam string) (*nftJsonSet, error) {
+	js := &nftJsonSet{Family: fam, Table: d.Table.Name, Name: d.Name, Type: nftJsonType(d.DType)}
+	// 不支持的集合原样输出类型名与十六进制元素
+	if d.Opaque {
+		js.Type = d.DType
+		for _, elem := range d.Elements {
+			js.Elem = append(js.Elem, elem)
+		}
+	}
+	if js.Type == nil {
+		return nil, fmt.Errorf("unsupport data type %s", d.DType)
+	}
+	js.Flags = d.flags()
+	js.Timeout, js.GcInterval = uint64(d.Timeout/time.Second), uint64(d.GCInterval/time.Second)
+	js.Size = d.Size
+	for _, elem := range d.Elements {
+		if d.Opaque {
+			break
+		}
+		e, err := ParseSetElem(elem)
+		if err != nil {
+			return nil, err
+		}
+		js.Elem = append(js.Elem, nftJsonSetElem(d.DType, e))
+	}
+	return js, nil
+}
+
+// nftJsonSetElem 带选项的集合元素编码为 {"elem": {"val": <元素>, "timeout": <秒>, "expires": <秒>, "comment": <注释>}}
+func nftJsonSetElem(dtype string, e SetElem) interface{} {
+	val := nftJsonElem(dtype, e.Value)
+	if e.Timeout == 0 && e.Expires == 0 && e.Comment == "" {
+		return val
+	}
+	elem := map[string]interface{}{"val": val}
+	if e.Timeout > 0 {
+		elem["timeout"] = uint64(e.Timeout / time.Second)
+	}
+	if e.Expires > 0 {
+		elem["expires"] = uint64(e.Expires / time.Second)
+	}
+	if e.Comment != "" {
+		elem["comment"] = e.Comment
+	}
+	return map[string]interface{}{"elem": elem}
+}
+
+// fromNftJsonSetElem 解析集合元素, 带选项的元素输出为 <元素> timeout <t> ...
+func fromNftJsonSetElem(v interface{}) ([]string, error) {
+	m, _ := v.(map[string]interface{})
+	elem, ok := m["elem"].(map[string]interface{})
+	if !ok {
+		return nftJsonValue(v)
+	}
+	vals, err := nftJsonValue(elem["val"])
+	if err != nil {
+		return nil, err
+	}
+	if len(vals) != 1 {
+		return nil, fmt.Errorf("invalid set element %v", v)
+	}
+	e := SetElem{Value: vals[0]}
+	if t, ok := elem["timeout"].(float64); ok {
+		e.Timeout = time.Duration(t) * time.Second
+	}
+	if t, ok := elem["expires"].(float64); ok {
+		e.Expires = time.Duration(t) * time.Second
+	}
+	e.Comment, _ = elem["comment"].(string)
+	return []string{e.String()}, nil
+}
+
+func (d *nftJsonSet) toSet(tbl *Table) (*Set, error) {
+	set := &Set{Table: tbl, Name: d.Name, DType: fromNftJsonType(d.Type)}
+	if set.DType == "" {
+		// 不支持的类型作为只读集合保留类型名
+		typ, ok := d.Type.(string)
+		if !ok || typ == "" {
+			return nil, fmt.Errorf("unsupport data type %v", d.Type)
+		}
+		set.DType, set.Opaque = typ, true
+	}
+	for _, flag := range d.Flags {
+		switch flag {
+		case "interval":
+			set.ElemRange = true
+		case "dynamic":
+			set.Dynamic = true
+		case "timeout":
+			set.HasTimeout = true
+		}
+	}
+	set.Timeout, set.GCInterval = time.Duration(d.Timeout)*time.Second, time.Duration(d.GcInterval)*time.Second
+	set.Size = d.Size
+	for _, elem := range d.Elem {
+		v, err := fromNftJsonSetElem(elem)
+		if err != nil {
+			return nil, err
+		}
+		set.Elements = append(set.Elements, v...)
+	}
+	return set, nil
+}
+
+func (d *Map) nftJson(fam string) (*nftJsonMap, error) {
+	jm := &nftJsonMap{Family: fam, Table: d.Table.Name, Name: d.Name, Type: nftJsonType(d.KeyType),
+		Map: dtypeKeyword[d.DataType]}
+	if d.DataType == MapDtypeVerdict {
+		jm.Map = MapDtypeVerdict
+	}
+	if jm.Type == nil || jm.Map == "" {
+		return nil, fmt.Errorf("unsupport map type %s : %s", d.KeyType, d.DataType)
+	}
+	if d.ElemRange {
+		jm.Flags = append(jm.Flags, "interval")
+	}
+	for _, e := range d.Elements {
+		jm.Elem = append(jm.Elem, []interface{}{nftJsonElem(d.KeyType, e.Key), nftJsonElem(d.DataType, e.Value)})
+	}
+	return jm, nil
+}
+
+func (d *nftJsonMap) toMap(tbl *Table) (*Map, error) {
+	m := &Map{Table: tbl, Name: d.Name, KeyType: fromNftJsonType(d.Type), DataType: dtypeOfKeyword(d.Map)}
+	if d.Map == MapDtypeVerdict {
+		m.DataType = MapDtypeVerdict
+	}
+	if m.KeyType == "" || m.DataType == "" {
+		return nil, fmt.Errorf("unsupport map type %v : %s", d.Type, d.Map)
+	}
+	for _, flag := range d.Flags {
+		if flag == "interval" {
+			m.ElemRange = true
+		}
+	}
+	for _, item := range d.Elem {
+		e, err := nftJsonMapElem(item, m.DataType)
+		if err != nil {
+			return nil, err
+		}
+		m.Elements = append(m.Elements, e)
+	}
+	return m, nil
+}
+
+// nftJson 映射查找编码为 {"key": <表达式>, "data": "@name" 或 {"set": [[key, value], ...]}}
+func (d *RuleMap) nftJson(dataType string) map[string]interface{} {
+	var data interface{} = "@" + d.Name
+	if d.Name == "" {
+		var set []interface{}
+		for _, e := range d.Elements {
+			set = append(set, []interface{}{nftJsonElem(ruleMapKeys[d.Key].dtype, e.Key), nftJsonElem(dataType, e.Value)})
+		}
+		data = map[string]interface{}{"set": set}
+	}
+	return map[string]interface{}{"key": nftJsonKey(d.Key), "data": data}
+}
+
+// nftJsonKey 查找键编码为payload或meta表达式
+func nftJsonKey(key string) map[string]interface{} {
+	l := strings.Fields(key)
+	switch {
+	case len(l) == 2 && l[0] == "meta":
+		return map[string]interface{}{"meta": map[string]interface{}{"key": l[1]}}
+	case len(l) == 2:
+		return map[string]interface{}{"payload": map[string]interface{}{"protocol": l[0], "field": l[1]}}
+	}
+	return map[string]interface{}{"meta": map[string]interface{}{"key": key}}
+}
+
+// fromNftJsonKey 解析payload或meta表达式对应的查找键
+func fromNftJsonKey(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	if pld, ok := m["payload"].(map[string]interface{}); ok {
+		proto, _ := pld["protocol"].(string)
+		field, _ := pld["field"].(string)
+		return proto + " " + field
+	}
+	if meta, ok := m["meta"].(map[string]interface{}); ok {
+		key, _ := meta["key"].(string)
+		if key == "l4proto" {
+			return "meta " + key
+		}
+		return key
+	}
+	return ""
+}
+
+// fromNftJsonMap 解析映射查找, 并设置查找键隐含的协议
+func (d *Rule) fromNftJsonMap(val interface{}, dataType string) (*RuleMap, error) {
+	m, _ := val.(map[string]interface{})
+	key := fromNftJsonKey(m["key"])
+	if err := d.useMapKey(key); err != nil {
+		return nil, err
+	}
+	rm := &RuleMap{Key: key}
+	switch data := m["data"].(type) {
+	case string:
+		if !strings.HasPrefix(data, "@") {
+			return nil, fmt.Errorf("invalid map %q", data)
+		}
+		rm.Name = data[1:]
+	case map[string]interface{}:
+		set, _ := data["set"].([]interface{})
+		for _, item := range set {
+			e, err := nftJsonMapElem(item, dataType)
+			if err != nil {
+				return nil, err
+			}
+			rm.Elements = append(rm.Elements, e)
+		}
+		if len(rm.Elements) == 0 {
+			return nil, fmt.Errorf("empty map %v", data)
+		}
+	default:
+		return nil, fmt.Errorf("invalid map %v", m["data"])
+	}
+	return rm, nil
+}
+
+// nftJsonType 数据类型编码, 拼接类型为关键字数组, 不支持时返回nil
+func nftJsonType(dtype string) interface{} {
+	dtypes := concatDtypes(dtype)
+	if dtypes == nil {
+		if kw, ok := dtypeKeyword[dtype]; ok {
+			return kw
+		}
+		return nil
+	}
+	var r []string
+	for _, v := range dtypes {
+		kw, ok := dtypeKeyword[v]
+		if !ok {
+			return nil
+		}
+		r = append(r, kw)
+	}
+	return r
+}
+
+// fromNftJsonType 解析字符串或关键字数组格式的数据类型
+func fromNftJsonType(v interface{}) string {
+	switch typ := v.(type) {
+	case string:
+		return dtypeOfKeyword(typ)
+	case []interface{}:
+		var r []string
+		for _, item := range typ {
+			kw, _ := item.(string)
+			r = append(r, kw)
+		}
+		return dtypeOfKeyword(strings.Join(r, " . "))
+	}
+	return ""
+}
+
+// nftJsonElem 集合或映射元素编码, 端口为数字, 地址同nftJsonAddr, verdict为动作对象, 拼接元素为concat数组
+func nftJsonElem(dtype, v string) interface{} {
+	if dtypes := concatDtypes(dtype); dtypes != nil {
+		var r []interface{}
+		for i, f := range strings.Split(v, " . ") {
+			if i < len(dtypes) {
+				r = append(r, nftJsonElem(dtypes[i], f))
+			}
+		}
+		return map[string]interface{}{"concat": r}
+	}
+	switch dtype {
+	case SetDtypePort:
+		return nftJsonPort(v)
+	case SetDtypeIfname:
+		return v
+	case SetDtypeProto:
+		if n, err := strconv.ParseUint(v, 10, 8); err == nil {
+			return n
+		}
+		return v
+	case MapDtypeVerdict:
+		l := strings.Fields(v)
+		if len(l) == 2 {
+			return map[string]interface{}{l[0]: map[string]interface{}{"target": l[1]}}
+		}
+		return map[string]interface{}{v: nil}
+	}
+	if c, ok := dtypeCodecs[dtype]; ok {
+		if start, end, err := codecSplit(c, v); err == nil && start != end {
+			return map[string]interface{}{"range": []string{start, end}}
+		}
+		return v
+	}
+	return nftJsonAddr(v)
+}
+
+// nftJsonMapElem 解析 [key, value] 格式的映射元素
+func nftJsonMapElem(item interface{}, dataType string) (MapElement, error) {
+	pair, ok := item.([]interface{})
+	if !ok || len(pair) != 2 {
+		return MapElement{}, fmt.Errorf("invalid map element %v", item)
+	}
+	key, err := nftJsonValue(pair[0])
+	if err != nil {
+		return MapElement{}, err
+	}
+	if len(key) != 1 {
+		return MapElement{}, fmt.Errorf("invalid map element %v", item)
+	}
+	if dataType != MapDtypeVerdict {
+		value, err := nftJsonValue(pair[1])
+		if err != nil {
+			return MapElement{}, err
+		}
+		if len(value) != 1 {
+			return MapElement{}, fmt.Errorf("invalid map element %v", item)
+		}
+		return MapElement{Key: key[0], Value: value[0]}, nil
+	}
+	vd, _ := pair[1].(map[string]interface{})
+	for kind, arg := range vd {
+		if _, ok := verdictKinds[kind]; !ok || len(vd) != 1 {
+			break
+		}
+		if target, _ := arg.(map[string]interface{}); target != nil {
+			chain, _ := target["target"].(string)
+			return MapElement{Key: key[0], Value: kind + " " + chain}, nil
+		}
+		return MapElement{Key: key[0], Value: kind}, nil
+	}
+	return MapElement{}, fmt.Errorf("%w: verdict %v", ErrUnsupportedExpr, pair[1])
+}
+
+// nftJsonExprs 将规则编码为libnftables JSON语句列表
+func (d *Rule) nftJsonExprs() ([]map[string]interface{}, error) {
+	var r []map[string]interface{}
+	if !d.FullyDecoded() {
+		return nil, &DecodeError{Exprs: d.rawExprs()}
+	}
+	match := func(left map[string]interface{}, op string, right interface{}) {
+		r = append(r, map[string]interface{}{"match": map[string]interface{}{"op": op, "left": left, "right": right}})
+	}
+	payload := func(proto, field string) map[string]interface{} {
+		return map[string]interface{}{"payload": map[string]interface{}{"protocol": proto, "field": field}}
+	}
+	// negMatch 以!开头的值编码为!=匹配, 逗号分隔的列表编码为匿名集合
+	negMatch := func(left map[string]interface{}, value string, encode func(string) interface{}) {
+		value, neg := splitNeg(value)
+		op := "=="
+		if neg {
+			op = "!="
+		}
+		if !isValueList(value) {
+			match(left, op, encode(value))
+			return
+		}
+		var set []interface{}
+		for _, elem := range strings.Split(value, ",") {
+			set = append(set, encode(strings.TrimSpace(elem)))
+		}
+		match(left, op, map[string]interface{}{"set": set})
+	}
+	for _, ifc := range []struct{ key, iface string }{{"iif", d.InIface}, {"oif", d.OutIface}} {
+		if ifc.iface == "" {
+			continue
+		}
+		key := ifc.key + "name"
+		if iface, _ := splitNeg(ifc.iface); isIfindex(iface) {
+			key = ifc.key
+		}
+		negMatch(map[string]interface{}{"meta": map[string]interface{}{"key": key}}, ifc.iface, func(v string) interface{} {
+			if idx, err := strconv.ParseUint(v, 10, 32); err == nil {
+				return idx
+			}
+			return v
+		})
+	}
+	l3 := "ip"
+	if d.L3Proto == RuleL3Ip6 {
+		l3 = "ip6"
+	}
+	mapL3, mapL4 := d.mapProto()
+	l4Pld := d.l4ProtoPayload()
+	if d.L3Proto != "" && d.L3SrcIP == "" && d.L3DstIP == "" && d.L3Proto != mapL3 && !l4Pld {
+		match(map[string]interface{}{"meta": map[string]interface{}{"key": "nfproto"}}, "==", d.L3Proto)
+	}
+	if d.L3SrcIP != "" {
+		negMatch(payload(l3, "saddr"), d.L3SrcIP, nftJsonAddr)
+	}
+	if d.L3DstIP != "" {
+		negMatch(payload(l3, "daddr"), d.L3DstIP, nftJsonAddr)
+	}
+	if d.L4Proto != "" {
+		proto, _ := splitNeg(d.L4Proto)
+		if _, ok := l4ProtoNum(proto); !ok {
+			return nil, fmt.Errorf("%w: l4 protocol %s", ErrUnsupportedExpr, d.L4Proto)
+		}
+		l4 := l4ProtoKeyword(proto)
+		hasPort := isPortProto(d.L4Proto) && (d.L4SrcPort != "" || d.L4DstPort != "")
+		left := map[string]interface{}{"meta": map[string]interface{}{"key": "l4proto"}}
+		if l4Pld {
+			left = payload(l3, l4ProtoField(d.L3Proto))
+		}
+		if l4Pld || !hasPort && d.L4Proto != mapL4 {
+			negMatch(left, d.L4Proto, func(string) interface{} {
+				if n, err := strconv.ParseUint(l4, 10, 8); err == nil {
+					return n
+				}
+				return l4
+			})
+		}
+		if hasPort && d.L4SrcPort != "" {
+			negMatch(payload(l4, "sport"), d.L4SrcPort, nftJsonPort)
+		}
+		if hasPort && d.L4DstPort != "" {
+			negMatch(payload(l4, "dport"), d.L4DstPort, nftJsonPort)
+		}
+	}
+	for _, h := range d.Headers {
+		f, ok := ruleHeaderFields[h.Field]
+		if !ok {
+			return nil, fmt.Errorf("%w: header field %s", ErrUnsupportedExpr, h.Field)
+		}
+		l := strings.SplitN(h.Field, " ", 2)
+		left := payload(l[0], l[1])
+		if h.Mask != "" {
+			left = map[string]interface{}{"&": []interface{}{left, nftJsonHeaderValue(f, h.Mask)}}
+		}
+		op := h.Op
+		if op == "" && f.flags && h.Mask == "" {
+			op = "in"
+		} else if op == "" {
+			op = "=="
+		}
+		match(left, op, nftJsonHeaderValue(f, h.Value))
+	}
+	if d.Concat != nil {
+		var (
+			keys   []interface{}
+			dtypes []string
+		)
+		for _, key := range d.Concat.Keys {
+			k, _ := concatKey(key)
+			keys = append(keys, nftJsonKey(key))
+			dtypes = append(dtypes, k.dtype)
+		}
+		dtype := strings.Join(dtypes, " . ")
+		negMatch(map[string]interface{}{"concat": keys}, d.Concat.Value, func(v string) interface{} {
+			if strings.HasPrefix(v, "@") {
+				return v
+			}
+			return nftJsonElem(dtype, v)
+		})
+	}
+	if len(d.CtStates) > 0 {
+		var right interface{} = sortCtStates(d.CtStates)
+		if len(d.CtStates) == 1 {
+			right = d.CtStates[0]
+		}
+		op := "in"
+		if d.CtStatesNeg {
+			op = "!="
+		}
+		match(map[string]interface{}{"ct": map[string]interface{}{"key": "state"}}, op, right)
+	}
+	for _, c := range d.CtMatches {
+		c, err := c.normalize()
+		if err != nil {
+			return nil, err
+		}
+		op := c.Op
+		if op == "" && c.Key == "status" {
+			op = "in"
+		} else if op == "" {
+			op = "=="
+		}
+		match(map[string]interface{}{"ct": nftJsonCtKey(c.Key)}, op, nftJsonCtValue(c))
+	}
+	if cnt := d.CtCount; cnt != nil {
+		jc := map[string]interface{}{"val": cnt.Count}
+		if cnt.Over {
+			jc["inv"] = true
+		}
+		r = append(r, map[string]interface{}{"ct count": jc})
+	}
+	markMatch := func(key map[string]interface{}, mark string) error {
+		value, mask, err := parseMarkMatch(mark)
+		if err != nil {
+			return err
+		}
+		if mask == 0xffffffff {
+			match(key, "==", value)
+		} else {
+			match(map[string]interface{}{"&": []interface{}{key, mask}}, "==", value)
+		}
+		return nil
+	}
+	if d.MetaMark != "" {
+		if err := markMatch(map[string]interface{}{"meta": map[string]interface{}{"key": "mark"}}, d.MetaMark); err != nil {
+			return nil, err
+		}
+	}
+	if d.CtMark != "" {
+		if err := markMatch(map[string]interface{}{"ct": map[string]interface{}{"key": "mark"}}, d.CtMark); err != nil {
+			return nil, err
+		}
+	}
+	if d.MetaPriority != "" {
+		match(map[string]interface{}{"meta": map[string]interface{}{"key": "priority"}}, "==", renderPriorityValue(d.MetaPriority))
+	}
+	if lmt := d.Limit; lmt != nil {
+		jl := map[string]interface{}{"rate": lmt.Rate, "per": lmt.Unit}
+		if lmt.Burst != 0 {
+			jl["burst"] = lmt.Burst
+		}
+		if lmt.Over {
+			jl["inv"] = true
+		}
+		r = append(r, map[string]interface{}{"limit": jl})
+	}
+	if cnt := d.Counter; cnt != nil {
+		r = append(r, map[string]interface{}{"counter": map[string]interface{}{"packets": cnt.Packets, "bytes": cnt.Bytes}})
+	}
+	if log := d.Log; log != nil {
+		jl := make(map[string]interface{})
+		if log.Prefix != "" {
+			jl["prefix"] = log.Prefix
+		}
+		if log.Level != "" {
+			jl["level"] = log.Level
+		}
+		if log.Group != nil {
+			jl["group"] = *log.Group
+		}
+		if log.Snaplen != 0 {
+			jl["snaplen"] = log.Snaplen
+		}
+		if len(log.Flags) > 0 {
+			jl["flags"] = log.Flags
+		}
+		r = append(r, map[string]interface{}{"log": jl})
+	}
+	mangle := func(key map[string]interface{}, value interface{}) {
+		r = append(r, map[string]interface{}{"mangle": map[string]interface{}{"key": key, "value": value}})
+	}
+	for _, ms := range []struct{ key, value string }{{"meta", d.MetaMarkSet}, {"ct", d.CtMarkSet}} {
+		if ms.value == "" {
+			continue
+		}
+		mv, err := parseMarkValue(ms.value)
+		if err != nil {
+			return nil, err
+		}
+		mangle(map[string]interface{}{ms.key: map[string]interface{}{"key": "mark"}}, mv.nftJson())
+	}
+	if d.CtZoneSet != "" {
+		zone, err := strconv.ParseUint(d.CtZoneSet, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ct zone %q", d.CtZoneSet)
+		}
+		mangle(map[string]interface{}{"ct": map[string]interface{}{"key": "zone"}}, zone)
+	}
+	if d.MetaPrioritySet != "" {
+		mangle(map[string]interface{}{"meta": map[string]interface{}{"key": "priority"}}, renderPriorityValue(d.MetaPrioritySet))
+	}
+	if d.Notrack {
+		r = append(r, map[string]interface{}{"notrack": nil})
+	}
+	if d.SetUpdate != nil {
+		r = append(r, map[string]interface{}{"set": d.SetUpdate.nftJson()})
+	}
+	if d.VMap != nil {
+		r = append(r, map[string]interface{}{"vmap": d.VMap.nftJson(MapDtypeVerdict)})
+	}
+	switch d.Action {
+	case RuleActAccept, RuleActDrop:
+		r = append(r, map[string]interface{}{d.Action: nil})
+	case RuleActJump, RuleActGoto:
+		r = append(r, map[string]interface{}{d.Action: map[string]interface{}{"target": d.DstChain}})
+	case RuleActSnat, RuleActDnat, RuleActMasq, RuleActRedir:
+		nat := make(map[string]interface{})
+		if (d.Action == RuleActSnat || d.Action == RuleActDnat) && d.natQualified() {
+			nat["family"] = "ip"
+			if d.natFamily() == unix.NFPROTO_IPV6 {
+				nat["family"] = "ip6"
+			}
+		}
+		if d.NatAddr != "" {
+			nat["addr"] = nftJsonAddr(d.NatAddr)
+		}
+		if d.NatMap != nil {
+			nat["addr"] = map[string]interface{}{"map": d.NatMap.nftJson(SetDtypeIpv4)}
+		}
+		if d.NatPort != "" {
+			nat["port"] = nftJsonPort(d.NatPort)
+		}
+		if len(d.NatFlags) > 0 {
+			nat["flags"] = sortNatFlags(d.NatFlags)
+		}
+		if len(nat) == 0 {
+			r = append(r, map[string]interface{}{d.Action: nil})
+		} else {
+			r = append(r, map[string]interface{}{d.Action: nat})
+		}
+	case RuleActReject:
+		switch d.RejectKind {
+		case "":
+			r = append(r, map[string]interface{}{d.Action: nil})
+		case RuleRejectTcpReset:
+			r = append(r, map[string]interface{}{d.Action: map[string]interface{}{"type": d.RejectKind}})
+		default:
+			code := d.RejectCode
+			if code == "" {
+				code = "port-unreachable"
+			}
+			r = append(r, map[string]interface{}{d.Action: map[string]interface{}{"type": d.RejectKind, "expr": code}})
+		}
+	case "":
+	default:
+		return nil, fmt.Errorf("%w: action %s", ErrUnsupportedExpr, d.Action)
+	}
+	return r, nil
+}
+
+// fromNftJson 解析libnftables JSON语句列表到规则
+func (d *Rule) fromNftJson(exprs []map[string]interface{}) error {
+	for _, exp := range exprs {
+		for kind, val := range exp {
+			switch kind {
+			case "match":
+				if err := d.fromNftJsonMatch(val); err != nil {
+					return err
+				}
+			case RuleActAccept, RuleActDrop:
+				d.Action = kind
+			case RuleActJump, RuleActGoto:
+				m, _ := val.(map[string]interface{})
+				target, _ := m["target"].(string)
+				if target == "" {
+					return fmt.Errorf("missing %s target", kind)
+				}
+				d.Action = kind
+				d.DstChain = target
+			case RuleActSnat, RuleActDnat, RuleActMasq, RuleActRedir:
+				if err := d.fromNftJsonNat(kind, val); err != nil {
+					return err
+				}
+			case "mangle":
+				if err := d.fromNftJsonMangle(val); err != nil {
+					return err
+				}
+			case "set":
+				if err := d.fromNftJsonSetUpdate(val); err != nil {
+					return err
+				}
+			case "vmap":
+				rm, err := d.fromNftJsonMap(val, MapDtypeVerdict)
+				if err != nil {
+					return err
+				}
+				d.VMap = rm
+			case "limit":
+				m, _ := val.(map[string]interface{})
+				rate, _ := m["rate"].(float64)
+				burst, _ := m["burst"].(float64)
+				unit, _ := m["per"].(string)
+				over, _ := m["inv"].(bool)
+				if _, ok := limitUnitMap[unit]; !ok {
+					return fmt.Errorf("%w: limit unit %s", ErrUnsupportedExpr, unit)
+				}
+				if bu, _ := m["rate_unit"].(string); bu != "" && bu != "packets" {
+					return fmt.Errorf("%w: limit rate unit %s", ErrUnsupportedExpr, bu)
+				}
+				d.Limit = &RuleLimit{Rate: uint64(rate), Unit: unit, Burst: uint32(burst), Over: over}
+			case "ct count":
+				m, _ := val.(map[string]interface{})
+				n, ok := m["val"].(float64)
+				if !ok {
+					return fmt.Errorf("invalid ct count %v", val)
+				}
+				over, _ := m["inv"].(bool)
+				d.CtCount = &RuleCtCount{Count: uint32(n), Over: over}
+			case "notrack":
+				d.Notrack = true
+			case "counter":
+				m, _ := val.(map[string]interface{})
+				packets, _ := m["packets"].(float64)
+				bytes, _ := m["bytes"].(float64)
+				d.Counter = &RuleCounter{Packets: uint64(packets), Bytes: uint64(bytes)}
+			case "log":
+				m, _ := val.(map[string]interface{})
+				log := new(RuleLog)
+				log.Prefix, _ = m["prefix"].(string)
+				log.Level, _ = m["level"].(string)
+				if g, ok := m["group"].(float64); ok {
+					group := uint16(g)
+					log.Group = &group
+				}
+				if n, ok := m["snaplen"].(float64); ok {
+					log.Snaplen = uint32(n)
+				}
+				if v, ok := m["flags"]; ok {
+					flags, err := nftJsonValue(v)
+					if err != nil {
+						return err
+					}
+					log.Flags = flags
+				}
+				d.Log = log
+			case RuleActReject:
+				m, _ := val.(map[string]interface{})
+				d.Action = kind
+				d.RejectKind, _ = m["type"].(string)
+				d.RejectCode, _ = m["expr"].(string)
+			default:
+				return fmt.Errorf("%w: %s", ErrUnsupportedExpr, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// nftJson 集合更新编码为 {"op": "add", "elem": <键>, "set": "@name"}, 带超时的元素为 {"elem": {"val": <键>, "timeout": <秒>}}
+func (d *RuleSetUpdate) nftJson() map[string]interface{} {
+	var keys []interface{}
+	for _, key := range d.Keys {
+		keys = append(keys, nftJsonKey(key))
+	}
+	var elem interface{} = map[string]interface{}{"concat": keys}
+	if len(keys) == 1 {
+		elem = keys[0]
+	}
+	if d.Timeout > 0 {
+		elem = map[string]interface{}{"elem": map[string]interface{}{"val": elem, "timeout": uint64(d.Timeout / time.Second)}}
+	}
+	return map[string]interface{}{"op": d.Op, "elem": elem, "set": "@" + d.Set}
+}
+
+// fromNftJsonSetUpdate 解析集合更新语句, 并设置键隐含的协议
+func (d *Rule) fromNftJsonSetUpdate(val interface{}) error {
+	m, _ := val.(map[string]interface{})
+	op, _ := m["op"].(string)
+	name, _ := m["set"].(string)
+	if op != RuleSetOpAdd && op != RuleSetOpUpdate {
+		return fmt.Errorf("%w: set operation %s", ErrUnsupportedExpr, op)
+	}
+	if !strings.HasPrefix(name, "@") {
+		return fmt.Errorf("invalid set %q", name)
+	}
+	su := &RuleSetUpdate{Op: op, Set: name[1:]}
+	keyVal := m["elem"]
+	if em, ok := keyVal.(map[string]interface{}); ok {
+		if elem, ok := em["elem"].(map[string]interface{}); ok {
+			t, _ := elem["timeout"].(float64)
+			su.Timeout = time.Duration(t) * time.Second
+			keyVal = elem["val"]
+		}
+	}
+	em, _ := keyVal.(map[string]interface{})
+	if concat, ok := em["concat"].([]interface{}); ok {
+		for _, item := range concat {
+			su.Keys = append(su.Keys, fromNftJsonKey(item))
+		}
+	} else {
+		su.Keys = []string{fromNftJsonKey(keyVal)}
+	}
+	if err := d.useConcat(su.Keys); err != nil {
+		return err
+	}
+	d.SetUpdate = su
+	return nil
+}
+
+func (d *Rule) fromNftJsonNat(action string, val interface{}) error {
+	d.Action = action
+	m, _ := val.(map[string]interface{})
+	if am, ok := m["addr"].(map[string]interface{}); ok && am["map"] != nil {
+		rm, err := d.fromNftJsonMap(am["map"], SetDtypeIpv4)
+		if err != nil {
+			return err
+		}
+		d.NatMap = rm
+		delete(m, "addr")
+	}
+	// 未指定地址时由地址族限定规则的L3协议, 匿名映射由其中的地址确定地址族
+	if fam, _ := m["family"].(string); fam == "ip6" && m["addr"] == nil && (d.NatMap == nil || d.NatMap.Name != "") {
+		d.L3Proto = RuleL3Ip6
+	}
+	if v, ok := m["addr"]; ok {
+		addr, err := nftJsonValue(v)
+		if err != nil {
+			return err
+		}
+		if len(addr) != 1 {
+			return fmt.Errorf("invalid %s addr %v", action, v)
+		}
+		d.NatAddr = addr[0]
+	}
+	if v, ok := m["port"]; ok {
+		port, err := nftJsonValue(v)
+		if err != nil {
+			return err
+		}
+		if len(port) != 1 {
+			return fmt.Errorf("invalid %s port %v", action, v)
+		}
+		d.NatPort = port[0]
+	}
+	if v, ok := m["flags"]; ok {
+		flags, err := nftJsonValue(v)
+		if err != nil {
+			return err
+		}
+		for _, f := range flags {
+			if !isNatFlag(f) {
+				return fmt.Errorf("%w: nat flag %s", ErrUnsupportedExpr, f)
+			}
+		}
+		d.NatFlags = flags
+	}
+	return nil
+}
+
+// fromNftJsonMangle 解析 meta mark/ct mark/meta priority 设置语句
+func (d *Rule) fromNftJsonMangle(val interface{}) error {
+	m, _ := val.(map[string]interface{})
+	key, _ := m["key"].(map[string]interface{})
+	value, err := nftJsonMarkValue(m["value"])
+	if err != nil {
+		return err
+	}
+	if meta, ok := key["meta"].(map[string]interface{}); ok {
+		switch meta["key"] {
+		case "mark":
+			d.MetaMarkSet = value
+			return nil
+		case "priority":
+			d.MetaPrioritySet = value
+			return nil
+		}
+	}
+	if ct, ok := key["ct"].(map[string]interface{}); ok {
+		switch ct["key"] {
+		case "mark":
+			d.CtMarkSet = value
+			return nil
+		case "zone":
+			d.CtZoneSet = value
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: mangle %v", ErrUnsupportedExpr, key)
+}
+
+func (d *Rule) fromNftJsonMatch(val interface{}) error {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid match %v", val)
+	}
+	op, _ := m["op"].(string)
+	if ok, err := d.fromNftJsonHeader(m["left"], op, m["right"]); ok {
+		return err
+	}
+	if ok, err := d.fromNftJsonCt(m["left"], op, m["right"]); ok {
+		return err
+	}
+	if op != "==" && op != "!=" && op != "in" {
+		return fmt.Errorf("%w: match op %s", ErrUnsupportedExpr, op)
+	}
+	left, _ := m["left"].(map[string]interface{})
+	right, err := nftJsonValue(m["right"])
+	if err != nil {
+		return err
+	}
+	if len(right) == 0 {
+		return fmt.Errorf("empty match value %v", m["right"])
+	}
+	one := right[0]
+	if set, ok := m["right"].(map[string]interface{}); ok && set["set"] != nil {
+		one = strings.Join(right, ",")
+	}
+	neg := negPrefix(op == "!=")
+	if concat, ok := left["concat"].([]interface{}); ok {
+		var keys []string
+		for _, item := range concat {
+			keys = append(keys, fromNftJsonKey(item))
+		}
+		if err = d.useConcat(keys); err != nil {
+			return err
+		}
+		if name, ok := m["right"].(string); ok && strings.HasPrefix(name, "@") {
+			one = name
+		}
+		d.Concat = &RuleConcat{Keys: keys, Value: neg + one}
+		return nil
+	}
+	// 仅地址、端口、四层协议、接口与连接跟踪状态支持!=匹配
+	noNeg := func() error {
+		if neg != "" {
+			return fmt.Errorf("%w: negated match %v", ErrUnsupportedExpr, left)
+		}
+		return nil
+	}
+	setL3 := func(l3 string) error {
+		if d.L3Proto != "" && d.L3Proto != l3 {
+			return fmt.Errorf("conflicting l3 protocol %s and %s", d.L3Proto, l3)
+		}
+		d.L3Proto = l3
+		return nil
+	}
+	setL4 := func(l4 string) error {
+		n, ok := l4ProtoNum(l4)
+		if !ok {
+			return fmt.Errorf("%w: l4 protocol %s", ErrUnsupportedExpr, l4)
+		}
+		d.L4Proto = neg + l4ProtoName(n)
+		return nil
+	}
+	if pld, ok := left["payload"].(map[string]interface{}); ok {
+		proto, _ := pld["protocol"].(string)
+		field, _ := pld["field"].(string)
+		switch {
+		case (proto == "ip" || proto == "ip6") && (field == "protocol" || field == "nexthdr"):
+			l3 := RuleL3Ip
+			if proto == "ip6" {
+				l3 = RuleL3Ip6
+			}
+			if err = setL3(l3); err != nil {
+				return err
+			}
+			return setL4(one)
+		case proto == "ip" || proto == "ip6":
+			l3 := RuleL3Ip
+			if proto == "ip6" {
+				l3 = RuleL3Ip6
+			}
+			if err = setL3(l3); err != nil {
+				return err
+			}
+			switch field {
+			case "saddr":
+				d.L3SrcIP = neg + one
+				return nil
+			case "daddr":
+				d.L3DstIP = neg + one
+				return nil
+			}
+		case isPortProto(proto):
+			d.L4Proto = proto
+			switch field {
+			case "sport":
+				d.L4SrcPort = neg + one
+				return nil
+			case "dport":
+				d.L4DstPort = neg + one
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: payload %s %s", ErrUnsupportedExpr, proto, field)
+	}
+	if meta, ok := left["meta"].(map[string]interface{}); ok {
+		switch key, _ := meta["key"].(string); key {
+		case "l4proto":
+			return setL4(one)
+		case "iifname", "oifname":
+			// 保留集合引用的@前缀以区分接口名
+			name, ok := m["right"].(string)
+			if !ok {
+				name = one
+			}
+			if name == "" || isIfindex(name) {
+				return fmt.Errorf("invalid interface name %v", m["right"])
+			}
+			if key == "iifname" {
+				d.InIface = neg + name
+			} else {
+				d.OutIface = neg + name
+			}
+			return nil
+		case "iif", "oif":
+			if !isIfindex(one) {
+				return fmt.Errorf("%w: %s %s", ErrUnsupportedExpr, key, one)
+			}
+			if key == "iif" {
+				d.InIface = neg + one
+			} else {
+				d.OutIface = neg + one
+			}
+			return nil
+		}
+	}
+	if ct, ok := left["ct"].(map[string]interface{}); ok && ct["key"] == "state" {
+		for _, st := range right {
+			if !inCtStateMap(st) {
+				return fmt.Errorf("unknown ct state %q", st)
+			}
+		}
+		d.CtStates = right
+		d.CtStatesNeg = neg != ""
+		return nil
+	}
+	if err = noNeg(); err != nil {
+		return err
+	}
+	// 带掩码的标记匹配
+	mask := ""
+	if and, ok := left["&"].([]interface{}); ok && len(and) == 2 {
+		m, err := nftJsonValue(and[1])
+		if err != nil {
+			return err
+		}
+		left, _ = and[0].(map[string]interface{})
+		mask = "/" + m[0]
+	}
+	if ct, ok := left["ct"].(map[string]interface{}); ok && ct["key"] == "mark" {
+		d.CtMark = one + mask
+		return nil
+	}
+	if meta, ok := left["meta"].(map[string]interface{}); ok {
+		switch key, _ := meta["key"].(string); key {
+		case "nfproto":
+			return setL3(one)
+		case "mark":
+			d.MetaMark = one + mask
+			return nil
+		case "priority":
+			d.MetaPriority = one
+			return nil
+		default:
+			return fmt.Errorf("%w: meta %s", ErrUnsupportedExpr, key)
+		}
+	}
+	return fmt.Errorf("%w: match %v", ErrUnsupportedExpr, left)
+}
+
+// nftJsonAddr 地址编码: 集合名为"@name", 网段为prefix, 范围为range
+func nftJsonAddr(addr string) interface{} {
+	if !strings.ContainsAny(addr, "./-: ") {
+		return "@" + addr
+	}
+	if strings.Contains(addr, "/") {
+		l := strings.SplitN(addr, "/", 2)
+		n, _ := strconv.Atoi(l[1])
+		return map[string]interface{}{"prefix": map[string]interface{}{"addr": l[0], "len": n}}
+	}
+	if strings.Contains(addr, "-") {
+		l := strings.SplitN(addr, "-", 2)
+		return map[string]interface{}{"range": []string{l[0], l[1]}}
+	}
+	return addr
+}
+
+// nftJsonPort 端口编码: 单个端口为数字, 范围为range
+func nftJsonPort(port string) interface{} {
+	if strings.Contains(port, "-") {
+		l := strings.SplitN(port, "-", 2)
+		return map[string]interface{}{"range": []interface{}{nftJsonPort(l[0]), nftJsonPort(l[1])}}
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+		return n
+	}
+	return renderPort(port)
+}
+
+// nftJsonHeaderValue 协议头匹配的取值编码: 集合引用为"@name", 列表为set, 范围为range, 多个标志为数组
+func nftJsonHeaderValue(f ruleHeaderField, value string) interface{} {
+	elem := func(v string) interface{} {
+		if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+			return n
+		}
+		return v
+	}
+	switch {
+	case strings.HasPrefix(value, "@"):
+		return value
+	case isValueList(value):
+		var set []interface{}
+		for _, v := range strings.Split(value, ",") {
+			set = append(set, nftJsonHeaderValue(f, v))
+		}
+		return map[string]interface{}{"set": set}
+	case f.flags && strings.Contains(value, "|"):
+		return strings.Split(value, "|")
+	}
+	if lo, hi, err := f.rangeOf(value); err == nil && lo != hi {
+		return map[string]interface{}{"range": []interface{}{elem(f.format(lo)), elem(f.format(hi))}}
+	}
+	return elem(value)
+}
+
+// fromNftJsonHeader 解析协议头字段的匹配, 不是协议头字段时返回false
+func (d *Rule) fromNftJsonHeader(left interface{}, op string, right interface{}) (bool, error) {
+	h := RuleHeader{Op: op}
+	l, _ := left.(map[string]interface{})
+	if and, ok := l["&"].([]interface{}); ok && len(and) == 2 {
+		mask, err := nftJsonValue(and[1])
+		if err != nil {
+			return true, err
+		}
+		l, _ = and[0].(map[string]interface{})
+		h.Mask = strings.Join(mask, "|")
+	}
+	pld, _ := l["payload"].(map[string]interface{})
+	proto, _ := pld["protocol"].(string)
+	field, _ := pld["field"].(string)
+	f, ok := ruleHeaderFields[proto+" "+field]
+	if !ok {
+		return false, nil
+	}
+	h.Field = proto + " " + field
+	if op == "in" {
+		h.Op = ""
+	}
+	values, err := nftJsonValue(right)
+	if err != nil {
+		return true, err
+	}
+	switch v := right.(type) {
+	case string:
+		h.Value = v
+	case []interface{}:
+		h.Value = strings.Join(values, "|")
+	default:
+		h.Value = strings.Join(values, ",")
+	}
+	if h, err = h.normalize(); err != nil {
+		return true, err
+	}
+	if err = d.useKeyProto(ruleMapKey{l3: f.l3, l4: f.l4}); err != nil {
+		return true, err
+	}
+	d.Headers = append(d.Headers, h)
+	return true, nil
+}
+
+// nftJsonValue 将JSON右值解析为字符串形式, 数组解析为多个值
+func nftJsonValue(v interface{}) ([]string, error) {
+	switch val := v.(type) {
+	case string:
+		return []string{strings.TrimPrefix(val, "@")}, nil
+	case float64:
+		return []string{strconv.FormatFloat(val, 'f', -1, 64)}, nil
+	case []interface{}:
+		var r []string
+		for _, item := range val {
+			s, err := nftJsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			r = append(r, s...)
+		}
+		return r, nil
+	case map[string]interface{}:
+		if set, ok := val["set"].([]interface{}); ok {
+			return nftJsonValue(set)
+		}
+		if concat, ok := val["concat"].([]interface{}); ok {
+			var fields []string
+			for _, item := range concat {
+				f, err := nftJsonValue(item)
+				if err != nil {
+					return nil, err
+				}
+				if len(f) != 1 {
+					return nil, fmt.Errorf("invalid concat %v", val)
+				}
+				fields = append(fields, f[0])
+			}
+			return []string{strings.Join(fields, " . ")}, nil
+		}
+		if pfx, ok := val["prefix"].(map[string]interface{}); ok {
+			addr, _ := pfx["addr"].(string)
+			n, _ := pfx["len"].(float64)
+			return []string{fmt.Sprintf("%s/%d", addr, int(n))}, nil
+		}
+		if rg, ok := val["range"].([]interface{}); ok && len(rg) == 2 {
+			start, err := nftJsonValue(rg[0])
+			if err != nil {
+				return nil, err
+			}
+			end, err := nftJsonValue(rg[1])
+			if err != nil {
+				return nil, err
+			}
+			if len(start) != 1 || len(end) != 1 {
+				return nil, fmt.Errorf("invalid range %v", val)
+			}
+			return []string{start[0] + "-" + end[0]}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: value %v", ErrUnsupportedExpr, v)
+}
+
+// nftJson 标记设置语句的取值编码为libnftables JSON表达式
+func (d *markValue) nftJson() interface{} {
+	if d.src == "" {
+		return d.imm
+	}
+	l := strings.SplitN(d.src, " ", 2)
+	key := map[string]interface{}{l[0]: map[string]interface{}{"key": l[1]}}
+	switch {
+	case d.mask == 0xffffffff && d.xor == 0:
+		return key
+	case d.xor != 0 && d.mask == ^d.xor:
+		return map[string]interface{}{"|": []interface{}{key, d.xor}}
+	case d.mask == 0xffffffff:
+		return map[string]interface{}{"^": []interface{}{key, d.xor}}
+	case d.xor == 0:
+		return map[string]interface{}{"&": []interface{}{key, d.mask}}
+	}
+	return map[string]interface{}{"^": []interface{}{map[string]interface{}{"&": []interface{}{key, d.mask}}, d.xor}}
+}
+
+// nftJsonMarkValue 将libnftables JSON表达式解析为标记设置语句的取值
+func nftJsonMarkValue(v interface{}) (string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		r, err := nftJsonValue(v)
+		if err != nil {
+			return "", err
+		}
+		return r[0], nil
+	}
+	for _, src := range []string{"meta", "ct"} {
+		if key, ok := m[src].(map[string]interface{}); ok && key["key"] == "mark" {
+			return src + " mark", nil
+		}
+	}
+	for op, name := range map[string]string{"&": "and", "|": "or", "^": "xor"} {
+		args, ok := m[op].([]interface{})
+		if !ok || len(args) != 2 {
+			continue
+		}
+		left, err := nftJsonMarkValue(args[0])
+		if err != nil {
+			return "", err
+		}
+		right, err := nftJsonValue(args[1])
+		if err != nil {
+			return "", err
+		}
+		return left + " " + name + " " + right[0], nil
+	}
+	return "", fmt.Errorf("%w: value %v", ErrUnsupportedExpr, v)
+}
+
+// nftJsonCtKey 连接跟踪字段的键, 元组字段带方向与可选的地址族 e.g.: {"key": "saddr", "dir": "original", "family": "ip"}
+func nftJsonCtKey(key string) map[string]interface{} {
+	switch l := strings.Fields(key); len(l) {
+	case 2:
+		return map[string]interface{}{"key": l[1], "dir": l[0]}
+	case 3:
+		return map[string]interface{}{"key": l[2], "dir": l[0], "family": l[1]}
+	}
+	return map[string]interface{}{"key": key}
+}
+
+// nftJsonCtValue 连接跟踪匹配的取值编码: 多个状态为数组, zone与端口为数字, 整秒的超时时间为秒数
+func nftJsonCtValue(c RuleCt) interface{} {
+	f := ruleCtKeys[c.Key]
+	switch f.kind {
+	case ctKindStatus:
+		if l := strings.Split(c.Value, ","); len(l) > 1 {
+			return l
+		}
+	case ctKindNum, ctKindPort:
+		if n, err := strconv.ParseUint(c.Value, 10, 16); err == nil {
+			return n
+		}
+	case ctKindTime:
+		if t, err := parseNftDuration(c.Value); err == nil && t%time.Second == 0 {
+			return uint64(t / time.Second)
+		}
+	}
+	return c.Value
+}
+
+// fromNftJsonCt 解析ct state与ct mark以外的连接跟踪字段匹配, 不是此类匹配时返回false
+func (d *Rule) fromNftJsonCt(left interface{}, op string, right interface{}) (bool, error) {
+	l, _ := left.(map[string]interface{})
+	ct, ok := l["ct"].(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	key, _ := ct["key"].(string)
+	if key == "state" || key == "mark" {
+		return false, nil
+	}
+	if fam, _ := ct["family"].(string); fam != "" {
+		key = fam + " " + key
+	}
+	if dir, _ := ct["dir"].(string); dir != "" {
+		key = dir + " " + key
+	}
+	c := RuleCt{Key: key, Op: op}
+	if op == "in" {
+		c.Op = ""
+	}
+	values, err := nftJsonValue(right)
+	if err != nil {
+		return true, err
+	}
+	if len(values) == 0 {
+		return true, fmt.Errorf("empty match value %v", right)
+	}
+	c.Value = strings.Join(values, ",")
+	if c, err = c.normalize(); err != nil {
+		return true, err
+	}
+	d.CtMatches = append(d.CtMatches, c)
+	return true, nil
+}
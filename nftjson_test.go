@@ -0,0 +1,59 @@
+// +build linux
+
+package nftlib
+
+import (
+	"testing"
+)
+
+func TestDecodeNftJson(t *testing.T) {
+	// nft -j list ruleset 的输出
+	data := `{"nftables": [{"metainfo": {"version": "1.0.2", "release_name": "Lester Gooch", "json_schema_version": 1}},
+{"table": {"family": "inet", "name": "filter", "handle": 1}},
+{"set": {"family": "inet", "name": "allow", "table": "filter", "type": "ipv4_addr", "handle": 2, "flags": ["interval"],
+  "elem": [{"prefix": {"addr": "10.0.0.0", "len": 8}}, {"range": ["1.1.1.1", "1.1.1.5"]}, "2.2.2.2"]}},
+{"chain": {"family": "inet", "table": "filter", "name": "input", "handle": 1, "type": "filter", "hook": "input", "prio": 0, "policy": "drop"}},
+{"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 3, "expr": [
+  {"match": {"op": "in", "left": {"ct": {"key": "state"}}, "right": ["established", "related"]}}, {"accept": null}]}},
+{"rule": {"family": "inet", "table": "filter", "chain": "input", "handle": 4, "expr": [
+  {"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": "@allow"}},
+  {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": {"range": [22, 23]}}},
+  {"jump": {"target": "ssh"}}]}}
+]}`
+	rs, err := DecodeNftJson([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `table inet filter {
+	set allow {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/8, 1.1.1.1-1.1.1.5, 2.2.2.2 }
+	}
+
+	chain input {
+		type filter hook input priority filter; policy drop;
+		ct state established,related accept
+		ip saddr @allow tcp dport 22-23 jump ssh
+	}
+}`
+	if got := rs.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if rs.Tables[0].Chains[0].Rules[1].Handle != 4 {
+		t.Fatalf("rule handle not decoded")
+	}
+
+	// 编码后再解析应得到相同的规则集
+	b, err := rs.EncodeNftJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs2, err := DecodeNftJson(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs2.String() != want {
+		t.Fatalf("round trip mismatch:\n%s\n%s", b, rs2)
+	}
+}
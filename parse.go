@@ -0,0 +1,1459 @@
+// +build linux
+
+package nftlib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nftToken nft脚本中的词法单元, 换行与分号统一视为语句结束符";"
+type nftToken struct {
+	text string
+	line int
+}
+
+// nftParser nft脚本语法解析器
+type nftParser struct {
+	toks []nftToken
+	pos  int
+}
+
+// ParseRuleset 解析nft脚本(nft list ruleset的输出格式)为规则集
+// 解析结果可通过Conn.ApplyRuleset或Conn.ADDTable/Table.AddSet/Table.AddBaseChain/Chain.AddRule下发
+func ParseRuleset(text string) (*Ruleset, error) {
+	toks, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &nftParser{toks: toks}
+	return p.ruleset()
+}
+
+// ParseRule 解析单条nft规则语句, 如 ip saddr 10.0.0.0/8 tcp dport 22 accept
+func ParseRule(text string) (*Rule, error) {
+	toks, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &nftParser{toks: toks}
+	p.skipSep()
+	rule, err := p.rule()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSep()
+	if !p.eof() {
+		return nil, p.errorf("unexpected %q after rule", p.peek())
+	}
+	return rule, nil
+}
+
+func tokenize(text string) ([]nftToken, error) {
+	var (
+		toks []nftToken
+		line = 1
+		rs   = []rune(text)
+	)
+	for i := 0; i < len(rs); i++ {
+		c := rs[i]
+		switch {
+		case c == '\n':
+			toks = append(toks, nftToken{text: ";", line: line})
+			line++
+		case c == '\\' && i+1 < len(rs) && rs[i+1] == '\n':
+			// 续行
+			i++
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#':
+			for i+1 < len(rs) && rs[i+1] != '\n' {
+				i++
+			}
+		case strings.ContainsRune("{},;", c):
+			toks = append(toks, nftToken{text: string(c), line: line})
+		case c == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' && rs[j] != '\n' {
+				j++
+			}
+			if j >= len(rs) || rs[j] != '"' {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			toks = append(toks, nftToken{text: string(rs[i : j+1]), line: line})
+			i = j
+		default:
+			j := i
+			for j < len(rs) && !strings.ContainsRune(" \t\r\n{},;#\"", rs[j]) {
+				j++
+			}
+			toks = append(toks, nftToken{text: string(rs[i:j]), line: line})
+			i = j - 1
+		}
+	}
+	return toks, nil
+}
+
+func (p *nftParser) eof() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *nftParser) peek() string {
+	if p.eof() {
+		return ""
+	}
+	return p.toks[p.pos].text
+}
+
+func (p *nftParser) next() string {
+	if p.eof() {
+		return ""
+	}
+	p.pos++
+	return p.toks[p.pos-1].text
+}
+
+func (p *nftParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return p.errorf("expect %q, got %q", tok, got)
+	}
+	return nil
+}
+
+// word 读取一个非符号的词
+func (p *nftParser) word() (string, error) {
+	tok := p.next()
+	if tok == "" || strings.Contains("{},;", tok) {
+		return "", p.errorf("unexpected %q", tok)
+	}
+	return tok, nil
+}
+
+// listValue 读取单个取值或花括号中的列表, 列表元素以逗号连接, 并去除两侧的引号
+func (p *nftParser) listValue() (string, error) {
+	if p.peek() != "{" {
+		v, err := p.word()
+		return strings.Trim(v, `"`), err
+	}
+	elems, err := p.values()
+	if err != nil {
+		return "", err
+	}
+	for i, v := range elems {
+		elems[i] = strings.Trim(v, `"`)
+	}
+	return strings.Join(elems, ","), nil
+}
+
+// negOp 读取可选的比较符, != 返回表示不匹配的!前缀
+func (p *nftParser) negOp() string {
+	switch p.peek() {
+	case "!=":
+		p.next()
+		return "!"
+	case "==":
+		p.next()
+	}
+	return ""
+}
+
+// peekN 查看当前位置之后第n个词法单元
+func (p *nftParser) peekN(n int) string {
+	if p.pos+n >= len(p.toks) {
+		return ""
+	}
+	return p.toks[p.pos+n].text
+}
+
+// isMapKeyWord 是否为映射查找键的起始词
+func isMapKeyWord(tok string) bool {
+	switch tok {
+	case "ip", "ip6", "tcp", "udp", "sctp", "dccp", "udplite", "iifname", "oifname":
+		return true
+	}
+	return false
+}
+
+// skipSep 跳过连续的语句结束符
+func (p *nftParser) skipSep() {
+	for p.peek() == ";" {
+		p.pos++
+	}
+}
+
+// errorf 生成带行号的解析错误
+func (p *nftParser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if n := len(p.toks); n > 0 {
+		idx := p.pos
+		if idx > 0 {
+			idx--
+		}
+		if idx >= n {
+			idx = n - 1
+		}
+		line = p.toks[idx].line
+	}
+	return fmt.Errorf("line %d: "+format, append([]interface{}{line}, args...)...)
+}
+
+func (p *nftParser) ruleset() (*Ruleset, error) {
+	var rs = new(Ruleset)
+	for {
+		p.skipSep()
+		if p.eof() {
+			return rs, nil
+		}
+		switch tok := p.next(); tok {
+		case "flush":
+			if err := p.expect("ruleset"); err != nil {
+				return nil, err
+			}
+		case "table":
+			ts, err := p.table()
+			if err != nil {
+				return nil, err
+			}
+			rs.Tables = append(rs.Tables, ts)
+		default:
+			return nil, p.errorf("unexpected %q", tok)
+		}
+	}
+}
+
+// table 解析 table <family> <name> { ... }
+func (p *nftParser) table() (*TableSpec, error) {
+	fam, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	name, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	tbl := &Table{Name: name}
+	for k, v := range familyKeyword {
+		if v == fam {
+			tbl.Family = k
+		}
+	}
+	if tbl.Family == "" {
+		return nil, p.errorf("unknown table family %q", fam)
+	}
+	ts := &TableSpec{Table: tbl}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSep()
+		switch tok := p.next(); tok {
+		case "}":
+			return ts, nil
+		case "set":
+			set, err := p.set(tbl)
+			if err != nil {
+				return nil, err
+			}
+			ts.Sets = append(ts.Sets, set)
+		case "map":
+			m, err := p.mapping(tbl)
+			if err != nil {
+				return nil, err
+			}
+			ts.Maps = append(ts.Maps, m)
+		case "chain":
+			cs, err := p.chain(tbl)
+			if err != nil {
+				return nil, err
+			}
+			ts.Chains = append(ts.Chains, cs)
+		default:
+			return nil, p.errorf("unexpected %q in table %s", tok, name)
+		}
+	}
+}
+
+// chain 解析 chain <name> { type <type> hook <hook> priority <prio>; policy <policy>; rules... }
+func (p *nftParser) chain(tbl *Table) (*ChainSpec, error) {
+	name, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	ch := &Chain{Table: tbl, Name: name}
+	cs := &ChainSpec{Chain: ch}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSep()
+		switch p.peek() {
+		case "":
+			return nil, p.errorf("unexpected end of chain %s", name)
+		case "}":
+			p.next()
+			if err = ch.Validate(); err != nil {
+				return nil, p.errorf("chain %s: %w", name, err)
+			}
+			return cs, nil
+		case "type":
+			p.next()
+			if err = p.chainHook(ch); err != nil {
+				return nil, err
+			}
+		case "policy":
+			p.next()
+			plc, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			switch chainPolicy(plc) {
+			case ChainPolicyAccept, ChainPolicyDrop:
+				ch.Policy = chainPolicy(plc)
+			default:
+				return nil, p.errorf("unknown chain policy %q", plc)
+			}
+		default:
+			rule, err := p.rule()
+			if err != nil {
+				return nil, err
+			}
+			rule.Chain = ch
+			cs.Rules = append(cs.Rules, rule)
+		}
+	}
+}
+
+// chainHook 解析基础链的 type <type> hook <hook> [device <dev>] priority <prio>
+func (p *nftParser) chainHook(ch *Chain) error {
+	typ, err := p.word()
+	if err != nil {
+		return err
+	}
+	switch chainType(typ) {
+	case ChainTypeFilter, ChainTypeNat, ChainTypeRoute:
+		ch.Type = chainType(typ)
+	default:
+		return p.errorf("unknown chain type %q", typ)
+	}
+	if err = p.expect("hook"); err != nil {
+		return err
+	}
+	hook, err := p.word()
+	if err != nil {
+		return err
+	}
+	switch chainHook(hook) {
+	case ChainHookPrerouting, ChainHookInput, ChainHookOutput, ChainHookForward, ChainHookPostrouting,
+		ChainHookIngress, ChainHookEgress:
+		ch.Hook = chainHook(hook)
+	default:
+		return p.errorf("unknown chain hook %q", hook)
+	}
+	if p.peek() == "device" {
+		p.next()
+		dev, err := p.word()
+		if err != nil {
+			return err
+		}
+		ch.Device = strings.Trim(dev, `"`)
+	}
+	if err = p.expect("priority"); err != nil {
+		return err
+	}
+	// 优先级可能由多个词组成, 如 filter + 10
+	var prio []string
+	for tok := p.peek(); tok != "" && !strings.Contains("{},;", tok); tok = p.peek() {
+		prio = append(prio, p.next())
+	}
+	if len(prio) == 0 {
+		return p.errorf("missing chain priority")
+	}
+	n, err := ParsePriority(ch.Table.Family, strings.Join(prio, " "))
+	if err != nil {
+		return p.errorf("%w", err)
+	}
+	ch.Priority = n
+	return nil
+}
+
+// set 解析 set <name> { type <type>; size <n>; flags interval,dynamic,timeout; timeout <t>; gc-interval <t>; elements = { ... } }
+func (p *nftParser) set(tbl *Table) (*Set, error) {
+	name, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{Table: tbl, Name: name}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSep()
+		switch tok := p.next(); tok {
+		case "}":
+			if set.DType == "" {
+				return nil, p.errorf("missing type of set %s", name)
+			}
+			for i, v := range set.Elements {
+				set.Elements[i] = unquoteElem(v)
+				if _, err := ParseSetElem(set.Elements[i]); err != nil {
+					return nil, p.errorf("%v", err)
+				}
+			}
+			return set, nil
+		case "type":
+			typ, err := p.dtypeWords()
+			if err != nil {
+				return nil, err
+			}
+			if set.DType = dtypeOfKeyword(typ); set.DType == "" {
+				return nil, p.errorf("unsupported set type %q", typ)
+			}
+		case "flags":
+			flags, err := p.values()
+			if err != nil {
+				return nil, err
+			}
+			for _, flag := range flags {
+				switch flag {
+				case "interval":
+					set.ElemRange = true
+				case "dynamic":
+					set.Dynamic = true
+				case "timeout":
+					set.HasTimeout = true
+				case "constant":
+				default:
+					return nil, p.errorf("unsupported set flag %q", flag)
+				}
+			}
+		case "timeout", "gc-interval":
+			v, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			t, err := parseNftDuration(v)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			if tok == "timeout" {
+				set.Timeout = t
+			} else {
+				set.GCInterval = t
+			}
+		case "size":
+			v, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, p.errorf("invalid set size %q", v)
+			}
+			set.Size = uint32(n)
+		case "elements":
+			if err = p.expect("="); err != nil {
+				return nil, err
+			}
+			if set.Elements, err = p.values(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf("unexpected %q in set %s", tok, name)
+		}
+	}
+}
+
+// mapping 解析 map <name> { type <key> : <data>; flags interval; elements = { <key> : <value>, ... } }
+func (p *nftParser) mapping(tbl *Table) (*Map, error) {
+	name, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	m := &Map{Table: tbl, Name: name}
+	if err = p.expect("{"); err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSep()
+		switch tok := p.next(); tok {
+		case "}":
+			if m.KeyType == "" || m.DataType == "" {
+				return nil, p.errorf("missing type of map %s", name)
+			}
+			return m, nil
+		case "type":
+			ktype, err := p.dtypeWords()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			dtype, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			if m.KeyType = dtypeOfKeyword(ktype); m.KeyType == "" {
+				return nil, p.errorf("unsupported map key type %q", ktype)
+			}
+			if m.DataType = dtypeOfKeyword(dtype); dtype == MapDtypeVerdict {
+				m.DataType = MapDtypeVerdict
+			}
+			if m.DataType == "" {
+				return nil, p.errorf("unsupported map data type %q", dtype)
+			}
+		case "flags":
+			flags, err := p.values()
+			if err != nil {
+				return nil, err
+			}
+			for _, flag := range flags {
+				switch flag {
+				case "interval":
+					m.ElemRange = true
+				case "constant":
+				default:
+					return nil, p.errorf("unsupported map flag %q", flag)
+				}
+			}
+		case "elements":
+			if err = p.expect("="); err != nil {
+				return nil, err
+			}
+			if m.Elements, err = p.mapElements(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorf("unexpected %q in map %s", tok, name)
+		}
+	}
+}
+
+// dtypeWords 读取数据类型, 拼接类型的各个关键字以 . 连接
+func (p *nftParser) dtypeWords() (string, error) {
+	typ, err := p.word()
+	if err != nil {
+		return "", err
+	}
+	for p.peek() == "." {
+		p.next()
+		v, err := p.word()
+		if err != nil {
+			return "", err
+		}
+		typ += " . " + v
+	}
+	return typ, nil
+}
+
+// dtypeOfKeyword nft数据类型关键字对应的集合数据类型, 支持拼接类型, 不支持时返回空
+func dtypeOfKeyword(typ string) string {
+	var r []string
+	for _, v := range strings.Split(typ, " . ") {
+		dtype := ""
+		for k, kw := range dtypeKeyword {
+			if kw == v || k == v {
+				dtype = k
+			}
+		}
+		if dtype == "" {
+			return ""
+		}
+		r = append(r, dtype)
+	}
+	return strings.Join(r, " . ")
+}
+
+// mapElements 解析 { <key> : <value>, ... } 格式的映射元素列表
+func (p *nftParser) mapElements() ([]MapElement, error) {
+	var r []MapElement
+	if p.peek() != "{" {
+		return nil, p.errorf("expect map elements, got %q", p.peek())
+	}
+	vals, err := p.values()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		e, err := parseMapElement(v)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		r = append(r, e)
+	}
+	return r, nil
+}
+
+// concatKeys 读取以tok开头、以 . 连接的键
+func (p *nftParser) concatKeys(tok string) ([]string, error) {
+	var keys []string
+	for {
+		key := tok
+		if tok != "iifname" && tok != "oifname" {
+			field, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			key += " " + field
+		}
+		keys = append(keys, key)
+		if p.peek() != "." {
+			return keys, nil
+		}
+		p.next()
+		var err error
+		if tok, err = p.word(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// setUpdateStmt 解析集合更新 add|update @name { <key> [. <key> ...] [timeout <t>] }
+func (p *nftParser) setUpdateStmt(rule *Rule, op string) error {
+	name, err := p.word()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(name, "@") {
+		return p.errorf("expect set name, got %q", name)
+	}
+	if err = p.expect("{"); err != nil {
+		return err
+	}
+	tok, err := p.word()
+	if err != nil {
+		return err
+	}
+	keys, err := p.concatKeys(tok)
+	if err != nil {
+		return err
+	}
+	if err = rule.useConcat(keys); err != nil {
+		return p.errorf("%v", err)
+	}
+	su := &RuleSetUpdate{Op: op, Set: name[1:], Keys: keys}
+	if p.peek() == "timeout" {
+		p.next()
+		v, err := p.word()
+		if err != nil {
+			return err
+		}
+		if su.Timeout, err = parseNftDuration(v); err != nil {
+			return p.errorf("%v", err)
+		}
+	}
+	if err = p.expect("}"); err != nil {
+		return err
+	}
+	rule.SetUpdate = su
+	return nil
+}
+
+// isConcat 以tok开头的语句是否为拼接匹配
+func (p *nftParser) isConcat(tok string) bool {
+	if tok == "iifname" || tok == "oifname" {
+		return p.peek() == "."
+	}
+	_, ok := concatKey(tok + " " + p.peek())
+	return ok && p.peekN(1) == "."
+}
+
+// concatStmt 解析拼接匹配 <key> . <key> ... [!=] @name 或 { <elem>, ... }
+func (p *nftParser) concatStmt(rule *Rule, tok string) error {
+	keys, err := p.concatKeys(tok)
+	if err != nil {
+		return err
+	}
+	if err := rule.useConcat(keys); err != nil {
+		return p.errorf("%v", err)
+	}
+	neg := p.negOp()
+	if p.peek() == "{" {
+		elems, err := p.values()
+		if err != nil {
+			return err
+		}
+		for i, v := range elems {
+			elems[i] = unquoteElem(v)
+		}
+		rule.Concat = &RuleConcat{Keys: keys, Value: neg + strings.Join(elems, ",")}
+		return nil
+	}
+	v, err := p.word()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(v, "@") {
+		return p.errorf("expect set name or elements, got %q", v)
+	}
+	rule.Concat = &RuleConcat{Keys: keys, Value: neg + v}
+	return nil
+}
+
+// ruleMap 解析映射查找的 @name 或 { <key> : <value>, ... }, 并设置查找键隐含的协议
+func (p *nftParser) ruleMap(rule *Rule, key string) (*RuleMap, error) {
+	if err := rule.useMapKey(key); err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	rm := &RuleMap{Key: key}
+	if p.peek() == "{" {
+		elems, err := p.mapElements()
+		if err != nil {
+			return nil, err
+		}
+		rm.Elements = elems
+		return rm, nil
+	}
+	v, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(v, "@") {
+		return nil, p.errorf("expect map name or elements, got %q", v)
+	}
+	rm.Name = v[1:]
+	return rm, nil
+}
+
+// values 解析以逗号分隔的值列表, 如 established,related 或 { 1.1.1.1, 2.2.2.2 }
+// 花括号中的单个元素可以由多个词组成, 以空格连接
+func (p *nftParser) values() ([]string, error) {
+	var r []string
+	if p.peek() == "{" {
+		p.next()
+		var elem []string
+		for {
+			tok := p.next()
+			switch tok {
+			case "":
+				return nil, p.errorf("unexpected end of list")
+			case ";":
+				continue
+			case ",", "}":
+				if len(elem) > 0 {
+					r = append(r, strings.Join(elem, " "))
+					elem = nil
+				}
+				if tok == "}" {
+					return r, nil
+				}
+			default:
+				elem = append(elem, tok)
+			}
+		}
+	}
+	for {
+		v, err := p.word()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, v)
+		if p.peek() != "," {
+			return r, nil
+		}
+		p.next()
+	}
+}
+
+// rule 解析一条规则语句, 直到语句结束符或链结束
+func (p *nftParser) rule() (*Rule, error) {
+	var rule = new(Rule)
+	for {
+		tok := p.peek()
+		if tok == "" || tok == ";" || tok == "}" {
+			break
+		}
+		p.next()
+		if err := p.ruleStmt(rule, tok); err != nil {
+			return nil, err
+		}
+	}
+	if rule.String() == "" {
+		return nil, p.errorf("empty rule")
+	}
+	if rule.VMap != nil && rule.Action != "" {
+		return nil, p.errorf("vmap cannot be combined with %s", rule.Action)
+	}
+	return rule, nil
+}
+
+// ruleStmt 解析以tok开头的单个匹配或动作语句
+func (p *nftParser) ruleStmt(rule *Rule, tok string) error {
+	if p.isConcat(tok) {
+		return p.concatStmt(rule, tok)
+	}
+	switch tok {
+	case "add", "update":
+		return p.setUpdateStmt(rule, tok)
+	case "iifname", "oifname", "iif", "oif":
+		return p.ifaceStmt(rule, tok)
+	case "ip", "ip6":
+		l3 := RuleL3Ip
+		if tok == "ip6" {
+			l3 = RuleL3Ip6
+		}
+		field, err := p.word()
+		if err != nil {
+			return err
+		}
+		if err = p.ruleL3Proto(rule, l3); err != nil {
+			return err
+		}
+		if field == "protocol" || field == "nexthdr" {
+			return p.l4Proto(rule)
+		}
+		if _, ok := ruleHeaderFields[tok+" "+field]; ok {
+			return p.headerStmt(rule, tok+" "+field)
+		}
+		if p.peek() == "vmap" && (field == "saddr" || field == "daddr") {
+			p.next()
+			rule.VMap, err = p.ruleMap(rule, tok+" "+field)
+			return err
+		}
+		neg := p.negOp()
+		v, err := p.listValue()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case "saddr":
+			rule.L3SrcIP = neg + strings.TrimPrefix(v, "@")
+		case "daddr":
+			rule.L3DstIP = neg + strings.TrimPrefix(v, "@")
+		default:
+			return p.errorf("%w: %s %s", ErrUnsupportedExpr, tok, field)
+		}
+	case RuleL4Tcp, RuleL4Udp, RuleL4Sctp, RuleL4Dccp, RuleL4UdpLite:
+		field, err := p.word()
+		if err != nil {
+			return err
+		}
+		if _, ok := ruleHeaderFields[tok+" "+field]; ok {
+			return p.headerStmt(rule, tok+" "+field)
+		}
+		if p.peek() == "vmap" {
+			p.next()
+			rule.VMap, err = p.ruleMap(rule, tok+" "+field)
+			return err
+		}
+		neg := p.negOp()
+		v, err := p.listValue()
+		if err != nil {
+			return err
+		}
+		if rule.L4Proto != "" && rule.L4Proto != tok {
+			return p.errorf("conflicting l4 protocol %s and %s", rule.L4Proto, tok)
+		}
+		rule.L4Proto = tok
+		switch field {
+		case "sport":
+			rule.L4SrcPort = neg + strings.TrimPrefix(v, "@")
+		case "dport":
+			rule.L4DstPort = neg + strings.TrimPrefix(v, "@")
+		default:
+			return p.errorf("%w: %s %s", ErrUnsupportedExpr, tok, field)
+		}
+	case "icmp", "icmpv6":
+		field, err := p.word()
+		if err != nil {
+			return err
+		}
+		if _, ok := ruleHeaderFields[tok+" "+field]; !ok {
+			return p.errorf("%w: %s %s", ErrUnsupportedExpr, tok, field)
+		}
+		return p.headerStmt(rule, tok+" "+field)
+	case "meta":
+		key, err := p.word()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "nfproto":
+			v, err := p.word()
+			if err != nil {
+				return err
+			}
+			return p.ruleL3Proto(rule, v)
+		case "l4proto":
+			return p.l4Proto(rule)
+		case "mark":
+			return p.markStmt(&rule.MetaMark, &rule.MetaMarkSet)
+		case "priority":
+			return p.priorityStmt(rule)
+		case "iifname", "oifname", "iif", "oif":
+			return p.ifaceStmt(rule, key)
+		default:
+			return p.errorf("%w: meta %s", ErrUnsupportedExpr, key)
+		}
+	case "ct":
+		key, err := p.word()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "mark":
+			return p.markStmt(&rule.CtMark, &rule.CtMarkSet)
+		case "count":
+			return p.ctCountStmt(rule)
+		case "state":
+		default:
+			return p.ctStmt(rule, key)
+		}
+		neg := p.negOp()
+		states, err := p.values()
+		if err != nil {
+			return err
+		}
+		for _, st := range states {
+			if !inCtStateMap(st) {
+				return p.errorf("unknown ct state %q", st)
+			}
+		}
+		rule.CtStates = states
+		rule.CtStatesNeg = neg != ""
+	case RuleActAccept, RuleActDrop:
+		rule.Action = tok
+	case RuleActJump, RuleActGoto:
+		ch, err := p.word()
+		if err != nil {
+			return err
+		}
+		rule.Action = tok
+		rule.DstChain = ch
+	case RuleActSnat, RuleActDnat, RuleActMasq, RuleActRedir:
+		return p.natStmt(rule, tok)
+	case RuleActReject:
+		return p.rejectStmt(rule)
+	case "counter":
+		rule.Counter = new(RuleCounter)
+		for p.peek() == "packets" || p.peek() == "bytes" {
+			key := p.next()
+			v, err := p.uint(64)
+			if err != nil {
+				return err
+			}
+			if key == "packets" {
+				rule.Counter.Packets = v
+			} else {
+				rule.Counter.Bytes = v
+			}
+		}
+	case "notrack":
+		rule.Notrack = true
+	case "limit":
+		return p.limitStmt(rule)
+	case "log":
+		return p.logStmt(rule)
+	default:
+		return p.errorf("%w: %s", ErrUnsupportedExpr, tok)
+	}
+	return nil
+}
+
+// headerStmt 解析协议头匹配 <field> [& <mask>] [op] <value>, 并设置字段隐含的协议
+func (p *nftParser) headerStmt(rule *Rule, field string) error {
+	h := RuleHeader{Field: field}
+	if p.peek() == "&" {
+		p.next()
+		// 掩码可由多个词组成, 如 (syn | ack)
+		var mask []string
+		for !isHeaderOp(p.peek()) {
+			w, err := p.word()
+			if err != nil {
+				return err
+			}
+			mask = append(mask, w)
+		}
+		h.Mask = strings.Trim(strings.Join(mask, ""), "()")
+	}
+	if isHeaderOp(p.peek()) {
+		h.Op = p.next()
+	}
+	v, err := p.listValue()
+	if err != nil {
+		return err
+	}
+	h.Value = v
+	if h, err = h.normalize(); err != nil {
+		return p.errorf("%v", err)
+	}
+	f := ruleHeaderFields[field]
+	if err = rule.useKeyProto(ruleMapKey{l3: f.l3, l4: f.l4}); err != nil {
+		return p.errorf("%v", err)
+	}
+	rule.Headers = append(rule.Headers, h)
+	return nil
+}
+
+// isHeaderOp 是否为协议头匹配的比较符
+func isHeaderOp(tok string) bool {
+	_, ok := headerCmpOps[tok]
+	return ok && tok != ""
+}
+
+// ctStmt 解析连接跟踪字段匹配 ct <key> [op] <value> 与 ct zone set <zone>
+// 元组字段为 ct original|reply [ip|ip6] saddr|daddr 与 ct original|reply proto-src|proto-dst
+func (p *nftParser) ctStmt(rule *Rule, key string) error {
+	if key == "original" || key == "reply" {
+		field, err := p.word()
+		if err != nil {
+			return err
+		}
+		if field == "ip" || field == "ip6" {
+			addr, err := p.word()
+			if err != nil {
+				return err
+			}
+			field += " " + addr
+		}
+		key += " " + field
+	}
+	if _, ok := ruleCtKeys[key]; !ok {
+		return p.errorf("%w: ct %s", ErrUnsupportedExpr, key)
+	}
+	if key == "zone" && p.peek() == "set" {
+		p.next()
+		v, err := p.uint(16)
+		if err != nil {
+			return err
+		}
+		rule.CtZoneSet = strconv.FormatUint(v, 10)
+		return nil
+	}
+	c := RuleCt{Key: key}
+	if isHeaderOp(p.peek()) {
+		c.Op = p.next()
+	}
+	values, err := p.values()
+	if err != nil {
+		return err
+	}
+	for i, v := range values {
+		values[i] = strings.Trim(v, `"`)
+	}
+	if len(values) > 1 && key != "status" {
+		return p.errorf("%w: ct %s list", ErrUnsupportedExpr, key)
+	}
+	c.Value = strings.Join(values, ",")
+	if c, err = c.normalize(); err != nil {
+		return p.errorf("%v", err)
+	}
+	rule.CtMatches = append(rule.CtMatches, c)
+	return nil
+}
+
+// ctCountStmt 解析 ct count [over] <count>
+func (p *nftParser) ctCountStmt(rule *Rule) error {
+	cnt := new(RuleCtCount)
+	if p.peek() == "over" {
+		p.next()
+		cnt.Over = true
+	}
+	v, err := p.uint(32)
+	if err != nil {
+		return err
+	}
+	cnt.Count = uint32(v)
+	rule.CtCount = cnt
+	return nil
+}
+
+// ifaceStmt 解析 iifname/oifname "eth0" 或 iif/oif 2, 接口名可为前缀匹配 eth* 或集合 @setname
+func (p *nftParser) ifaceStmt(rule *Rule, key string) error {
+	if p.peek() == "vmap" && strings.HasSuffix(key, "name") {
+		p.next()
+		var err error
+		rule.VMap, err = p.ruleMap(rule, key)
+		return err
+	}
+	neg := p.negOp()
+	v, err := p.listValue()
+	if err != nil {
+		return err
+	}
+	iface := &rule.InIface
+	if key[0] == 'o' {
+		iface = &rule.OutIface
+	}
+	if strings.HasSuffix(key, "name") {
+		if isIfindex(v) {
+			return p.errorf("numeric interface name %q is ambiguous with an interface index", v)
+		}
+	} else if !isIfindex(v) {
+		return p.errorf("%s expects an interface index, got %q", key, v)
+	}
+	*iface = neg + v
+	return nil
+}
+
+// natStmt 解析 snat/dnat [ip|ip6] to addr[:port] 或 masquerade/redirect [to :port], 以及其后的nat标志
+func (p *nftParser) natStmt(rule *Rule, action string) error {
+	var l3 string
+	rule.Action = action
+	if action == RuleActSnat || action == RuleActDnat {
+		switch p.peek() {
+		case "ip":
+			l3 = RuleL3Ip
+			p.next()
+		case "ip6":
+			l3 = RuleL3Ip6
+			p.next()
+		}
+	}
+	if p.peek() == "to" && (action == RuleActSnat || action == RuleActDnat) && isMapKeyWord(p.peekN(1)) {
+		// 以映射查找转换地址, 如 dnat to tcp dport map { 80 : 10.0.0.2 }
+		p.next()
+		key := p.next()
+		if key != "iifname" && key != "oifname" {
+			field, err := p.word()
+			if err != nil {
+				return err
+			}
+			key += " " + field
+		}
+		if err := p.expect("map"); err != nil {
+			return err
+		}
+		rm, err := p.ruleMap(rule, key)
+		if err != nil {
+			return err
+		}
+		rule.NatMap = rm
+	} else if p.peek() == "to" {
+		p.next()
+		v, err := p.word()
+		if err != nil {
+			return err
+		}
+		if rule.NatAddr, rule.NatPort, err = splitNatAddr(v); err != nil {
+			return p.errorf("%v", err)
+		}
+	}
+	if rule.NatAddr != "" && action != RuleActSnat && action != RuleActDnat {
+		return p.errorf("%s does not take an address", action)
+	}
+	// 未指定地址时由地址族限定规则的L3协议, 匿名映射由其中的地址确定地址族
+	if l3 != "" && rule.NatAddr == "" && (rule.NatMap == nil || rule.NatMap.Name != "") {
+		if err := p.ruleL3Proto(rule, l3); err != nil {
+			return err
+		}
+	}
+	for isNatFlag(p.peek()) {
+		rule.NatFlags = append(rule.NatFlags, p.next())
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	return nil
+}
+
+// markStmt 解析 mark [and <mask> ==] <value> 匹配或 mark set <value> 设置语句
+func (p *nftParser) markStmt(match, set *string) error {
+	if p.peek() == "set" {
+		p.next()
+		v, err := p.markValue()
+		if err != nil {
+			return err
+		}
+		*set = v
+		return nil
+	}
+	var mask string
+	if tok := p.peek(); tok == "and" || tok == "&" {
+		p.next()
+		m, err := p.word()
+		if err != nil {
+			return err
+		}
+		mask = "/" + m
+	}
+	if p.peek() == "==" {
+		p.next()
+	}
+	v, err := p.word()
+	if err != nil {
+		return err
+	}
+	if _, _, err = parseMarkMatch(v + mask); err != nil {
+		return p.errorf("%v", err)
+	}
+	*match = v + mask
+	return nil
+}
+
+// markValue 解析标记设置语句的取值 <n> | meta mark | ct mark, 及其后的 and/or/xor 运算
+func (p *nftParser) markValue() (string, error) {
+	v, err := p.word()
+	if err != nil {
+		return "", err
+	}
+	if v == "meta" || v == "ct" {
+		if err = p.expect("mark"); err != nil {
+			return "", err
+		}
+		v += " mark"
+		for {
+			op := p.peek()
+			if op != "and" && op != "or" && op != "xor" && op != "&" && op != "|" && op != "^" {
+				break
+			}
+			p.next()
+			n, err := p.word()
+			if err != nil {
+				return "", err
+			}
+			v += " " + op + " " + n
+		}
+	}
+	if _, err = parseMarkValue(v); err != nil {
+		return "", p.errorf("%v", err)
+	}
+	return v, nil
+}
+
+// priorityStmt 解析 meta priority [set] <major:minor>
+func (p *nftParser) priorityStmt(rule *Rule) error {
+	set := p.peek() == "set"
+	if set {
+		p.next()
+	}
+	v, err := p.word()
+	if err != nil {
+		return err
+	}
+	if _, err = parseMetaPriority(v); err != nil {
+		return p.errorf("%v", err)
+	}
+	if set {
+		rule.MetaPrioritySet = v
+	} else {
+		rule.MetaPriority = v
+	}
+	return nil
+}
+
+// uint 读取一个无符号整数
+func (p *nftParser) uint(bitSize int) (uint64, error) {
+	tok, err := p.word()
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(tok, 10, bitSize)
+	if err != nil {
+		return 0, p.errorf("invalid number %q", tok)
+	}
+	return n, nil
+}
+
+// limitStmt 解析 limit rate [over] <rate>/<unit> [burst <n> packets]
+func (p *nftParser) limitStmt(rule *Rule) error {
+	var lmt = new(RuleLimit)
+	if err := p.expect("rate"); err != nil {
+		return err
+	}
+	if p.peek() == "over" {
+		p.next()
+		lmt.Over = true
+	}
+	v, err := p.word()
+	if err != nil {
+		return err
+	}
+	l := strings.SplitN(v, "/", 2)
+	if len(l) != 2 {
+		return p.errorf("invalid limit rate %q", v)
+	}
+	if lmt.Rate, err = strconv.ParseUint(l[0], 10, 64); err != nil {
+		return p.errorf("invalid limit rate %q", v)
+	}
+	if _, ok := limitUnitMap[l[1]]; !ok {
+		return p.errorf("%w: limit unit %s", ErrUnsupportedExpr, l[1])
+	}
+	lmt.Unit = l[1]
+	if p.peek() == "burst" {
+		p.next()
+		n, err := p.uint(32)
+		if err != nil {
+			return err
+		}
+		lmt.Burst = uint32(n)
+		if p.peek() == "packets" {
+			p.next()
+		}
+	}
+	rule.Limit = lmt
+	return nil
+}
+
+// logStmt 解析 log [prefix <str>] [level <lvl>] [group <n>] [snaplen <n>] [flags <flags>]...
+func (p *nftParser) logStmt(rule *Rule) error {
+	var log = new(RuleLog)
+	for {
+		switch p.peek() {
+		case "prefix":
+			p.next()
+			v, err := p.word()
+			if err != nil {
+				return err
+			}
+			log.Prefix = strings.Trim(v, `"`)
+		case "level":
+			p.next()
+			v, err := p.word()
+			if err != nil {
+				return err
+			}
+			log.Level = v
+		case "group":
+			p.next()
+			n, err := p.uint(16)
+			if err != nil {
+				return err
+			}
+			group := uint16(n)
+			log.Group = &group
+		case "snaplen":
+			p.next()
+			n, err := p.uint(32)
+			if err != nil {
+				return err
+			}
+			log.Snaplen = uint32(n)
+		case "flags":
+			p.next()
+			flags, err := p.logFlags()
+			if err != nil {
+				return err
+			}
+			log.Flags = append(log.Flags, flags...)
+		default:
+			rule.Log = log
+			return nil
+		}
+	}
+}
+
+// logFlags 解析 tcp sequence,options | ip options | skuid | ether | all
+func (p *nftParser) logFlags() ([]string, error) {
+	tok, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case RuleLogSkUid, RuleLogEther, RuleLogAll:
+		return []string{tok}, nil
+	case "ip":
+		if err = p.expect("options"); err != nil {
+			return nil, err
+		}
+		return []string{RuleLogIpOpt}, nil
+	case "tcp":
+		var r []string
+		for {
+			v, err := p.word()
+			if err != nil {
+				return nil, err
+			}
+			if v != "sequence" && v != "options" {
+				return nil, p.errorf("%w: log flags tcp %s", ErrUnsupportedExpr, v)
+			}
+			r = append(r, "tcp "+v)
+			if p.peek() != "," {
+				return r, nil
+			}
+			p.next()
+		}
+	}
+	return nil, p.errorf("%w: log flags %s", ErrUnsupportedExpr, tok)
+}
+
+// rejectStmt 解析 reject [with tcp reset | with icmp|icmpv6|icmpx [type] <code>]
+func (p *nftParser) rejectStmt(rule *Rule) error {
+	rule.Action = RuleActReject
+	if p.peek() != "with" {
+		return nil
+	}
+	p.next()
+	kind, err := p.word()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "tcp":
+		if err = p.expect("reset"); err != nil {
+			return err
+		}
+		rule.RejectKind = RuleRejectTcpReset
+		return nil
+	case RuleRejectIcmp, RuleRejectIcmp6, RuleRejectIcmpx:
+		rule.RejectKind = kind
+	default:
+		return p.errorf("%w: reject with %s", ErrUnsupportedExpr, kind)
+	}
+	if p.peek() == "type" {
+		p.next()
+	}
+	if rule.RejectCode, err = p.word(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// splitNatAddr 拆分 addr:port, IPv6地址带端口时以[]包围
+func splitNatAddr(s string) (addr, port string, err error) {
+	if strings.HasPrefix(s, "[") {
+		i := strings.Index(s, "]")
+		if i < 0 {
+			return "", "", fmt.Errorf("invalid nat address %q", s)
+		}
+		addr, port = s[1:i], s[i+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return "", "", fmt.Errorf("invalid nat address %q", s)
+		}
+		return addr, strings.TrimPrefix(port, ":"), nil
+	}
+	if strings.Count(s, ":") > 1 {
+		return s, "", nil
+	}
+	if i := strings.Index(s, ":"); i >= 0 {
+		return s[:i], s[i+1:], nil
+	}
+	return s, "", nil
+}
+
+func (p *nftParser) ruleL3Proto(rule *Rule, l3 string) error {
+	if l3 != RuleL3Ip && l3 != RuleL3Ip6 {
+		return p.errorf("%w: nfproto %s", ErrUnsupportedExpr, l3)
+	}
+	if rule.L3Proto != "" && rule.L3Proto != l3 {
+		return p.errorf("conflicting l3 protocol %s and %s", rule.L3Proto, l3)
+	}
+	rule.L3Proto = l3
+	return nil
+}
+
+// l4Proto 解析 meta l4proto/ip protocol 后的协议名或协议号
+func (p *nftParser) l4Proto(rule *Rule) error {
+	neg := p.negOp()
+	v, err := p.word()
+	if err != nil {
+		return err
+	}
+	n, ok := l4ProtoNum(v)
+	if !ok {
+		return p.errorf("%w: l4proto %s", ErrUnsupportedExpr, v)
+	}
+	rule.L4Proto = neg + l4ProtoName(n)
+	return nil
+}
+
+func inCtStateMap(st string) bool {
+	for _, v := range ctStateMap {
+		if v == st {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+// +build linux
+
+package nftlib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRuleset(t *testing.T) {
+	text := `flush ruleset
+table inet filter {
+	set allow {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/8, 192.168.1.1,
+			     172.16.0.1-172.16.0.9 }
+	}
+
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ct state established,related accept # handle 3
+		ip saddr @allow tcp dport 22-23 accept
+		ip6 daddr ffee::1 drop
+		meta l4proto icmp jump icmp_in
+	}
+
+	chain icmp_in {
+		accept
+	}
+}
+`
+	rs, err := ParseRuleset(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Tables) != 1 {
+		t.Fatalf("expect 1 table, got %d", len(rs.Tables))
+	}
+	ts := rs.Tables[0]
+	if ts.Table.Name != "filter" || ts.Table.Family != TableFamilyInet {
+		t.Fatalf("unexpected table %+v", ts.Table)
+	}
+	set := ts.Sets[0]
+	if set.DType != SetDtypeIpv4 || !set.ElemRange || len(set.Elements) != 3 || set.Table != ts.Table {
+		t.Fatalf("unexpected set %+v", set)
+	}
+	input := ts.Chains[0]
+	if input.Chain.Hook != ChainHookInput || input.Chain.Policy != ChainPolicyDrop || len(input.Rules) != 4 {
+		t.Fatalf("unexpected chain %+v", input)
+	}
+	r := input.Rules[1]
+	if r.L3Proto != RuleL3Ip || r.L3SrcIP != "allow" || r.L4Proto != RuleL4Tcp || r.L4DstPort != "22-23" ||
+		r.Action != RuleActAccept || r.Chain != input.Chain {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+
+	// 解析结果重新输出后应与再次解析一致
+	rs2, err := ParseRuleset(rs.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs2.String() != rs.String() {
+		t.Fatalf("round trip mismatch:\n%s\n%s", rs, rs2)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("ip protocol udp ct state new drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.L3Proto != RuleL3Ip || r.L4Proto != RuleL4Udp || len(r.CtStates) != 1 || r.Action != RuleActDrop {
+		t.Fatalf("unexpected rule %+v", r)
+	}
+	if _, err = ParseRule("ip saddr 1.1.1.1 frobnicate"); !errors.Is(err, ErrUnsupportedExpr) {
+		t.Fatalf("expect ErrUnsupportedExpr, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// +build linux
+
+package nftlib
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// protocolsFile 系统的协议名称数据库
+	protocolsFile = "/etc/protocols"
+	protocolsOnce sync.Once
+	// sysProtoNums sysProtoNames 协议名称数据库中的名称(含别名)与协议号, 协议号对应的首个名称
+	sysProtoNums  map[string]byte
+	sysProtoNames map[byte]string
+	// portProtos 含源/目标端口的四层协议, 端口均位于传输层头部偏移0与2处
+	portProtos = []string{RuleL4Tcp, RuleL4Udp, RuleL4Sctp, RuleL4Dccp, RuleL4UdpLite}
+)
+
+// readProtocols 读取协议名称数据库, 每行格式为 名称 协议号 [别名...] [# 注释]
+func readProtocols(path string) (map[string]byte, map[byte]string) {
+	nums, names := make(map[string]byte), make(map[byte]string)
+	f, err := os.Open(path)
+	if err != nil {
+		return nums, names
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			continue
+		}
+		if _, ok := names[byte(n)]; !ok {
+			names[byte(n)] = fields[0]
+		}
+		for _, name := range append(fields[:1], fields[2:]...) {
+			nums[name] = byte(n)
+		}
+	}
+	return nums, names
+}
+
+func loadProtocols() {
+	protocolsOnce.Do(func() {
+		sysProtoNums, sysProtoNames = readProtocols(protocolsFile)
+	})
+}
+
+// l4ProtoNum 四层协议的协议号, 支持常用协议名、协议号及协议名称数据库中的名称
+func l4ProtoNum(name string) (byte, bool) {
+	if name == RuleL4Icmp6 || name == "icmpv6" {
+		name = "ipv6-icmp"
+	}
+	if n, ok := protoNames[name]; ok {
+		return n, true
+	}
+	if n, err := strconv.ParseUint(name, 10, 8); err == nil {
+		return byte(n), true
+	}
+	loadProtocols()
+	n, ok := sysProtoNums[name]
+	return n, ok
+}
+
+// l4ProtoName 协议号对应的协议名, 优先使用常用协议名, 无名称时为协议号
+func l4ProtoName(n byte) string {
+	if n == protoNames["ipv6-icmp"] {
+		return RuleL4Icmp6
+	}
+	for k, v := range protoNames {
+		if v == n {
+			return k
+		}
+	}
+	loadProtocols()
+	if name, ok := sysProtoNames[n]; ok {
+		return name
+	}
+	return strconv.Itoa(int(n))
+}
+
+// l4ProtoKeyword nft输出四层协议时使用的名称, icmpv6输出为ipv6-icmp
+func l4ProtoKeyword(l4 string) string {
+	if l4 == RuleL4Icmp6 {
+		return "ipv6-icmp"
+	}
+	return l4
+}
+
+// l4ProtoField L3协议头中记录四层协议的字段, ipv4为protocol, ipv6为nexthdr
+func l4ProtoField(l3 string) string {
+	if l3 == RuleL3Ip6 {
+		return "nexthdr"
+	}
+	return "protocol"
+}
+
+// isPortProto 四层协议是否含有端口
+func isPortProto(l4 string) bool {
+	for _, v := range portProtos {
+		if v == l4 {
+			return true
+		}
+	}
+	return false
+}
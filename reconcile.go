@@ -0,0 +1,427 @@
+// +build linux
+
+package nftlib
+
+import (
+	"github.com/google/nftables"
+	"sort"
+)
+
+const (
+	ChangeAdd     changeOp = "add"
+	ChangeDelete  changeOp = "delete"
+	ChangeReplace changeOp = "replace"
+	ChangeUpdate  changeOp = "update"
+	ChangeFlush   changeOp = "flush"
+)
+
+type changeOp string
+
+// Change 单个对象的变更
+type Change struct {
+	Op     changeOp    `json:"op"`
+	Kind   ObjKind     `json:"kind"`
+	Family tableFamily `json:"family"`
+	Table  string      `json:"table"`
+	Chain  string      `json:"chain,omitempty"`
+	// Name 集合或链的名称, 元素变更时为集合名称
+	Name string `json:"name,omitempty"`
+	// Handle 被删除或替换的规则句柄
+	Handle uint64 `json:"handle,omitempty"`
+	// Old New 变更前后对象的nft格式
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	set    *Set
+	mp     *Map
+	chain  *Chain
+	rule   *Rule
+	elem   string
+	melem  MapElement
+	before uint64
+}
+
+// ChangeReport Reconcile执行的变更列表, 按下发顺序排列
+type ChangeReport struct {
+	Changes []*Change `json:"changes,omitempty"`
+}
+
+// Reconcile 将内核中的表调整为desired描述的状态
+// 对比表下的集合、映射、元素、链与有序规则, 在同一批次中下发最少的增删改操作并提交
+func (d *Conn) Reconcile(desired *TableSpec) (*ChangeReport, error) {
+	for _, cs := range desired.Chains {
+		ch := *cs.Chain
+		ch.Table = desired.Table
+		if err := ch.Validate(); err != nil {
+			return nil, newObjErr("reconcile", ObjChain, err).table(desired.Table.Name).name(cs.Chain.Name)
+		}
+	}
+	plan, err := d.PlanTable(desired)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Changes) == 0 {
+		return &ChangeReport{}, nil
+	}
+	if err = d.applyChanges(desired.Table, plan.Changes); err != nil {
+		d.Discard()
+		return nil, err
+	}
+	if err = d.Commit(); err != nil {
+		return nil, err
+	}
+	return &ChangeReport{Changes: plan.Changes}, nil
+}
+
+// liveTableSpec 读取内核中与table同名同协议族的表, 表不存在时返回nil
+func (d *Conn) liveTableSpec(table *Table) (*TableSpec, error) {
+	tables, err := d.ShowTables()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tables {
+		if t.Name == table.Name && t.Family == table.Family {
+			return t.spec()
+		}
+	}
+	return nil, nil
+}
+
+// diffTable 计算由live变为desired所需的变更, live为nil表示表不存在
+func diffTable(live, desired *TableSpec) []*Change {
+	var (
+		r      []*Change
+		tbl    = desired.Table
+		newChg = func(op changeOp, kind ObjKind) *Change {
+			return &Change{Op: op, Kind: kind, Family: tbl.Family, Table: tbl.Name}
+		}
+	)
+	if live == nil {
+		r = append(r, newChg(ChangeAdd, ObjTable))
+		r[0].New = tbl.String()
+		live = &TableSpec{Table: tbl}
+	}
+
+	// 集合及元素
+	liveSets := make(map[string]*Set)
+	for _, set := range live.Sets {
+		liveSets[set.Name] = set
+	}
+	for _, set := range desired.Sets {
+		ls, ok := liveSets[set.Name]
+		if !ok || ls.DType != set.DType || ls.ElemRange != set.ElemRange || !sameSetOpts(ls, set) {
+			c := newChg(ChangeAdd, ObjSet)
+			c.Name, c.New, c.set = set.Name, set.String(), set
+			if ok {
+				c.Op, c.Old = ChangeReplace, ls.String()
+			}
+			r = append(r, c)
+			continue
+		}
+		liveElems := elemsNoExpires(ls.Elements)
+		for _, elem := range diffStrings(liveElems, set.Elements) {
+			c := newChg(ChangeAdd, ObjElement)
+			c.Name, c.New, c.set, c.elem = set.Name, elem, set, elem
+			r = append(r, c)
+		}
+		for _, elem := range diffStrings(set.Elements, liveElems) {
+			c := newChg(ChangeDelete, ObjElement)
+			c.Name, c.Old, c.set, c.elem = set.Name, elem, set, elem
+			r = append(r, c)
+		}
+	}
+
+	// 链, 规则变更放在映射之后以便引用新的映射
+	var ruleChgs []*Change
+	liveChains := make(map[string]*ChainSpec)
+	for _, cs := range live.Chains {
+		liveChains[cs.Chain.Name] = cs
+	}
+	for _, cs := range desired.Chains {
+		ch := cs.Chain
+		lcs, ok := liveChains[ch.Name]
+		var liveRules []*Rule
+		switch {
+		case !ok:
+			c := newChg(ChangeAdd, ObjChain)
+			c.Name, c.New, c.chain = ch.Name, ch.String(), ch
+			r = append(r, c)
+		case lcs.Chain.Type != ch.Type || lcs.Chain.Hook != ch.Hook || lcs.Chain.Priority != ch.Priority ||
+			lcs.Chain.Device != ch.Device:
+			// 基础链的类型、钩子、优先级与设备无法修改, 需删除后重建
+			c := newChg(ChangeReplace, ObjChain)
+			c.Name, c.Old, c.New, c.chain = ch.Name, lcs.Chain.String(), ch.String(), ch
+			r = append(r, c)
+		default:
+			if lcs.Chain.Policy != ch.Policy {
+				c := newChg(ChangeUpdate, ObjChain)
+				c.Name, c.Old, c.New, c.chain = ch.Name, lcs.Chain.String(), ch.String(), ch
+				r = append(r, c)
+			}
+			liveRules = lcs.Rules
+		}
+		for _, c := range diffRules(liveRules, cs.Rules) {
+			c.Family, c.Table, c.Chain, c.chain = tbl.Family, tbl.Name, ch.Name, ch
+			ruleChgs = append(ruleChgs, c)
+		}
+	}
+
+	// 映射及元素, 放在链之后以便verdict引用新增的链
+	liveMaps := make(map[string]*Map)
+	for _, m := range live.Maps {
+		liveMaps[m.Name] = m
+	}
+	for _, m := range desired.Maps {
+		lm, ok := liveMaps[m.Name]
+		if !ok || lm.KeyType != m.KeyType || lm.DataType != m.DataType || lm.ElemRange != m.ElemRange {
+			c := newChg(ChangeAdd, ObjMap)
+			c.Name, c.New, c.mp = m.Name, m.String(), m
+			if ok {
+				c.Op, c.Old = ChangeReplace, lm.String()
+			}
+			r = append(r, c)
+			continue
+		}
+		// 值变化的元素先按键删除再添加
+		for _, elem := range diffStrings(mapElemStrings(m.KeyType, m.Elements), mapElemStrings(lm.KeyType, lm.Elements)) {
+			c := newChg(ChangeDelete, ObjElement)
+			c.Name, c.Old, c.mp = m.Name, elem, m
+			c.melem, _ = parseMapElement(elem)
+			r = append(r, c)
+		}
+		for _, elem := range diffStrings(mapElemStrings(lm.KeyType, lm.Elements), mapElemStrings(m.KeyType, m.Elements)) {
+			c := newChg(ChangeAdd, ObjElement)
+			c.Name, c.New, c.mp = m.Name, elem, m
+			c.melem, _ = parseMapElement(elem)
+			r = append(r, c)
+		}
+	}
+	r = append(r, ruleChgs...)
+
+	// 删除多余的映射、链与集合, 放在规则变更之后以免仍被引用
+	desiredMaps := make(map[string]bool)
+	for _, m := range desired.Maps {
+		desiredMaps[m.Name] = true
+	}
+	for _, m := range live.Maps {
+		if !desiredMaps[m.Name] {
+			c := newChg(ChangeDelete, ObjMap)
+			c.Name, c.Old, c.mp = m.Name, m.String(), m
+			r = append(r, c)
+		}
+	}
+	desiredChains := make(map[string]bool)
+	for _, cs := range desired.Chains {
+		desiredChains[cs.Chain.Name] = true
+	}
+	for _, cs := range live.Chains {
+		if !desiredChains[cs.Chain.Name] {
+			c := newChg(ChangeDelete, ObjChain)
+			c.Name, c.Old, c.chain = cs.Chain.Name, cs.Chain.String(), cs.Chain
+			r = append(r, c)
+		}
+	}
+	desiredSets := make(map[string]bool)
+	for _, set := range desired.Sets {
+		desiredSets[set.Name] = true
+	}
+	for _, set := range live.Sets {
+		if !desiredSets[set.Name] {
+			c := newChg(ChangeDelete, ObjSet)
+			c.Name, c.Old, c.set = set.Name, set.String(), set
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// diffRules 基于最长公共子序列对比有序规则, 规则以nft格式文本作为标识
+// 同一间隔内被删除与新增的规则成对替换, 多余的新增规则插入到下一条保留规则之前
+func diffRules(live, desired []*Rule) []*Change {
+	var (
+		r          []*Change
+		n, m       = len(live), len(desired)
+		lcs        = make([][]int, n+1)
+		gapDel     []*Rule
+		gapAdd     []*Rule
+		liveKeys   = make([]string, n)
+		wantedKeys = make([]string, m)
+	)
+	for i, rule := range live {
+		liveKeys[i] = rule.String()
+	}
+	for i, rule := range desired {
+		wantedKeys[i] = rule.String()
+	}
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if liveKeys[i] == wantedKeys[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	flush := func(next *Rule) {
+		for k := 0; k < len(gapDel) || k < len(gapAdd); k++ {
+			switch {
+			case k < len(gapDel) && k < len(gapAdd):
+				r = append(r, &Change{Op: ChangeReplace, Kind: ObjRule, Handle: gapDel[k].Handle,
+					Old: gapDel[k].String(), New: gapAdd[k].String(), rule: gapAdd[k]})
+			case k < len(gapDel):
+				r = append(r, &Change{Op: ChangeDelete, Kind: ObjRule, Handle: gapDel[k].Handle,
+					Old: gapDel[k].String(), rule: gapDel[k]})
+			default:
+				c := &Change{Op: ChangeAdd, Kind: ObjRule, New: gapAdd[k].String(), rule: gapAdd[k]}
+				if next != nil {
+					c.before = next.Handle
+				}
+				r = append(r, c)
+			}
+		}
+		gapDel, gapAdd = nil, nil
+	}
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case liveKeys[i] == wantedKeys[j]:
+			flush(live[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			gapDel = append(gapDel, live[i])
+			i++
+		default:
+			gapAdd = append(gapAdd, desired[j])
+			j++
+		}
+	}
+	gapDel = append(gapDel, live[i:]...)
+	gapAdd = append(gapAdd, desired[j:]...)
+	flush(nil)
+	return r
+}
+
+// applyChanges 将变更加入当前批次
+func (d *Conn) applyChanges(table *Table, changes []*Change) error {
+	tbl := &Table{conn: d, Name: table.Name, Family: table.Family}
+	for _, c := range changes {
+		var err error
+		switch c.Kind {
+		case ObjTable:
+			d.ADDTable(tbl)
+		case ObjSet:
+			if c.Op == ChangeDelete || c.Op == ChangeReplace {
+				d.DelSet(&nftables.Set{Table: tbl.toNTable(), Name: c.Name})
+				tbl.recordDelSet(c.Name)
+			}
+			if c.Op == ChangeAdd || c.Op == ChangeReplace {
+				err = tbl.addSet(c.set)
+			}
+		case ObjMap:
+			if c.Op == ChangeDelete || c.Op == ChangeReplace {
+				d.DelSet(&nftables.Set{Table: tbl.toNTable(), Name: c.Name})
+				tbl.recordDelMap(c.Name)
+			}
+			if c.Op == ChangeAdd || c.Op == ChangeReplace {
+				err = tbl.addMap(c.mp)
+			}
+		case ObjElement:
+			if c.mp != nil {
+				c.mp.conn, c.mp.Table = d, tbl
+				if c.Op == ChangeAdd {
+					err = c.mp.AddElements(c.melem)
+				} else {
+					err = c.mp.DelElements(c.melem)
+				}
+				break
+			}
+			c.set.conn, c.set.Table = d, tbl
+			if c.Op == ChangeAdd {
+				err = c.set.AddElements(c.elem)
+			} else {
+				err = c.set.DelElements(c.elem)
+			}
+		case ObjChain:
+			c.chain.Conn, c.chain.Table = d, tbl
+			if c.Op == ChangeDelete || c.Op == ChangeReplace {
+				nch := c.chain.toNch()
+				d.FlushChain(nch)
+				d.DelChain(nch)
+				dc := tbl.change(ChangeDelete, ObjChain)
+				dc.Name = c.Name
+				d.record(dc)
+			}
+			if c.Op != ChangeDelete {
+				if _, err := tbl.AddBaseChain(c.chain); err != nil {
+					return err
+				}
+			}
+		case ObjRule:
+			switch c.Op {
+			case ChangeAdd:
+				rule := *c.rule
+				rule.Handle = 0
+				if c.before != 0 {
+					err = c.chain.InsertRule(&rule, c.before)
+				} else {
+					err = c.chain.AddRule(&rule)
+				}
+			case ChangeReplace:
+				rule := *c.rule
+				rule.Handle = c.Handle
+				err = c.chain.ReplaceRule(&rule)
+			case ChangeDelete:
+				err = c.chain.DelRule(c.rule)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameSetOpts 集合的超时、动态标志与大小是否相同, 这些属性无法修改, 不同时需重建集合
+// 内核不返回gc-interval, 不参与比较
+func sameSetOpts(a, b *Set) bool {
+	return a.timeoutFlag() == b.timeoutFlag() && a.Dynamic == b.Dynamic && a.Timeout == b.Timeout && a.Size == b.Size
+}
+
+// elemsNoExpires 去除集合元素随时间变化的剩余时间
+func elemsNoExpires(elems []string) []string {
+	r := make([]string, len(elems))
+	for i, v := range elems {
+		e, err := ParseSetElem(v)
+		if err != nil || e.Expires == 0 {
+			r[i] = v
+			continue
+		}
+		e.Expires = 0
+		r[i] = e.String()
+	}
+	return r
+}
+
+// diffStrings 返回b中存在而a中不存在的元素
+func diffStrings(a, b []string) []string {
+	var (
+		r    []string
+		seen = make(map[string]bool)
+	)
+	for _, v := range a {
+		seen[v] = true
+	}
+	for _, v := range b {
+		if !seen[v] {
+			r = append(r, v)
+		}
+	}
+	sort.Strings(r)
+	return r
+}
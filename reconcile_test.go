@@ -0,0 +1,108 @@
+// +build linux
+
+package nftlib
+
+import (
+	"fmt"
+	"github.com/google/nftables/expr"
+	"testing"
+)
+
+func TestDiffRules(t *testing.T) {
+	rule := func(handle uint64, ip string) *Rule {
+		return &Rule{Handle: handle, L3Proto: RuleL3Ip, L3SrcIP: ip, Action: RuleActAccept}
+	}
+	live := []*Rule{rule(1, "1.1.1.1"), rule(2, "2.2.2.2"), rule(3, "3.3.3.3"), rule(4, "4.4.4.4")}
+	desired := []*Rule{rule(0, "9.9.9.9"), rule(0, "1.1.1.1"), rule(0, "5.5.5.5"), rule(0, "3.3.3.3"),
+		rule(0, "6.6.6.6")}
+	var got []string
+	for _, c := range diffRules(live, desired) {
+		got = append(got, fmt.Sprintf("%s %d %d %s", c.Op, c.Handle, c.before, c.New))
+	}
+	want := []string{
+		"add 0 1 ip saddr 9.9.9.9 accept",
+		"replace 2 0 ip saddr 5.5.5.5 accept",
+		"replace 4 0 ip saddr 6.6.6.6 accept",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// 含无法解析的表达式的规则与不含这些表达式的规则不同
+	partial := rule(1, "1.1.1.1")
+	partial.Raw = []RuleRaw{{Exprs: []expr.Any{&expr.Quota{Bytes: 1000}}}}
+	changes := diffRules([]*Rule{partial}, []*Rule{rule(0, "1.1.1.1")})
+	if len(changes) != 1 || changes[0].Op != ChangeReplace || changes[0].Handle != 1 {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+}
+
+func TestDiffTable(t *testing.T) {
+	live, err := ParseRuleset(`table inet filter {
+	set allow {
+		type ipv4_addr
+		elements = { 1.1.1.1, 2.2.2.2 }
+	}
+	set old {
+		type inet_service
+	}
+	chain input {
+		type filter hook input priority 0; policy accept;
+		ip saddr @allow accept
+	}
+	chain unused {
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, err := ParseRuleset(`table inet filter {
+	set allow {
+		type ipv4_addr
+		elements = { 2.2.2.2, 3.3.3.3 }
+	}
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ip saddr @allow accept
+		tcp dport 22 accept
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range diffTable(live.Tables[0], desired.Tables[0]) {
+		got = append(got, fmt.Sprintf("%s %s %s %s", c.Op, c.Kind, c.Name, c.elem))
+	}
+	want := []string{
+		"add element allow 3.3.3.3",
+		"delete element allow 1.1.1.1",
+		"update chain input ",
+		"add rule  ",
+		"delete chain unused ",
+		"delete set old ",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if len(diffTable(desired.Tables[0], desired.Tables[0])) != 0 {
+		t.Fatal("expect no changes between identical tables")
+	}
+
+	// 基础链的设备无法修改, 需重建
+	ingress := func(dev string) *TableSpec {
+		rs, err := ParseRuleset(`table netdev filter {
+	chain ingress {
+		type filter hook ingress device "` + dev + `" priority 0; policy accept;
+	}
+}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.Tables[0]
+	}
+	chs := diffTable(ingress("eth0"), ingress("eth1"))
+	if len(chs) != 1 || chs[0].Op != ChangeReplace || chs[0].Kind != ObjChain {
+		t.Fatalf("expect chain replace, got %v", chs)
+	}
+}
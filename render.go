@@ -0,0 +1,696 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// familyKeyword 表协议族对应的nft关键字
+	familyKeyword = map[tableFamily]string{
+		TableFamilyInet:   "inet",
+		TableFamilyIpv4:   "ip",
+		TableFamilyIpv6:   "ip6",
+		TableFamilyBridge: "bridge",
+		TableFamilyArp:    "arp",
+		TableFamilyNetdev: "netdev",
+	}
+	// dtypeKeyword 集合数据类型对应的nft关键字
+	dtypeKeyword = map[string]string{
+		SetDtypeIpv4:      "ipv4_addr",
+		SetDtypeIpv6:      "ipv6_addr",
+		SetDtypePort:      "inet_service",
+		SetDtypeIfname:    "ifname",
+		SetDtypeProto:     "inet_proto",
+		SetDtypeEther:     "ether_addr",
+		SetDtypeMark:      "mark",
+		SetDtypeCtState:   "ct_state",
+		SetDtypeIcmpType:  "icmp_type",
+		SetDtypeIcmp6Type: "icmpv6_type",
+		SetDtypeDscp:      "dscp",
+	}
+)
+
+// String 以nft list ruleset的格式输出规则, 如 ip saddr 10.0.0.0/8 tcp dport 22-23 accept
+// 无法解析的表达式输出为 raw 加表达式的编码, 此时输出无法被nft解析
+func (d *Rule) String() string {
+	var stmts []string
+	// appendRaw 在stmt语句之后输出无法解析的表达式
+	appendRaw := func(stmt string) {
+		for _, raw := range d.rawAfter(stmt) {
+			stmts = append(stmts, raw.String())
+		}
+	}
+	if d.InIface != "" {
+		stmts = append(stmts, renderIface("iif", d.InIface))
+	}
+	if d.OutIface != "" {
+		stmts = append(stmts, renderIface("oif", d.OutIface))
+	}
+	l3 := "ip"
+	if d.L3Proto == RuleL3Ip6 {
+		l3 = "ip6"
+	}
+	// 映射查找键隐含的协议不单独输出
+	mapL3, mapL4 := d.mapProto()
+	l4Pld := d.l4ProtoPayload()
+	if d.L3Proto != "" && d.L3SrcIP == "" && d.L3DstIP == "" && d.L3Proto != mapL3 && !l4Pld {
+		stmts = append(stmts, "meta nfproto "+d.L3Proto)
+	}
+	if d.L3SrcIP != "" {
+		stmts = append(stmts, fmt.Sprintf("%s saddr %s", l3, renderAddr(d.L3SrcIP)))
+	}
+	if d.L3DstIP != "" {
+		stmts = append(stmts, fmt.Sprintf("%s daddr %s", l3, renderAddr(d.L3DstIP)))
+	}
+	if d.L4Proto != "" {
+		l4, neg := splitNeg(d.L4Proto)
+		l4 = l4ProtoKeyword(l4)
+		hasPort := isPortProto(d.L4Proto) && (d.L4SrcPort != "" || d.L4DstPort != "")
+		if l4Pld {
+			op := ""
+			if neg {
+				op = "!= "
+			}
+			stmts = append(stmts, fmt.Sprintf("%s %s %s%s", l3, l4ProtoField(d.L3Proto), op, l4))
+		} else if neg {
+			stmts = append(stmts, "meta l4proto != "+l4)
+		} else if !hasPort && d.L4Proto != mapL4 {
+			stmts = append(stmts, "meta l4proto "+l4)
+		}
+		if hasPort && d.L4SrcPort != "" {
+			stmts = append(stmts, fmt.Sprintf("%s sport %s", l4, renderPort(d.L4SrcPort)))
+		}
+		if hasPort && d.L4DstPort != "" {
+			stmts = append(stmts, fmt.Sprintf("%s dport %s", l4, renderPort(d.L4DstPort)))
+		}
+	}
+	for _, h := range d.Headers {
+		stmts = append(stmts, h.String())
+	}
+	if d.Concat != nil {
+		stmts = append(stmts, d.Concat.String())
+	}
+	if len(d.CtStates) > 0 {
+		op := ""
+		if d.CtStatesNeg {
+			op = "!= "
+		}
+		stmts = append(stmts, "ct state "+op+strings.Join(sortCtStates(d.CtStates), ","))
+	}
+	for _, c := range d.CtMatches {
+		stmts = append(stmts, c.String())
+	}
+	if d.CtCount != nil {
+		stmts = append(stmts, d.CtCount.String())
+	}
+	if d.MetaMark != "" {
+		stmts = append(stmts, renderMarkStmt("meta mark", d.MetaMark))
+	}
+	if d.CtMark != "" {
+		stmts = append(stmts, renderMarkStmt("ct mark", d.CtMark))
+	}
+	if d.MetaPriority != "" {
+		stmts = append(stmts, "meta priority "+renderPriorityValue(d.MetaPriority))
+	}
+	appendRaw("")
+	if d.Limit != nil {
+		stmts = append(stmts, d.Limit.String())
+	}
+	appendRaw("limit")
+	// 计数值随流量变化, 不输出以保证规则比较稳定
+	if d.Counter != nil {
+		stmts = append(stmts, "counter")
+	}
+	appendRaw("counter")
+	if d.Log != nil {
+		stmts = append(stmts, d.Log.String())
+	}
+	appendRaw("log")
+	if d.MetaMarkSet != "" {
+		stmts = append(stmts, "meta mark set "+renderMarkValue(d.MetaMarkSet))
+	}
+	appendRaw("meta mark set")
+	if d.CtMarkSet != "" {
+		stmts = append(stmts, "ct mark set "+renderMarkValue(d.CtMarkSet))
+	}
+	appendRaw("ct mark set")
+	if d.CtZoneSet != "" {
+		stmts = append(stmts, "ct zone set "+d.CtZoneSet)
+	}
+	appendRaw("ct zone set")
+	if d.MetaPrioritySet != "" {
+		stmts = append(stmts, "meta priority set "+renderPriorityValue(d.MetaPrioritySet))
+	}
+	appendRaw("meta priority set")
+	if d.Notrack {
+		stmts = append(stmts, "notrack")
+	}
+	appendRaw("notrack")
+	if d.SetUpdate != nil {
+		stmts = append(stmts, d.SetUpdate.String())
+	}
+	appendRaw("set")
+	if d.VMap != nil {
+		stmts = append(stmts, d.VMap.render("vmap"))
+	}
+	appendRaw("vmap")
+	switch d.Action {
+	case RuleActJump, RuleActGoto:
+		stmts = append(stmts, d.Action+" "+d.DstChain)
+	case RuleActSnat, RuleActDnat, RuleActMasq, RuleActRedir:
+		stmts = append(stmts, d.natStmt())
+	case RuleActReject:
+		stmts = append(stmts, d.rejectStmt())
+	case "":
+	default:
+		stmts = append(stmts, d.Action)
+	}
+	appendRaw("action")
+	return strings.Join(stmts, " ")
+}
+
+// natStmt 输出nat语句, inet表中snat/dnat需指明地址族
+func (d *Rule) natStmt() string {
+	var s = d.Action
+	if (d.Action == RuleActSnat || d.Action == RuleActDnat) && d.natQualified() {
+		if d.natFamily() == unix.NFPROTO_IPV6 {
+			s += " ip6"
+		} else {
+			s += " ip"
+		}
+	}
+	to := d.NatAddr
+	if d.NatMap != nil {
+		to = d.NatMap.render("map")
+	}
+	if d.NatPort != "" {
+		if strings.Contains(to, ":") {
+			to = "[" + to + "]"
+		}
+		to += ":" + d.NatPort
+	}
+	if to != "" {
+		s += " to " + to
+	}
+	if len(d.NatFlags) > 0 {
+		s += " " + strings.Join(sortNatFlags(d.NatFlags), ",")
+	}
+	return s
+}
+
+// render 输出映射查找, 如 tcp dport vmap @name 或 tcp dport vmap { 22 : jump ssh, 80 : accept }
+func (d *RuleMap) render(kind string) string {
+	if d.Name != "" {
+		return fmt.Sprintf("%s %s @%s", d.Key, kind, d.Name)
+	}
+	elems := mapElemStrings(ruleMapKeys[d.Key].dtype, d.Elements)
+	return fmt.Sprintf("%s %s { %s }", d.Key, kind, strings.Join(elems, ", "))
+}
+
+// String 以nft格式输出拼接匹配, 如 ip saddr . tcp dport { 10.0.0.1 . 22 }
+func (d *RuleConcat) String() string {
+	value, neg := splitNeg(d.Value)
+	s := strings.Join(d.Keys, " . ")
+	if neg {
+		s += " !="
+	}
+	if strings.HasPrefix(value, "@") {
+		return s + " " + value
+	}
+	var dtypes []string
+	for _, key := range d.Keys {
+		k, _ := concatKey(key)
+		dtypes = append(dtypes, k.dtype)
+	}
+	elems := strings.Split(value, ",")
+	for i := range elems {
+		elems[i] = strings.TrimSpace(elems[i])
+	}
+	return fmt.Sprintf("%s { %s }", s, strings.Join(quoteElems(strings.Join(dtypes, " . "), elems), ", "))
+}
+
+// String 以nft格式输出集合更新语句, 如 add @blk { ip saddr . tcp dport timeout 10m }
+func (d *RuleSetUpdate) String() string {
+	s := fmt.Sprintf("%s @%s { %s", d.Op, d.Set, strings.Join(d.Keys, " . "))
+	if d.Timeout > 0 {
+		s += " timeout " + formatNftDuration(d.Timeout)
+	}
+	return s + " }"
+}
+
+// String 输出协议头匹配, 如 tcp flags & (syn|ack) == syn 或 icmp type { echo-request, echo-reply }
+func (d RuleHeader) String() string {
+	s := d.Field
+	op := d.Op
+	if d.Mask != "" {
+		mask := d.Mask
+		if strings.Contains(mask, "|") {
+			mask = "(" + mask + ")"
+		}
+		s += " & " + mask
+		if op == "" {
+			op = "=="
+		}
+	}
+	if op != "" {
+		s += " " + op
+	}
+	if isValueList(d.Value) {
+		return s + " " + renderList(d.Value, func(v string) string { return v })
+	}
+	return s + " " + d.Value
+}
+
+// String 以nft格式输出连接跟踪匹配, helper名称带引号
+func (d RuleCt) String() string {
+	if c, err := d.normalize(); err == nil {
+		d = c
+	}
+	value := d.Value
+	if d.Key == "helper" {
+		value = strconv.Quote(value)
+	}
+	if d.Op == "" {
+		return fmt.Sprintf("ct %s %s", d.Key, value)
+	}
+	return fmt.Sprintf("ct %s %s %s", d.Key, d.Op, value)
+}
+
+func (d *RuleCtCount) String() string {
+	if d.Over {
+		return fmt.Sprintf("ct count over %d", d.Count)
+	}
+	return fmt.Sprintf("ct count %d", d.Count)
+}
+
+// String 以 raw 名称:十六进制编码 输出表达式, 如 raw meta:..., cmp:..., 仅用于展示与比较规则
+func (d RuleRaw) String() string {
+	var l []string
+	for _, e := range d.Exprs {
+		b, err := expr.MarshalExprData(0, e)
+		if err != nil {
+			l = append(l, exprName(e))
+			continue
+		}
+		l = append(l, fmt.Sprintf("%s:%x", exprName(e), b))
+	}
+	return "raw " + strings.Join(l, ",")
+}
+
+// String 以nft格式输出限速语句, 省略内核默认的突发值5
+func (d *RuleLimit) String() string {
+	s := "limit rate "
+	if d.Over {
+		s += "over "
+	}
+	s += fmt.Sprintf("%d/%s", d.Rate, d.Unit)
+	if d.Burst != 0 && d.Burst != 5 {
+		s += fmt.Sprintf(" burst %d packets", d.Burst)
+	}
+	return s
+}
+
+// String 以nft格式输出日志语句, 省略默认级别warn
+func (d *RuleLog) String() string {
+	var r = []string{"log"}
+	if d.Prefix != "" {
+		r = append(r, fmt.Sprintf("prefix %q", d.Prefix))
+	}
+	if d.Level != "" && d.Level != "warn" {
+		r = append(r, "level "+d.Level)
+	}
+	if d.Group != nil {
+		r = append(r, fmt.Sprintf("group %d", *d.Group))
+	}
+	if d.Snaplen != 0 {
+		r = append(r, fmt.Sprintf("snaplen %d", d.Snaplen))
+	}
+	for _, f := range d.Flags {
+		r = append(r, "flags "+f)
+	}
+	return strings.Join(r, " ")
+}
+
+// rejectStmt 输出reject语句, 未指定类型时省略with子句
+func (d *Rule) rejectStmt() string {
+	switch d.RejectKind {
+	case "":
+		return RuleActReject
+	case RuleRejectTcpReset:
+		return "reject with tcp reset"
+	}
+	code := d.RejectCode
+	if code == "" {
+		code = "port-unreachable"
+	}
+	return fmt.Sprintf("reject with %s type %s", d.RejectKind, code)
+}
+
+// natQualified 规则是否位于inet表中
+func (d *Rule) natQualified() bool {
+	return d.Chain != nil && d.Chain.Table != nil && d.Chain.Table.Family == TableFamilyInet
+}
+
+// String 以nft格式输出链定义, 不包含链中的规则
+func (d *Chain) String() string {
+	return renderBlock("chain "+d.Name, d.stmts())
+}
+
+// stmts 基础链的类型、钩子、优先级与默认策略
+func (d *Chain) stmts() []string {
+	var r []string
+	if d.Hook != "" {
+		dev := ""
+		if d.Device != "" {
+			dev = fmt.Sprintf(" device %q", d.Device)
+		}
+		var family tableFamily
+		if d.Table != nil {
+			family = d.Table.Family
+		}
+		prio := PriorityString(family, d.Hook, d.Priority)
+		r = append(r, fmt.Sprintf("type %s hook %s%s priority %s;", d.Type, d.Hook, dev, prio))
+	}
+	if d.Policy != "" {
+		if len(r) > 0 {
+			r[0] += fmt.Sprintf(" policy %s;", d.Policy)
+		} else {
+			r = append(r, fmt.Sprintf("policy %s;", d.Policy))
+		}
+	}
+	return r
+}
+
+// String 以nft格式输出集合定义及其元素
+func (d *Set) String() string {
+	var r []string
+	r = append(r, "type "+dtypeString(d.DType))
+	if d.Size > 0 {
+		r = append(r, fmt.Sprintf("size %d", d.Size))
+	}
+	if flags := d.flags(); len(flags) > 0 {
+		r = append(r, "flags "+strings.Join(flags, ","))
+	}
+	if d.Timeout > 0 {
+		r = append(r, "timeout "+formatNftDuration(d.Timeout))
+	}
+	if d.GCInterval > 0 {
+		r = append(r, "gc-interval "+formatNftDuration(d.GCInterval))
+	}
+	if len(d.Elements) > 0 {
+		r = append(r, fmt.Sprintf("elements = { %s }", strings.Join(quoteElems(d.DType, d.Elements), ", ")))
+	}
+	return renderBlock("set "+d.Name, r)
+}
+
+// flags 集合的nft标志
+func (d *Set) flags() []string {
+	var r []string
+	if d.ElemRange {
+		r = append(r, "interval")
+	}
+	if d.Dynamic {
+		r = append(r, "dynamic")
+	}
+	if d.timeoutFlag() {
+		r = append(r, "timeout")
+	}
+	return r
+}
+
+// dtypeString 集合数据类型对应的nft关键字, 拼接类型的关键字以 . 连接
+func dtypeString(dtype string) string {
+	var r []string
+	for _, v := range strings.Split(dtype, " . ") {
+		if kw, ok := dtypeKeyword[v]; ok {
+			v = kw
+		}
+		r = append(r, v)
+	}
+	return strings.Join(r, " . ")
+}
+
+// quoteElems 为集合元素中的接口名加引号, 包括拼接元素中的接口名字段, 元素选项原样保留
+func quoteElems(dtype string, elems []string) []string {
+	dtypes := strings.Split(dtype, " . ")
+	r := make([]string, len(elems))
+	for i, v := range elems {
+		v, opts := splitElemOpts(v)
+		fields := strings.Split(v, " . ")
+		for j := range fields {
+			if j < len(dtypes) && dtypes[j] == SetDtypeIfname {
+				fields[j] = strconv.Quote(fields[j])
+			}
+		}
+		r[i] = strings.Join(fields, " . ") + opts
+	}
+	return r
+}
+
+// String 以nft格式输出映射定义及其元素
+func (d *Map) String() string {
+	var r []string
+	r = append(r, fmt.Sprintf("type %s : %s", dtypeString(d.KeyType), dtypeString(d.DataType)))
+	if d.ElemRange {
+		r = append(r, "flags interval")
+	}
+	if len(d.Elements) > 0 {
+		r = append(r, fmt.Sprintf("elements = { %s }", strings.Join(mapElemStrings(d.KeyType, d.Elements), ", ")))
+	}
+	return renderBlock("map "+d.Name, r)
+}
+
+// String 以nft格式输出表定义, 不包含表中的集合与链
+func (d *Table) String() string {
+	return renderBlock(fmt.Sprintf("table %s %s", d.familyKeyword(), d.Name), nil)
+}
+
+func (d *Table) familyKeyword() string {
+	if v, ok := familyKeyword[d.Family]; ok {
+		return v
+	}
+	return string(d.Family)
+}
+
+// String 以nft格式输出链及其所有规则
+func (d *ChainSpec) String() string {
+	var r = d.Chain.stmts()
+	for _, rule := range d.Rules {
+		r = append(r, rule.String())
+	}
+	return renderBlock("chain "+d.Chain.Name, r)
+}
+
+// String 以nft格式输出表及其所有集合、映射、链
+func (d *TableSpec) String() string {
+	var blocks []string
+	for _, set := range d.Sets {
+		blocks = append(blocks, set.String())
+	}
+	for _, m := range d.Maps {
+		blocks = append(blocks, m.String())
+	}
+	for _, ch := range d.Chains {
+		blocks = append(blocks, ch.String())
+	}
+	var lines []string
+	if len(blocks) > 0 {
+		lines = []string{strings.Join(blocks, "\n\n")}
+	}
+	return renderBlock(fmt.Sprintf("table %s %s", d.Table.familyKeyword(), d.Table.Name), lines)
+}
+
+// String 以nft list ruleset格式输出完整规则集, 可直接通过nft -f加载
+func (d *Ruleset) String() string {
+	var r []string
+	for _, ts := range d.Tables {
+		r = append(r, ts.String())
+	}
+	return strings.Join(r, "\n")
+}
+
+// DumpRuleset 读取内核中的完整规则集并以nft脚本格式输出
+func (d *Conn) DumpRuleset() (string, error) {
+	rs, err := d.ListRuleset()
+	if err != nil {
+		return "", err
+	}
+	return rs.String(), nil
+}
+
+func (d *Rule) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Chain) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Set) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Map) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Table) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// MarshalJSON 以下MarshalJSON保持结构体原有的JSON格式, 避免encoding/json使用MarshalText编码
+func (d *Rule) MarshalJSON() ([]byte, error) {
+	type rule Rule
+	return json.Marshal((*rule)(d))
+}
+
+func (d *Chain) MarshalJSON() ([]byte, error) {
+	type chain Chain
+	return json.Marshal((*chain)(d))
+}
+
+func (d *Set) MarshalJSON() ([]byte, error) {
+	type set Set
+	return json.Marshal((*set)(d))
+}
+
+func (d *Map) MarshalJSON() ([]byte, error) {
+	type nmap Map
+	return json.Marshal((*nmap)(d))
+}
+
+func (d *Table) MarshalJSON() ([]byte, error) {
+	type table Table
+	return json.Marshal((*table)(d))
+}
+
+// renderBlock 输出 name { ... } 格式的块, 块内每行缩进一个制表符
+func renderBlock(head string, lines []string) string {
+	var b strings.Builder
+	b.WriteString(head + " {\n")
+	for _, line := range lines {
+		for _, l := range strings.Split(line, "\n") {
+			if l != "" {
+				b.WriteString("\t" + l)
+			}
+			b.WriteString("\n")
+		}
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// renderAddr 集合名前加@, 不匹配时加!=, 其他地址格式原样输出
+func renderAddr(addr string) string {
+	if addr, neg := splitNeg(addr); neg {
+		return "!= " + renderAddr(addr)
+	}
+	if isValueList(addr) {
+		return renderList(addr, renderAddr)
+	}
+	if !strings.ContainsAny(addr, "./-: ") {
+		return "@" + addr
+	}
+	return addr
+}
+
+// renderList 以匿名集合的格式输出逗号分隔的列表, 如 { 22, 80 }
+func renderList(list string, elem func(string) string) string {
+	var r []string
+	for _, v := range strings.Split(list, ",") {
+		r = append(r, elem(strings.TrimSpace(v)))
+	}
+	return "{ " + strings.Join(r, ", ") + " }"
+}
+
+// renderIface 输出接口匹配, 接口索引使用iif/oif, 接口名使用iifname/oifname
+func renderIface(key, iface string) string {
+	if iface, neg := splitNeg(iface); neg {
+		return strings.Replace(renderIface(key, iface), " ", " != ", 1)
+	}
+	switch {
+	case isValueList(iface):
+		return key + "name " + renderList(iface, strconv.Quote)
+	case isIfindex(iface):
+		return key + " " + iface
+	case strings.HasPrefix(iface, "@"):
+		return key + "name " + iface
+	}
+	return fmt.Sprintf("%sname %q", key, iface)
+}
+
+func renderPort(port string) string {
+	if port, neg := splitNeg(port); neg {
+		return "!= " + renderPort(port)
+	}
+	if isValueList(port) {
+		return renderList(port, renderPort)
+	}
+	if _, err := strconv.Atoi(port); err != nil && !strings.ContainsAny(port, "./-: ") {
+		return "@" + port
+	}
+	return port
+}
+
+// sortCtStates 按状态位顺序排列连接跟踪状态
+func sortCtStates(states []string) []string {
+	var bits = make(map[string]uint32)
+	for k, v := range ctStateMap {
+		bits[v] = k
+	}
+	r := append([]string{}, states...)
+	sort.SliceStable(r, func(i, j int) bool {
+		return bits[r[i]] < bits[r[j]]
+	})
+	return r
+}
+
+// sortNatFlags 按natFlagList顺序排列nat标志
+func sortNatFlags(flags []string) []string {
+	var idx = make(map[string]int)
+	for i, v := range natFlagList {
+		idx[v] = i
+	}
+	r := append([]string{}, flags...)
+	sort.SliceStable(r, func(i, j int) bool {
+		return idx[r[i]] < idx[r[j]]
+	})
+	return r
+}
+
+// renderMarkStmt 输出标记匹配, 带掩码时为 and <mask> == <value>
+func renderMarkStmt(key, mark string) string {
+	value, mask, err := parseMarkMatch(mark)
+	if err != nil {
+		return key + " " + mark
+	}
+	if mask == 0xffffffff {
+		return fmt.Sprintf("%s 0x%x", key, value)
+	}
+	return fmt.Sprintf("%s and 0x%x == 0x%x", key, mask, value)
+}
+
+// renderMarkValue 以化简后的格式输出标记设置语句的取值
+func renderMarkValue(value string) string {
+	mv, err := parseMarkValue(value)
+	if err != nil {
+		return value
+	}
+	return mv.String()
+}
+
+func renderPriorityValue(prio string) string {
+	v, err := parseMetaPriority(prio)
+	if err != nil {
+		return prio
+	}
+	return renderMetaPriority(v)
+}
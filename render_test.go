@@ -0,0 +1,71 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRule_String(t *testing.T) {
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{
+			rule: &Rule{L3Proto: RuleL3Ip, L3SrcIP: "10.0.0.0/8", L4Proto: RuleL4Tcp, L4DstPort: "22-23",
+				CtStates: []string{RuleCtRelated, RuleCtEstablished}, Action: RuleActAccept},
+			want: "ip saddr 10.0.0.0/8 tcp dport 22-23 ct state established,related accept",
+		},
+		{
+			rule: &Rule{L3Proto: RuleL3Ip6, L3DstIP: "blocklist", Action: RuleActDrop},
+			want: "ip6 daddr @blocklist drop",
+		},
+		{
+			rule: &Rule{L3Proto: RuleL3Ip, L4Proto: RuleL4Icmp, Action: RuleActJump, DstChain: "icmp_in"},
+			want: "ip protocol icmp jump icmp_in",
+		},
+	}
+	for _, c := range cases {
+		if got := c.rule.String(); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+}
+
+func TestRuleset_String(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	ch := &Chain{Table: tbl, Name: "input", Type: ChainTypeFilter, Hook: ChainHookInput, Policy: ChainPolicyDrop}
+	rs := &Ruleset{Tables: []*TableSpec{{
+		Table: tbl,
+		Sets:  []*Set{{Table: tbl, Name: "allow", DType: SetDtypeIpv4, ElemRange: true, Elements: []string{"10.0.0.0/8"}}},
+		Chains: []*ChainSpec{{
+			Chain: ch,
+			Rules: []*Rule{{Chain: ch, L3Proto: RuleL3Ip, L3SrcIP: "allow", Action: RuleActAccept}},
+		}},
+	}}}
+	want := `table inet filter {
+	set allow {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/8 }
+	}
+
+	chain input {
+		type filter hook input priority filter; policy drop;
+		ip saddr @allow accept
+	}
+}`
+	if got := rs.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// MarshalText不能影响JSON编码
+	b, err := json.Marshal(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"table":{"name":"filter","family":"inet"},"name":"input","priority":0,"hook":"input","type":"filter","policy":"drop"}` {
+		t.Errorf("unexpected json %s", b)
+	}
+}
@@ -5,13 +5,15 @@ package nftlib
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"golang.org/x/sys/unix"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -24,11 +26,48 @@ const (
 	RuleL4Udp   = "udp"
 	RuleL4Icmp  = "icmp"
 	RuleL4Icmp6 = "icmp6"
+	// RuleL4Sctp RuleL4Dccp RuleL4UdpLite 与tcp/udp同样可匹配端口
+	RuleL4Sctp    = "sctp"
+	RuleL4Dccp    = "dccp"
+	RuleL4UdpLite = "udplite"
+	RuleL4Gre     = "gre"
+	RuleL4Esp     = "esp"
+	RuleL4Ah      = "ah"
 
 	RuleActAccept = "accept"
 	RuleActDrop   = "drop"
 	RuleActJump   = "jump"
 	RuleActGoto   = "goto"
+	RuleActSnat   = "snat"
+	RuleActDnat   = "dnat"
+	RuleActMasq   = "masquerade"
+	RuleActRedir  = "redirect"
+	RuleActReject = "reject"
+
+	RuleRejectTcpReset = "tcp reset"
+	RuleRejectIcmp     = "icmp"
+	RuleRejectIcmp6    = "icmpv6"
+	RuleRejectIcmpx    = "icmpx"
+
+	RuleLimitSecond = "second"
+	RuleLimitMinute = "minute"
+	RuleLimitHour   = "hour"
+	RuleLimitDay    = "day"
+	RuleLimitWeek   = "week"
+
+	RuleLogTcpSeq = "tcp sequence"
+	RuleLogTcpOpt = "tcp options"
+	RuleLogIpOpt  = "ip options"
+	RuleLogSkUid  = "skuid"
+	RuleLogEther  = "ether"
+	RuleLogAll    = "all"
+
+	RuleNatRandom      = "random"
+	RuleNatFullyRandom = "fully-random"
+	RuleNatPersistent  = "persistent"
+
+	RuleSetOpAdd    = "add"
+	RuleSetOpUpdate = "update"
 
 	RuleCtInvalid     = "invalid"
 	RuleCtEstablished = "established"
@@ -51,6 +90,15 @@ const (
 	curMatchL4SPort  = "l4sport"
 	curMatchL4DPort  = "l4dport"
 	curMatchCtState  = "ctstate"
+	curMatchMetaMark = "metamark"
+	curMatchCtMark   = "ctmark"
+	curMatchCt       = "ct"
+	curMatchMetaPrio = "metaprio"
+	curMatchIifname  = "iifname"
+	curMatchOifname  = "oifname"
+	curMatchHeader   = "header"
+	curMatchIif      = "iif"
+	curMatchOif      = "oif"
 )
 
 var (
@@ -67,28 +115,197 @@ var (
 		expr.VerdictJump:   RuleActJump,
 		expr.VerdictGoto:   RuleActGoto,
 	}
+	// ruleStmts 规则语句的输出顺序, 用于定位无法解析的表达式
+	ruleStmts = []string{"limit", "counter", "log", "meta mark set", "ct mark set", "ct zone set",
+		"meta priority set", "notrack", "set", "vmap", "action"}
+	// natFlagList nat标志的输出顺序
+	natFlagList  = []string{RuleNatRandom, RuleNatFullyRandom, RuleNatPersistent}
+	limitUnitMap = map[string]expr.LimitTime{
+		RuleLimitSecond: expr.LimitTimeSecond,
+		RuleLimitMinute: expr.LimitTimeMinute,
+		RuleLimitHour:   expr.LimitTimeHour,
+		RuleLimitDay:    expr.LimitTimeDay,
+		RuleLimitWeek:   expr.LimitTimeWeek,
+	}
+	// logLevelList 日志级别, 下标为内核中的取值
+	logLevelList = []string{"emerg", "alert", "crit", "err", "warn", "notice", "info", "debug", "audit"}
+	logFlagMap   = map[string]expr.LogFlags{
+		RuleLogTcpSeq: expr.LogFlagsTCPSeq,
+		RuleLogTcpOpt: expr.LogFlagsTCPOpt,
+		RuleLogIpOpt:  expr.LogFlagsIPOpt,
+		RuleLogSkUid:  expr.LogFlagsUID,
+		RuleLogEther:  expr.LogFlagsMACDecode,
+	}
+	// rejectCodes 各reject类型支持的icmp代码
+	rejectCodes = map[string]map[string]uint8{
+		RuleRejectIcmp: {
+			"net-unreachable":  0,
+			"host-unreachable": 1,
+			"prot-unreachable": 2,
+			"port-unreachable": 3,
+			"net-prohibited":   9,
+			"host-prohibited":  10,
+			"admin-prohibited": 13,
+		},
+		RuleRejectIcmp6: {
+			"no-route":         0,
+			"admin-prohibited": 1,
+			"addr-unreachable": 3,
+			"port-unreachable": 4,
+			"policy-fail":      5,
+			"reject-route":     6,
+		},
+		RuleRejectIcmpx: {
+			"no-route":         unix.NFT_REJECT_ICMPX_NO_ROUTE,
+			"port-unreachable": unix.NFT_REJECT_ICMPX_PORT_UNREACH,
+			"host-unreachable": unix.NFT_REJECT_ICMPX_HOST_UNREACH,
+			"admin-prohibited": unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED,
+		},
+	}
 )
 
 type Rule struct {
-	conn   *Conn
-	Chain  *Chain `json:"-"`
-	Handle uint64 `json:"handle,omitempty"`
+	conn *Conn
+	// anonSets toNRule生成的匿名集合, 需在规则之前加入同一批次
+	anonSets []*anonSet
+	Chain    *Chain `json:"-"`
+	Handle   uint64 `json:"handle,omitempty"`
+	// InIface OutIface 入/出接口 e.g.: eth0 or eth* (前缀匹配) or @setname or 2 (接口索引) or !eth0 (不匹配) or eth0,eth1
+	InIface  string `json:"in_iface,omitempty"`
+	OutIface string `json:"out_iface,omitempty"`
 	// L3Proto ipv4 or ipv6
 	L3Proto string `json:"l3proto,omitempty"`
-	// SrcIP DstIP e.g.: 1.1.1.1 or 1.1.1.1-1.1.1.100 or 1.1.1.0/24 or setname
+	// SrcIP DstIP e.g.: 1.1.1.1 or 1.1.1.1-1.1.1.100 or 1.1.1.0/24 or setname, 以!开头表示不匹配 e.g.: !10.0.0.0/8
+	// 逗号分隔的列表使用匿名集合匹配 e.g.: 10.0.0.1,192.168.0.0/16
 	L3SrcIP string `json:"src_ip,omitempty"`
 	L3DstIP string `json:"dst_ip,omitempty"`
-	// L4Proto tcp or udp
+	// L4Proto 协议名或协议号 e.g.: tcp or sctp or gre or 47 or /etc/protocols中的名称
+	// 仅tcp/udp/sctp/dccp/udplite可匹配端口, 不匹配端口时可以!开头表示不匹配 e.g.: !tcp
 	L4Proto string `json:"l4proto,omitempty"`
-	// SrcPort DstPort e.g.: 3306 or 3306-3307
+	// SrcPort DstPort e.g.: 3306 or 3306-3307 or setname or 22,80,8000-8100, 以!开头表示不匹配 e.g.: !22
 	L4SrcPort string `json:"src_port,omitempty"`
 	L4DstPort string `json:"dst_port,omitempty"`
 	// CtStates one of [established,related,new,invalid,untracked]
 	CtStates []string `json:"ct_states,omitempty"`
+	// CtStatesNeg 为true时匹配CtStates均不成立 e.g.: ct state != established,related
+	CtStatesNeg bool `json:"ct_states_neg,omitempty"`
+	// CtMatches 连接跟踪字段匹配 e.g.: ct status dnat or ct zone 1 or ct reply saddr 10.0.0.1
+	CtMatches []RuleCt `json:"ct_matches,omitempty"`
+	// CtCount 连接数限制 e.g.: ct count over 10
+	CtCount *RuleCtCount `json:"ct_count,omitempty"`
 	// Action one of [accept,drop,jump,goto]
 	Action string `json:"action,omitempty"`
 	// DstChain chain of goto/jump action destination
 	DstChain string `json:"dst_chain,omitempty"`
+	// NatAddr snat/dnat转换地址 e.g.: 1.1.1.1 or 1.1.1.1-1.1.1.10
+	NatAddr string `json:"nat_addr,omitempty"`
+	// NatPort snat/dnat/masquerade/redirect转换端口 e.g.: 8080 or 8080-8090
+	NatPort string `json:"nat_port,omitempty"`
+	// NatFlags some of [random,fully-random,persistent]
+	NatFlags []string `json:"nat_flags,omitempty"`
+	// RejectKind one of [tcp reset,icmp,icmpv6,icmpx], 为空时使用协议族默认的端口不可达
+	RejectKind string `json:"reject_kind,omitempty"`
+	// RejectCode icmp代码 e.g.: port-unreachable or admin-prohibited
+	RejectCode string `json:"reject_code,omitempty"`
+	// MetaMark CtMark 匹配包标记与连接标记 e.g.: 0x1 or 0x1/0xff(标记/掩码)
+	MetaMark string `json:"meta_mark,omitempty"`
+	CtMark   string `json:"ct_mark,omitempty"`
+	// MetaPriority 匹配skb优先级, tc句柄格式 e.g.: 1:10
+	MetaPriority string `json:"meta_priority,omitempty"`
+	// MetaMarkSet CtMarkSet 设置包标记与连接标记 e.g.: 0x1 or ct mark or meta mark and 0xff
+	MetaMarkSet string `json:"meta_mark_set,omitempty"`
+	CtMarkSet   string `json:"ct_mark_set,omitempty"`
+	// CtZoneSet 设置连接跟踪区域 e.g.: 1
+	CtZoneSet string `json:"ct_zone_set,omitempty"`
+	// MetaPrioritySet 设置skb优先级 e.g.: 1:10
+	MetaPrioritySet string `json:"meta_priority_set,omitempty"`
+	// Notrack 不对匹配的数据包进行连接跟踪
+	Notrack bool `json:"notrack,omitempty"`
+	// Limit Counter Log 在动作之前依次执行的语句
+	Limit   *RuleLimit   `json:"limit,omitempty"`
+	Counter *RuleCounter `json:"counter,omitempty"`
+	Log     *RuleLog     `json:"log,omitempty"`
+	// VMap 以查找键在verdict map中查找并执行对应的动作, 不能与Action同时使用 e.g.: tcp dport vmap { 22 : jump ssh }
+	VMap *RuleMap `json:"vmap,omitempty"`
+	// NatMap snat/dnat以查找键在映射中查找转换地址, 不能与NatAddr、NatPort同时使用
+	NatMap *RuleMap `json:"nat_map,omitempty"`
+	// Concat 以多个字段拼接的键匹配集合 e.g.: ip saddr . tcp dport @allow
+	Concat *RuleConcat `json:"concat,omitempty"`
+	// Headers 协议头字段匹配 e.g.: tcp flags & (syn|ack) == syn or icmp type echo-request
+	Headers []RuleHeader `json:"headers,omitempty"`
+	// SetUpdate 以匹配的字段向动态集合添加或更新元素 e.g.: add @blk { ip saddr timeout 10m }
+	SetUpdate *RuleSetUpdate `json:"set_update,omitempty"`
+	// Raw 读取规则时无法解析的表达式, toNRule在原来的位置写回
+	// 文本输出为 raw 加表达式的编码, 无法编码为JSON或保存到快照
+	Raw []RuleRaw `json:"-"`
+}
+
+// RuleRaw 规则中一段无法解析的表达式
+type RuleRaw struct {
+	// After 表达式之前的最后一个语句, 取值同ruleStmts, 为空时位于匹配之后
+	After string
+	Exprs []expr.Any
+}
+
+// RuleSetUpdate 集合更新语句
+type RuleSetUpdate struct {
+	// Op one of [add,update], update在元素已存在时刷新其超时
+	Op string `json:"op"`
+	// Set 集合名称
+	Set string `json:"set"`
+	// Keys 元素的字段, 取值同RuleConcat.Keys, 多个字段时集合为拼接类型
+	Keys []string `json:"keys"`
+	// Timeout 元素超时时间, 为0时使用集合的默认超时
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// RuleConcat 拼接匹配
+type RuleConcat struct {
+	// Keys 拼接的字段, 取值同RuleMap.Key, 另支持 meta l4proto, th sport, th dport
+	Keys []string `json:"keys"`
+	// Value @开头为集合名称, 否则为逗号分隔的元素列表, 如 10.0.0.1 . 22,10.0.0.2 . 80, 以!开头表示不匹配
+	Value string `json:"value"`
+}
+
+// RuleMap 规则引用的映射, Name为空时以Elements创建匿名映射
+type RuleMap struct {
+	// Key 查找键 one of [ip saddr,ip daddr,ip6 saddr,ip6 daddr,tcp sport,tcp dport,udp sport,udp dport,iifname,oifname], sctp/dccp/udplite的端口同tcp
+	Key      string       `json:"key"`
+	Name     string       `json:"name,omitempty"`
+	Elements []MapElement `json:"elements,omitempty"`
+}
+
+// anonSet 规则中取值列表对应的匿名常量集合, 加入批次后回填lookup的集合名与ID
+type anonSet struct {
+	set    *nftables.Set
+	elems  []nftables.SetElement
+	lookup *expr.Lookup
+}
+
+// RuleCounter 计数器, ListRule返回内核中的当前计数
+type RuleCounter struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// RuleLog 日志, 设置Group时通过nflog发送到用户态, 此时Level与Flags无效
+type RuleLog struct {
+	Prefix string `json:"prefix,omitempty"`
+	// Level one of [emerg,alert,crit,err,warn,notice,info,debug,audit], 默认warn
+	Level   string  `json:"level,omitempty"`
+	Group   *uint16 `json:"group,omitempty"`
+	Snaplen uint32  `json:"snaplen,omitempty"`
+	// Flags some of [tcp sequence,tcp options,ip options,skuid,ether,all]
+	Flags []string `json:"flags,omitempty"`
+}
+
+// RuleLimit 速率限制, Over为true时匹配超出速率的包
+type RuleLimit struct {
+	Rate uint64 `json:"rate"`
+	// Unit one of [second,minute,hour,day,week]
+	Unit  string `json:"unit"`
+	Burst uint32 `json:"burst,omitempty"`
+	Over  bool   `json:"over,omitempty"`
 }
 
 func (d *Rule) SetL3Proto(proto string) *Rule {
@@ -198,6 +415,13 @@ func (d *Rule) SetCt(cts ...string) *Rule {
 	return d
 }
 
+// SetCtNeg 匹配连接跟踪状态均不成立, 如 ct state != established
+func (d *Rule) SetCtNeg(cts ...string) *Rule {
+	d.CtStates = cts
+	d.CtStatesNeg = true
+	return d
+}
+
 func (d *Rule) SetAccept() *Rule {
 	d.Action = RuleActAccept
 	return d
@@ -220,21 +444,393 @@ func (d *Rule) SetGoto(tochain string) *Rule {
 	return d
 }
 
+// SetSNAT 源地址转换, addr为IPv4/IPv6地址或地址范围, portRange为空时不转换端口
+func (d *Rule) SetSNAT(addr, portRange string, flags ...string) *Rule {
+	d.Action = RuleActSnat
+	d.NatAddr, d.NatPort, d.NatFlags = addr, portRange, flags
+	return d
+}
+
+// SetDNAT 目标地址转换, addr为IPv4/IPv6地址或地址范围, portRange为空时不转换端口
+func (d *Rule) SetDNAT(addr, portRange string, flags ...string) *Rule {
+	d.Action = RuleActDnat
+	d.NatAddr, d.NatPort, d.NatFlags = addr, portRange, flags
+	return d
+}
+
+// SetMasquerade 源地址转换为出接口地址
+// opts为random/fully-random/persistent标志, 其他值作为转换端口或端口范围
+func (d *Rule) SetMasquerade(opts ...string) *Rule {
+	d.Action = RuleActMasq
+	d.NatAddr, d.NatPort, d.NatFlags = "", "", nil
+	for _, opt := range opts {
+		if isNatFlag(opt) {
+			d.NatFlags = append(d.NatFlags, opt)
+		} else {
+			d.NatPort = opt
+		}
+	}
+	return d
+}
+
+// SetRedirect 重定向到本机端口, port为端口或端口范围
+func (d *Rule) SetRedirect(port string) *Rule {
+	d.Action = RuleActRedir
+	d.NatAddr, d.NatPort, d.NatFlags = "", port, nil
+	return d
+}
+
+// SetVMap 以key查找verdict map, name为映射名, 为空时以elems创建匿名映射
+// 如 SetVMap("tcp dport", "", MapElement{"22", "jump ssh"}), 同时设置key对应的L3/L4协议
+func (d *Rule) SetVMap(key, name string, elems ...MapElement) *Rule {
+	d.VMap = &RuleMap{Key: key, Name: name, Elements: elems}
+	d.Action, d.DstChain = "", ""
+	_ = d.useMapKey(key)
+	return d
+}
+
+// SetSNATMap 以key查找映射得到源地址转换地址, name与elems同SetVMap
+func (d *Rule) SetSNATMap(key, name string, elems ...MapElement) *Rule {
+	d.Action = RuleActSnat
+	d.NatAddr, d.NatPort = "", ""
+	d.NatMap = &RuleMap{Key: key, Name: name, Elements: elems}
+	_ = d.useMapKey(key)
+	return d
+}
+
+// SetDNATMap 以key查找映射得到目标地址转换地址, name与elems同SetVMap
+func (d *Rule) SetDNATMap(key, name string, elems ...MapElement) *Rule {
+	d.Action = RuleActDnat
+	d.NatAddr, d.NatPort = "", ""
+	d.NatMap = &RuleMap{Key: key, Name: name, Elements: elems}
+	_ = d.useMapKey(key)
+	return d
+}
+
+// SetConcat 以拼接键匹配集合, 如 SetConcat([]string{"ip saddr", "tcp dport"}, "@allow"), 同时设置键对应的L3/L4协议
+func (d *Rule) SetConcat(keys []string, value string) *Rule {
+	d.Concat = &RuleConcat{Keys: keys, Value: value}
+	_ = d.useConcat(keys)
+	return d
+}
+
+// SetSetUpdate 以keys组成元素添加或更新到集合name, op为RuleSetOpAdd或RuleSetOpUpdate, 同时设置键对应的L3/L4协议
+func (d *Rule) SetSetUpdate(op, name string, keys []string, timeout time.Duration) *Rule {
+	d.SetUpdate = &RuleSetUpdate{Op: op, Set: name, Keys: keys, Timeout: timeout}
+	_ = d.useConcat(keys)
+	return d
+}
+
+// AddHeader 添加协议头字段匹配, 如 AddHeader("tcp flags", "syn|ack", "==", "syn")
+func (d *Rule) AddHeader(field, mask, op, value string) *Rule {
+	d.Headers = append(d.Headers, RuleHeader{Field: field, Mask: mask, Op: op, Value: value})
+	if f, ok := ruleHeaderFields[field]; ok {
+		_ = d.useKeyProto(ruleMapKey{l3: f.l3, l4: f.l4})
+	}
+	return d
+}
+
+// SetInIface 匹配入接口, name为接口名, 以*结尾表示前缀匹配, @开头表示接口名集合, 纯数字表示接口索引
+func (d *Rule) SetInIface(name string) *Rule {
+	d.InIface = name
+	return d
+}
+
+// SetOutIface 匹配出接口, 格式同SetInIface
+func (d *Rule) SetOutIface(name string) *Rule {
+	d.OutIface = name
+	return d
+}
+
+// SetMetaMark 匹配包标记, mark为标记或 标记/掩码
+func (d *Rule) SetMetaMark(mark string) *Rule {
+	d.MetaMark = mark
+	return d
+}
+
+// SetCtMark 匹配连接标记, mark为标记或 标记/掩码
+func (d *Rule) SetCtMark(mark string) *Rule {
+	d.CtMark = mark
+	return d
+}
+
+// AddCtMatch 添加连接跟踪字段匹配, 如 AddCtMatch("expiration", "<", "30s")
+func (d *Rule) AddCtMatch(key, op, value string) *Rule {
+	d.CtMatches = append(d.CtMatches, RuleCt{Key: key, Op: op, Value: value})
+	return d
+}
+
+// SetCtCount 匹配连接数, over为true时匹配超过count
+func (d *Rule) SetCtCount(count uint32, over bool) *Rule {
+	d.CtCount = &RuleCtCount{Count: count, Over: over}
+	return d
+}
+
+// SetMetaPriority 匹配skb优先级, 如 1:10
+func (d *Rule) SetMetaPriority(prio string) *Rule {
+	d.MetaPriority = prio
+	return d
+}
+
+// SetMetaMarkSet 设置包标记, value为立即数或 ct mark [and|or|xor <n>]
+func (d *Rule) SetMetaMarkSet(value string) *Rule {
+	d.MetaMarkSet = value
+	return d
+}
+
+// SetCtMarkSet 设置连接标记, value为立即数或 meta mark [and|or|xor <n>]
+func (d *Rule) SetCtMarkSet(value string) *Rule {
+	d.CtMarkSet = value
+	return d
+}
+
+// SetCtZoneSet 设置连接跟踪区域
+func (d *Rule) SetCtZoneSet(zone string) *Rule {
+	d.CtZoneSet = zone
+	return d
+}
+
+// SetMetaPrioritySet 设置skb优先级, 如 1:10
+func (d *Rule) SetMetaPrioritySet(prio string) *Rule {
+	d.MetaPrioritySet = prio
+	return d
+}
+
+// SetNotrack 不对匹配的数据包进行连接跟踪
+func (d *Rule) SetNotrack() *Rule {
+	d.Notrack = true
+	return d
+}
+
+// SetCounter 统计匹配规则的包数与字节数
+func (d *Rule) SetCounter() *Rule {
+	d.Counter = new(RuleCounter)
+	return d
+}
+
+// SetLog 记录匹配规则的包
+func (d *Rule) SetLog(log *RuleLog) *Rule {
+	d.Log = log
+	return d
+}
+
+// SetLimit 限制匹配规则的速率, 如 SetLimit(10, RuleLimitSecond, 20, false)
+func (d *Rule) SetLimit(rate uint64, unit string, burst uint32, over bool) *Rule {
+	d.Limit = &RuleLimit{Rate: rate, Unit: unit, Burst: burst, Over: over}
+	return d
+}
+
+// SetReject 拒绝并回应, kind为tcp reset/icmp/icmpv6/icmpx, code为icmp代码, 为空时为port-unreachable
+func (d *Rule) SetReject(kind, code string) *Rule {
+	d.Action = RuleActReject
+	d.RejectKind, d.RejectCode = kind, code
+	return d
+}
+
+// rejectDefault 未指定类型时内核使用的reject类型, ip/ip6表为icmp/icmpv6, 其他表为icmpx
+func (d *Rule) rejectDefault() string {
+	if d.Chain != nil && d.Chain.Table != nil {
+		switch d.Chain.Table.Family {
+		case TableFamilyIpv4:
+			return RuleRejectIcmp
+		case TableFamilyIpv6:
+			return RuleRejectIcmp6
+		}
+	}
+	return RuleRejectIcmpx
+}
+
+// headerL3 解析协议头字段时的L3协议, ip/ip6表中的规则不含L3协议匹配
+func (d *Rule) headerL3() string {
+	if d.L3Proto != "" || d.Chain == nil || d.Chain.Table == nil {
+		return d.L3Proto
+	}
+	switch d.Chain.Table.Family {
+	case TableFamilyIpv4:
+		return RuleL3Ip
+	case TableFamilyIpv6:
+		return RuleL3Ip6
+	}
+	return ""
+}
+
+// natFamily snat/dnat的地址族, 依次由转换地址或匿名映射中的地址、L3协议、表协议族确定
+func (d *Rule) natFamily() byte {
+	addr := d.NatAddr
+	if d.NatMap != nil && len(d.NatMap.Elements) > 0 {
+		addr = d.NatMap.Elements[0].Value
+	}
+	if addr != "" {
+		ip := net.ParseIP(strings.SplitN(addr, "-", 2)[0])
+		if ip != nil && ip.To4() == nil {
+			return unix.NFPROTO_IPV6
+		}
+		return unix.NFPROTO_IPV4
+	}
+	if d.L3Proto == RuleL3Ip6 {
+		return unix.NFPROTO_IPV6
+	}
+	if d.Chain != nil && d.Chain.Table != nil && d.Chain.Table.Family == TableFamilyIpv6 {
+		return unix.NFPROTO_IPV6
+	}
+	return unix.NFPROTO_IPV4
+}
+
+// parseRejectExpr 校验reject类型与代码, tcp reset仅能用于tcp规则
+func (d *Rule) parseRejectExpr() (*expr.Reject, error) {
+	kind, code := d.RejectKind, d.RejectCode
+	if kind == "" {
+		kind = d.rejectDefault()
+	}
+	if kind == RuleRejectTcpReset {
+		if d.L4Proto != RuleL4Tcp {
+			return nil, fmt.Errorf("reject with tcp reset requires l4 protocol tcp, got %q", d.L4Proto)
+		}
+		if code != "" {
+			return nil, fmt.Errorf("reject with tcp reset does not take a code, got %q", code)
+		}
+		return &expr.Reject{Type: unix.NFT_REJECT_TCP_RST}, nil
+	}
+	codes, ok := rejectCodes[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w: reject with %s", ErrUnsupportedExpr, kind)
+	}
+	if code == "" {
+		code = "port-unreachable"
+	}
+	n, ok := codes[code]
+	if !ok {
+		// 未命名的代码以数字表示
+		v, err := strconv.ParseUint(code, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reject with %s type %s", ErrUnsupportedExpr, kind, code)
+		}
+		n = uint8(v)
+	}
+	typ := uint32(unix.NFT_REJECT_ICMP_UNREACH)
+	if kind == RuleRejectIcmpx {
+		typ = unix.NFT_REJECT_ICMPX_UNREACH
+	}
+	return &expr.Reject{Type: typ, Code: n}, nil
+}
+
+// rejectKind 由reject表达式解析类型与代码, 协议族默认的端口不可达解析为空
+func (d *Rule) rejectKind(typ uint32, code uint8) (string, string) {
+	var kind string
+	switch typ {
+	case unix.NFT_REJECT_TCP_RST:
+		return RuleRejectTcpReset, ""
+	case unix.NFT_REJECT_ICMPX_UNREACH:
+		kind = RuleRejectIcmpx
+	default:
+		// icmp与icmpv6共用类型, 由L3协议或表协议族区分
+		kind = RuleRejectIcmp
+		if d.L3Proto == RuleL3Ip6 || d.rejectDefault() == RuleRejectIcmp6 {
+			kind = RuleRejectIcmp6
+		}
+	}
+	for k, v := range rejectCodes[kind] {
+		if v != code {
+			continue
+		}
+		if k == "port-unreachable" && kind == d.rejectDefault() {
+			return "", ""
+		}
+		return kind, k
+	}
+	return kind, strconv.Itoa(int(code))
+}
+
+func isNatFlag(flag string) bool {
+	for _, v := range natFlagList {
+		if v == flag {
+			return true
+		}
+	}
+	return false
+}
+
 // toRule 解析nftables规则到rule结构体
-// TODO:toRule目前只返回nil错误，后续增加更完善的错误处理
+// 无法解析的表达式保留在Raw中, 连接开启StrictDecode时返回DecodeError
 func (d *Rule) toRule(nrule nftables.Rule) error {
 	var (
 		curMatch                         string
 		curMask                          net.IPMask
 		curRangeIpMin, curRangeIpMax     net.IP
 		curRangePortMin, curRangePortMax uint16
+		// regs 立即数写入的寄存器, 用于解析nat地址与端口
+		regs = make(map[uint32][]byte)
+		// curLoad curBtw 最近加载到寄存器的标记及其位运算, 用于解析标记设置语句
+		curLoad string
+		curBtw  *expr.Bitwise
+		// maps 映射查找结果写入的寄存器, 用于解析nat映射
+		maps = make(map[uint32]*RuleMap)
+		// curHdr curHdrBtw 最近加载的协议头字段及其位运算
+		curHdr    string
+		curHdrBtw *expr.Bitwise
+		// curCt curCtBtw curCtHton 最近加载的连接跟踪字段及其位运算与字节序转换
+		curCt     string
+		curCtBtw  *expr.Bitwise
+		curCtHton bool
+		// loadIdx 最近的加载表达式位置, rawEnd 已保留到Raw的表达式结束位置
+		loadIdx, rawEnd int
 	)
 	d.Handle = nrule.Handle
+	d.Raw = nil
 	for i := 0; i < len(nrule.Exprs); i++ {
 		exp := nrule.Exprs[i]
+		// 拼接匹配与集合更新由多个加载表达式与集合查找或更新组成
+		n, err := d.toRuleKeys(nrule.Exprs[i:])
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			i += n - 1
+			continue
+		}
+		if isLoadExpr(exp) {
+			loadIdx = i
+		}
 		switch exp.(type) {
 		case *expr.Meta:
 			meta := exp.(*expr.Meta)
+			if meta.SourceRegister && meta.Key == expr.MetaKeyMARK {
+				d.MetaMarkSet = markSetValue(curLoad, curBtw, regs[meta.Register])
+				curLoad, curBtw = "", nil
+				continue
+			}
+			if meta.SourceRegister && meta.Key == expr.MetaKeyPRIORITY {
+				if v := regs[meta.Register]; len(v) == 4 {
+					d.MetaPrioritySet = renderMetaPriority(binaryutil.NativeEndian.Uint32(v))
+					curLoad, curBtw = "", nil
+					continue
+				}
+			}
+			if meta.SourceRegister {
+				break
+			}
+			if meta.Key == expr.MetaKeyMARK {
+				curMatch, curLoad, curBtw = curMatchMetaMark, "meta mark", nil
+				continue
+			}
+			switch meta.Key {
+			case expr.MetaKeyIIFNAME:
+				curMatch = curMatchIifname
+				continue
+			case expr.MetaKeyOIFNAME:
+				curMatch = curMatchOifname
+				continue
+			case expr.MetaKeyIIF:
+				curMatch = curMatchIif
+				continue
+			case expr.MetaKeyOIF:
+				curMatch = curMatchOif
+				continue
+			}
+			if meta.Key == expr.MetaKeyPRIORITY {
+				curMatch = curMatchMetaPrio
+				continue
+			}
 			if meta.Key == expr.MetaKeyNFPROTO {
 				curMatch = curMatchL3Proto
 				continue
@@ -245,24 +841,68 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 			}
 		case *expr.Cmp:
 			cmp := exp.(*expr.Cmp)
-			if curMatch == curMatchL3Proto {
+			if curMatch == curMatchHeader {
+				if h, ok := toRuleHeader(curHdr, curHdrBtw, cmp.Op, cmp.Data, cmp.Data); ok {
+					d.Headers = append(d.Headers, h)
+					continue
+				}
+				break
+			}
+			if curMatch == curMatchCt {
+				if c, ok := toRuleCt(curCt, curCtBtw, curCtHton, cmp); ok {
+					d.CtMatches = append(d.CtMatches, c)
+					continue
+				}
+				break
+			}
+			if (curMatch == curMatchMetaMark || curMatch == curMatchCtMark) && len(cmp.Data) == 4 {
+				mask := uint32(0xffffffff)
+				if curBtw != nil && len(curBtw.Mask) == 4 {
+					mask = binaryutil.NativeEndian.Uint32(curBtw.Mask)
+				}
+				mark := renderMarkMatch(binaryutil.NativeEndian.Uint32(cmp.Data), mask)
+				if curMatch == curMatchMetaMark {
+					d.MetaMark = mark
+				} else {
+					d.CtMark = mark
+				}
+				curLoad, curBtw = "", nil
+				continue
+			}
+			neg := negPrefix(cmp.Op == expr.CmpOpNeq)
+			switch {
+			case curMatch == curMatchIifname:
+				d.InIface = neg + ifnameString(cmp.Data)
+				continue
+			case curMatch == curMatchOifname:
+				d.OutIface = neg + ifnameString(cmp.Data)
+				continue
+			case curMatch == curMatchIif && len(cmp.Data) == 4:
+				d.InIface = neg + strconv.FormatUint(uint64(binaryutil.NativeEndian.Uint32(cmp.Data)), 10)
+				continue
+			case curMatch == curMatchOif && len(cmp.Data) == 4:
+				d.OutIface = neg + strconv.FormatUint(uint64(binaryutil.NativeEndian.Uint32(cmp.Data)), 10)
+				continue
+			}
+			if curMatch == curMatchMetaPrio && len(cmp.Data) == 4 {
+				d.MetaPriority = renderMetaPriority(binaryutil.NativeEndian.Uint32(cmp.Data))
+				continue
+			}
+			if curMatch == curMatchL3Proto && cmp.Op == expr.CmpOpEq {
 				if bytes.Equal(cmp.Data, []byte{unix.NFPROTO_IPV4}) {
 					d.L3Proto = RuleL3Ip
+					continue
 				} else if bytes.Equal(cmp.Data, []byte{unix.NFPROTO_IPV6}) {
 					d.L3Proto = RuleL3Ip6
+					continue
 				}
+			}
+			if curMatch == curMatchL4Proto && len(cmp.Data) == 1 && (cmp.Op == expr.CmpOpEq || cmp.Op == expr.CmpOpNeq) {
+				d.L4Proto = neg + l4ProtoName(cmp.Data[0])
 				continue
 			}
-			if curMatch == curMatchL4Proto {
-				if bytes.Equal(cmp.Data, []byte{unix.IPPROTO_TCP}) {
-					d.L4Proto = RuleL4Tcp
-				} else if bytes.Equal(cmp.Data, []byte{unix.IPPROTO_UDP}) {
-					d.L4Proto = RuleL4Udp
-				} else if bytes.Equal(cmp.Data, []byte{unix.IPPROTO_ICMP}) {
-					d.L4Proto = RuleL4Icmp
-				} else if bytes.Equal(cmp.Data, []byte{unix.IPPROTO_ICMPV6}) {
-					d.L4Proto = RuleL4Icmp6
-				}
+			if curMatch == curMatchCtState && (cmp.Op == expr.CmpOpNeq || cmp.Op == expr.CmpOpEq) {
+				d.CtStatesNeg = cmp.Op == expr.CmpOpEq
 				continue
 			}
 			if curMatch == curMatchL3SAddr || curMatch == curMatchL3SAddr6 {
@@ -272,13 +912,13 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 					curRangeIpMin = ip
 				case expr.CmpOpLte:
 					curRangeIpMax = ip
-				case expr.CmpOpEq:
+				case expr.CmpOpEq, expr.CmpOpNeq:
 					if curMask != nil {
 						one, _ := curMask.Size()
-						d.L3SrcIP = fmt.Sprintf("%s/%d", ip.String(), one)
+						d.L3SrcIP = fmt.Sprintf("%s%s/%d", neg, ip.String(), one)
 						curMask = nil
 					} else {
-						d.L3SrcIP = ip.String()
+						d.L3SrcIP = neg + ip.String()
 					}
 				}
 				if curRangeIpMin != nil && curRangeIpMax != nil {
@@ -295,13 +935,13 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 					curRangeIpMin = ip
 				case expr.CmpOpLte:
 					curRangeIpMax = ip
-				case expr.CmpOpEq:
+				case expr.CmpOpEq, expr.CmpOpNeq:
 					if curMask != nil {
 						one, _ := curMask.Size()
-						d.L3DstIP = fmt.Sprintf("%s/%d", ip.String(), one)
+						d.L3DstIP = fmt.Sprintf("%s%s/%d", neg, ip.String(), one)
 						curMask = nil
 					} else {
-						d.L3DstIP = ip.String()
+						d.L3DstIP = neg + ip.String()
 					}
 					continue
 				}
@@ -318,8 +958,8 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 					curRangePortMin = binary.BigEndian.Uint16(cmp.Data)
 				case expr.CmpOpLte:
 					curRangePortMax = binary.BigEndian.Uint16(cmp.Data)
-				case expr.CmpOpEq:
-					d.L4SrcPort = fmt.Sprintf("%d", binary.BigEndian.Uint16(cmp.Data))
+				case expr.CmpOpEq, expr.CmpOpNeq:
+					d.L4SrcPort = fmt.Sprintf("%s%d", neg, binary.BigEndian.Uint16(cmp.Data))
 					continue
 				}
 				if curRangePortMin != 0 && curRangePortMax != 0 {
@@ -333,8 +973,8 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 					curRangePortMin = binary.BigEndian.Uint16(cmp.Data)
 				case expr.CmpOpLte:
 					curRangePortMax = binary.BigEndian.Uint16(cmp.Data)
-				case expr.CmpOpEq:
-					d.L4DstPort = fmt.Sprintf("%d", binary.BigEndian.Uint16(cmp.Data))
+				case expr.CmpOpEq, expr.CmpOpNeq:
+					d.L4DstPort = fmt.Sprintf("%s%d", neg, binary.BigEndian.Uint16(cmp.Data))
 					continue
 				}
 				if curRangePortMin != 0 && curRangePortMax != 0 {
@@ -344,28 +984,57 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 			}
 		case *expr.Payload:
 			pld := exp.(*expr.Payload)
+			if pld.OperationType != expr.PayloadLoad {
+				break
+			}
 			if pld.Base == expr.PayloadBaseNetworkHeader {
-				if pld.Offset == 12 && pld.Len == 4 {
+				switch {
+				case pld.Offset == 12 && pld.Len == 4:
 					curMatch = curMatchL3SAddr
-				} else if pld.Offset == 16 && pld.Len == 4 {
+					continue
+				case pld.Offset == 16 && pld.Len == 4:
 					curMatch = curMatchL3DAddr
-				} else if pld.Offset == 8 && pld.Len == 16 {
+					continue
+				case pld.Offset == 8 && pld.Len == 16:
 					curMatch = curMatchL3SAddr6
-				} else if pld.Offset == 24 && pld.Len == 16 {
+					continue
+				case pld.Offset == 24 && pld.Len == 16:
 					curMatch = curMatchL3DAddr6
+					continue
+				case pld.Len == 1 && (d.L3Proto == RuleL3Ip && pld.Offset == 9 || d.L3Proto == RuleL3Ip6 && pld.Offset == 6):
+					curMatch = curMatchL4Proto
+					continue
 				}
-				continue
 			}
 			if pld.Base == expr.PayloadBaseTransportHeader {
-				if pld.Offset == 0 && pld.Len == 2 {
+				switch {
+				case pld.Offset == 0 && pld.Len == 2:
 					curMatch = curMatchL4SPort
-				} else if pld.Offset == 2 && pld.Len == 2 {
+					continue
+				case pld.Offset == 2 && pld.Len == 2:
 					curMatch = curMatchL4DPort
+					continue
 				}
+			}
+			if name, ok := headerFieldOf(pld, d.headerL3(), d.L4Proto); ok {
+				curMatch, curHdr, curHdrBtw = curMatchHeader, name, nil
+				_ = d.useKeyProto(ruleMapKey{l3: ruleHeaderFields[name].l3})
 				continue
 			}
 		case *expr.Bitwise:
 			btw := exp.(*expr.Bitwise)
+			if curMatch == curMatchHeader && curHdrBtw == nil {
+				curHdrBtw = btw
+				continue
+			}
+			if curMatch == curMatchMetaMark || curMatch == curMatchCtMark {
+				curBtw = btw
+				continue
+			}
+			if curMatch == curMatchCt && curCtBtw == nil && !curCtHton {
+				curCtBtw = btw
+				continue
+			}
 			if curMatch == curMatchL3SAddr || curMatch == curMatchL3DAddr ||
 				curMatch == curMatchL3SAddr6 || curMatch == curMatchL3DAddr6 {
 				curMask = btw.Mask
@@ -382,83 +1051,282 @@ func (d *Rule) toRule(nrule nftables.Rule) error {
 			}
 		case *expr.Range:
 			rg := exp.(*expr.Range)
-			if curMatch == curMatchL3SAddr {
-				start := net.IP(rg.FromData[4:])
-				end := net.IP(rg.ToData[4:])
-				d.L3SrcIP = fmt.Sprintf("%s-%s", start.String(), end.String())
-				continue
+			if curMatch == curMatchHeader && (rg.Op == expr.CmpOpEq || rg.Op == expr.CmpOpNeq) {
+				if h, ok := toRuleHeader(curHdr, curHdrBtw, rg.Op, rg.FromData, rg.ToData); ok {
+					d.Headers = append(d.Headers, h)
+					continue
+				}
+				break
 			}
-			if curMatch == curMatchL3DAddr {
-				start := net.IP(rg.FromData[4:])
-				end := net.IP(rg.ToData[4:])
-				d.L3DstIP = fmt.Sprintf("%s-%s", start.String(), end.String())
+			neg := negPrefix(rg.Op == expr.CmpOpNeq)
+			if curMatch == curMatchL3SAddr || curMatch == curMatchL3SAddr6 ||
+				curMatch == curMatchL3DAddr || curMatch == curMatchL3DAddr6 {
+				size := net.IPv4len
+				if curMatch == curMatchL3SAddr6 || curMatch == curMatchL3DAddr6 {
+					size = net.IPv6len
+				}
+				start := net.IP(rangeData(rg.FromData, size))
+				end := net.IP(rangeData(rg.ToData, size))
+				if curMatch == curMatchL3SAddr || curMatch == curMatchL3SAddr6 {
+					d.L3SrcIP = fmt.Sprintf("%s%s-%s", neg, start.String(), end.String())
+				} else {
+					d.L3DstIP = fmt.Sprintf("%s%s-%s", neg, start.String(), end.String())
+				}
 				continue
 			}
-			if curMatch == curMatchL3SAddr6 {
-				start := net.IP(rg.FromData)
-				end := net.IP(rg.ToData)
-				d.L3SrcIP = fmt.Sprintf("%s-%s", start.String(), end.String())
-			}
-			if curMatch == curMatchL3DAddr6 {
-				start := net.IP(rg.FromData[4:])
-				end := net.IP(rg.ToData[4:])
-				d.L3DstIP = fmt.Sprintf("%s-%s", start.String(), end.String())
-			}
 			if curMatch == curMatchL4SPort {
-				start := binary.BigEndian.Uint16(rg.FromData[4:6])
-				end := binary.BigEndian.Uint16(rg.ToData[4:6])
-				d.L4SrcPort = fmt.Sprintf("%d-%d", start, end)
+				start := binary.BigEndian.Uint16(rangeData(rg.FromData, 2))
+				end := binary.BigEndian.Uint16(rangeData(rg.ToData, 2))
+				d.L4SrcPort = fmt.Sprintf("%s%d-%d", neg, start, end)
 				continue
 			}
 			if curMatch == curMatchL4DPort {
-				start := binary.BigEndian.Uint16(rg.FromData[4:6])
-				end := binary.BigEndian.Uint16(rg.ToData[4:6])
-				d.L4DstPort = fmt.Sprintf("%d-%d", start, end)
+				start := binary.BigEndian.Uint16(rangeData(rg.FromData, 2))
+				end := binary.BigEndian.Uint16(rangeData(rg.ToData, 2))
+				d.L4DstPort = fmt.Sprintf("%s%d-%d", neg, start, end)
 				continue
 			}
 		case *expr.Lookup:
 			lp := exp.(*expr.Lookup)
+			if lp.IsDestRegSet {
+				rm, err := d.toRuleMap(lp, curMatch)
+				if err != nil {
+					return err
+				}
+				if lp.DestRegister == 0 {
+					d.VMap = rm
+				} else {
+					maps[lp.DestRegister] = rm
+					delete(regs, lp.DestRegister)
+				}
+				continue
+			}
+			neg := negPrefix(lp.Invert)
+			name := lp.SetName
+			if isAnonSetName(name) && d.conn != nil {
+				list, err := d.anonSetValue(name)
+				if err != nil {
+					return err
+				}
+				name = list
+			} else if curMatch == curMatchIifname || curMatch == curMatchOifname || curMatch == curMatchHeader {
+				name = "@" + name
+			}
+			if curMatch == curMatchHeader && curHdrBtw == nil {
+				h := RuleHeader{Field: curHdr, Value: name}
+				if lp.Invert {
+					h.Op = "!="
+				}
+				d.Headers = append(d.Headers, h)
+				continue
+			}
+			if curMatch == curMatchIifname {
+				d.InIface = neg + name
+				continue
+			}
+			if curMatch == curMatchOifname {
+				d.OutIface = neg + name
+				continue
+			}
 			if curMatch == curMatchL3SAddr || curMatch == curMatchL3SAddr6 {
-				d.L3SrcIP = lp.SetName
+				d.L3SrcIP = neg + name
 				continue
 			}
 			if curMatch == curMatchL3DAddr || curMatch == curMatchL3DAddr6 {
-				d.L3DstIP = lp.SetName
+				d.L3DstIP = neg + name
 				continue
 			}
 			if curMatch == curMatchL4SPort {
-				d.L4SrcPort = lp.SetName
+				d.L4SrcPort = neg + name
 				continue
 			}
 			if curMatch == curMatchL4DPort {
-				d.L4DstPort = lp.SetName
+				d.L4DstPort = neg + name
 				continue
 			}
 		case *expr.Ct:
 			ct := exp.(*expr.Ct)
+			if ct.Key == expr.CtKeyMARK && ct.SourceRegister {
+				d.CtMarkSet = markSetValue(curLoad, curBtw, regs[ct.Register])
+				curLoad, curBtw = "", nil
+				continue
+			}
+			if ct.Key == expr.CtKeyMARK {
+				curMatch, curLoad, curBtw = curMatchCtMark, "ct mark", nil
+				continue
+			}
+			if ct.Key == expr.CtKeyZONE && ct.SourceRegister {
+				if v := regs[ct.Register]; len(v) == 2 {
+					d.CtZoneSet = strconv.Itoa(int(binaryutil.NativeEndian.Uint16(v)))
+					continue
+				}
+			}
+			if ct.SourceRegister {
+				break
+			}
 			if ct.Key == expr.CtKeySTATE {
 				curMatch = curMatchCtState
 				continue
 			}
+			if name, ok := ctKeyOf(ct); ok {
+				curMatch, curCt, curCtBtw, curCtHton = curMatchCt, name, nil, false
+				continue
+			}
+		case *expr.Byteorder:
+			bo := exp.(*expr.Byteorder)
+			if curMatch == curMatchCt && bo.Op == expr.ByteorderHton && bo.Size == ruleCtKeys[curCt].size &&
+				!curCtHton && curCtBtw == nil {
+				curCtHton = true
+				continue
+			}
+		case *expr.Connlimit:
+			cl := exp.(*expr.Connlimit)
+			d.CtCount = &RuleCtCount{Count: cl.Count, Over: cl.Flags&expr.NFT_CONNLIMIT_F_INV != 0}
+			continue
+		case *expr.Notrack:
+			d.Notrack = true
+			continue
+		case *expr.Immediate:
+			imm := exp.(*expr.Immediate)
+			regs[imm.Register] = imm.Data
+			curLoad, curBtw = "", nil
+			continue
+		case *expr.NAT:
+			nat := exp.(*expr.NAT)
+			d.Action = RuleActSnat
+			if nat.Type == expr.NATTypeDestNAT {
+				d.Action = RuleActDnat
+			}
+			d.NatAddr = natRegAddr(regs, nat.RegAddrMin, nat.RegAddrMax)
+			if rm, ok := maps[nat.RegAddrMin]; ok && d.NatAddr == "" {
+				d.NatMap = rm
+			}
+			d.NatPort = natRegPort(regs, nat.RegProtoMin, nat.RegProtoMax)
+			d.NatFlags = natFlags(nat.Random, nat.FullyRandom, nat.Persistent)
+			continue
+		case *expr.Masq:
+			masq := exp.(*expr.Masq)
+			d.Action = RuleActMasq
+			if masq.ToPorts {
+				d.NatPort = natRegPort(regs, masq.RegProtoMin, masq.RegProtoMax)
+			}
+			d.NatFlags = natFlags(masq.Random, masq.FullyRandom, masq.Persistent)
+			continue
+		case *expr.Redir:
+			redir := exp.(*expr.Redir)
+			d.Action = RuleActRedir
+			d.NatPort = natRegPort(regs, redir.RegisterProtoMin, redir.RegisterProtoMax)
+			d.NatFlags = natFlags(redir.Flags&expr.NF_NAT_RANGE_PROTO_RANDOM != 0,
+				redir.Flags&expr.NF_NAT_RANGE_PROTO_RANDOM_FULLY != 0, redir.Flags&expr.NF_NAT_RANGE_PERSISTENT != 0)
+			continue
+		case *expr.Counter:
+			cnt := exp.(*expr.Counter)
+			d.Counter = &RuleCounter{Packets: cnt.Packets, Bytes: cnt.Bytes}
+			continue
+		case *expr.Log:
+			d.Log = toRuleLog(exp.(*expr.Log))
+			continue
+		case *expr.Limit:
+			lmt := exp.(*expr.Limit)
+			d.Limit = &RuleLimit{Rate: lmt.Rate, Burst: lmt.Burst, Over: lmt.Over}
+			for k, v := range limitUnitMap {
+				if v == lmt.Unit {
+					d.Limit.Unit = k
+				}
+			}
+			continue
+		case *expr.Reject:
+			rej := exp.(*expr.Reject)
+			d.Action = RuleActReject
+			d.RejectKind, d.RejectCode = d.rejectKind(rej.Type, rej.Code)
+			continue
 		case *expr.Verdict:
 			vd := exp.(*expr.Verdict)
-			for k, v := range actionMap {
-				if vd.Kind == k {
-					d.Action = v
-					if vd.Chain != "" {
-						d.DstChain = vd.Chain
-					}
-					break
+			if v, ok := actionMap[vd.Kind]; ok {
+				d.Action = v
+				if vd.Chain != "" {
+					d.DstChain = vd.Chain
 				}
+				continue
+			}
+		}
+		// 未解析的表达式原样保留, 操作数连同其加载表达式, 语句连同写入其源寄存器的立即数
+		start := i
+		if isOperandExpr(exp) {
+			if curMatch != "" && loadIdx >= rawEnd {
+				start = loadIdx
+			}
+		} else if i > 0 && i-1 >= rawEnd {
+			if _, ok := nrule.Exprs[i-1].(*expr.Immediate); ok {
+				start = i - 1
 			}
-			continue
 		}
+		d.Raw = append(d.Raw, RuleRaw{After: d.lastStmt(""), Exprs: nrule.Exprs[start : i+1]})
+		rawEnd = i + 1
+		curMatch = ""
+	}
+	if len(d.Raw) > 0 && d.conn != nil && d.conn.StrictDecode {
+		return &DecodeError{Exprs: d.rawExprs()}
 	}
 	return nil
 }
 
+// FullyDecoded 规则读取时所有表达式是否均已解析, 否则未解析部分保留在Raw中
+func (d *Rule) FullyDecoded() bool {
+	return len(d.Raw) == 0
+}
+
+// rawExprs Raw中所有的表达式
+func (d *Rule) rawExprs() []expr.Any {
+	var r []expr.Any
+	for _, raw := range d.Raw {
+		r = append(r, raw.Exprs...)
+	}
+	return r
+}
+
+// lastStmt 规则中按输出顺序位于stmt之前(含stmt)的最后一个语句, stmt为空时查找所有语句
+func (d *Rule) lastStmt(stmt string) string {
+	has := []bool{d.Limit != nil, d.Counter != nil, d.Log != nil, d.MetaMarkSet != "", d.CtMarkSet != "",
+		d.CtZoneSet != "", d.MetaPrioritySet != "", d.Notrack, d.SetUpdate != nil, d.VMap != nil, d.Action != ""}
+	i := len(ruleStmts) - 1
+	if stmt != "" {
+		for i >= 0 && ruleStmts[i] != stmt {
+			i--
+		}
+	}
+	for ; i >= 0; i-- {
+		if has[i] {
+			return ruleStmts[i]
+		}
+	}
+	return ""
+}
+
+// rawAfter 位于stmt语句之后的无法解析的表达式, 原来所在的语句已删除时位于前一个语句之后
+func (d *Rule) rawAfter(stmt string) []RuleRaw {
+	var r []RuleRaw
+	for _, raw := range d.Raw {
+		after := raw.After
+		if after != "" {
+			after = d.lastStmt(after)
+		}
+		if after == stmt {
+			r = append(r, raw)
+		}
+	}
+	return r
+}
+
 func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 	var ntr = new(nftables.Rule)
+	d.anonSets = nil
+	// appendRaw 在stmt语句之后写回无法解析的表达式
+	appendRaw := func(stmt string) {
+		for _, raw := range d.rawAfter(stmt) {
+			ntr.Exprs = append(ntr.Exprs, raw.Exprs...)
+		}
+	}
 	ntr.Table = d.Chain.Table.toNTable()
 	ntr.Chain = d.Chain.toNch()
 	if len(position) > 0 && position[0] > 0 {
@@ -467,6 +1335,21 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 	if d.Handle != 0 {
 		ntr.Handle = d.Handle
 	}
+	// 解析入/出接口
+	if d.InIface != "" {
+		exprs, err := d.matchExpr(d.InIface, SetDtypeIfname, 0, ifaceParser(expr.MetaKeyIIFNAME, expr.MetaKeyIIF))
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	if d.OutIface != "" {
+		exprs, err := d.matchExpr(d.OutIface, SetDtypeIfname, 0, ifaceParser(expr.MetaKeyOIFNAME, expr.MetaKeyOIF))
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
 	// 解析L3协议
 	if d.L3Proto != "" {
 		switch d.L3Proto {
@@ -481,18 +1364,18 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
 			)
 		default:
-			return nil, errors.New("wrong l3 protocol type")
+			return nil, fmt.Errorf("%w: l3 protocol %s", ErrUnsupportedExpr, d.L3Proto)
 		}
 	}
 	// 解析源IP
 	if d.L3Proto == RuleL3Ip && d.L3SrcIP != "" {
-		exprs, err := parseIpv4Expr(d.L3SrcIP, 12)
+		exprs, err := d.matchExpr(d.L3SrcIP, SetDtypeIpv4, 12, parseIpv4Expr)
 		if err != nil {
 			return nil, err
 		}
 		ntr.Exprs = append(ntr.Exprs, exprs...)
 	} else if d.L3Proto == RuleL3Ip6 && d.L3SrcIP != "" {
-		exprs, err := parseIpv6Expr(d.L3SrcIP, 8)
+		exprs, err := d.matchExpr(d.L3SrcIP, SetDtypeIpv6, 8, parseIpv6Expr)
 		if err != nil {
 			return nil, err
 		}
@@ -500,13 +1383,13 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 	}
 	// 解析目标IP
 	if d.L3Proto == RuleL3Ip && d.L3DstIP != "" {
-		exprs, err := parseIpv4Expr(d.L3DstIP, 16)
+		exprs, err := d.matchExpr(d.L3DstIP, SetDtypeIpv4, 16, parseIpv4Expr)
 		if err != nil {
 			return nil, err
 		}
 		ntr.Exprs = append(ntr.Exprs, exprs...)
 	} else if d.L3Proto == RuleL3Ip6 && d.L3DstIP != "" {
-		exprs, err := parseIpv6Expr(d.L3DstIP, 24)
+		exprs, err := d.matchExpr(d.L3DstIP, SetDtypeIpv6, 24, parseIpv6Expr)
 		if err != nil {
 			return nil, err
 		}
@@ -514,40 +1397,60 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 	}
 	// 解析l4协议
 	if d.L4Proto != "" {
-		switch d.L4Proto {
-		case RuleL4Tcp:
-			ntr.Exprs = append(ntr.Exprs,
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
-			)
-		case RuleL4Udp:
-			ntr.Exprs = append(ntr.Exprs,
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
-			)
-		case RuleL4Icmp:
+		l4, neg := splitNeg(d.L4Proto)
+		if neg && (d.L4SrcPort != "" || d.L4DstPort != "") {
+			return nil, fmt.Errorf("negated l4 protocol %s can not match ports", l4)
+		}
+		num, ok := l4ProtoNum(l4)
+		if !ok {
+			return nil, fmt.Errorf("%w: l4 protocol %s", ErrUnsupportedExpr, l4)
+		}
+		if d.l4ProtoPayload() {
+			offset := uint32(9)
+			if d.L3Proto == RuleL3Ip6 {
+				offset = 6
+			}
 			ntr.Exprs = append(ntr.Exprs,
-				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 1},
+				&expr.Cmp{Op: cmpOp(neg), Register: 1, Data: []byte{num}},
 			)
-		case RuleL4Icmp6:
+		} else {
 			ntr.Exprs = append(ntr.Exprs,
 				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
-				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+				&expr.Cmp{Op: cmpOp(neg), Register: 1, Data: []byte{num}},
 			)
 		}
 	}
+	if (d.L4SrcPort != "" || d.L4DstPort != "") && !isPortProto(d.L4Proto) {
+		return nil, fmt.Errorf("l4 protocol %q does not have ports", d.L4Proto)
+	}
 	// 解析源端口
-	if (d.L4Proto == RuleL4Tcp || d.L4Proto == RuleL4Udp) && d.L4SrcPort != "" {
-		exprs, err := parsePortExpr(d.L4SrcPort, 0)
+	if d.L4SrcPort != "" {
+		exprs, err := d.matchExpr(d.L4SrcPort, SetDtypePort, 0, parsePortExpr)
 		if err != nil {
 			return nil, err
 		}
 		ntr.Exprs = append(ntr.Exprs, exprs...)
 	}
 	// 解析目标端口
-	if (d.L4Proto == RuleL4Tcp || d.L4Proto == RuleL4Udp) && d.L4DstPort != "" {
-		exprs, err := parsePortExpr(d.L4DstPort, 2)
+	if d.L4DstPort != "" {
+		exprs, err := d.matchExpr(d.L4DstPort, SetDtypePort, 2, parsePortExpr)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	// 解析协议头字段
+	for _, h := range d.Headers {
+		exprs, err := d.headerExpr(h)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	// 解析拼接匹配
+	if d.Concat != nil {
+		exprs, err := d.concatExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -555,12 +1458,136 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 	}
 	// 解析状态跟踪
 	if len(d.CtStates) != 0 {
-		exprs, err := parseCtState(d.CtStates)
+		exprs, err := parseCtState(d.CtStates, d.CtStatesNeg)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	for _, c := range d.CtMatches {
+		exprs, err := c.exprs()
 		if err != nil {
 			return nil, err
 		}
 		ntr.Exprs = append(ntr.Exprs, exprs...)
 	}
+	if d.CtCount != nil {
+		var flags uint32
+		if d.CtCount.Over {
+			flags = expr.NFT_CONNLIMIT_F_INV
+		}
+		ntr.Exprs = append(ntr.Exprs, &expr.Connlimit{Count: d.CtCount.Count, Flags: flags})
+	}
+	// 解析标记与优先级匹配
+	if d.MetaMark != "" {
+		exprs, err := parseMarkMatchExpr(d.MetaMark, &expr.Meta{Key: expr.MetaKeyMARK, Register: 1})
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	if d.CtMark != "" {
+		exprs, err := parseMarkMatchExpr(d.CtMark, &expr.Ct{Key: expr.CtKeyMARK, Register: 1})
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	if d.MetaPriority != "" {
+		prio, err := parseMetaPriority(d.MetaPriority)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs,
+			&expr.Meta{Key: expr.MetaKeyPRIORITY, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(prio)},
+		)
+	}
+	appendRaw("")
+	// 解析动作前的语句
+	if d.Limit != nil {
+		lmt, err := parseLimitExpr(d.Limit)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, lmt)
+	}
+	appendRaw("limit")
+	if d.Counter != nil {
+		ntr.Exprs = append(ntr.Exprs, &expr.Counter{Packets: d.Counter.Packets, Bytes: d.Counter.Bytes})
+	}
+	appendRaw("counter")
+	if d.Log != nil {
+		log, err := parseLogExpr(d.Log)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, log)
+	}
+	appendRaw("log")
+	if d.MetaMarkSet != "" {
+		exprs, err := parseMarkSetExpr(d.MetaMarkSet, &expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1})
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	appendRaw("meta mark set")
+	if d.CtMarkSet != "" {
+		exprs, err := parseMarkSetExpr(d.CtMarkSet, &expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1})
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	appendRaw("ct mark set")
+	if d.CtZoneSet != "" {
+		zone, err := strconv.ParseUint(d.CtZoneSet, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ct zone %q", d.CtZoneSet)
+		}
+		ntr.Exprs = append(ntr.Exprs,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint16(uint16(zone))},
+			&expr.Ct{Key: expr.CtKeyZONE, SourceRegister: true, Register: 1},
+		)
+	}
+	appendRaw("ct zone set")
+	if d.MetaPrioritySet != "" {
+		prio, err := parseMetaPriority(d.MetaPrioritySet)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(prio)},
+			&expr.Meta{Key: expr.MetaKeyPRIORITY, SourceRegister: true, Register: 1},
+		)
+	}
+	appendRaw("meta priority set")
+	if d.Notrack {
+		ntr.Exprs = append(ntr.Exprs, &expr.Notrack{})
+	}
+	appendRaw("notrack")
+	// 解析集合更新
+	if d.SetUpdate != nil {
+		exprs, err := d.setUpdateExpr()
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	appendRaw("set")
+	// 解析verdict map
+	if d.VMap != nil {
+		if d.Action != "" {
+			return nil, fmt.Errorf("vmap can not be combined with action %s", d.Action)
+		}
+		exprs, err := d.mapExpr(d.VMap, MapDtypeVerdict, 0)
+		if err != nil {
+			return nil, err
+		}
+		ntr.Exprs = append(ntr.Exprs, exprs...)
+	}
+	appendRaw("vmap")
 	// 解析策略动作
 	if d.Action != "" {
 		switch d.Action {
@@ -572,7 +1599,33 @@ func (d *Rule) toNRule(position ...uint64) (*nftables.Rule, error) {
 			ntr.Exprs = append(ntr.Exprs, &expr.Verdict{Kind: expr.VerdictGoto, Chain: d.DstChain})
 		case RuleActJump:
 			ntr.Exprs = append(ntr.Exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: d.DstChain})
+		case RuleActReject:
+			rej, err := d.parseRejectExpr()
+			if err != nil {
+				return nil, err
+			}
+			ntr.Exprs = append(ntr.Exprs, rej)
+		case RuleActSnat, RuleActDnat, RuleActMasq, RuleActRedir:
+			if d.NatMap != nil {
+				exprs, err := d.natMapExpr()
+				if err != nil {
+					return nil, err
+				}
+				ntr.Exprs = append(ntr.Exprs, exprs...)
+			}
+			exprs, err := parseNatExpr(d.Action, d.NatAddr, d.NatPort, d.NatFlags, d.natFamily())
+			if err != nil {
+				return nil, err
+			}
+			// 转换地址由映射查找写入寄存器1
+			if nat, ok := exprs[len(exprs)-1].(*expr.NAT); ok && d.NatMap != nil {
+				nat.RegAddrMin = 1
+			}
+			ntr.Exprs = append(ntr.Exprs, exprs...)
+		default:
+			return nil, fmt.Errorf("%w: action %s", ErrUnsupportedExpr, d.Action)
 		}
 	}
+	appendRaw("action")
 	return ntr, nil
 }
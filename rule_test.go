@@ -3,8 +3,18 @@
 package nftlib
 
 import (
+	"errors"
 	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRuleList(t *testing.T) {
@@ -34,12 +44,15 @@ func TestRule_Regular(t *testing.T) {
 	}
 	conn.FlushRuleset()
 	tbl := conn.ADDTable(&Table{Name: "mytable", Family: TableFamilyInet})
-	ch := tbl.AddBaseChain(&Chain{
+	ch, err := tbl.AddBaseChain(&Chain{
 		Name:   "mychain",
 		Hook:   ChainHookInput,
 		Type:   ChainTypeFilter,
 		Policy: ChainPolicyDrop,
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 	err = ch.AddRule(&Rule{
 		L3Proto: RuleL3Ip,
 		L3DstIP: "1.1.1.1",
@@ -147,3 +160,784 @@ func TestRule_Replace(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// ruleRoundTrip 规则经toNRule/toRule、String/ParseRule及libnftables JSON往返后应保持不变
+func ruleRoundTrip(t *testing.T, ch *Chain, rule *Rule, want string) {
+	t.Helper()
+	rule.Chain = ch
+	if got := rule.String(); got != want {
+		t.Fatalf("string: got %q, want %q", got, want)
+	}
+	nrule, err := rule.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 匿名集合的名称由内核分配, 由TestRule_AnonSet单独检查
+	if len(rule.anonSets) == 0 {
+		back := &Rule{Chain: ch}
+		if err = back.toRule(*nrule); err != nil {
+			t.Fatal(err)
+		}
+		if !back.FullyDecoded() {
+			t.Fatalf("toRule: %q left undecoded expressions %v", want, back.Raw)
+		}
+		if got := back.String(); got != want {
+			t.Fatalf("toRule: got %q, want %q", got, want)
+		}
+	}
+	parsed, err := ParseRule(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed.Chain = ch
+	if got := parsed.String(); got != want {
+		t.Fatalf("parse: got %q, want %q", got, want)
+	}
+	rs := &Ruleset{Tables: []*TableSpec{{Table: ch.Table, Chains: []*ChainSpec{{Chain: ch, Rules: []*Rule{rule}}}}}}
+	data, err := rs.EncodeNftJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeNftJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Tables[0].Chains[0].Rules[0].String(); got != want {
+		t.Fatalf("json: got %q, want %q", got, want)
+	}
+}
+
+func TestRule_Nat(t *testing.T) {
+	inet := &Chain{Name: "prerouting", Table: &Table{Name: "nat", Family: TableFamilyInet}}
+	ip := &Chain{Name: "postrouting", Table: &Table{Name: "nat", Family: TableFamilyIpv4}}
+	cases := []struct {
+		ch   *Chain
+		rule *Rule
+		want string
+	}{
+		{inet, (&Rule{L4Proto: RuleL4Tcp, L4DstPort: "8080"}).SetDNAT("10.0.0.2", "80"),
+			"tcp dport 8080 dnat ip to 10.0.0.2:80"},
+		{inet, (&Rule{L4Proto: RuleL4Tcp, L4DstPort: "8080"}).SetDNAT("fd00::2", "80-81"),
+			"tcp dport 8080 dnat ip6 to [fd00::2]:80-81"},
+		{ip, (&Rule{L3Proto: RuleL3Ip, L3SrcIP: "10.0.0.0/8"}).SetSNAT("1.1.1.1-1.1.1.10", "", RuleNatPersistent, RuleNatRandom),
+			"ip saddr 10.0.0.0/8 snat to 1.1.1.1-1.1.1.10 random,persistent"},
+		{ip, (&Rule{}).SetMasquerade(RuleNatFullyRandom), "masquerade fully-random"},
+		{ip, (&Rule{}).SetMasquerade("1024-65535"), "masquerade to :1024-65535"},
+		{ip, (&Rule{L4Proto: RuleL4Udp, L4DstPort: "53"}).SetRedirect("5353"), "udp dport 53 redirect to :5353"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, c.ch, c.rule, c.want)
+	}
+	if _, err := (&Rule{Chain: ip, Action: RuleActMasq, NatAddr: "1.1.1.1"}).toNRule(); err == nil {
+		t.Fatal("expect error for masquerade with address")
+	}
+}
+
+func TestRule_Reject(t *testing.T) {
+	inet := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	ip6 := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyIpv6}}
+	cases := []struct {
+		ch   *Chain
+		rule *Rule
+		want string
+	}{
+		{inet, (&Rule{}).SetReject("", ""), "reject"},
+		{inet, (&Rule{L4Proto: RuleL4Tcp, L4DstPort: "23"}).SetReject(RuleRejectTcpReset, ""),
+			"tcp dport 23 reject with tcp reset"},
+		{inet, (&Rule{}).SetReject(RuleRejectIcmpx, "admin-prohibited"), "reject with icmpx type admin-prohibited"},
+		{inet, (&Rule{L3Proto: RuleL3Ip, L3SrcIP: "10.0.0.1"}).SetReject(RuleRejectIcmp, "host-prohibited"),
+			"ip saddr 10.0.0.1 reject with icmp type host-prohibited"},
+		{ip6, (&Rule{}).SetReject("", ""), "reject"},
+		{ip6, (&Rule{}).SetReject(RuleRejectIcmp6, "admin-prohibited"), "reject with icmpv6 type admin-prohibited"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, c.ch, c.rule, c.want)
+	}
+	if _, err := (&Rule{Chain: inet, L4Proto: RuleL4Udp}).SetReject(RuleRejectTcpReset, "").toNRule(); err == nil {
+		t.Fatal("expect error for tcp reset on udp rule")
+	}
+	if _, err := (&Rule{Chain: inet}).SetReject(RuleRejectIcmp, "bogus").toNRule(); err == nil {
+		t.Fatal("expect error for unknown icmp code")
+	}
+}
+
+func TestRule_Statements(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	group := uint16(2)
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{L4Proto: RuleL4Tcp, L4DstPort: "22"}).SetCounter().SetAccept(), "tcp dport 22 counter accept"},
+		{(&Rule{}).SetLimit(10, RuleLimitSecond, 20, true).SetCounter().SetDrop(),
+			"limit rate over 10/second burst 20 packets counter drop"},
+		{(&Rule{}).SetLimit(3, RuleLimitMinute, 0, false).SetLog(&RuleLog{Prefix: "ssh in: ", Level: "info",
+			Flags: []string{RuleLogTcpSeq, RuleLogIpOpt}}).SetAccept(),
+			`limit rate 3/minute log prefix "ssh in: " level info flags tcp sequence flags ip options accept`},
+		{(&Rule{}).SetLog(&RuleLog{Group: &group, Snaplen: 128}), "log group 2 snaplen 128"},
+		{(&Rule{}).SetLog(&RuleLog{Flags: []string{RuleLogAll}}).SetDrop(), "log flags all drop"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	// 内核返回的计数值
+	rule := &Rule{Chain: ch}
+	if err := rule.toRule(nftables.Rule{Exprs: []expr.Any{&expr.Counter{Packets: 3, Bytes: 180}}}); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Counter == nil || rule.Counter.Packets != 3 || rule.Counter.Bytes != 180 {
+		t.Fatalf("unexpected counter %+v", rule.Counter)
+	}
+
+	if _, err := (&Rule{Chain: ch}).SetLog(&RuleLog{Group: &group, Level: "info"}).toNRule(); err == nil {
+		t.Fatal("expect error for log level with group")
+	}
+	if _, err := (&Rule{Chain: ch}).SetLimit(1, "fortnight", 0, false).toNRule(); err == nil {
+		t.Fatal("expect error for unknown limit unit")
+	}
+}
+
+func TestRule_Mark(t *testing.T) {
+	ch := &Chain{Name: "prerouting", Table: &Table{Name: "mangle", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{}).SetMetaMark("0x1").SetAccept(), "meta mark 0x1 accept"},
+		{(&Rule{}).SetCtMark("0x2/0xff"), "ct mark and 0xff == 0x2"},
+		{(&Rule{}).SetCtMarkSet("meta mark and 0xff"), "ct mark set meta mark and 0xff"},
+		{(&Rule{}).SetMetaMarkSet("ct mark"), "meta mark set ct mark"},
+		{(&Rule{}).SetMetaMarkSet("meta mark or 0x10"), "meta mark set meta mark or 0x10"},
+		{(&Rule{}).SetMetaMarkSet("16"), "meta mark set 0x10"},
+		{(&Rule{}).SetMetaPriority("1:10").SetMetaPrioritySet("1:20"), "meta priority 1:10 meta priority set 1:20"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+	if _, err := (&Rule{Chain: ch}).SetMetaMarkSet("meta mark plus 1").toNRule(); err == nil {
+		t.Fatal("expect error for unknown mark operator")
+	}
+}
+
+func TestRule_Iface(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{}).SetInIface("eth0").SetAccept(), `iifname "eth0" accept`},
+		{(&Rule{}).SetInIface("veth*").SetOutIface("br0").SetDrop(), `iifname "veth*" oifname "br0" drop`},
+		{(&Rule{L4Proto: RuleL4Tcp, L4DstPort: "22"}).SetInIface("@mgmt").SetAccept(), `iifname @mgmt tcp dport 22 accept`},
+		{(&Rule{}).SetOutIface("2").SetAccept(), "oif 2 accept"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+	for _, name := range []string{"*", "averyveryverylongname", "eth 0"} {
+		if _, err := (&Rule{Chain: ch}).SetInIface(name).toNRule(); err == nil {
+			t.Fatalf("expect error for interface %q", name)
+		}
+	}
+	if _, err := ParseRule("iif eth0 accept"); err == nil {
+		t.Fatal("expect error for interface name in iif")
+	}
+}
+
+func TestRule_Negation(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{&Rule{L3Proto: RuleL3Ip, L3SrcIP: "!10.0.0.0/8", Action: RuleActDrop}, "ip saddr != 10.0.0.0/8 drop"},
+		{&Rule{L3Proto: RuleL3Ip, L3SrcIP: "!blocklist", Action: RuleActAccept}, "ip saddr != @blocklist accept"},
+		{&Rule{L3Proto: RuleL3Ip6, L3DstIP: "!fd00::1-fd00::9"}, "ip6 daddr != fd00::1-fd00::9"},
+		{&Rule{L4Proto: RuleL4Tcp, L4DstPort: "!22", Action: RuleActDrop}, "tcp dport != 22 drop"},
+		{&Rule{L4Proto: RuleL4Udp, L4SrcPort: "!1024-65535"}, "udp sport != 1024-65535"},
+		{&Rule{L4Proto: RuleL4Tcp, L4DstPort: "!ports"}, "tcp dport != @ports"},
+		{&Rule{L4Proto: "!" + RuleL4Tcp, Action: RuleActDrop}, "meta l4proto != tcp drop"},
+		{(&Rule{}).SetInIface("!eth*").SetOutIface("!3"), `iifname != "eth*" oif != 3`},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+	if _, err := (&Rule{Chain: ch, L4Proto: "!" + RuleL4Tcp, L4DstPort: "22"}).toNRule(); err == nil {
+		t.Fatal("expect error for ports with negated l4 protocol")
+	}
+}
+
+func TestRule_AnonSet(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule  *Rule
+		want  string
+		elems []string
+	}{
+		{&Rule{L4Proto: RuleL4Tcp, L4DstPort: "22,80,443,8000-8100", Action: RuleActAccept},
+			"tcp dport { 22, 80, 443, 8000-8100 } accept", []string{"22", "80", "443", "8000-8100"}},
+		{&Rule{L3Proto: RuleL3Ip, L3SrcIP: "!10.0.0.1,192.168.0.0/16", Action: RuleActDrop},
+			"ip saddr != { 10.0.0.1, 192.168.0.0/16 } drop", []string{"10.0.0.1", "192.168.0.0/16"}},
+		{&Rule{L3Proto: RuleL3Ip6, L3DstIP: "fd00::1,fd00::2"}, "ip6 daddr { fd00::1, fd00::2 }", []string{"fd00::1", "fd00::2"}},
+		{&Rule{L4Proto: RuleL4Udp, L4SrcPort: "53,123"}, "udp sport { 53, 123 }", []string{"53", "123"}},
+		{(&Rule{}).SetInIface("eth0,br-lan"), `iifname { "eth0", "br-lan" }`, []string{"eth0", "br-lan"}},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+		nrule, err := c.rule.toNRule()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.rule.anonSets) != 1 {
+			t.Fatalf("%s: expect 1 anonymous set, got %d", c.want, len(c.rule.anonSets))
+		}
+		as := c.rule.anonSets[0]
+		bound := false
+		for _, e := range nrule.Exprs {
+			bound = bound || e == expr.Any(as.lookup)
+		}
+		if !as.set.Anonymous || !as.set.Constant || !bound {
+			t.Fatalf("%s: unexpected anonymous set %+v", c.want, as.set)
+		}
+		// 按内核返回的元素还原列表, 区间集合的元素按逆序返回
+		elems := append([]nftables.SetElement{}, as.elems...)
+		if as.set.Interval {
+			for i, j := 0, len(elems)-1; i < j; i, j = i+1, j-1 {
+				elems[i], elems[j] = elems[j], elems[i]
+			}
+		}
+		set := new(Set)
+		if err = set.toSet(*as.set, elems...); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(set.Elements)
+		sort.Strings(c.elems)
+		if fmt.Sprint(set.Elements) != fmt.Sprint(c.elems) {
+			t.Fatalf("%s: got elements %v, want %v", c.want, set.Elements, c.elems)
+		}
+	}
+	for _, v := range []string{"22,ports", "22,!80", "22,abc-1"} {
+		if _, err := (&Rule{Chain: ch, L4Proto: RuleL4Tcp, L4DstPort: v}).toNRule(); err == nil {
+			t.Fatalf("expect error for port list %q", v)
+		}
+	}
+	if _, err := (&Rule{Chain: ch}).SetInIface("eth0,2").toNRule(); err == nil {
+		t.Fatal("expect error for interface index in list")
+	}
+}
+
+func TestRule_Map(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	nat := &Chain{Name: "prerouting", Table: &Table{Name: "nat", Family: TableFamilyInet}}
+	cases := []struct {
+		ch   *Chain
+		rule *Rule
+		want string
+	}{
+		{ch, (&Rule{}).SetVMap("tcp dport", "", MapElement{"22", "jump ssh"}, MapElement{"80", "accept"}),
+			"tcp dport vmap { 22 : jump ssh, 80 : accept }"},
+		{ch, (&Rule{}).SetVMap("ip saddr", "blk"), "ip saddr vmap @blk"},
+		{ch, (&Rule{}).SetVMap("ip6 daddr", "", MapElement{"fd00::/64", "drop"}), "ip6 daddr vmap { fd00::/64 : drop }"},
+		{ch, (&Rule{}).SetVMap("iifname", "", MapElement{"eth0", "accept"}), `iifname vmap { "eth0" : accept }`},
+		{ch, (&Rule{}).SetVMap("oifname", "ifs"), "oifname vmap @ifs"},
+		{ch, (&Rule{CtStates: []string{"new"}}).SetVMap("udp sport", "svc"), "ct state new udp sport vmap @svc"},
+		{nat, (&Rule{}).SetDNATMap("tcp dport", "", MapElement{"80", "10.0.0.2"}, MapElement{"443", "10.0.0.3"}),
+			"dnat ip to tcp dport map { 80 : 10.0.0.2, 443 : 10.0.0.3 }"},
+		{nat, (&Rule{L3Proto: RuleL3Ip}).SetSNATMap("ip saddr", "egress"), "snat ip to ip saddr map @egress"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, c.ch, c.rule, c.want)
+	}
+
+	// 命名映射的查找绑定到映射名称
+	nrule, err := cases[1].rule.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range nrule.Exprs {
+		if lp, ok := e.(*expr.Lookup); ok {
+			found = lp.SetName == "blk" && lp.IsDestRegSet && lp.DestRegister == 0
+		}
+	}
+	if !found {
+		t.Fatalf("unexpected exprs %v", nrule.Exprs)
+	}
+
+	for _, rule := range []*Rule{
+		(&Rule{}).SetVMap("tcp dport", "svc").SetAccept(),
+		(&Rule{L4Proto: RuleL4Udp}).SetVMap("tcp dport", "svc"),
+		(&Rule{}).SetVMap("tcp dport", "", MapElement{"22", "reject"}),
+		(&Rule{}).SetVMap("ip tos", "svc"),
+		func() *Rule { r := (&Rule{}).SetDNATMap("tcp dport", "fwd"); r.NatPort = "80"; return r }(),
+	} {
+		rule.Chain = ch
+		if _, err := rule.toNRule(); err == nil {
+			t.Fatalf("expect error for rule %s", rule)
+		}
+	}
+	for _, text := range []string{"tcp dport vmap @svc accept", "ip saddr vmap { 10.0.0.1 }"} {
+		if _, err := ParseRule(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+}
+
+func TestRule_Concat(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{Action: RuleActAccept}).SetConcat([]string{"ip saddr", "tcp dport"}, "@allow"), "ip saddr . tcp dport @allow accept"},
+		{(&Rule{Action: RuleActAccept}).SetConcat([]string{"ip saddr", "meta l4proto", "th dport"}, "@allow"),
+			"ip saddr . meta l4proto . th dport @allow accept"},
+		{(&Rule{Action: RuleActDrop}).SetConcat([]string{"iifname", "ip6 saddr"}, "!@peers"), "iifname . ip6 saddr != @peers drop"},
+		{(&Rule{Action: RuleActAccept}).SetConcat([]string{"ip saddr", "udp dport"}, "10.0.0.1 . 53,10.0.0.2 . 123"),
+			"ip saddr . udp dport { 10.0.0.1 . 53, 10.0.0.2 . 123 } accept"},
+		{(&Rule{Action: RuleActAccept}).SetConcat([]string{"ip saddr", "th dport"}, "10.0.0.0/8 . 1000-2000"),
+			"ip saddr . th dport { 10.0.0.0/8 . 1000-2000 } accept"},
+		{(&Rule{}).SetConcat([]string{"iifname", "meta l4proto"}, "eth0 . tcp"), `iifname . meta l4proto { "eth0" . tcp }`},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	// 拼接键加载到连续的32位寄存器
+	nrule, err := cases[1].rule.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var regs []uint32
+	for _, e := range nrule.Exprs {
+		switch v := e.(type) {
+		case *expr.Payload:
+			regs = append(regs, v.DestRegister)
+		case *expr.Meta:
+			if v.Key == expr.MetaKeyL4PROTO && len(regs) > 0 {
+				regs = append(regs, v.Register)
+			}
+		}
+	}
+	if fmt.Sprint(regs) != "[1 9 10]" {
+		t.Fatalf("unexpected registers %v", regs)
+	}
+	as := cases[4].rule.anonSets
+	if len(as) != 1 || !as[0].set.Interval || !as[0].set.Concatenation || len(as[0].elems[0].KeyEnd) != 8 {
+		t.Fatalf("unexpected anonymous set %+v", as)
+	}
+
+	for _, rule := range []*Rule{
+		(&Rule{}).SetConcat([]string{"ip saddr"}, "@allow"),
+		(&Rule{}).SetConcat([]string{"ip saddr", "ip tos"}, "@allow"),
+		(&Rule{L4Proto: RuleL4Udp}).SetConcat([]string{"ip saddr", "tcp dport"}, "@allow"),
+		(&Rule{}).SetConcat([]string{"ip saddr", "tcp dport"}, "10.0.0.1"),
+	} {
+		rule.Chain = ch
+		if _, err := rule.toNRule(); err == nil {
+			t.Fatalf("expect error for rule %s", rule)
+		}
+	}
+}
+
+func TestRule_SetUpdate(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{}).SetSetUpdate(RuleSetOpAdd, "blk", []string{"ip saddr"}, 10*time.Minute), "add @blk { ip saddr timeout 10m }"},
+		{(&Rule{Action: RuleActAccept}).SetSetUpdate(RuleSetOpUpdate, "seen", []string{"ip6 saddr"}, 0),
+			"update @seen { ip6 saddr } accept"},
+		{(&Rule{L3SrcIP: "10.0.0.0/8", Counter: &RuleCounter{}, Action: RuleActDrop}).
+			SetSetUpdate(RuleSetOpAdd, "flows", []string{"ip saddr", "tcp dport"}, time.Hour),
+			"ip saddr 10.0.0.0/8 counter add @flows { ip saddr . tcp dport timeout 1h } drop"},
+		{(&Rule{}).SetSetUpdate(RuleSetOpUpdate, "ports", []string{"iifname", "meta l4proto", "th dport"}, 30*time.Second),
+			"update @ports { iifname . meta l4proto . th dport timeout 30s }"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	nrule, err := cases[2].rule.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, ok := nrule.Exprs[len(nrule.Exprs)-2].(*expr.Dynset)
+	if !ok || ds.SrcRegKey != 1 || ds.SetName != "flows" || ds.Operation != unix.NFT_DYNSET_OP_ADD || ds.Timeout != time.Hour {
+		t.Fatalf("unexpected dynset %+v", nrule.Exprs[len(nrule.Exprs)-2])
+	}
+
+	for _, rule := range []*Rule{
+		(&Rule{}).SetSetUpdate("delete", "blk", []string{"ip saddr"}, 0),
+		(&Rule{}).SetSetUpdate(RuleSetOpAdd, "", []string{"ip saddr"}, 0),
+		(&Rule{}).SetSetUpdate(RuleSetOpAdd, "blk", nil, 0),
+		(&Rule{L4Proto: RuleL4Udp}).SetSetUpdate(RuleSetOpAdd, "blk", []string{"tcp dport"}, 0),
+	} {
+		rule.Chain = ch
+		if _, err := rule.toNRule(); err == nil {
+			t.Fatalf("expect error for rule %s", rule)
+		}
+	}
+	for _, text := range []string{"add blk { ip saddr }", "add @blk { ip saddr timeout x }", "update @blk ip saddr"} {
+		if _, err := ParseRule(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+}
+
+func TestRule_Raw(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	known, err := ParseRule(`iifname "eth0" tcp dport 22 accept`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known.Chain = ch
+	nrule, err := known.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// meta skuid 1000 ip protocol 6 quota 1000 bytes meta nftrace set 1, 均为不支持的表达式
+	raw := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeySKUID, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0xe8, 0x03, 0, 0}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 9, Len: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Quota{Bytes: 1000},
+		&expr.Immediate{Register: 1, Data: []byte{1}},
+		&expr.Meta{Key: expr.MetaKeyNFTRACE, Register: 1, SourceRegister: true},
+	}
+	n := len(nrule.Exprs)
+	exprs := append(append(append([]expr.Any{}, nrule.Exprs[:n-1]...), raw...), nrule.Exprs[n-1])
+
+	rule := &Rule{Chain: ch}
+	if err = rule.toRule(nftables.Rule{Exprs: exprs}); err != nil {
+		t.Fatal(err)
+	}
+	// 无法解析的表达式参与文本输出, 输出的规则无法被解析, 也无法编码为JSON
+	got := rule.String()
+	if !strings.HasPrefix(got, known.String()[:len(known.String())-len("accept")]+"raw meta:") || !strings.HasSuffix(got, " accept") {
+		t.Fatalf("unexpected rule %q", got)
+	}
+	if _, err = ParseRule(got); err == nil {
+		t.Fatalf("expect error for %q", got)
+	}
+	if _, err = rule.nftJsonExprs(); !errors.Is(err, ErrUnsupportedExpr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if rule.FullyDecoded() || !reflect.DeepEqual(rule.rawExprs(), raw) {
+		t.Fatalf("unexpected raw %v", rule.Raw)
+	}
+	// 未解析的表达式在原来的位置写回
+	back, err := rule.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back.Exprs, exprs) {
+		t.Fatalf("got %v, want %v", back.Exprs, exprs)
+	}
+
+	// 匹配字段的操作数无法解析时连同加载表达式一并保留
+	dport := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0xff, 0}, Xor: []byte{0, 0}},
+	}
+	rule = &Rule{Chain: ch}
+	if err = rule.toRule(nftables.Rule{Exprs: append(dport, &expr.Verdict{Kind: expr.VerdictReturn})}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rule.String(), "raw payload:") || !reflect.DeepEqual(rule.rawExprs(), append(dport, &expr.Verdict{Kind: expr.VerdictReturn})) {
+		t.Fatalf("unexpected rule %q raw %v", rule.String(), rule.Raw)
+	}
+
+	// 语句之后的表达式写回到该语句之后, 语句删除时写回到前一个语句之后
+	skuid := raw[:2]
+	exprs = append(append([]expr.Any{&expr.Counter{}}, skuid...), &expr.Verdict{Kind: expr.VerdictAccept})
+	rule = &Rule{Chain: ch}
+	if err = rule.toRule(nftables.Rule{Exprs: exprs}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rule.Raw {
+		if r.After != "counter" {
+			t.Fatalf("unexpected raw %v", rule.Raw)
+		}
+	}
+	if got = rule.String(); !strings.HasPrefix(got, "counter raw meta:") || !strings.HasSuffix(got, " accept") {
+		t.Fatalf("unexpected rule %q", got)
+	}
+	for _, c := range []struct {
+		modify func()
+		want   []expr.Any
+	}{
+		{func() {}, exprs},
+		{func() { rule.Action = RuleActDrop }, append(append([]expr.Any{&expr.Counter{}}, skuid...), &expr.Verdict{Kind: expr.VerdictDrop})},
+		{func() { rule.Counter = nil }, append(append([]expr.Any{}, skuid...), &expr.Verdict{Kind: expr.VerdictDrop})},
+	} {
+		c.modify()
+		back, err = rule.toNRule()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back.Exprs, c.want) {
+			t.Fatalf("got %v, want %v", back.Exprs, c.want)
+		}
+	}
+
+	// 严格模式返回DecodeError
+	exprs = append(append(append([]expr.Any{}, nrule.Exprs[:n-1]...), raw...), nrule.Exprs[n-1])
+	rule = &Rule{Chain: ch, conn: &Conn{StrictDecode: true}}
+	err = rule.toRule(nftables.Rule{Exprs: exprs})
+	var de *DecodeError
+	if !errors.Is(err, ErrUnsupportedExpr) || !errors.As(err, &de) || len(de.Exprs) != len(raw) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = rule.toRule(*nrule); err != nil || !rule.FullyDecoded() {
+		t.Fatalf("unexpected error %v raw %v", err, rule.Raw)
+	}
+}
+
+func TestRule_Header(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{}).AddHeader("tcp flags", "syn|ack", "==", "syn").SetAccept(), "tcp flags & (syn|ack) == syn accept"},
+		{(&Rule{}).AddHeader("tcp flags", "fin|syn|rst|ack", "!=", "syn").SetDrop(), "tcp flags & (fin|syn|rst|ack) != syn drop"},
+		{(&Rule{}).AddHeader("tcp flags", "", "", "syn|rst"), "tcp flags syn|rst"},
+		{(&Rule{L4Proto: RuleL4Tcp, L4DstPort: "22"}).AddHeader("tcp flags", "", "==", "syn"), "tcp dport 22 tcp flags == syn"},
+		{(&Rule{}).AddHeader("icmp type", "", "", "echo-request").SetAccept(), "icmp type echo-request accept"},
+		{(&Rule{}).AddHeader("icmp type", "", "", "echo-reply").AddHeader("icmp code", "", "!=", "0"), "icmp type echo-reply icmp code != 0"},
+		{(&Rule{}).AddHeader("icmpv6 type", "", "!=", "nd-neighbor-solicit"), "icmpv6 type != nd-neighbor-solicit"},
+		{(&Rule{}).AddHeader("icmp type", "", "", "@types"), "icmp type @types"},
+		{(&Rule{}).AddHeader("ip dscp", "", "", "ef"), "ip dscp ef"},
+		{(&Rule{}).AddHeader("ip6 dscp", "", "!=", "cs1-cs3"), "ip6 dscp != cs1-cs3"},
+		{(&Rule{}).AddHeader("ip ttl", "", "<", "10").AddHeader("ip length", "", "", "100-200"), "ip ttl < 10 ip length 100-200"},
+		{(&Rule{L3SrcIP: "10.0.0.0/8"}).AddHeader("ip frag-off", "0x1fff", "!=", "0").SetDrop(), "ip saddr 10.0.0.0/8 ip frag-off & 0x1fff != 0 drop"},
+		{(&Rule{}).AddHeader("ip frag-off", "0x2000", "", "8192"), "ip frag-off & 0x2000 == 8192"},
+		{(&Rule{}).AddHeader("ip6 hoplimit", "", "", "255").AddHeader("ip6 length", "", ">=", "1280"), "ip6 hoplimit 255 ip6 length >= 1280"},
+		{(&Rule{}).AddHeader("udp length", "", "<=", "8"), "udp length <= 8"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	// 列表使用匿名集合匹配
+	list := (&Rule{Chain: ch}).AddHeader("icmp type", "", "", "echo-request,echo-reply")
+	ruleRoundTrip(t, ch, list, "icmp type { echo-request, echo-reply }")
+	nrule, err := list.toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.anonSets) != 1 || list.anonSets[0].set.Interval || list.anonSets[0].set.KeyType != nftables.TypeICMPType {
+		t.Fatalf("unexpected anonymous set %+v", list.anonSets)
+	}
+	if _, ok := nrule.Exprs[len(nrule.Exprs)-1].(*expr.Lookup); !ok {
+		t.Fatalf("expect lookup, got %v", nrule.Exprs)
+	}
+
+	// 解析时转换为与内核读取一致的形式
+	for text, want := range map[string]string{
+		"tcp flags & (syn | ack) != 0":  "tcp flags syn|ack",
+		"tcp flags & syn != 0x0":        "tcp flags syn",
+		"ip ttl == 64":                  "ip ttl 64",
+		"ip frag-off & 0x1FFF != 0x0":   "ip frag-off & 0x1fff != 0",
+		"icmp type { 8, 0 }":            "icmp type { echo-request, echo-reply }",
+		"icmpv6 type 135 ip6 dscp 0x2e": "icmpv6 type nd-neighbor-solicit ip6 dscp ef",
+	} {
+		rule, err := ParseRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.String(); got != want {
+			t.Fatalf("parse %q: got %q, want %q", text, got, want)
+		}
+	}
+	for _, text := range []string{
+		"ip dscp & 0x3 == 1",
+		"tcp flags 1-3",
+		"tcp flags & syn syn",
+		"ip ttl 300",
+		"ip ttl < 1-5",
+		"ip ttl { 1, 2 }",
+		"icmp type foo",
+		"tcp window @wins",
+		"ip saddr 10.0.0.1 ip6 hoplimit 1",
+		"icmp type echo-request tcp flags syn",
+		"icmp checksum 0",
+	} {
+		if _, err := ParseRule(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+	if _, err := (&Rule{Chain: ch, L4Proto: RuleL4Udp, Headers: []RuleHeader{{Field: "tcp flags", Value: "syn"}}}).toNRule(); err == nil {
+		t.Fatal("expect error for tcp flags in udp rule")
+	}
+
+	// ip表中的规则不含L3协议匹配, 按表的协议族解析
+	rule := &Rule{Chain: &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyIpv4}}}
+	err = rule.toRule(nftables.Rule{Exprs: []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{64}},
+	}})
+	if err != nil || !rule.FullyDecoded() || rule.String() != "ip ttl 64" {
+		t.Fatalf("unexpected rule %q raw %v err %v", rule.String(), rule.Raw, err)
+	}
+}
+
+func TestRule_L4Proto(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	// 测试使用独立的协议名称数据库
+	loadProtocols()
+	nums, names := sysProtoNums, sysProtoNames
+	defer func() { sysProtoNums, sysProtoNames = nums, names }()
+	path := filepath.Join(t.TempDir(), "protocols")
+	if err := os.WriteFile(path, []byte("# protocols\nospf\t89\tOSPFIGP\t# Open Shortest Path First\nvrrp 112 VRRP\nbad x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sysProtoNums, sysProtoNames = readProtocols(path)
+
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{&Rule{L4Proto: RuleL4Sctp, L4DstPort: "2905", Action: RuleActAccept}, "sctp dport 2905 accept"},
+		{&Rule{L4Proto: RuleL4Dccp, L4SrcPort: "1000-2000"}, "dccp sport 1000-2000"},
+		{&Rule{L4Proto: RuleL4UdpLite, L4DstPort: "!5000"}, "udplite dport != 5000"},
+		{&Rule{L4Proto: RuleL4UdpLite, L4DstPort: "5000,5001"}, "udplite dport { 5000, 5001 }"},
+		{&Rule{L4Proto: RuleL4Gre, Action: RuleActAccept}, "meta l4proto gre accept"},
+		{&Rule{L4Proto: RuleL4Esp, Action: RuleActAccept}, "meta l4proto esp accept"},
+		{&Rule{L4Proto: "!" + RuleL4Ah, Action: RuleActDrop}, "meta l4proto != ah drop"},
+		{&Rule{L4Proto: "ospf"}, "meta l4proto ospf"},
+		{&Rule{L4Proto: "253"}, "meta l4proto 253"},
+		{&Rule{L3Proto: RuleL3Ip, L4Proto: RuleL4Gre, Action: RuleActAccept}, "ip protocol gre accept"},
+		{&Rule{L3Proto: RuleL3Ip, L3SrcIP: "10.0.0.1", L4Proto: "!" + RuleL4Esp}, "ip saddr 10.0.0.1 ip protocol != esp"},
+		{&Rule{L3Proto: RuleL3Ip6, L4Proto: RuleL4Icmp6}, "ip6 nexthdr ipv6-icmp"},
+		{(&Rule{}).SetVMap("sctp dport", "", MapElement{"2905", "accept"}), "sctp dport vmap { 2905 : accept }"},
+		{(&Rule{}).SetConcat([]string{"ip saddr", "dccp dport"}, "@allow"), "ip saddr . dccp dport @allow"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	for text, want := range map[string]string{
+		"meta l4proto 47":        "meta l4proto gre",
+		"ip protocol 50":         "ip protocol esp",
+		"meta l4proto OSPFIGP":   "meta l4proto ospf",
+		"meta l4proto != 112":    "meta l4proto != vrrp",
+		"meta l4proto ipv6-icmp": "meta l4proto ipv6-icmp",
+	} {
+		rule, err := ParseRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.String(); got != want {
+			t.Fatalf("parse %q: got %q, want %q", text, got, want)
+		}
+	}
+	for _, text := range []string{"meta l4proto foo", "meta l4proto 256", "sctp chunk 1"} {
+		if _, err := ParseRule(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+	for _, rule := range []*Rule{
+		{Chain: ch, L4Proto: RuleL4Gre, L4DstPort: "1"},
+		{Chain: ch, L4DstPort: "22"},
+		{Chain: ch, L4Proto: "foo"},
+	} {
+		if _, err := rule.toNRule(); err == nil {
+			t.Fatalf("expect error for rule %+v", rule)
+		}
+	}
+}
+
+func TestRule_Ct(t *testing.T) {
+	ch := &Chain{Name: "input", Table: &Table{Name: "filter", Family: TableFamilyInet}}
+	cases := []struct {
+		rule *Rule
+		want string
+	}{
+		{(&Rule{}).AddCtMatch("status", "", "dnat").SetAccept(), "ct status dnat accept"},
+		{(&Rule{}).AddCtMatch("status", "", "dnat,snat,assured"), "ct status assured,snat,dnat"},
+		{(&Rule{}).AddCtMatch("status", "!=", "assured"), "ct status != assured"},
+		{(&Rule{}).AddCtMatch("status", "==", "seen-reply,confirmed"), "ct status == seen-reply,confirmed"},
+		{(&Rule{}).AddCtMatch("direction", "", "reply"), "ct direction reply"},
+		{(&Rule{}).AddCtMatch("direction", "!=", "original"), "ct direction != original"},
+		{(&Rule{}).AddCtMatch("zone", "", "10").AddCtMatch("zone", ">", "5"), "ct zone 10 ct zone > 5"},
+		{(&Rule{}).AddCtMatch("helper", "", "ftp").SetAccept(), `ct helper "ftp" accept`},
+		{(&Rule{}).AddCtMatch("expiration", "<", "30s"), "ct expiration < 30s"},
+		{(&Rule{}).AddCtMatch("expiration", "", "1m500ms"), "ct expiration 1m500ms"},
+		{(&Rule{}).AddCtMatch("original saddr", "", "10.0.0.1").AddCtMatch("reply daddr", "!=", "fd00::1"),
+			"ct original saddr 10.0.0.1 ct reply daddr != fd00::1"},
+		{(&Rule{}).AddCtMatch("original proto-dst", "", "22").AddCtMatch("reply proto-src", ">=", "1024"),
+			"ct original proto-dst 22 ct reply proto-src >= 1024"},
+		{(&Rule{}).AddCtMatch("original ip saddr", "", "10.0.0.1").AddCtMatch("reply ip6 daddr", "!=", "fd00::1"),
+			"ct original ip saddr 10.0.0.1 ct reply ip6 daddr != fd00::1"},
+		{(&Rule{CtStates: []string{RuleCtNew}}).SetCtCount(10, true).SetDrop(), "ct state new ct count over 10 drop"},
+		{(&Rule{}).SetCtCount(3, false), "ct count 3"},
+		{(&Rule{}).SetCtNeg(RuleCtRelated, RuleCtEstablished).SetDrop(), "ct state != established,related drop"},
+		{(&Rule{L4Proto: RuleL4Udp, L4DstPort: "53"}).SetCtZoneSet("2"), "udp dport 53 ct zone set 2"},
+		{(&Rule{L4Proto: RuleL4Udp, L4DstPort: "53"}).SetNotrack(), "udp dport 53 notrack"},
+	}
+	for _, c := range cases {
+		ruleRoundTrip(t, ch, c.rule, c.want)
+	}
+
+	// 大小比较前将主机字节序的取值转换为网络字节序
+	nrule, err := (&Rule{Chain: ch}).AddCtMatch("zone", "<", "256").toNRule()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bo, ok := nrule.Exprs[1].(*expr.Byteorder)
+	cmp, _ := nrule.Exprs[2].(*expr.Cmp)
+	if !ok || bo.Op != expr.ByteorderHton || cmp == nil || !reflect.DeepEqual(cmp.Data, []byte{1, 0}) {
+		t.Fatalf("unexpected exprs %v", nrule.Exprs)
+	}
+
+	// nft写入的带地址族的元组字段使用NFT_CT_SRC_IP等键
+	rule := &Rule{Chain: ch}
+	err = rule.toRule(nftables.Rule{Exprs: []expr.Any{
+		&expr.Ct{Key: ctKeyDstIp, Direction: 1, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 0, 1}},
+	}})
+	if err != nil || !rule.FullyDecoded() || rule.String() != "ct reply ip daddr 192.168.0.1" {
+		t.Fatalf("unexpected rule %q raw %v err %v", rule.String(), rule.Raw, err)
+	}
+
+	// 解析时转换为与内核读取一致的形式
+	for text, want := range map[string]string{
+		"ct status == snat":                 "ct status == snat",
+		"ct state != new":                   "ct state != new",
+		"ct zone == 0x10":                   "ct zone 16",
+		"ct expiration 90":                  "ct expiration 1m30s",
+		"ct original ip saddr 192.168.0.1":  "ct original ip saddr 192.168.0.1",
+		"ct reply ip6 daddr 2001:db8:0::1":  "ct reply ip6 daddr 2001:db8::1",
+		"ct helper \"sip\" ct status 0x200": `ct helper "sip" ct status dying`,
+	} {
+		rule, err := ParseRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.String(); got != want {
+			t.Fatalf("parse %q: got %q, want %q", text, got, want)
+		}
+	}
+	for _, text := range []string{
+		"ct status foo",
+		"ct direction < reply",
+		"ct helper thisnameistoolong",
+		"ct zone 70000",
+		"ct zone 1,2",
+		"ct original saddr 22",
+		"ct original ip saddr fd00::1",
+		"ct reply ip6 daddr 10.0.0.1",
+		"ct reply proto-dst 10.0.0.1",
+		"ct bytes 100",
+		"ct count over",
+		"ct zone set foo",
+	} {
+		if _, err := ParseRule(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+// +build linux
+
+package nftlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleCt 连接跟踪字段匹配 e.g.: ct status dnat or ct original saddr 10.0.0.1 or ct expiration < 30s
+type RuleCt struct {
+	// Key 连接跟踪字段, 取值见ruleCtKeys e.g.: status or zone or reply proto-dst
+	Key string `json:"key"`
+	// Op one of [==,!=,<,>,<=,>=], 仅zone、expiration与端口支持大小比较
+	// status为空时匹配任一状态置位, !=匹配均未置位, ==匹配完全相等, 其余字段为空时匹配相等
+	Op string `json:"op,omitempty"`
+	// Value e.g.: snat,dnat or reply or 10 or ftp or 10.0.0.1 or 22 or 30s
+	Value string `json:"value"`
+}
+
+// RuleCtCount 连接数限制, 匹配同一规则已跟踪的连接数
+type RuleCtCount struct {
+	Count uint32 `json:"count"`
+	// Over 为true时匹配连接数超过Count, 否则匹配不超过Count
+	Over bool `json:"over,omitempty"`
+}
+
+const (
+	ctKindStatus    = "status"
+	ctKindDirection = "direction"
+	ctKindNum       = "num"
+	ctKindHelper    = "helper"
+	ctKindTime      = "time"
+	ctKindAddr      = "addr"
+	ctKindPort      = "port"
+
+	// ctHelperLen 内核中连接跟踪helper名称的长度
+	ctHelperLen = 16
+
+	// ctKeySrcIp 等为内核中的NFT_CT_SRC_IP等键, google/nftables v0.3.0未定义
+	ctKeySrcIp  expr.CtKey = 19
+	ctKeyDstIp  expr.CtKey = 20
+	ctKeySrcIp6 expr.CtKey = 21
+	ctKeyDstIp6 expr.CtKey = 22
+)
+
+// ruleCtKey 连接跟踪字段的键、方向与取值类型
+type ruleCtKey struct {
+	key expr.CtKey
+	// dir 元组字段的方向, 0为original, 1为reply
+	dir  uint32
+	size uint32
+	kind string
+}
+
+var (
+	// ruleCtKeys 支持的连接跟踪字段, 不带地址族的地址长度由取值决定
+	// 带地址族的地址使用nft生成的ctKeySrcIp等键, google/nftables v0.3.0编码这些键时不携带内核要求的方向属性,
+	// 写入规则需要更新的google/nftables, 不带地址族的形式可用于旧版本
+	ruleCtKeys = map[string]ruleCtKey{
+		"status":             {key: expr.CtKeySTATUS, size: 4, kind: ctKindStatus},
+		"direction":          {key: expr.CtKeyDIRECTION, size: 1, kind: ctKindDirection},
+		"zone":               {key: expr.CtKeyZONE, size: 2, kind: ctKindNum},
+		"helper":             {key: expr.CtKeyHELPER, size: ctHelperLen, kind: ctKindHelper},
+		"expiration":         {key: expr.CtKeyEXPIRATION, size: 4, kind: ctKindTime},
+		"original saddr":     {key: expr.CtKeySRC, dir: 0, kind: ctKindAddr},
+		"original daddr":     {key: expr.CtKeyDST, dir: 0, kind: ctKindAddr},
+		"original proto-src": {key: expr.CtKeyPROTOSRC, dir: 0, size: 2, kind: ctKindPort},
+		"original proto-dst": {key: expr.CtKeyPROTODST, dir: 0, size: 2, kind: ctKindPort},
+		"reply saddr":        {key: expr.CtKeySRC, dir: 1, kind: ctKindAddr},
+		"reply daddr":        {key: expr.CtKeyDST, dir: 1, kind: ctKindAddr},
+		"reply proto-src":    {key: expr.CtKeyPROTOSRC, dir: 1, size: 2, kind: ctKindPort},
+		"reply proto-dst":    {key: expr.CtKeyPROTODST, dir: 1, size: 2, kind: ctKindPort},
+		"original ip saddr":  {key: ctKeySrcIp, dir: 0, size: 4, kind: ctKindAddr},
+		"original ip daddr":  {key: ctKeyDstIp, dir: 0, size: 4, kind: ctKindAddr},
+		"original ip6 saddr": {key: ctKeySrcIp6, dir: 0, size: 16, kind: ctKindAddr},
+		"original ip6 daddr": {key: ctKeyDstIp6, dir: 0, size: 16, kind: ctKindAddr},
+		"reply ip saddr":     {key: ctKeySrcIp, dir: 1, size: 4, kind: ctKindAddr},
+		"reply ip daddr":     {key: ctKeyDstIp, dir: 1, size: 4, kind: ctKindAddr},
+		"reply ip6 saddr":    {key: ctKeySrcIp6, dir: 1, size: 16, kind: ctKindAddr},
+		"reply ip6 daddr":    {key: ctKeyDstIp6, dir: 1, size: 16, kind: ctKindAddr},
+	}
+	// ctStatusList 连接状态名称, 下标为状态位
+	ctStatusList = []string{"expected", "seen-reply", "assured", "confirmed", "snat", "dnat", "", "", "", "dying"}
+	// ctDirList 连接方向名称, 下标为内核中的取值
+	ctDirList = []string{"original", "reply"}
+)
+
+// ordered 字段是否支持大小比较
+func (f ruleCtKey) ordered() bool {
+	return f.kind == ctKindNum || f.kind == ctKindTime || f.kind == ctKindPort
+}
+
+// hostOrder 字段是否以主机字节序加载, 大小比较前需转换为网络字节序
+func (f ruleCtKey) hostOrder() bool {
+	return f.kind == ctKindNum || f.kind == ctKindTime
+}
+
+// ctStatusBits 解析逗号分隔的连接状态, 支持名称与数字
+func ctStatusBits(s string) (uint32, error) {
+	var v uint32
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		bit := -1
+		for i, st := range ctStatusList {
+			if st != "" && st == name {
+				bit = i
+			}
+		}
+		if bit >= 0 {
+			v |= 1 << uint(bit)
+			continue
+		}
+		n, err := strconv.ParseUint(name, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("unknown ct status %q", name)
+		}
+		v |= uint32(n)
+	}
+	if v == 0 {
+		return 0, fmt.Errorf("empty ct status %q", s)
+	}
+	return v, nil
+}
+
+// ctStatusString 按状态位顺序输出连接状态, 无名称的状态位以十六进制输出
+func ctStatusString(v uint32) string {
+	var names []string
+	for i, st := range ctStatusList {
+		if st != "" && v&(1<<uint(i)) != 0 {
+			names = append(names, st)
+			v &^= 1 << uint(i)
+		}
+	}
+	if v != 0 {
+		names = append(names, fmt.Sprintf("0x%x", v))
+	}
+	return strings.Join(names, ",")
+}
+
+// data 编码字段取值, hton为true时数值以网络字节序编码
+func (f ruleCtKey) data(value string, hton bool) ([]byte, error) {
+	switch f.kind {
+	case ctKindStatus:
+		v, err := ctStatusBits(value)
+		if err != nil {
+			return nil, err
+		}
+		return binaryutil.NativeEndian.PutUint32(v), nil
+	case ctKindDirection:
+		for i, dir := range ctDirList {
+			if dir == value {
+				return []byte{byte(i)}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown ct direction %q", value)
+	case ctKindNum:
+		n, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ct zone %q", value)
+		}
+		if hton {
+			return binaryutil.BigEndian.PutUint16(uint16(n)), nil
+		}
+		return binaryutil.NativeEndian.PutUint16(uint16(n)), nil
+	case ctKindHelper:
+		if value == "" || len(value) >= ctHelperLen {
+			return nil, fmt.Errorf("invalid ct helper %q", value)
+		}
+		data := make([]byte, ctHelperLen)
+		copy(data, value)
+		return data, nil
+	case ctKindTime:
+		d, err := parseNftDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		ms := uint64(d / time.Millisecond)
+		if ms > 0xffffffff {
+			return nil, fmt.Errorf("ct expiration %s out of range", value)
+		}
+		if hton {
+			return binaryutil.BigEndian.PutUint32(uint32(ms)), nil
+		}
+		return binaryutil.NativeEndian.PutUint32(uint32(ms)), nil
+	case ctKindAddr:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ct address %q", value)
+		}
+		data := ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			data = ip4
+		}
+		if f.size != 0 && uint32(len(data)) != f.size {
+			return nil, fmt.Errorf("ct address %s does not match family", value)
+		}
+		return data, nil
+	case ctKindPort:
+		n, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ct port %q", value)
+		}
+		return binaryutil.BigEndian.PutUint16(uint16(n)), nil
+	}
+	return nil, fmt.Errorf("%w: ct kind %s", ErrUnsupportedExpr, f.kind)
+}
+
+// format 输出字段取值, 数据无法解析时返回false
+func (f ruleCtKey) format(data []byte, hton bool) (string, bool) {
+	if f.size != 0 && uint32(len(data)) != f.size {
+		return "", false
+	}
+	switch f.kind {
+	case ctKindStatus:
+		return ctStatusString(binaryutil.NativeEndian.Uint32(data)), true
+	case ctKindDirection:
+		if int(data[0]) < len(ctDirList) {
+			return ctDirList[data[0]], true
+		}
+	case ctKindNum:
+		if hton {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data))), true
+		}
+		return strconv.Itoa(int(binaryutil.NativeEndian.Uint16(data))), true
+	case ctKindHelper:
+		i := bytes.IndexByte(data, 0)
+		if i <= 0 {
+			return "", false
+		}
+		return string(data[:i]), true
+	case ctKindTime:
+		ms := binaryutil.NativeEndian.Uint32(data)
+		if hton {
+			ms = binary.BigEndian.Uint32(data)
+		}
+		return formatNftDuration(time.Duration(ms) * time.Millisecond), true
+	case ctKindAddr:
+		if len(data) == net.IPv4len || len(data) == net.IPv6len {
+			return net.IP(data).String(), true
+		}
+	case ctKindPort:
+		return strconv.Itoa(int(binary.BigEndian.Uint16(data))), true
+	}
+	return "", false
+}
+
+// normalize 校验连接跟踪匹配, 并转换为与toRule解析结果一致的形式
+func (d RuleCt) normalize() (RuleCt, error) {
+	f, ok := ruleCtKeys[d.Key]
+	if !ok {
+		return d, fmt.Errorf("%w: ct %s", ErrUnsupportedExpr, d.Key)
+	}
+	if _, ok = headerCmpOps[d.Op]; !ok {
+		return d, fmt.Errorf("%w: ct %s op %s", ErrUnsupportedExpr, d.Key, d.Op)
+	}
+	if d.Op != "" && d.Op != "==" && d.Op != "!=" && !f.ordered() {
+		return d, fmt.Errorf("ct %s does not support op %s", d.Key, d.Op)
+	}
+	if d.Op == "==" && f.kind != ctKindStatus {
+		d.Op = ""
+	}
+	data, err := f.data(d.Value, false)
+	if err != nil {
+		return d, err
+	}
+	d.Value, _ = f.format(data, false)
+	return d, nil
+}
+
+// exprs 连接跟踪匹配的表达式
+func (d RuleCt) exprs() ([]expr.Any, error) {
+	d, err := d.normalize()
+	if err != nil {
+		return nil, err
+	}
+	f := ruleCtKeys[d.Key]
+	hton := f.hostOrder() && d.Op != "" && d.Op != "!="
+	data, err := f.data(d.Value, hton)
+	if err != nil {
+		return nil, err
+	}
+	r := []expr.Any{&expr.Ct{Key: f.key, Direction: f.dir, Register: 1}}
+	if f.kind == ctKindStatus && d.Op != "==" {
+		// 状态位匹配: & status != 0 或 & status == 0
+		op := expr.CmpOpNeq
+		if d.Op == "!=" {
+			op = expr.CmpOpEq
+		}
+		return append(r,
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: data, Xor: make([]byte, 4)},
+			&expr.Cmp{Op: op, Register: 1, Data: make([]byte, 4)},
+		), nil
+	}
+	if hton {
+		r = append(r, &expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: f.size, Size: f.size})
+	}
+	return append(r, &expr.Cmp{Op: headerCmpOps[d.Op], Register: 1, Data: data}), nil
+}
+
+// ctKeyOf 按加载的键与方向查找连接跟踪字段
+func ctKeyOf(ct *expr.Ct) (string, bool) {
+	for name, f := range ruleCtKeys {
+		if f.key == ct.Key && (f.kind != ctKindAddr && f.kind != ctKindPort || f.dir == ct.Direction) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// toRuleCt 解析连接跟踪字段的比较, btw hton为加载后的位运算与字节序转换
+func toRuleCt(name string, btw *expr.Bitwise, hton bool, cmp *expr.Cmp) (RuleCt, bool) {
+	f := ruleCtKeys[name]
+	c := RuleCt{Key: name}
+	if btw != nil {
+		// 仅status支持 & status != 0 与 & status == 0
+		if f.kind != ctKindStatus || hton || len(cmp.Data) != 4 || binaryutil.NativeEndian.Uint32(cmp.Data) != 0 {
+			return c, false
+		}
+		switch cmp.Op {
+		case expr.CmpOpNeq:
+		case expr.CmpOpEq:
+			c.Op = "!="
+		default:
+			return c, false
+		}
+		v, ok := f.format(btw.Mask, false)
+		c.Value = v
+		return c, ok && v != ""
+	}
+	if hton && !f.hostOrder() {
+		return c, false
+	}
+	for _, k := range []string{"==", "!=", "<", ">", "<=", ">="} {
+		if headerCmpOps[k] == cmp.Op {
+			c.Op = k
+		}
+	}
+	if c.Op == "==" && f.kind != ctKindStatus {
+		c.Op = ""
+	}
+	if c.Op != "" && c.Op != "==" && c.Op != "!=" && (!f.ordered() || f.hostOrder() && !hton) {
+		return c, false
+	}
+	if f.kind == ctKindStatus && c.Op == "!=" {
+		return c, false
+	}
+	v, ok := f.format(cmp.Data, hton)
+	c.Value = v
+	return c, ok
+}
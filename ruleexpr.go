@@ -3,16 +3,21 @@
 package nftlib
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 	"net"
+	"reflect"
 	"strconv"
 	"strings"
 )
 
-// parseIpv4Expr offset=12为源IP,offset=16为目标IP
+// parseIpv4Expr offset=12为源IP,offset=16为目标IP, 以!开头表示不匹配
 func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 	var (
 		r       []expr.Any
@@ -23,6 +28,8 @@ func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 			Len:          4,
 		}
 	)
+	ipaddr, neg := splitNeg(ipaddr)
+	op := cmpOp(neg)
 	if strings.Contains(ipaddr, "/") {
 		_, netw, err := net.ParseCIDR(ipaddr)
 		if err != nil {
@@ -38,7 +45,7 @@ func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 					Xor:            make([]byte, 4),
 				},
 				&expr.Cmp{
-					Op:       expr.CmpOpEq,
+					Op:       op,
 					Register: 1,
 					Data:     netw.IP,
 				},
@@ -59,7 +66,7 @@ func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 		if start != nil && end != nil {
 			r = append(r, pldExpr,
 				&expr.Range{
-					Op:       expr.CmpOpEq,
+					Op:       op,
 					Register: 1,
 					FromData: start,
 					ToData:   end,
@@ -74,7 +81,7 @@ func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 	if ip := net.ParseIP(ipaddr).To4(); ip != nil {
 		r = append(r, pldExpr,
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
+				Op:       op,
 				Register: 1,
 				Data:     ip,
 			},
@@ -86,6 +93,7 @@ func parseIpv4Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 		r = append(r, pldExpr,
 			&expr.Lookup{
 				SourceRegister: 1,
+				Invert:         neg,
 				SetName:        ipaddr,
 			},
 		)
@@ -105,6 +113,8 @@ func parseIpv6Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 			Len:          16,
 		}
 	)
+	ipaddr, neg := splitNeg(ipaddr)
+	op := cmpOp(neg)
 	if strings.Contains(ipaddr, "/") {
 		_, netw, err := net.ParseCIDR(ipaddr)
 		if err != nil {
@@ -120,7 +130,7 @@ func parseIpv6Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 					Xor:            make([]byte, 16),
 				},
 				&expr.Cmp{
-					Op:       expr.CmpOpEq,
+					Op:       op,
 					Register: 1,
 					Data:     netw.IP,
 				},
@@ -141,7 +151,7 @@ func parseIpv6Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 		if start != nil && end != nil && start.To4() == nil && end.To4() == nil {
 			r = append(r, pldExpr,
 				&expr.Range{
-					Op:       expr.CmpOpEq,
+					Op:       op,
 					Register: 1,
 					FromData: start,
 					ToData:   end,
@@ -157,7 +167,7 @@ func parseIpv6Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 		if ip.To4() == nil {
 			r = append(r, pldExpr,
 				&expr.Cmp{
-					Op:       expr.CmpOpEq,
+					Op:       op,
 					Register: 1,
 					Data:     ip,
 				},
@@ -172,6 +182,7 @@ func parseIpv6Expr(ipaddr string, offset uint32) ([]expr.Any, error) {
 		r = append(r, pldExpr,
 			&expr.Lookup{
 				SourceRegister: 1,
+				Invert:         neg,
 				SetName:        ipaddr,
 			},
 		)
@@ -192,6 +203,8 @@ func parsePortExpr(port string, offset uint32) ([]expr.Any, error) {
 			Offset:       offset,
 		}
 	)
+	port, neg := splitNeg(port)
+	op := cmpOp(neg)
 	if strings.Contains(port, "-") {
 		l := strings.Split(port, "-")
 		if len(l) != 2 {
@@ -210,7 +223,7 @@ func parsePortExpr(port string, offset uint32) ([]expr.Any, error) {
 		}
 		r = append(r, pldExpr,
 			&expr.Range{
-				Op:       expr.CmpOpEq,
+				Op:       op,
 				Register: 1,
 				FromData: binaryutil.BigEndian.PutUint16(uint16(start)),
 				ToData:   binaryutil.BigEndian.PutUint16(uint16(end)),
@@ -222,7 +235,7 @@ func parsePortExpr(port string, offset uint32) ([]expr.Any, error) {
 	if pt, err := strconv.ParseUint(port, 10, 16); err == nil {
 		r = append(r, pldExpr,
 			&expr.Cmp{
-				Op:       expr.CmpOpEq,
+				Op:       op,
 				Register: 1,
 				Data:     binaryutil.BigEndian.PutUint16(uint16(pt)),
 			},
@@ -234,7 +247,7 @@ func parsePortExpr(port string, offset uint32) ([]expr.Any, error) {
 		r = append(r, pldExpr,
 			&expr.Lookup{
 				SourceRegister: 1,
-				Invert:         false,
+				Invert:         neg,
 				SetName:        port,
 			},
 		)
@@ -244,7 +257,7 @@ func parsePortExpr(port string, offset uint32) ([]expr.Any, error) {
 	return nil, errors.New(fmt.Sprintf("parse port expr error, format mismatch,port=%s", port))
 }
 
-func parseCtState(ctList []string) ([]expr.Any, error) {
+func parseCtState(ctList []string, neg bool) ([]expr.Any, error) {
 	var (
 		r   []expr.Any
 		stt uint32
@@ -266,9 +279,1081 @@ func parseCtState(ctList []string) ([]expr.Any, error) {
 				Mask:           binaryutil.NativeEndian.PutUint32(stt),
 				Xor:            binaryutil.NativeEndian.PutUint32(0),
 			},
-			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+			// 任一状态置位时不为0, 不匹配时要求均未置位
+			&expr.Cmp{Op: cmpOp(!neg), Register: 1, Data: make([]byte, 4)},
 		)
 		return r, nil
 	}
 	return nil, errors.New(fmt.Sprintf("parse ct state error,ct=%v", ctList))
 }
+
+// rangeData 取出Range表达式中的数据, 旧版本google/nftables未解开嵌套属性, 数据前带有4字节属性头
+func rangeData(data []byte, size int) []byte {
+	if len(data) >= size+4 {
+		return data[4 : 4+size]
+	}
+	if len(data) < size {
+		return make([]byte, size)
+	}
+	return data[:size]
+}
+
+// parseNatExpr 转换地址写入寄存器1-2, 转换端口写入寄存器3-4
+func parseNatExpr(action, addr, port string, flags []string, family byte) ([]expr.Any, error) {
+	var (
+		r                        []expr.Any
+		regAddrMin, regAddrMax   uint32
+		regProtoMin, regProtoMax uint32
+		random, fully, persist   bool
+	)
+	if addr != "" {
+		if action != RuleActSnat && action != RuleActDnat {
+			return nil, errors.New(fmt.Sprintf("parse nat failed, %s does not take an address,addr=%s", action, addr))
+		}
+		l := strings.Split(addr, "-")
+		if len(l) > 2 {
+			return nil, errors.New(fmt.Sprintf("parse nat failed, addr format mismatch,addr=%s", addr))
+		}
+		for i, s := range l {
+			ip := net.ParseIP(s)
+			if ip != nil && family == unix.NFPROTO_IPV4 {
+				ip = ip.To4()
+			} else if ip != nil && ip.To4() != nil {
+				ip = nil
+			}
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("parse nat failed, addr format mismatch,addr=%s", addr))
+			}
+			r = append(r, &expr.Immediate{Register: uint32(i + 1), Data: ip})
+		}
+		regAddrMin = 1
+		if len(l) == 2 {
+			regAddrMax = 2
+		}
+	}
+	if port != "" {
+		l := strings.Split(port, "-")
+		if len(l) > 2 {
+			return nil, errors.New(fmt.Sprintf("parse nat failed, port format mismatch,port=%s", port))
+		}
+		for i, s := range l {
+			n, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("parse nat failed, port format mismatch,port=%s", port))
+			}
+			r = append(r, &expr.Immediate{Register: uint32(i + 3), Data: binaryutil.BigEndian.PutUint16(uint16(n))})
+		}
+		regProtoMin = 3
+		if len(l) == 2 {
+			regProtoMax = 4
+		}
+	}
+	for _, f := range flags {
+		switch f {
+		case RuleNatRandom:
+			random = true
+		case RuleNatFullyRandom:
+			fully = true
+		case RuleNatPersistent:
+			persist = true
+		default:
+			return nil, fmt.Errorf("%w: nat flag %s", ErrUnsupportedExpr, f)
+		}
+	}
+	switch action {
+	case RuleActSnat, RuleActDnat:
+		nat := &expr.NAT{
+			Type:        expr.NATTypeSourceNAT,
+			Family:      uint32(family),
+			RegAddrMin:  regAddrMin,
+			RegAddrMax:  regAddrMax,
+			RegProtoMin: regProtoMin,
+			RegProtoMax: regProtoMax,
+			Random:      random,
+			FullyRandom: fully,
+			Persistent:  persist,
+			Specified:   regProtoMin != 0,
+		}
+		if action == RuleActDnat {
+			nat.Type = expr.NATTypeDestNAT
+		}
+		r = append(r, nat)
+	case RuleActMasq:
+		r = append(r, &expr.Masq{
+			Random:      random,
+			FullyRandom: fully,
+			Persistent:  persist,
+			ToPorts:     regProtoMin != 0,
+			RegProtoMin: regProtoMin,
+			RegProtoMax: regProtoMax,
+		})
+	case RuleActRedir:
+		var nflags uint32
+		if regProtoMin != 0 {
+			nflags |= expr.NF_NAT_RANGE_PROTO_SPECIFIED
+		}
+		if random {
+			nflags |= expr.NF_NAT_RANGE_PROTO_RANDOM
+		}
+		if fully {
+			nflags |= expr.NF_NAT_RANGE_PROTO_RANDOM_FULLY
+		}
+		if persist {
+			nflags |= expr.NF_NAT_RANGE_PERSISTENT
+		}
+		r = append(r, &expr.Redir{RegisterProtoMin: regProtoMin, RegisterProtoMax: regProtoMax, Flags: nflags})
+	}
+	return r, nil
+}
+
+// natRegAddr 从寄存器中取出nat地址, min为0表示不转换地址
+func natRegAddr(regs map[uint32][]byte, min, max uint32) string {
+	if min == 0 || regs[min] == nil {
+		return ""
+	}
+	addr := net.IP(regs[min]).String()
+	if max != 0 && regs[max] != nil {
+		addr += "-" + net.IP(regs[max]).String()
+	}
+	return addr
+}
+
+// natRegPort 从寄存器中取出nat端口, min为0表示不转换端口
+func natRegPort(regs map[uint32][]byte, min, max uint32) string {
+	if min == 0 || len(regs[min]) < 2 {
+		return ""
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(regs[min])))
+	if max != 0 && len(regs[max]) >= 2 && !bytes.Equal(regs[max], regs[min]) {
+		port += "-" + strconv.Itoa(int(binary.BigEndian.Uint16(regs[max])))
+	}
+	return port
+}
+
+func natFlags(random, fully, persist bool) []string {
+	var r []string
+	if random {
+		r = append(r, RuleNatRandom)
+	}
+	if fully {
+		r = append(r, RuleNatFullyRandom)
+	}
+	if persist {
+		r = append(r, RuleNatPersistent)
+	}
+	return r
+}
+
+func parseLimitExpr(lmt *RuleLimit) (*expr.Limit, error) {
+	unit, ok := limitUnitMap[lmt.Unit]
+	if !ok {
+		return nil, fmt.Errorf("%w: limit unit %s", ErrUnsupportedExpr, lmt.Unit)
+	}
+	if lmt.Rate == 0 {
+		return nil, errors.New("parse limit failed, rate must be positive")
+	}
+	return &expr.Limit{Type: expr.LimitTypePkts, Rate: lmt.Rate, Unit: unit, Burst: lmt.Burst, Over: lmt.Over}, nil
+}
+
+// parseLogExpr Key中按NFTA_LOG_*的位标记设置了哪些属性
+func parseLogExpr(log *RuleLog) (*expr.Log, error) {
+	var r = new(expr.Log)
+	if log.Prefix != "" {
+		r.Key |= 1 << unix.NFTA_LOG_PREFIX
+		r.Data = []byte(log.Prefix)
+	}
+	if log.Group != nil {
+		if log.Level != "" || len(log.Flags) > 0 {
+			return nil, errors.New("parse log failed, level and flags are not allowed with group")
+		}
+		r.Key |= 1 << unix.NFTA_LOG_GROUP
+		r.Group = *log.Group
+		if log.Snaplen != 0 {
+			r.Key |= 1 << unix.NFTA_LOG_SNAPLEN
+			r.Snaplen = log.Snaplen
+		}
+		return r, nil
+	}
+	if log.Snaplen != 0 {
+		return nil, errors.New("parse log failed, snaplen requires group")
+	}
+	if log.Level != "" {
+		lvl := -1
+		for i, v := range logLevelList {
+			if v == log.Level {
+				lvl = i
+			}
+		}
+		if lvl < 0 {
+			return nil, fmt.Errorf("%w: log level %s", ErrUnsupportedExpr, log.Level)
+		}
+		r.Key |= 1 << unix.NFTA_LOG_LEVEL
+		r.Level = expr.LogLevel(lvl)
+	}
+	for _, f := range log.Flags {
+		if f == RuleLogAll {
+			r.Flags |= expr.LogFlagsMask
+			continue
+		}
+		v, ok := logFlagMap[f]
+		if !ok {
+			return nil, fmt.Errorf("%w: log flag %s", ErrUnsupportedExpr, f)
+		}
+		r.Flags |= v
+	}
+	if r.Flags != 0 {
+		r.Key |= 1 << unix.NFTA_LOG_FLAGS
+	}
+	return r, nil
+}
+
+// toRuleLog 解析日志表达式, 默认级别warn不记录
+func toRuleLog(nlog *expr.Log) *RuleLog {
+	var log = &RuleLog{Prefix: string(bytes.TrimRight(nlog.Data, "\x00"))}
+	if nlog.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+		group := nlog.Group
+		log.Group = &group
+		log.Snaplen = nlog.Snaplen
+		return log
+	}
+	if nlog.Key&(1<<unix.NFTA_LOG_LEVEL) != 0 && int(nlog.Level) < len(logLevelList) && nlog.Level != expr.LogLevelWarning {
+		log.Level = logLevelList[nlog.Level]
+	}
+	if nlog.Flags&expr.LogFlagsMask == expr.LogFlagsMask {
+		log.Flags = []string{RuleLogAll}
+		return log
+	}
+	for _, f := range []string{RuleLogTcpSeq, RuleLogTcpOpt, RuleLogIpOpt, RuleLogSkUid, RuleLogEther} {
+		if nlog.Flags&logFlagMap[f] != 0 {
+			log.Flags = append(log.Flags, f)
+		}
+	}
+	return log
+}
+
+// markValue 标记设置语句的取值: 立即数, 或从meta mark/ct mark复制后做 (v & mask) ^ xor 运算
+type markValue struct {
+	// src meta mark或ct mark, 为空表示立即数
+	src  string
+	imm  uint32
+	mask uint32
+	xor  uint32
+}
+
+// parseMarkValue 解析 0x1 | meta mark | ct mark [and|or|xor <n>]...
+func parseMarkValue(s string) (*markValue, error) {
+	var (
+		r   = &markValue{mask: 0xffffffff}
+		tks = strings.Fields(s)
+	)
+	if len(tks) == 0 {
+		return nil, errors.New("parse mark failed, empty value")
+	}
+	if tks[0] == "meta" || tks[0] == "ct" {
+		if len(tks) < 2 || tks[1] != "mark" {
+			return nil, errors.New(fmt.Sprintf("parse mark failed, value format mismatch,mark=%s", s))
+		}
+		r.src = tks[0] + " mark"
+		tks = tks[2:]
+	} else {
+		n, err := strconv.ParseUint(tks[0], 0, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("parse mark failed, value format mismatch,mark=%s", s))
+		}
+		r.imm = uint32(n)
+		tks = tks[1:]
+	}
+	if r.src == "" && len(tks) > 0 {
+		return nil, errors.New(fmt.Sprintf("parse mark failed, operation on immediate value,mark=%s", s))
+	}
+	for ; len(tks) > 0; tks = tks[2:] {
+		if len(tks) < 2 {
+			return nil, errors.New(fmt.Sprintf("parse mark failed, value format mismatch,mark=%s", s))
+		}
+		n, err := strconv.ParseUint(tks[1], 0, 32)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("parse mark failed, value format mismatch,mark=%s", s))
+		}
+		v := uint32(n)
+		switch tks[0] {
+		case "and", "&":
+			r.mask &= v
+			r.xor &= v
+		case "or", "|":
+			r.mask &^= v
+			r.xor |= v
+		case "xor", "^":
+			r.xor ^= v
+		default:
+			return nil, errors.New(fmt.Sprintf("parse mark failed, unknown operation %s,mark=%s", tks[0], s))
+		}
+	}
+	return r, nil
+}
+
+// String 以nft格式输出, 运算化简为 and/or/xor
+func (d *markValue) String() string {
+	if d.src == "" {
+		return fmt.Sprintf("0x%x", d.imm)
+	}
+	switch {
+	case d.mask == 0xffffffff && d.xor == 0:
+		return d.src
+	case d.xor != 0 && d.mask == ^d.xor:
+		return fmt.Sprintf("%s or 0x%x", d.src, d.xor)
+	case d.mask == 0xffffffff:
+		return fmt.Sprintf("%s xor 0x%x", d.src, d.xor)
+	case d.xor == 0:
+		return fmt.Sprintf("%s and 0x%x", d.src, d.mask)
+	}
+	return fmt.Sprintf("%s and 0x%x xor 0x%x", d.src, d.mask, d.xor)
+}
+
+// parseMarkSetExpr 将取值写入寄存器1后由set表达式写入标记
+func parseMarkSetExpr(value string, set expr.Any) ([]expr.Any, error) {
+	var r []expr.Any
+	mv, err := parseMarkValue(value)
+	if err != nil {
+		return nil, err
+	}
+	switch mv.src {
+	case "":
+		r = append(r, &expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(mv.imm)})
+	case "meta mark":
+		r = append(r, &expr.Meta{Key: expr.MetaKeyMARK, Register: 1})
+	case "ct mark":
+		r = append(r, &expr.Ct{Key: expr.CtKeyMARK, Register: 1})
+	}
+	if mv.src != "" && (mv.mask != 0xffffffff || mv.xor != 0) {
+		r = append(r, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(mv.mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(mv.xor),
+		})
+	}
+	return append(r, set), nil
+}
+
+// parseMarkMatch 解析 value 或 value/mask
+func parseMarkMatch(s string) (value, mask uint32, err error) {
+	l := strings.SplitN(s, "/", 2)
+	v, err := strconv.ParseUint(l[0], 0, 32)
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("parse mark failed, match format mismatch,mark=%s", s))
+	}
+	mask = 0xffffffff
+	if len(l) == 2 {
+		m, err := strconv.ParseUint(l[1], 0, 32)
+		if err != nil {
+			return 0, 0, errors.New(fmt.Sprintf("parse mark failed, match format mismatch,mark=%s", s))
+		}
+		mask = uint32(m)
+	}
+	return uint32(v) & mask, mask, nil
+}
+
+// parseMarkMatchExpr load为加载标记到寄存器1的表达式
+func parseMarkMatchExpr(mark string, load expr.Any) ([]expr.Any, error) {
+	value, mask, err := parseMarkMatch(mark)
+	if err != nil {
+		return nil, err
+	}
+	r := []expr.Any{load}
+	if mask != 0xffffffff {
+		r = append(r, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(mask),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		})
+	}
+	return append(r, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(value)}), nil
+}
+
+// renderMarkMatch 以value或value/mask格式输出标记匹配
+func renderMarkMatch(value, mask uint32) string {
+	if mask == 0xffffffff {
+		return fmt.Sprintf("0x%x", value)
+	}
+	return fmt.Sprintf("0x%x/0x%x", value, mask)
+}
+
+// parseMetaPriority 解析tc句柄格式的skb优先级, 如 1:10, none, root
+func parseMetaPriority(s string) (uint32, error) {
+	switch s {
+	case "none":
+		return 0, nil
+	case "root":
+		return 0xffffffff, nil
+	}
+	l := strings.SplitN(s, ":", 2)
+	if len(l) != 2 {
+		return 0, errors.New(fmt.Sprintf("parse priority failed, format mismatch,priority=%s", s))
+	}
+	major, err := strconv.ParseUint(l[0], 16, 16)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("parse priority failed, format mismatch,priority=%s", s))
+	}
+	minor, err := strconv.ParseUint(l[1], 16, 16)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("parse priority failed, format mismatch,priority=%s", s))
+	}
+	return uint32(major<<16 | minor), nil
+}
+
+func renderMetaPriority(v uint32) string {
+	switch v {
+	case 0:
+		return "none"
+	case 0xffffffff:
+		return "root"
+	}
+	return fmt.Sprintf("%x:%x", v>>16, v&0xffff)
+}
+
+// markSetValue 由加载到寄存器的标记及位运算, 或写入寄存器的立即数还原设置语句的取值
+func markSetValue(load string, btw *expr.Bitwise, imm []byte) string {
+	if load == "" {
+		if len(imm) < 4 {
+			return ""
+		}
+		return (&markValue{imm: binaryutil.NativeEndian.Uint32(imm)}).String()
+	}
+	mv := &markValue{src: load, mask: 0xffffffff}
+	if btw != nil && len(btw.Mask) == 4 && len(btw.Xor) == 4 {
+		mv.mask = binaryutil.NativeEndian.Uint32(btw.Mask)
+		mv.xor = binaryutil.NativeEndian.Uint32(btw.Xor)
+	}
+	return mv.String()
+}
+
+// isIfindex 纯数字的接口值表示接口索引
+func isIfindex(iface string) bool {
+	_, err := strconv.ParseUint(iface, 10, 32)
+	return err == nil
+}
+
+// parseIfaceExpr 接口匹配, 接口名使用nameKey, 接口索引使用indexKey
+// 精确匹配的接口名补零到IFNAMSIZ长度, 前缀匹配只比较*之前的部分
+func parseIfaceExpr(iface string, nameKey, indexKey expr.MetaKey) ([]expr.Any, error) {
+	iface, neg := splitNeg(iface)
+	if strings.HasPrefix(iface, "@") {
+		return []expr.Any{
+			&expr.Meta{Key: nameKey, Register: 1},
+			&expr.Lookup{SourceRegister: 1, SetName: iface[1:], Invert: neg},
+		}, nil
+	}
+	if isIfindex(iface) {
+		idx, _ := strconv.ParseUint(iface, 10, 32)
+		return []expr.Any{
+			&expr.Meta{Key: indexKey, Register: 1},
+			&expr.Cmp{Op: cmpOp(neg), Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(idx))},
+		}, nil
+	}
+	name := strings.TrimSuffix(iface, "*")
+	if name == "" || len(name) >= unix.IFNAMSIZ || strings.ContainsAny(name, "*\" \t/") {
+		return nil, fmt.Errorf("invalid interface name %q", iface)
+	}
+	data := []byte(name)
+	if name == iface {
+		data = ifnameBytes(name)
+	}
+	return []expr.Any{
+		&expr.Meta{Key: nameKey, Register: 1},
+		&expr.Cmp{Op: cmpOp(neg), Register: 1, Data: data},
+	}, nil
+}
+
+// ifnameBytes 接口名补零到IFNAMSIZ长度
+func ifnameBytes(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return data
+}
+
+// ifnameString 解析接口名, 不含结束符时为前缀匹配
+func ifnameString(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return string(data[:i])
+	}
+	return string(data) + "*"
+}
+
+// splitNeg 去除表示不匹配的!前缀
+func splitNeg(s string) (string, bool) {
+	if strings.HasPrefix(s, "!") {
+		return strings.TrimPrefix(s, "!"), true
+	}
+	return s, false
+}
+
+// cmpOp 匹配与不匹配对应的比较操作
+func cmpOp(neg bool) expr.CmpOp {
+	if neg {
+		return expr.CmpOpNeq
+	}
+	return expr.CmpOpEq
+}
+
+// negPrefix 不匹配时返回!前缀
+func negPrefix(neg bool) string {
+	if neg {
+		return "!"
+	}
+	return ""
+}
+
+// isValueList 取值是否为逗号分隔的列表
+func isValueList(value string) bool {
+	return strings.Contains(value, ",")
+}
+
+// isAnonSetName 内核为匿名集合与匿名映射分配的名称
+func isAnonSetName(name string) bool {
+	return strings.HasPrefix(name, "__set") || strings.HasPrefix(name, "__map")
+}
+
+// ifaceParser 以matchExpr所需的形式包装parseIfaceExpr
+func ifaceParser(nameKey, indexKey expr.MetaKey) func(string, uint32) ([]expr.Any, error) {
+	return func(iface string, _ uint32) ([]expr.Any, error) {
+		return parseIfaceExpr(iface, nameKey, indexKey)
+	}
+}
+
+// matchExpr 单个取值由parse解析, 逗号分隔的列表使用绑定到规则的匿名集合匹配
+func (d *Rule) matchExpr(value, dtype string, offset uint32, parse func(string, uint32) ([]expr.Any, error)) ([]expr.Any, error) {
+	if !isValueList(value) {
+		return parse(value, offset)
+	}
+	list, neg := splitNeg(value)
+	var (
+		elems    = strings.Split(list, ",")
+		load     expr.Any
+		interval bool
+	)
+	for i, elem := range elems {
+		elem = strings.TrimSpace(elem)
+		elems[i] = elem
+		if dtype == SetDtypeIfname && isIfindex(elem) {
+			return nil, fmt.Errorf("interface index %s in list %s", elem, value)
+		}
+		exprs, err := parse(elem, offset)
+		if err != nil {
+			return nil, err
+		}
+		// 列表元素不能是集合引用或取反
+		if _, ok := exprs[len(exprs)-1].(*expr.Lookup); ok || strings.HasPrefix(elem, "!") {
+			return nil, fmt.Errorf("invalid element %q in list %s", elem, value)
+		}
+		load = exprs[0]
+		if c, ok := dtypeCodecs[dtype]; ok {
+			// 具名取值中可能包含-
+			if start, end, err := codecSplit(c, elem); err == nil && start != end {
+				interval = true
+			}
+		} else if dtype != SetDtypeIfname && strings.ContainsAny(elem, "-/") {
+			interval = true
+		}
+	}
+	nelems, err := setElemToNElem(dtype, interval, elems)
+	if err != nil {
+		return nil, err
+	}
+	if interval {
+		nelems = padIntervalElems(dtype, nelems)
+	}
+	as := &anonSet{
+		set: &nftables.Set{
+			Table:     d.Chain.Table.toNTable(),
+			Anonymous: true,
+			Constant:  true,
+			Interval:  interval,
+			KeyType:   dtypeList[dtype],
+		},
+		elems:  nelems,
+		lookup: &expr.Lookup{SourceRegister: 1, Invert: neg},
+	}
+	d.anonSets = append(d.anonSets, as)
+	return []expr.Any{load, as.lookup}, nil
+}
+
+// anonSetValue 读取规则引用的匿名集合, 还原为逗号分隔的列表
+func (d *Rule) anonSetValue(name string) (string, error) {
+	nset, err := d.conn.GetSetByName(d.Chain.Table.toNTable(), name)
+	if err != nil {
+		return "", err
+	}
+	nelems, err := d.conn.GetSetElements(nset)
+	if err != nil {
+		return "", err
+	}
+	set := new(Set)
+	if err = set.toSet(*nset, nelems...); err != nil {
+		return "", err
+	}
+	return strings.Join(set.Elements, ","), nil
+}
+
+// ruleMapKey 映射查找键对应的集合数据类型、所需的L3/L4协议及加载到指定寄存器的表达式
+type ruleMapKey struct {
+	dtype string
+	l3    string
+	l4    string
+	load  func(reg uint32) expr.Any
+}
+
+var (
+	// ruleMapKeys 规则支持的映射查找键
+	ruleMapKeys = map[string]ruleMapKey{
+		"ip saddr":      {SetDtypeIpv4, RuleL3Ip, "", payloadLoad(expr.PayloadBaseNetworkHeader, 12, 4)},
+		"ip daddr":      {SetDtypeIpv4, RuleL3Ip, "", payloadLoad(expr.PayloadBaseNetworkHeader, 16, 4)},
+		"ip6 saddr":     {SetDtypeIpv6, RuleL3Ip6, "", payloadLoad(expr.PayloadBaseNetworkHeader, 8, 16)},
+		"ip6 daddr":     {SetDtypeIpv6, RuleL3Ip6, "", payloadLoad(expr.PayloadBaseNetworkHeader, 24, 16)},
+		"tcp sport":     {SetDtypePort, "", RuleL4Tcp, payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"tcp dport":     {SetDtypePort, "", RuleL4Tcp, payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+		"udp sport":     {SetDtypePort, "", RuleL4Udp, payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"udp dport":     {SetDtypePort, "", RuleL4Udp, payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+		"sctp sport":    {SetDtypePort, "", RuleL4Sctp, payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"sctp dport":    {SetDtypePort, "", RuleL4Sctp, payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+		"dccp sport":    {SetDtypePort, "", RuleL4Dccp, payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"dccp dport":    {SetDtypePort, "", RuleL4Dccp, payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+		"udplite sport": {SetDtypePort, "", RuleL4UdpLite, payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"udplite dport": {SetDtypePort, "", RuleL4UdpLite, payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+		"iifname":       {SetDtypeIfname, "", "", metaLoad(expr.MetaKeyIIFNAME)},
+		"oifname":       {SetDtypeIfname, "", "", metaLoad(expr.MetaKeyOIFNAME)},
+	}
+	// ruleMapMatches 加载查找键的匹配字段对应的查找键, 端口由L4协议补全
+	ruleMapMatches = map[string]string{
+		curMatchL3SAddr:  "ip saddr",
+		curMatchL3DAddr:  "ip daddr",
+		curMatchL3SAddr6: "ip6 saddr",
+		curMatchL3DAddr6: "ip6 daddr",
+		curMatchL4SPort:  "sport",
+		curMatchL4DPort:  "dport",
+		curMatchIifname:  "iifname",
+		curMatchOifname:  "oifname",
+	}
+	// ruleConcatKeys 仅用于拼接匹配的键, 其余可用的键同ruleMapKeys
+	ruleConcatKeys = map[string]ruleMapKey{
+		"meta l4proto": {SetDtypeProto, "", "", metaLoad(expr.MetaKeyL4PROTO)},
+		"th sport":     {SetDtypePort, "", "", payloadLoad(expr.PayloadBaseTransportHeader, 0, 2)},
+		"th dport":     {SetDtypePort, "", "", payloadLoad(expr.PayloadBaseTransportHeader, 2, 2)},
+	}
+)
+
+// concatReg32 拼接键从寄存器1开始存放, 寄存器1即32位寄存器NFT_REG32_00
+const concatReg32 = 8
+
+func payloadLoad(base expr.PayloadBase, offset, size uint32) func(uint32) expr.Any {
+	return func(reg uint32) expr.Any {
+		return &expr.Payload{DestRegister: reg, Base: base, Offset: offset, Len: size}
+	}
+}
+
+func metaLoad(key expr.MetaKey) func(uint32) expr.Any {
+	return func(reg uint32) expr.Any {
+		return &expr.Meta{Key: key, Register: reg}
+	}
+}
+
+// concatKey 拼接匹配支持的键
+func concatKey(key string) (ruleMapKey, bool) {
+	if k, ok := ruleMapKeys[key]; ok {
+		return k, true
+	}
+	k, ok := ruleConcatKeys[key]
+	return k, ok
+}
+
+// useMapKey 设置映射查找键隐含的L3/L4协议
+func (d *Rule) useMapKey(key string) error {
+	k, ok := ruleMapKeys[key]
+	if !ok {
+		return fmt.Errorf("%w: map key %s", ErrUnsupportedExpr, key)
+	}
+	return d.useKeyProto(k)
+}
+
+// useConcat 设置拼接匹配的各个键隐含的L3/L4协议
+func (d *Rule) useConcat(keys []string) error {
+	for _, key := range keys {
+		k, ok := concatKey(key)
+		if !ok {
+			return fmt.Errorf("%w: concat key %s", ErrUnsupportedExpr, key)
+		}
+		if err := d.useKeyProto(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Rule) useKeyProto(k ruleMapKey) error {
+	if k.l3 != "" {
+		if d.L3Proto != "" && d.L3Proto != k.l3 {
+			return fmt.Errorf("conflicting l3 protocol %s and %s", d.L3Proto, k.l3)
+		}
+		d.L3Proto = k.l3
+	}
+	if k.l4 != "" {
+		if d.L4Proto != "" && d.L4Proto != k.l4 {
+			return fmt.Errorf("conflicting l4 protocol %s and %s", d.L4Proto, k.l4)
+		}
+		d.L4Proto = k.l4
+	}
+	return nil
+}
+
+// l4ProtoPayload 四层协议是否以 ip protocol/ip6 nexthdr 匹配,
+// 与nft一致, 规则已确定L3协议且四层协议未由端口、映射键或协议头隐含时使用
+func (d *Rule) l4ProtoPayload() bool {
+	if d.L4Proto == "" || (d.L3Proto != RuleL3Ip && d.L3Proto != RuleL3Ip6) {
+		return false
+	}
+	if isPortProto(d.L4Proto) && (d.L4SrcPort != "" || d.L4DstPort != "") {
+		return false
+	}
+	_, mapL4 := d.mapProto()
+	return d.L4Proto != mapL4
+}
+
+// mapProto 规则引用的映射查找键、拼接匹配与集合更新的键及协议头匹配隐含的L3/L4协议
+func (d *Rule) mapProto() (l3, l4 string) {
+	var keys []string
+	for _, rm := range []*RuleMap{d.VMap, d.NatMap} {
+		if rm != nil {
+			keys = append(keys, rm.Key)
+		}
+	}
+	if d.Concat != nil {
+		keys = append(keys, d.Concat.Keys...)
+	}
+	if d.SetUpdate != nil {
+		keys = append(keys, d.SetUpdate.Keys...)
+	}
+	for _, key := range keys {
+		if k, ok := concatKey(key); ok {
+			if k.l3 != "" {
+				l3 = k.l3
+			}
+			if k.l4 != "" {
+				l4 = k.l4
+			}
+		}
+	}
+	for _, h := range d.Headers {
+		if f, ok := ruleHeaderFields[h.Field]; ok {
+			if f.l3 != "" {
+				l3 = f.l3
+			}
+			if f.l4 != "" {
+				l4 = f.l4
+			}
+		}
+	}
+	return l3, l4
+}
+
+// mapExpr 映射查找, dreg为0时查找结果作为verdict, 否则写入dreg寄存器
+// 未指定映射名时以元素创建绑定到规则的匿名映射
+func (d *Rule) mapExpr(rm *RuleMap, dataType string, dreg uint32) ([]expr.Any, error) {
+	key, ok := ruleMapKeys[rm.Key]
+	if !ok {
+		return nil, fmt.Errorf("%w: map key %s", ErrUnsupportedExpr, rm.Key)
+	}
+	if key.l3 != "" && d.L3Proto != key.l3 {
+		return nil, fmt.Errorf("map key %s requires l3 protocol %s, got %q", rm.Key, key.l3, d.L3Proto)
+	}
+	if key.l4 != "" && d.L4Proto != key.l4 {
+		return nil, fmt.Errorf("map key %s requires l4 protocol %s, got %q", rm.Key, key.l4, d.L4Proto)
+	}
+	lookup := &expr.Lookup{SourceRegister: 1, DestRegister: dreg, IsDestRegSet: true, SetName: rm.Name}
+	if rm.Name != "" {
+		return []expr.Any{key.load(1), lookup}, nil
+	}
+	if len(rm.Elements) == 0 {
+		return nil, fmt.Errorf("empty anonymous map on %s", rm.Key)
+	}
+	var interval bool
+	for _, e := range rm.Elements {
+		if key.dtype != SetDtypeIfname && strings.ContainsAny(e.Key, "-/") {
+			interval = true
+		}
+	}
+	nelems, err := mapElemToNElem(key.dtype, dataType, interval, rm.Elements, true)
+	if err != nil {
+		return nil, err
+	}
+	if interval {
+		nelems = padIntervalElems(key.dtype, nelems)
+	}
+	ndtype, err := mapNDataType(dataType)
+	if err != nil {
+		return nil, err
+	}
+	as := &anonSet{
+		set: &nftables.Set{
+			Table:     d.Chain.Table.toNTable(),
+			Anonymous: true,
+			Constant:  true,
+			Interval:  interval,
+			IsMap:     true,
+			KeyType:   dtypeList[key.dtype],
+			DataType:  ndtype,
+		},
+		elems:  nelems,
+		lookup: lookup,
+	}
+	d.anonSets = append(d.anonSets, as)
+	return []expr.Any{key.load(1), lookup}, nil
+}
+
+// natMapExpr snat/dnat的映射查找, 查找结果作为转换地址写入寄存器1
+func (d *Rule) natMapExpr() ([]expr.Any, error) {
+	if d.Action != RuleActSnat && d.Action != RuleActDnat {
+		return nil, fmt.Errorf("%s does not take a map", d.Action)
+	}
+	if d.NatAddr != "" || d.NatPort != "" {
+		return nil, errors.New("nat map can not be combined with address or port")
+	}
+	dtype := SetDtypeIpv4
+	if d.natFamily() == unix.NFPROTO_IPV6 {
+		dtype = SetDtypeIpv6
+	}
+	return d.mapExpr(d.NatMap, dtype, 1)
+}
+
+// toRuleMap 解析映射查找, 查找键由之前加载的匹配字段确定, 匿名映射还原为元素列表
+func (d *Rule) toRuleMap(lp *expr.Lookup, curMatch string) (*RuleMap, error) {
+	key := ruleMapMatches[curMatch]
+	if curMatch == curMatchL4SPort || curMatch == curMatchL4DPort {
+		key = d.L4Proto + " " + key
+	}
+	if _, ok := ruleMapKeys[key]; !ok {
+		return nil, fmt.Errorf("%w: map lookup on %s", ErrUnsupportedExpr, curMatch)
+	}
+	rm := &RuleMap{Key: key, Name: lp.SetName}
+	if isAnonSetName(rm.Name) && d.conn != nil {
+		nset, err := d.conn.GetSetByName(d.Chain.Table.toNTable(), rm.Name)
+		if err != nil {
+			return nil, err
+		}
+		nelems, err := d.conn.GetSetElements(nset)
+		if err != nil {
+			return nil, err
+		}
+		m := new(Map)
+		if err = m.toMap(*nset, nelems...); err != nil {
+			return nil, err
+		}
+		rm.Name, rm.Elements = "", m.Elements
+	}
+	return rm, nil
+}
+
+// concatExpr 拼接匹配, 各字段依次加载到从寄存器1开始的连续32位寄存器后查找集合
+// 取值为集合引用时查找命名集合, 否则以元素创建绑定到规则的匿名集合
+func (d *Rule) concatExpr() ([]expr.Any, error) {
+	if len(d.Concat.Keys) < 2 {
+		return nil, fmt.Errorf("concat requires at least 2 keys, got %v", d.Concat.Keys)
+	}
+	r, dtypes, err := d.loadConcatKeys(d.Concat.Keys)
+	if err != nil {
+		return nil, err
+	}
+	value, neg := splitNeg(d.Concat.Value)
+	lookup := &expr.Lookup{SourceRegister: 1, Invert: neg}
+	if strings.HasPrefix(value, "@") {
+		lookup.SetName = value[1:]
+		return append(r, lookup), nil
+	}
+	var (
+		dtype    = strings.Join(dtypes, " . ")
+		elems    = strings.Split(value, ",")
+		interval bool
+	)
+	for i, elem := range elems {
+		elems[i] = strings.TrimSpace(elem)
+		for j, f := range strings.Split(elems[i], " . ") {
+			if j < len(dtypes) && dtypes[j] != SetDtypeProto && dtypes[j] != SetDtypeIfname && strings.ContainsAny(f, "-/") {
+				interval = true
+			}
+		}
+	}
+	nelems, err := setElemToNElem(dtype, interval, elems)
+	if err != nil {
+		return nil, err
+	}
+	ktype, _ := setNDatatype(dtype)
+	as := &anonSet{
+		set: &nftables.Set{
+			Table:         d.Chain.Table.toNTable(),
+			Anonymous:     true,
+			Constant:      true,
+			Interval:      interval,
+			Concatenation: interval,
+			KeyType:       ktype,
+		},
+		elems:  nelems,
+		lookup: lookup,
+	}
+	d.anonSets = append(d.anonSets, as)
+	return append(r, lookup), nil
+}
+
+// loadConcatKeys 将各个键依次加载到从寄存器1开始的连续32位寄存器, 返回加载表达式与各键的数据类型
+func (d *Rule) loadConcatKeys(keys []string) ([]expr.Any, []string, error) {
+	var (
+		r      []expr.Any
+		dtypes []string
+		off    uint32
+	)
+	for _, name := range keys {
+		key, ok := concatKey(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: concat key %s", ErrUnsupportedExpr, name)
+		}
+		if key.l3 != "" && d.L3Proto != key.l3 {
+			return nil, nil, fmt.Errorf("concat key %s requires l3 protocol %s, got %q", name, key.l3, d.L3Proto)
+		}
+		if key.l4 != "" && d.L4Proto != key.l4 {
+			return nil, nil, fmt.Errorf("concat key %s requires l4 protocol %s, got %q", name, key.l4, d.L4Proto)
+		}
+		reg := uint32(1)
+		if off > 0 {
+			reg = concatReg32 + off/4
+		}
+		r = append(r, key.load(reg))
+		dtypes = append(dtypes, key.dtype)
+		off += uint32(concatFieldLen(key.dtype)+3) &^ 3
+	}
+	// 16个32位寄存器共64字节
+	if off > 64 {
+		return nil, nil, fmt.Errorf("concat key %v too long", keys)
+	}
+	return r, dtypes, nil
+}
+
+// setUpdateExpr 集合更新, 元素各字段同拼接匹配加载到连续寄存器后添加或更新到集合
+func (d *Rule) setUpdateExpr() ([]expr.Any, error) {
+	su := d.SetUpdate
+	var op uint32
+	switch su.Op {
+	case RuleSetOpAdd:
+		op = unix.NFT_DYNSET_OP_ADD
+	case RuleSetOpUpdate:
+		op = unix.NFT_DYNSET_OP_UPDATE
+	default:
+		return nil, fmt.Errorf("%w: set operation %s", ErrUnsupportedExpr, su.Op)
+	}
+	if su.Set == "" || len(su.Keys) == 0 {
+		return nil, fmt.Errorf("set update requires set name and keys, got %q %v", su.Set, su.Keys)
+	}
+	r, _, err := d.loadConcatKeys(su.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return append(r, &expr.Dynset{SrcRegKey: 1, SetName: su.Set, Operation: op, Timeout: su.Timeout}), nil
+}
+
+// toRuleKeys 解析加载到连续寄存器的键及其后的拼接集合查找或集合更新, 返回解析的表达式数量, 不是这两种语句时返回0
+func (d *Rule) toRuleKeys(exprs []expr.Any) (int, error) {
+	var (
+		keys []string
+		off  uint32
+	)
+	for i, e := range exprs {
+		if ds, ok := e.(*expr.Dynset); ok {
+			if len(keys) == 0 || ds.SrcRegKey != 1 || ds.SrcRegData != 0 || len(ds.Exprs) > 0 {
+				return 0, nil
+			}
+			var op string
+			switch ds.Operation {
+			case unix.NFT_DYNSET_OP_ADD:
+				op = RuleSetOpAdd
+			case unix.NFT_DYNSET_OP_UPDATE:
+				op = RuleSetOpUpdate
+			default:
+				return 0, fmt.Errorf("%w: dynset operation %d", ErrUnsupportedExpr, ds.Operation)
+			}
+			d.SetUpdate = &RuleSetUpdate{Op: op, Set: ds.SetName, Keys: keys, Timeout: ds.Timeout}
+			return i + 1, nil
+		}
+		if lp, ok := e.(*expr.Lookup); ok {
+			if len(keys) < 2 || lp.SourceRegister != 1 || lp.IsDestRegSet {
+				return 0, nil
+			}
+			value := "@" + lp.SetName
+			if isAnonSetName(lp.SetName) && d.conn != nil {
+				v, err := d.anonSetValue(lp.SetName)
+				if err != nil {
+					return 0, err
+				}
+				value = v
+			}
+			d.Concat = &RuleConcat{Keys: keys, Value: negPrefix(lp.Invert) + value}
+			return i + 1, nil
+		}
+		reg := uint32(1)
+		if i > 0 {
+			reg = concatReg32 + off/4
+		}
+		key := d.concatLoadKey(e, reg)
+		if key == "" {
+			return 0, nil
+		}
+		k, _ := concatKey(key)
+		keys = append(keys, key)
+		off += uint32(concatFieldLen(k.dtype)+3) &^ 3
+	}
+	return 0, nil
+}
+
+// concatLoadKey 加载到reg寄存器的表达式对应的拼接键, 端口按已匹配的四层协议区分, 无端口协议时为th
+func (d *Rule) concatLoadKey(e expr.Any, reg uint32) string {
+	var keys []string
+	for _, m := range []map[string]ruleMapKey{ruleMapKeys, ruleConcatKeys} {
+		for name, k := range m {
+			if reflect.DeepEqual(k.load(reg), e) {
+				keys = append(keys, name)
+			}
+		}
+	}
+	if len(keys) <= 1 {
+		return strings.Join(keys, "")
+	}
+	field := strings.Fields(keys[0])[1]
+	if isPortProto(d.L4Proto) {
+		return d.L4Proto + " " + field
+	}
+	return "th " + field
+}
+
+// isLoadExpr 是否为将数据加载到寄存器的表达式
+func isLoadExpr(e expr.Any) bool {
+	switch v := e.(type) {
+	case *expr.Meta:
+		return !v.SourceRegister
+	case *expr.Ct:
+		return !v.SourceRegister
+	case *expr.Payload:
+		return v.OperationType == expr.PayloadLoad
+	case *expr.Exthdr:
+		return v.DestRegister != 0
+	case *expr.Fib, *expr.Rt, *expr.Socket, *expr.Numgen, *expr.Hash:
+		return true
+	}
+	return false
+}
+
+// isOperandExpr 是否为处理加载结果的表达式
+func isOperandExpr(e expr.Any) bool {
+	switch e.(type) {
+	case *expr.Cmp, *expr.Bitwise, *expr.Range, *expr.Lookup, *expr.Byteorder:
+		return true
+	}
+	return false
+}
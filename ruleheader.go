@@ -0,0 +1,373 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/nftables/expr"
+	"strconv"
+	"strings"
+)
+
+// RuleHeader 协议头字段匹配 e.g.: tcp flags & (syn|ack) == syn or icmp type echo-request or ip ttl < 10
+type RuleHeader struct {
+	// Field 协议头字段, 取值见ruleHeaderFields e.g.: tcp flags or ip6 hoplimit or icmpv6 type
+	Field string `json:"field"`
+	// Mask 比较前与字段按位与的掩码, 标志字段以|组合 e.g.: syn|ack or 0x1fff
+	Mask string `json:"mask,omitempty"`
+	// Op one of [==,!=,<,>,<=,>=], 为空时标志字段匹配任一标志置位, 其余字段匹配相等
+	Op string `json:"op,omitempty"`
+	// Value 名称或数字, 标志以|组合 e.g.: echo-request or 64 or 100-200 or syn|ack
+	// 具名类型的字段支持逗号分隔的列表与@setname
+	Value string `json:"value"`
+}
+
+// ruleHeaderField 协议头字段的位置与取值类型
+type ruleHeaderField struct {
+	l3     string
+	l4     string
+	base   expr.PayloadBase
+	offset uint32
+	size   uint32
+	// mask shift 不足整字节的字段的掩码与位移, 如dscp
+	mask  uint32
+	shift uint
+	// dtype 具名取值的集合数据类型
+	dtype string
+	// flags 是否为标志字段
+	flags bool
+}
+
+var (
+	// ruleHeaderFields 支持的协议头字段
+	ruleHeaderFields = map[string]ruleHeaderField{
+		"ip dscp":         {l3: RuleL3Ip, base: expr.PayloadBaseNetworkHeader, offset: 1, size: 1, mask: 0xfc, shift: 2, dtype: SetDtypeDscp},
+		"ip length":       {l3: RuleL3Ip, base: expr.PayloadBaseNetworkHeader, offset: 2, size: 2},
+		"ip id":           {l3: RuleL3Ip, base: expr.PayloadBaseNetworkHeader, offset: 4, size: 2},
+		"ip frag-off":     {l3: RuleL3Ip, base: expr.PayloadBaseNetworkHeader, offset: 6, size: 2},
+		"ip ttl":          {l3: RuleL3Ip, base: expr.PayloadBaseNetworkHeader, offset: 8, size: 1},
+		"ip6 dscp":        {l3: RuleL3Ip6, base: expr.PayloadBaseNetworkHeader, offset: 0, size: 2, mask: 0x0fc0, shift: 6, dtype: SetDtypeDscp},
+		"ip6 flowlabel":   {l3: RuleL3Ip6, base: expr.PayloadBaseNetworkHeader, offset: 0, size: 4, mask: 0x000fffff},
+		"ip6 length":      {l3: RuleL3Ip6, base: expr.PayloadBaseNetworkHeader, offset: 4, size: 2},
+		"ip6 hoplimit":    {l3: RuleL3Ip6, base: expr.PayloadBaseNetworkHeader, offset: 7, size: 1},
+		"tcp sequence":    {l4: RuleL4Tcp, base: expr.PayloadBaseTransportHeader, offset: 4, size: 4},
+		"tcp flags":       {l4: RuleL4Tcp, base: expr.PayloadBaseTransportHeader, offset: 13, size: 1, flags: true},
+		"tcp window":      {l4: RuleL4Tcp, base: expr.PayloadBaseTransportHeader, offset: 14, size: 2},
+		"udp length":      {l4: RuleL4Udp, base: expr.PayloadBaseTransportHeader, offset: 4, size: 2},
+		"icmp type":       {l4: RuleL4Icmp, base: expr.PayloadBaseTransportHeader, offset: 0, size: 1, dtype: SetDtypeIcmpType},
+		"icmp code":       {l4: RuleL4Icmp, base: expr.PayloadBaseTransportHeader, offset: 1, size: 1},
+		"icmp id":         {l4: RuleL4Icmp, base: expr.PayloadBaseTransportHeader, offset: 4, size: 2},
+		"icmp sequence":   {l4: RuleL4Icmp, base: expr.PayloadBaseTransportHeader, offset: 6, size: 2},
+		"icmpv6 type":     {l4: RuleL4Icmp6, base: expr.PayloadBaseTransportHeader, offset: 0, size: 1, dtype: SetDtypeIcmp6Type},
+		"icmpv6 code":     {l4: RuleL4Icmp6, base: expr.PayloadBaseTransportHeader, offset: 1, size: 1},
+		"icmpv6 id":       {l4: RuleL4Icmp6, base: expr.PayloadBaseTransportHeader, offset: 4, size: 2},
+		"icmpv6 sequence": {l4: RuleL4Icmp6, base: expr.PayloadBaseTransportHeader, offset: 6, size: 2},
+	}
+	// tcpFlagList tcp标志名称, 下标为标志位
+	tcpFlagList = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"}
+	// headerCmpOps 协议头匹配的比较符
+	headerCmpOps = map[string]expr.CmpOp{
+		"":   expr.CmpOpEq,
+		"==": expr.CmpOpEq,
+		"!=": expr.CmpOpNeq,
+		"<":  expr.CmpOpLt,
+		">":  expr.CmpOpGt,
+		"<=": expr.CmpOpLte,
+		">=": expr.CmpOpGte,
+	}
+)
+
+// fieldMask 字段在载荷中占用的位
+func (f ruleHeaderField) fieldMask() uint32 {
+	if f.mask != 0 {
+		return f.mask
+	}
+	return uint32(1<<(f.size*8) - 1)
+}
+
+// num 解析单个取值, 支持名称与数字, 标志字段以|组合
+func (f ruleHeaderField) num(s string) (uint32, error) {
+	var v uint64
+	switch c, ok := dtypeCodecs[f.dtype]; {
+	case f.flags:
+		for _, name := range strings.Split(s, "|") {
+			bit := -1
+			for i, fl := range tcpFlagList {
+				if fl == name {
+					bit = i
+				}
+			}
+			if bit >= 0 {
+				v |= 1 << uint(bit)
+				continue
+			}
+			n, err := strconv.ParseUint(name, 0, 8)
+			if err != nil {
+				return 0, fmt.Errorf("invalid flag %q", name)
+			}
+			v |= n
+		}
+	case ok:
+		b, err := c.enc(s)
+		if err != nil {
+			return 0, err
+		}
+		v = uint64(b[0])
+	default:
+		n, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		v = n
+	}
+	if v > uint64(f.fieldMask()>>f.shift) {
+		return 0, fmt.Errorf("value %s out of range", s)
+	}
+	return uint32(v), nil
+}
+
+// rangeOf 解析取值为闭区间的起止, 名称中可能包含-, 因此先尝试整体解析
+func (f ruleHeaderField) rangeOf(s string) (uint32, uint32, error) {
+	if v, err := f.num(s); err == nil {
+		return v, v, nil
+	}
+	for i := range s {
+		if s[i] != '-' || f.flags {
+			continue
+		}
+		lo, err1 := f.num(s[:i])
+		hi, err2 := f.num(s[i+1:])
+		if err1 == nil && err2 == nil && lo <= hi {
+			return lo, hi, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid value %q", s)
+}
+
+// format 输出取值, 有名称时输出名称
+func (f ruleHeaderField) format(v uint32) string {
+	if f.flags {
+		var names []string
+		for i, fl := range tcpFlagList {
+			if v&(1<<uint(i)) != 0 {
+				names = append(names, fl)
+			}
+		}
+		if len(names) == 0 {
+			return "0x0"
+		}
+		return strings.Join(names, "|")
+	}
+	if c, ok := dtypeCodecs[f.dtype]; ok {
+		return c.dec([]byte{byte(v)})
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+// formatMask 输出掩码, 非标志字段以十六进制输出
+func (f ruleHeaderField) formatMask(v uint32) string {
+	if f.flags {
+		return f.format(v)
+	}
+	return fmt.Sprintf("0x%x", v)
+}
+
+// data 按字段长度以网络字节序编码载荷中的取值
+func (f ruleHeaderField) data(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b[4-f.size:]
+}
+
+// value 载荷中取值的数字形式
+func (f ruleHeaderField) value(b []byte) (uint32, bool) {
+	if uint32(len(b)) != f.size {
+		return 0, false
+	}
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v, true
+}
+
+func (f ruleHeaderField) load() expr.Any {
+	return &expr.Payload{DestRegister: 1, Base: f.base, Offset: f.offset, Len: f.size}
+}
+
+func (f ruleHeaderField) bitwise(mask uint32) expr.Any {
+	return &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: f.size, Mask: f.data(mask), Xor: make([]byte, f.size)}
+}
+
+// isHeaderSet 取值是否为列表或集合引用
+func isHeaderSet(value string) bool {
+	return isValueList(value) || strings.HasPrefix(value, "@")
+}
+
+// normalize 校验协议头匹配, 并转换为与toRule解析结果一致的形式
+func (d RuleHeader) normalize() (RuleHeader, error) {
+	f, ok := ruleHeaderFields[d.Field]
+	if !ok {
+		return d, fmt.Errorf("%w: header field %s", ErrUnsupportedExpr, d.Field)
+	}
+	if _, ok = headerCmpOps[d.Op]; !ok {
+		return d, fmt.Errorf("%w: %s op %s", ErrUnsupportedExpr, d.Field, d.Op)
+	}
+	if d.Op == "==" && !f.flags {
+		d.Op = ""
+	}
+	if isHeaderSet(d.Value) {
+		if f.dtype == "" || f.mask != 0 || d.Mask != "" || (d.Op != "" && d.Op != "!=") {
+			return d, fmt.Errorf("%s does not support set match %s", d.Field, d.Value)
+		}
+		if strings.HasPrefix(d.Value, "@") {
+			return d, nil
+		}
+		elems := strings.Split(d.Value, ",")
+		for i, elem := range elems {
+			lo, hi, err := f.rangeOf(strings.TrimSpace(elem))
+			if err != nil {
+				return d, err
+			}
+			elems[i] = f.rangeString(lo, hi)
+		}
+		d.Value = strings.Join(elems, ",")
+		return d, nil
+	}
+	lo, hi, err := f.rangeOf(d.Value)
+	if err != nil {
+		return d, err
+	}
+	if d.Mask != "" {
+		if f.mask != 0 {
+			return d, fmt.Errorf("%s does not support mask", d.Field)
+		}
+		m, err := f.num(d.Mask)
+		if err != nil {
+			return d, err
+		}
+		// 标志字段 & mask != 0 即匹配任一标志置位
+		if f.flags && d.Op == "!=" && hi == 0 {
+			return RuleHeader{Field: d.Field, Value: f.format(m)}, nil
+		}
+		if f.flags && d.Op == "" {
+			return d, fmt.Errorf("%s with mask requires comparison", d.Field)
+		}
+		d.Mask = f.formatMask(m)
+	}
+	if lo != hi && d.Op != "" && d.Op != "!=" {
+		return d, fmt.Errorf("%s range %s with op %s", d.Field, d.Value, d.Op)
+	}
+	if f.flags && d.Op == "" && lo == 0 {
+		return d, fmt.Errorf("empty %s", d.Field)
+	}
+	d.Value = f.rangeString(lo, hi)
+	return d, nil
+}
+
+func (f ruleHeaderField) rangeString(lo, hi uint32) string {
+	if lo == hi {
+		return f.format(lo)
+	}
+	return f.format(lo) + "-" + f.format(hi)
+}
+
+// headerExpr 协议头匹配的表达式, 列表使用绑定到规则的匿名集合匹配
+func (d *Rule) headerExpr(h RuleHeader) ([]expr.Any, error) {
+	h, err := h.normalize()
+	if err != nil {
+		return nil, err
+	}
+	f := ruleHeaderFields[h.Field]
+	if (f.l3 != "" && d.L3Proto != f.l3) || (f.l4 != "" && d.L4Proto != f.l4) {
+		return nil, fmt.Errorf("%s requires protocol %s%s", h.Field, f.l3, f.l4)
+	}
+	if isHeaderSet(h.Value) {
+		neg := h.Op == "!="
+		if name := strings.TrimPrefix(h.Value, "@"); name != h.Value {
+			return []expr.Any{f.load(), &expr.Lookup{SourceRegister: 1, SetName: name, Invert: neg}}, nil
+		}
+		return d.matchExpr(negPrefix(neg)+h.Value, f.dtype, 0, func(v string, _ uint32) ([]expr.Any, error) {
+			return f.exprs(RuleHeader{Field: h.Field, Value: v})
+		})
+	}
+	return f.exprs(h)
+}
+
+// exprs 单个取值的匹配表达式, h已经过normalize
+func (f ruleHeaderField) exprs(h RuleHeader) ([]expr.Any, error) {
+	r := []expr.Any{f.load()}
+	lo, hi, err := f.rangeOf(h.Value)
+	if err != nil {
+		return nil, err
+	}
+	if f.flags && h.Op == "" {
+		return append(r, f.bitwise(lo), &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, f.size)}), nil
+	}
+	mask := f.mask
+	if h.Mask != "" {
+		if mask, err = f.num(h.Mask); err != nil {
+			return nil, err
+		}
+	}
+	if mask != 0 {
+		r = append(r, f.bitwise(mask))
+	}
+	if lo != hi {
+		return append(r, &expr.Range{Op: headerCmpOps[h.Op], Register: 1,
+			FromData: f.data(lo << f.shift), ToData: f.data(hi << f.shift)}), nil
+	}
+	return append(r, &expr.Cmp{Op: headerCmpOps[h.Op], Register: 1, Data: f.data(lo << f.shift)}), nil
+}
+
+// headerFieldOf 按载荷位置与已匹配的协议查找协议头字段
+func headerFieldOf(pld *expr.Payload, l3, l4 string) (string, bool) {
+	for name, f := range ruleHeaderFields {
+		if f.base == pld.Base && f.offset == pld.Offset && f.size == pld.Len &&
+			(f.l3 == "" || f.l3 == l3) && (f.l4 == "" || f.l4 == l4) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// toRuleHeader 解析协议头字段的比较, btw为加载后的位运算
+func toRuleHeader(name string, btw *expr.Bitwise, op expr.CmpOp, from, to []byte) (RuleHeader, bool) {
+	f := ruleHeaderFields[name]
+	h := RuleHeader{Field: name}
+	lo, ok1 := f.value(from)
+	hi, ok2 := f.value(to)
+	if !ok1 || !ok2 {
+		return h, false
+	}
+	if btw != nil {
+		m, ok := f.value(btw.Mask)
+		switch {
+		case !ok:
+			return h, false
+		case f.mask != 0 && m != f.mask:
+			return h, false
+		case f.flags && op == expr.CmpOpNeq && lo == 0 && hi == 0:
+			h.Value = f.format(m)
+			return h, m != 0
+		case f.mask == 0:
+			h.Mask = f.formatMask(m)
+		}
+	} else if f.mask != 0 {
+		return h, false
+	}
+	for _, k := range []string{"==", "!=", "<", ">", "<=", ">="} {
+		if headerCmpOps[k] == op {
+			h.Op = k
+		}
+	}
+	if h.Op == "==" && !f.flags {
+		h.Op = ""
+	}
+	if lo&^f.fieldMask() != 0 || hi&^f.fieldMask() != 0 {
+		return h, false
+	}
+	h.Value = f.rangeString(lo>>f.shift, hi>>f.shift)
+	return h, true
+}
@@ -0,0 +1,137 @@
+// +build linux
+
+package nftlib
+
+// Ruleset 完整的规则集, 包含所有表及表下的集合、映射、链、规则
+type Ruleset struct {
+	Tables []*TableSpec `json:"tables,omitempty"`
+}
+
+// TableSpec 表及其下属的集合、映射与链
+type TableSpec struct {
+	Table  *Table       `json:"table"`
+	Sets   []*Set       `json:"sets,omitempty"`
+	Maps   []*Map       `json:"maps,omitempty"`
+	Chains []*ChainSpec `json:"chains,omitempty"`
+}
+
+// ChainSpec 链及其下属的有序规则
+type ChainSpec struct {
+	Chain *Chain  `json:"chain"`
+	Rules []*Rule `json:"rules,omitempty"`
+}
+
+// ListRuleset 读取内核中的完整规则集
+func (d *Conn) ListRuleset() (*Ruleset, error) {
+	var rs = new(Ruleset)
+	tables, err := d.ShowTables()
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		ts, err := table.spec()
+		if err != nil {
+			return nil, err
+		}
+		rs.Tables = append(rs.Tables, ts)
+	}
+	return rs, nil
+}
+
+// ApplyRuleset 将规则集中的表、集合、链、映射、规则加入当前批次, 需调用Commit提交
+// 与nft -f相同, 已存在的表、集合、映射、链会被合并, 规则追加到链尾
+// 映射在链之后创建, 以便verdict map的元素引用链
+func (d *Conn) ApplyRuleset(rs *Ruleset) error {
+	rs.link()
+	for _, ts := range rs.Tables {
+		tbl := d.ADDTable(ts.Table)
+		for _, set := range ts.Sets {
+			if err := tbl.addSet(set); err != nil {
+				return err
+			}
+		}
+		for _, cs := range ts.Chains {
+			if _, err := tbl.AddBaseChain(cs.Chain); err != nil {
+				return err
+			}
+		}
+		for _, m := range ts.Maps {
+			if err := tbl.addMap(m); err != nil {
+				return err
+			}
+		}
+		for _, cs := range ts.Chains {
+			for _, rule := range cs.Rules {
+				// 句柄仅对内核中已存在的规则有效, 新增时需清除
+				r := *rule
+				r.Handle = 0
+				if err := cs.Chain.AddRule(&r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// link 重建规则集中集合、映射、链、规则到所属表与链的引用, 用于JSON反序列化之后
+func (d *Ruleset) link() {
+	for _, ts := range d.Tables {
+		for _, set := range ts.Sets {
+			set.Table = ts.Table
+		}
+		for _, m := range ts.Maps {
+			m.Table = ts.Table
+		}
+		for _, cs := range ts.Chains {
+			cs.Chain.Table = ts.Table
+			for _, rule := range cs.Rules {
+				rule.Chain = cs.Chain
+			}
+		}
+	}
+}
+
+// spec 读取表下的所有集合、映射、链与规则
+func (d *Table) spec() (*TableSpec, error) {
+	var ts = &TableSpec{Table: d}
+	sets, err := d.ListSet()
+	if err != nil {
+		return nil, err
+	}
+	ts.Sets = sets
+	if ts.Maps, err = d.ListMap(); err != nil {
+		return nil, err
+	}
+	chains, err := d.ListChain()
+	if err != nil {
+		return nil, err
+	}
+	for _, ch := range chains {
+		rules, err := ch.ListRule()
+		if err != nil {
+			return nil, err
+		}
+		ts.Chains = append(ts.Chains, &ChainSpec{Chain: ch, Rules: rules})
+	}
+	ts.fillMapKeyTypes()
+	return ts, nil
+}
+
+// fillMapKeyTypes 由引用映射的规则补全无法从内核读取键类型的空verdict map
+func (d *TableSpec) fillMapKeyTypes() {
+	for _, m := range d.Maps {
+		if m.KeyType != "" {
+			continue
+		}
+		for _, cs := range d.Chains {
+			for _, rule := range cs.Rules {
+				for _, rm := range []*RuleMap{rule.VMap, rule.NatMap} {
+					if rm != nil && rm.Name == m.Name {
+						m.KeyType = ruleMapKeys[rm.Key].dtype
+					}
+				}
+			}
+		}
+	}
+}
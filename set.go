@@ -4,62 +4,178 @@ package nftlib
 
 import (
 	"errors"
+	"fmt"
 	"github.com/google/nftables"
+	"strings"
+	"time"
 )
 
 const (
 	SetDtypeIpv4 = "ipv4"
 	SetDtypeIpv6 = "ipv6"
 	SetDtypePort = "port"
+	// SetDtypeIfname 接口名集合, 用于iifname/oifname匹配
+	SetDtypeIfname = "ifname"
+	// SetDtypeProto 四层协议, 元素为协议名或协议号
+	SetDtypeProto = "proto"
+	// SetDtypeEther MAC地址, 如 00:11:22:33:44:55
+	SetDtypeEther = "ether"
+	// SetDtypeMark 标记, 元素读取时以0x开头的十六进制表示, 不支持区间
+	SetDtypeMark = "mark"
+	// SetDtypeCtState 连接跟踪状态, 元素为单个状态名, 不支持区间
+	SetDtypeCtState = "ct_state"
+	// SetDtypeIcmpType SetDtypeIcmp6Type ICMP类型, 元素为类型名或类型号, 如 echo-request
+	SetDtypeIcmpType  = "icmp_type"
+	SetDtypeIcmp6Type = "icmpv6_type"
+	// SetDtypeDscp DSCP, 元素为名称或6位的DSCP值, 如 ef, af41
+	SetDtypeDscp = "dscp"
 )
 
 var (
 	dtypeList = map[string]nftables.SetDatatype{
-		SetDtypeIpv4: nftables.TypeIPAddr,
-		SetDtypeIpv6: nftables.TypeIP6Addr,
-		SetDtypePort: nftables.TypeInetService,
+		SetDtypeIpv4:      nftables.TypeIPAddr,
+		SetDtypeIpv6:      nftables.TypeIP6Addr,
+		SetDtypePort:      nftables.TypeInetService,
+		SetDtypeIfname:    nftables.TypeIFName,
+		SetDtypeProto:     nftables.TypeInetProto,
+		SetDtypeEther:     nftables.TypeEtherAddr,
+		SetDtypeMark:      nftables.TypeMark,
+		SetDtypeCtState:   nftables.TypeCTState,
+		SetDtypeIcmpType:  nftables.TypeICMPType,
+		SetDtypeIcmp6Type: nftables.TypeICMP6Type,
+		SetDtypeDscp:      nftables.TypeDSCP,
 	}
 )
 
 type Set struct {
-	conn      *Conn
-	Table     *Table   `json:"table"`
-	Name      string   `json:"name,omitempty"`
-	DType     string   `json:"dtype,omitempty"`
-	ElemRange bool     `json:"elemrange"`
-	Elements  []string `json:"elements,omitempty"`
+	conn  *Conn
+	Table *Table `json:"table"`
+	Name  string `json:"name,omitempty"`
+	// DType 数据类型, 多个类型以 " . " 拼接, 如 ipv4 . proto . port, 元素为 10.0.0.1 . tcp . 443
+	DType     string `json:"dtype,omitempty"`
+	ElemRange bool   `json:"elemrange"`
+	// Elements 元素可带选项, 如 10.0.0.1 timeout 10m comment "blocked", 读取内核集合时附带剩余时间 expires 9m32s
+	Elements []string `json:"elements,omitempty"`
+	// HasTimeout 元素可设置超时, 设置Timeout或元素带timeout选项时自动开启
+	HasTimeout bool `json:"has_timeout,omitempty"`
+	// Dynamic 可由规则通过 add @set / update @set 添加元素
+	Dynamic bool `json:"dynamic,omitempty"`
+	// Timeout 元素默认超时时间
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// GCInterval 超时元素的回收间隔, nftables库不支持下发该属性, 仅用于输出与比较
+	GCInterval time.Duration `json:"gc_interval,omitempty"`
+	// Size 最大元素数量, 0为不限制
+	Size uint32 `json:"size,omitempty"`
+	// Opaque 内核中数据类型不受支持的集合, DType为nft类型名, 元素为十六进制的键, 只能读取、清空与删除
+	Opaque bool `json:"opaque,omitempty"`
+	// ntype 不受支持的集合在内核中的数据类型
+	ntype nftables.SetDatatype
+}
+
+// SetElem 带选项的集合元素, 对应Set.Elements中的 <value> [timeout <t>] [expires <t>] [comment "<text>"]
+type SetElem struct {
+	Value   string
+	Timeout time.Duration
+	// Expires 元素的剩余存活时间, 仅读取内核集合时有值
+	Expires time.Duration
+	Comment string
+}
+
+// ParseSetElem 解析带选项的集合元素, 如 10.0.0.1 timeout 10m comment "blocked"
+func ParseSetElem(s string) (SetElem, error) {
+	var (
+		e          SetElem
+		value, opt = splitElemOpts(s)
+		err        error
+	)
+	e.Value = value
+	for opt = strings.TrimSpace(opt); opt != ""; opt = strings.TrimSpace(opt) {
+		var key, v string
+		key, opt = cutWord(opt)
+		if key == "comment" && strings.HasPrefix(opt, `"`) {
+			end := strings.Index(opt[1:], `"`)
+			if end < 0 {
+				return e, fmt.Errorf("unterminated comment in set element %q", s)
+			}
+			e.Comment, opt = opt[1:end+1], opt[end+2:]
+			continue
+		}
+		v, opt = cutWord(opt)
+		if v == "" {
+			return e, fmt.Errorf("missing value of %s in set element %q", key, s)
+		}
+		switch key {
+		case "timeout":
+			e.Timeout, err = parseNftDuration(v)
+		case "expires":
+			e.Expires, err = parseNftDuration(v)
+		case "comment":
+			e.Comment = v
+		default:
+			return e, fmt.Errorf("unknown option %q in set element %q", key, s)
+		}
+		if err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// String 以nft格式输出元素及其选项
+func (d SetElem) String() string {
+	s := d.Value
+	if d.Timeout > 0 {
+		s += " timeout " + formatNftDuration(d.Timeout)
+	}
+	if d.Expires > 0 {
+		s += " expires " + formatNftDuration(d.Expires)
+	}
+	if d.Comment != "" {
+		s += fmt.Sprintf(" comment %q", d.Comment)
+	}
+	return s
 }
 
 func (d *Set) AddElements(elems ...string) error {
+	if d.Opaque {
+		return d.setErr("add elements", errOpaqueSet)
+	}
 	nset, _, err := d.toNSet()
 	if err != nil {
-		return err
+		return d.setErr("add elements", err)
 	}
-	nelems, err := setElemToNElem(d.DType, d.ElemRange, elems)
+	// 集合未开启超时时元素的超时不会下发
+	nset.HasTimeout = nset.HasTimeout || elemsHaveTimeout(elems)
+	nelems, err := setElemsToNElems(d.DType, d.ElemRange, elems)
 	if err != nil {
-		return err
+		return d.setErr("add elements", err)
 	}
 	err = d.conn.SetAddElements(nset, nelems)
 	if err != nil {
-		return err
+		return d.setErr("add elements", err)
 	}
+	d.recordElements(ChangeAdd, elems)
 	return nil
 }
 
 func (d *Set) DelElements(elems ...string) error {
+	if d.Opaque {
+		return d.setErr("delete elements", errOpaqueSet)
+	}
 	nset, _, err := d.toNSet()
 	if err != nil {
-		return err
+		return d.setErr("delete elements", err)
 	}
 
-	nelems, err := setElemToNElem(d.DType, d.ElemRange, elems)
+	nelems, err := setElemToNElem(d.DType, d.ElemRange, elemValues(elems))
 	if err != nil {
-		return err
+		return d.setErr("delete elements", err)
 	}
 	err = d.conn.SetDeleteElements(nset, nelems)
 	if err != nil {
-		return err
+		return d.setErr("delete elements", err)
 	}
+	d.recordElements(ChangeDelete, elems)
 	return nil
 }
 
@@ -70,27 +186,74 @@ func (d *Set) Commit() error {
 func (d *Set) Flush() error {
 	ns, _, err := d.toNSet()
 	if err != nil {
-		return err
+		return d.setErr("flush", err)
 	}
 	d.conn.FlushSet(ns)
+	c := d.Table.change(ChangeFlush, ObjSet)
+	c.Name = d.Name
+	d.conn.record(c)
 	return nil
 }
 
+func (d *Set) recordElements(op changeOp, elems []string) {
+	c := d.Table.change(op, ObjElement)
+	c.Name = d.Name
+	if op == ChangeDelete {
+		c.Old = strings.Join(elems, ", ")
+	} else {
+		c.New = strings.Join(elems, ", ")
+	}
+	d.conn.record(c)
+}
+
+func (d *Set) setErr(op string, err error) error {
+	e := newObjErr(op, ObjSet, err).name(d.Name)
+	if d.Table != nil {
+		e.table(d.Table.Name)
+	}
+	return e
+}
+
 func (d *Set) toSet(set nftables.Set, elems ...nftables.SetElement) error {
 	d.Name = set.Name
-	for k, v := range dtypeList {
-		if set.KeyType.GetNFTMagic() == v.GetNFTMagic() && set.KeyType.GetNFTMagic() != 0 {
-			d.DType = k
-			break
-		}
-	}
+	d.DType = dtypeName(set.KeyType)
 	d.ElemRange = set.Interval
+	d.HasTimeout, d.Dynamic = set.HasTimeout, set.Dynamic
+	d.Timeout, d.Size = set.Timeout, set.Size
+	// 不支持的数据类型不报错, 以原始格式返回, 避免其他程序创建的集合导致读取失败
 	if d.DType == "" {
-		return errors.New("unsupport data type")
+		d.Opaque, d.ntype = true, set.KeyType
+		d.DType = set.KeyType.Name
+		if d.DType == "" {
+			d.DType = fmt.Sprintf("0x%x", set.KeyType.GetNFTMagic())
+		}
+		d.Elements = setElemRaw(d.ElemRange, elems)
+		return nil
 	}
 	if len(elems) == 0 {
 		return nil
 	}
+	if err := d.toElements(elems); err != nil {
+		return err
+	}
+	d.Elements = setElemOpts(d.DType, d.ElemRange, d.Timeout, d.Elements, elems)
+	return nil
+}
+
+// toElements 解析内核元素的取值
+func (d *Set) toElements(elems []nftables.SetElement) error {
+	if dtypes := concatDtypes(d.DType); dtypes != nil {
+		elements, err := setElemConcat(dtypes, elems)
+		if err != nil {
+			return err
+		}
+		d.Elements = elements
+		return nil
+	}
+	if c, ok := dtypeCodecs[d.DType]; ok {
+		d.Elements = setElemCodec(c, d.ElemRange, elems)
+		return nil
+	}
 	// 解析范围类型值
 	if d.ElemRange {
 		switch d.DType {
@@ -113,6 +276,8 @@ func (d *Set) toSet(set nftables.Set, elems ...nftables.SetElement) error {
 			return nil
 		case SetDtypePort:
 			d.Elements = setElemPort(elems)
+		case SetDtypeIfname:
+			d.Elements = setElemIfname(elems)
 		}
 	}
 	return nil
@@ -127,20 +292,58 @@ func (d *Set) toNSet() (*nftables.Set, []nftables.SetElement, error) {
 	nset.Table = d.Table.toNTable()
 	nset.Name = d.Name
 	nset.Interval = d.ElemRange
-	ktype, ok := dtypeList[d.DType]
+	// 不支持的集合只用于清空与删除, 不转换元素
+	if d.Opaque {
+		if d.ntype.GetNFTMagic() == 0 {
+			return nil, nil, errOpaqueSet
+		}
+		nset.KeyType = d.ntype
+		return nset, nil, nil
+	}
+	ktype, ok := setNDatatype(d.DType)
 	if !ok {
 		return nil, nil, errors.New("unsupport key data type")
 	}
 	nset.KeyType = ktype
+	// 拼接类型的区间集合以KeyEnd表示区间
+	nset.Concatenation = d.ElemRange && concatDtypes(d.DType) != nil
+	nset.HasTimeout = d.timeoutFlag()
+	nset.Dynamic = d.Dynamic
+	nset.Timeout = d.Timeout
+	nset.Size = d.Size
 
 	if len(d.Elements) == 0 {
 		return nset, nil, nil
 	}
 
-	nelems, err = setElemToNElem(d.DType, d.ElemRange, d.Elements)
+	nelems, err = setElemsToNElems(d.DType, d.ElemRange, d.Elements)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return nset, nelems, nil
 }
+
+// timeoutFlag 集合是否需要开启超时标志
+func (d *Set) timeoutFlag() bool {
+	return d.HasTimeout || d.Timeout > 0 || elemsHaveTimeout(d.Elements)
+}
+
+// setNDatatype 集合数据类型对应的内核数据类型, 支持拼接类型
+func setNDatatype(dtype string) (nftables.SetDatatype, bool) {
+	dtypes := concatDtypes(dtype)
+	if dtypes == nil {
+		t, ok := dtypeList[dtype]
+		return t, ok
+	}
+	var types []nftables.SetDatatype
+	for _, v := range dtypes {
+		t, ok := dtypeList[v]
+		if !ok {
+			return nftables.TypeInvalid, false
+		}
+		types = append(types, t)
+	}
+	t, err := nftables.ConcatSetType(types...)
+	return t, err == nil
+}
@@ -2,7 +2,13 @@
 
 package nftlib
 
-import "testing"
+import (
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"testing"
+	"time"
+)
 
 func TestFlushRuleSet(t *testing.T) {
 	conn, err := New()
@@ -403,3 +409,380 @@ func TestListSet(t *testing.T) {
 	}
 	t.Log(IndentJson(sets))
 }
+
+func TestSet_Ifname(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	set := &Set{Table: tbl, Name: "mgmt", DType: SetDtypeIfname, Elements: []string{"eth0", "bond1"}}
+	nset, nelems, err := set.toNSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := new(Set)
+	if err = back.toSet(*nset, nelems...); err != nil {
+		t.Fatal(err)
+	}
+	if back.DType != SetDtypeIfname || len(back.Elements) != 2 || back.Elements[0] != "eth0" || back.Elements[1] != "bond1" {
+		t.Fatalf("unexpected set %+v", back)
+	}
+	want := "set mgmt {\n\ttype ifname\n\telements = { \"eth0\", \"bond1\" }\n}"
+	if got := set.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	rs, err := ParseRuleset("table inet filter {\n" + set.String() + "\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rs.Tables[0].Sets[0].String(); got != want {
+		t.Fatalf("parse: got %q, want %q", got, want)
+	}
+	data, err := rs.EncodeNftJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeNftJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Tables[0].Sets[0].String(); got != want {
+		t.Fatalf("json: got %q, want %q", got, want)
+	}
+	if _, _, err = (&Set{Table: tbl, DType: SetDtypeIfname, Elements: []string{"eth*"}}).toNSet(); err == nil {
+		t.Fatal("expect error for wildcard element")
+	}
+}
+
+func TestSet_Concat(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	cases := []struct {
+		set  *Set
+		want string
+	}{
+		{&Set{Table: tbl, Name: "allow", DType: "ipv4 . proto . port", Elements: []string{"10.0.0.1 . tcp . 443", "10.0.0.2 . udp . 53"}},
+			"set allow {\n\ttype ipv4_addr . inet_proto . inet_service\n\telements = { 10.0.0.1 . tcp . 443, 10.0.0.2 . udp . 53 }\n}"},
+		{&Set{Table: tbl, Name: "nets", DType: "ipv4 . port", ElemRange: true,
+			Elements: []string{"10.0.0.0/24 . 1000-2000", "192.168.1.1-192.168.1.5 . 22", "10.1.1.1 . 80"}},
+			"set nets {\n\ttype ipv4_addr . inet_service\n\tflags interval\n\telements = { 10.0.0.0/24 . 1000-2000, 192.168.1.1-192.168.1.5 . 22, 10.1.1.1 . 80 }\n}"},
+		{&Set{Table: tbl, Name: "peers", DType: "ifname . ipv6", Elements: []string{"eth0 . fd00::1"}},
+			"set peers {\n\ttype ifname . ipv6_addr\n\telements = { \"eth0\" . fd00::1 }\n}"},
+	}
+	for _, c := range cases {
+		nset, nelems, err := c.set.toNSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nset.Concatenation != c.set.ElemRange {
+			t.Fatalf("%s: unexpected concatenation flag", c.set.Name)
+		}
+		back := new(Set)
+		if err = back.toSet(*nset, nelems...); err != nil {
+			t.Fatal(err)
+		}
+		back.Table = tbl
+		if got := back.String(); got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+		rs, err := ParseRuleset("table inet filter {\n" + c.want + "\n}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rs.Tables[0].Sets[0].String(); got != c.want {
+			t.Fatalf("parse: got %q, want %q", got, c.want)
+		}
+		data, err := rs.EncodeNftJson()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeNftJson(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.Tables[0].Sets[0].String(); got != c.want {
+			t.Fatalf("json: got %q, want %q", got, c.want)
+		}
+	}
+
+	// 每个字段按4字节对齐
+	nset, nelems, err := cases[0].set.toNSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nset.KeyType.Bytes != 12 || fmt.Sprintf("%x", nelems[1].Key) != "0a0000010600000001bb0000" {
+		t.Fatalf("unexpected key type %+v, element %x", nset.KeyType, nelems[1].Key)
+	}
+	for _, set := range []*Set{
+		{Table: tbl, DType: "ipv4 . port", Elements: []string{"10.0.0.1"}},
+		{Table: tbl, DType: "ipv4 . port", Elements: []string{"10.0.0.0/24 . 22"}},
+		{Table: tbl, DType: "ipv4 . proto", Elements: []string{"10.0.0.1 . foo"}},
+		{Table: tbl, DType: "ipv4 . port", Elements: []string{"fd00::1 . 22"}},
+		{Table: tbl, DType: "ipv4 . uid", Elements: []string{"10.0.0.1 . 1"}},
+	} {
+		if _, _, err := set.toNSet(); err == nil {
+			t.Fatalf("expect error for set %+v", set)
+		}
+	}
+}
+
+func TestSet_Timeout(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	cases := []struct {
+		set  *Set
+		want string
+	}{
+		{&Set{Table: tbl, Name: "blk", DType: SetDtypeIpv4, Dynamic: true, Timeout: 10 * time.Minute, Size: 65535},
+			"set blk {\n\ttype ipv4_addr\n\tsize 65535\n\tflags dynamic,timeout\n\ttimeout 10m\n}"},
+		{&Set{Table: tbl, Name: "tmp", DType: SetDtypeIpv4, ElemRange: true, HasTimeout: true,
+			Elements: []string{`10.0.0.0/24 timeout 1h30m comment "lan"`, "10.1.0.1"}},
+			"set tmp {\n\ttype ipv4_addr\n\tflags interval,timeout\n\telements = { 10.0.0.0/24 timeout 1h30m comment \"lan\", 10.1.0.1 }\n}"},
+		{&Set{Table: tbl, Name: "ports", DType: SetDtypePort, Timeout: time.Hour,
+			Elements: []string{"22", "80 timeout 1d"}},
+			"set ports {\n\ttype inet_service\n\tflags timeout\n\ttimeout 1h\n\telements = { 22, 80 timeout 1d }\n}"},
+		{&Set{Table: tbl, Name: "peers", DType: "ifname . ipv4", Elements: []string{"eth0 . 10.0.0.1 timeout 30s"}},
+			"set peers {\n\ttype ifname . ipv4_addr\n\tflags timeout\n\telements = { \"eth0\" . 10.0.0.1 timeout 30s }\n}"},
+	}
+	for _, c := range cases {
+		nset, nelems, err := c.set.toNSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !nset.HasTimeout || nset.Dynamic != c.set.Dynamic || nset.Size != c.set.Size {
+			t.Fatalf("%s: unexpected set %+v", c.set.Name, nset)
+		}
+		// 模拟内核返回: 区间集合补充起始的区间结束元素并逆序返回
+		if c.set.ElemRange {
+			nelems = padIntervalElems(c.set.DType, nelems)
+			for i, j := 0, len(nelems)-1; i < j; i, j = i+1, j-1 {
+				nelems[i], nelems[j] = nelems[j], nelems[i]
+			}
+		}
+		back := new(Set)
+		if err = back.toSet(*nset, nelems...); err != nil {
+			t.Fatal(err)
+		}
+		back.Table = tbl
+		if got := back.String(); got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+		rs, err := ParseRuleset("table inet filter {\n" + c.want + "\n}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rs.Tables[0].Sets[0].String(); got != c.want {
+			t.Fatalf("parse: got %q, want %q", got, c.want)
+		}
+		data, err := rs.EncodeNftJson()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeNftJson(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.Tables[0].Sets[0].String(); got != c.want {
+			t.Fatalf("json: got %q, want %q", got, c.want)
+		}
+	}
+
+	// 区间元素的超时同时设置在区间结束元素上, 注释仅在起始元素上
+	_, nelems, err := cases[1].set.toNSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nelems[0].Timeout != 90*time.Minute || nelems[1].Timeout != 90*time.Minute ||
+		nelems[0].Comment != "lan" || nelems[1].Comment != "" || nelems[2].Timeout != 0 {
+		t.Fatalf("unexpected elements %+v", nelems)
+	}
+
+	// 读取内核元素时输出剩余时间, 与集合默认超时相同的元素超时不输出
+	nset, nelems, err := cases[2].set.toNSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range nelems {
+		if nelems[i].Timeout == 0 {
+			nelems[i].Timeout = time.Hour
+		}
+		nelems[i].Expires = nelems[i].Timeout - 90*time.Second
+	}
+	live := &Set{Table: tbl}
+	if err = live.toSet(*nset, nelems...); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"22 expires 58m30s", "80 timeout 1d expires 23h58m30s"}
+	if fmt.Sprint(live.Elements) != fmt.Sprint(want) {
+		t.Fatalf("got %q, want %q", live.Elements, want)
+	}
+	e, err := ParseSetElem(live.Elements[1])
+	if err != nil || e.Value != "80" || e.Timeout != 24*time.Hour || e.Expires != 24*time.Hour-90*time.Second {
+		t.Fatalf("unexpected element %+v, err %v", e, err)
+	}
+	// 剩余时间不产生差异
+	lrs := &Ruleset{Tables: []*TableSpec{{Table: tbl, Sets: []*Set{live}}}}
+	drs := &Ruleset{Tables: []*TableSpec{{Table: tbl, Sets: []*Set{cases[2].set}}}}
+	if d := Diff(lrs, drs); len(d.Changes) != 0 {
+		t.Fatalf("unexpected diff:\n%s", d)
+	}
+
+	for _, s := range []string{"10.0.0.1 timeout", "10.0.0.1 timeout 10x", "10.0.0.1 timeout 10m foo", "10.0.0.1 comment", `10.0.0.1 comment "x`} {
+		if _, err := ParseSetElem(s); err == nil {
+			t.Fatalf("expect error for %q", s)
+		}
+	}
+	for _, text := range []string{
+		"table inet filter {\n\tset s {\n\t\ttype ipv4_addr\n\t\ttimeout abc\n\t}\n}",
+		"table inet filter {\n\tset s {\n\t\ttype ipv4_addr\n\t\tsize -1\n\t}\n}",
+		"table inet filter {\n\tset s {\n\t\ttype ipv4_addr\n\t\telements = { 10.0.0.1 expires }\n\t}\n}",
+	} {
+		if _, err := ParseRuleset(text); err == nil {
+			t.Fatalf("expect error for %q", text)
+		}
+	}
+}
+
+func TestSet_Dtypes(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	cases := []struct {
+		set  *Set
+		want string
+	}{
+		{&Set{Table: tbl, Name: "macs", DType: SetDtypeEther, Elements: []string{"00:11:22:33:44:55", "aa:bb:cc:dd:ee:ff"}},
+			"set macs {\n\ttype ether_addr\n\telements = { 00:11:22:33:44:55, aa:bb:cc:dd:ee:ff }\n}"},
+		{&Set{Table: tbl, Name: "vendors", DType: SetDtypeEther, ElemRange: true,
+			Elements: []string{"00:11:22:00:00:00-00:11:22:ff:ff:ff"}},
+			"set vendors {\n\ttype ether_addr\n\tflags interval\n\telements = { 00:11:22:00:00:00-00:11:22:ff:ff:ff }\n}"},
+		{&Set{Table: tbl, Name: "marks", DType: SetDtypeMark, Elements: []string{"0x10", "0xff00"}},
+			"set marks {\n\ttype mark\n\telements = { 0x10, 0xff00 }\n}"},
+		{&Set{Table: tbl, Name: "protos", DType: SetDtypeProto, Elements: []string{"tcp", "udp", "200"}},
+			"set protos {\n\ttype inet_proto\n\telements = { tcp, udp, 200 }\n}"},
+		{&Set{Table: tbl, Name: "states", DType: SetDtypeCtState, Elements: []string{RuleCtEstablished, RuleCtRelated}},
+			"set states {\n\ttype ct_state\n\telements = { established, related }\n}"},
+		{&Set{Table: tbl, Name: "icmps", DType: SetDtypeIcmpType, ElemRange: true,
+			Elements: []string{"echo-reply", "destination-unreachable-redirect", "echo-request"}},
+			"set icmps {\n\ttype icmp_type\n\tflags interval\n\telements = { echo-reply, destination-unreachable-redirect, echo-request }\n}"},
+		{&Set{Table: tbl, Name: "icmp6s", DType: SetDtypeIcmp6Type, Elements: []string{"nd-neighbor-solicit", "echo-request"}},
+			"set icmp6s {\n\ttype icmpv6_type\n\telements = { nd-neighbor-solicit, echo-request }\n}"},
+		{&Set{Table: tbl, Name: "prio", DType: SetDtypeDscp, Elements: []string{"ef", "af41", "1"}},
+			"set prio {\n\ttype dscp\n\telements = { ef, af41, 1 }\n}"},
+		{&Set{Table: tbl, Name: "hosts", DType: "ether . ipv4", Elements: []string{"00:11:22:33:44:55 . 10.0.0.1"}},
+			"set hosts {\n\ttype ether_addr . ipv4_addr\n\telements = { 00:11:22:33:44:55 . 10.0.0.1 }\n}"},
+	}
+	for _, c := range cases {
+		nset, nelems, err := c.set.toNSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.set.ElemRange {
+			nelems = padIntervalElems(c.set.DType, nelems)
+			for i, j := 0, len(nelems)-1; i < j; i, j = i+1, j-1 {
+				nelems[i], nelems[j] = nelems[j], nelems[i]
+			}
+		}
+		back := new(Set)
+		if err = back.toSet(*nset, nelems...); err != nil {
+			t.Fatal(err)
+		}
+		back.Table = tbl
+		if got := back.String(); got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+		rs, err := ParseRuleset("table inet filter {\n" + c.want + "\n}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rs.EncodeNftJson()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeNftJson(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decoded.Tables[0].Sets[0].String(); got != c.want {
+			t.Fatalf("json: got %q, want %q", got, c.want)
+		}
+	}
+
+	// 映射的值可以为扩展类型
+	m := &Map{Table: tbl, Name: "classify", KeyType: SetDtypeIpv4, DataType: SetDtypeMark,
+		Elements: []MapElement{{"10.0.0.1", "0x1"}}}
+	nset, nelems, err := m.toNMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := new(Map)
+	if err = back.toMap(*nset, nelems...); err != nil {
+		t.Fatal(err)
+	}
+	back.Table = tbl
+	if got, want := back.String(), m.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	for _, set := range []*Set{
+		{Table: tbl, DType: SetDtypeEther, Elements: []string{"00:11:22:33:44"}},
+		{Table: tbl, DType: SetDtypeMark, Elements: []string{"abc"}},
+		{Table: tbl, DType: SetDtypeMark, ElemRange: true, Elements: []string{"0x1-0x10"}},
+		{Table: tbl, DType: SetDtypeCtState, Elements: []string{"closed"}},
+		{Table: tbl, DType: SetDtypeIcmpType, Elements: []string{"echo"}},
+		{Table: tbl, DType: SetDtypeIcmpType, ElemRange: true, Elements: []string{"echo-request-echo-reply"}},
+		{Table: tbl, DType: SetDtypeDscp, Elements: []string{"256"}},
+	} {
+		if _, _, err := set.toNSet(); err == nil {
+			t.Fatalf("expect error for set %+v", set)
+		}
+	}
+}
+
+func TestSet_Opaque(t *testing.T) {
+	tbl := &Table{Name: "filter", Family: TableFamilyInet}
+	nset := nftables.Set{Name: "labels", KeyType: nftables.TypeCTLabel}
+	label := make([]byte, 16)
+	label[15] = 1
+	set := &Set{Table: tbl}
+	if err := set.toSet(nset, nftables.SetElement{Key: label}); err != nil {
+		t.Fatal(err)
+	}
+	want := "set labels {\n\ttype ct_label\n\telements = { 0x00000000000000000000000000000001 }\n}"
+	if got := set.String(); !set.Opaque || got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// 只能清空与删除
+	back, nelems, err := set.toNSet()
+	if err != nil || back.KeyType.GetNFTMagic() != nftables.TypeCTLabel.GetNFTMagic() || len(nelems) != 0 {
+		t.Fatalf("unexpected set %+v, elements %v, err %v", back, nelems, err)
+	}
+	if err = set.AddElements("0x1"); !errors.Is(err, errOpaqueSet) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err = tbl.addSet(set); !errors.Is(err, errOpaqueSet) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	rs := &Ruleset{Tables: []*TableSpec{{Table: tbl, Sets: []*Set{set}}}}
+	data, err := rs.EncodeNftJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeNftJson(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.Tables[0].Sets[0]; !got.Opaque || got.String() != want {
+		t.Fatalf("json: got %q, want %q", got, want)
+	}
+
+	// 区间元素输出为闭区间
+	nset = nftables.Set{Name: "uids", KeyType: nftables.TypeUID, Interval: true}
+	elems := []nftables.SetElement{
+		{Key: []byte{0, 0, 0, 0}, IntervalEnd: true},
+		{Key: []byte{0, 0, 0x03, 0xe8}},
+		{Key: []byte{0, 0, 0x07, 0xd1}, IntervalEnd: true},
+	}
+	elems[0], elems[2] = elems[2], elems[0]
+	set = &Set{Table: tbl}
+	if err = set.toSet(nset, elems...); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(set.Elements) != "[0x000003e8-0x000007d0]" {
+		t.Fatalf("unexpected elements %v", set.Elements)
+	}
+}
@@ -0,0 +1,260 @@
+// +build linux
+
+package nftlib
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"net"
+	"strconv"
+)
+
+// dtypeCodec 定长数据类型的元素编解码
+type dtypeCodec struct {
+	size int
+	enc  func(string) ([]byte, error)
+	dec  func([]byte) string
+	// interval 是否支持区间, 主机字节序的类型不支持
+	interval bool
+}
+
+var (
+	dtypeCodecs = map[string]dtypeCodec{
+		SetDtypeEther:     {6, encEther, decEther, true},
+		SetDtypeMark:      {4, encMark, decMark, false},
+		SetDtypeProto:     {1, encByteName(protoNames), decByteName(protoNames), true},
+		SetDtypeCtState:   {4, encCtState, decCtState, false},
+		SetDtypeIcmpType:  {1, encByteName(icmpTypeNames), decByteName(icmpTypeNames), true},
+		SetDtypeIcmp6Type: {1, encByteName(icmp6TypeNames), decByteName(icmp6TypeNames), true},
+		SetDtypeDscp:      {1, encByteName(dscpNames), decByteName(dscpNames), true},
+	}
+	// icmpTypeNames ICMP类型名称
+	icmpTypeNames = map[string]byte{
+		"echo-reply":              0,
+		"destination-unreachable": 3,
+		"source-quench":           4,
+		"redirect":                5,
+		"echo-request":            8,
+		"router-advertisement":    9,
+		"router-solicitation":     10,
+		"time-exceeded":           11,
+		"parameter-problem":       12,
+		"timestamp-request":       13,
+		"timestamp-reply":         14,
+		"info-request":            15,
+		"info-reply":              16,
+		"address-mask-request":    17,
+		"address-mask-reply":      18,
+	}
+	// icmp6TypeNames ICMPv6类型名称
+	icmp6TypeNames = map[string]byte{
+		"destination-unreachable": 1,
+		"packet-too-big":          2,
+		"time-exceeded":           3,
+		"parameter-problem":       4,
+		"echo-request":            128,
+		"echo-reply":              129,
+		"mld-listener-query":      130,
+		"mld-listener-report":     131,
+		"mld-listener-done":       132,
+		"nd-router-solicit":       133,
+		"nd-router-advert":        134,
+		"nd-neighbor-solicit":     135,
+		"nd-neighbor-advert":      136,
+		"nd-redirect":             137,
+		"router-renumbering":      138,
+		"ind-neighbor-solicit":    141,
+		"ind-neighbor-advert":     142,
+		"mld2-listener-report":    143,
+	}
+	// dscpNames DSCP取值名称, 取值为6位的DSCP字段
+	dscpNames = map[string]byte{
+		"cs0": 0x00, "cs1": 0x08, "cs2": 0x10, "cs3": 0x18, "cs4": 0x20, "cs5": 0x28, "cs6": 0x30, "cs7": 0x38,
+		"af11": 0x0a, "af12": 0x0c, "af13": 0x0e,
+		"af21": 0x12, "af22": 0x14, "af23": 0x16,
+		"af31": 0x1a, "af32": 0x1c, "af33": 0x1e,
+		"af41": 0x22, "af42": 0x24, "af43": 0x26,
+		"ef": 0x2e,
+	}
+)
+
+func encEther(v string) ([]byte, error) {
+	mac, err := net.ParseMAC(v)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid ether address %q", v)
+	}
+	return mac, nil
+}
+
+func decEther(b []byte) string {
+	return net.HardwareAddr(b).String()
+}
+
+// encMark 标记为主机字节序, 支持十进制与0x开头的十六进制
+func encMark(v string) ([]byte, error) {
+	n, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mark %q", v)
+	}
+	return binaryutil.NativeEndian.PutUint32(uint32(n)), nil
+}
+
+func decMark(b []byte) string {
+	return fmt.Sprintf("0x%x", binaryutil.NativeEndian.Uint32(b))
+}
+
+// encCtState 连接跟踪状态为主机字节序的状态位
+func encCtState(v string) ([]byte, error) {
+	for bit, name := range ctStateMap {
+		if name == v {
+			return binaryutil.NativeEndian.PutUint32(bit), nil
+		}
+	}
+	return nil, fmt.Errorf("invalid ct state %q", v)
+}
+
+func decCtState(b []byte) string {
+	bits := binaryutil.NativeEndian.Uint32(b)
+	if name, ok := ctStateMap[bits]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", bits)
+}
+
+// encByteName 单字节类型的编码, 支持名称与数字
+func encByteName(names map[string]byte) func(string) ([]byte, error) {
+	return func(v string) ([]byte, error) {
+		if n, ok := names[v]; ok {
+			return []byte{n}, nil
+		}
+		n, err := strconv.ParseUint(v, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", v)
+		}
+		return []byte{byte(n)}, nil
+	}
+}
+
+// decByteName 单字节类型的解码, 有名称时输出名称
+func decByteName(names map[string]byte) func([]byte) string {
+	return func(b []byte) string {
+		for k, v := range names {
+			if v == b[0] {
+				return k
+			}
+		}
+		return strconv.Itoa(int(b[0]))
+	}
+}
+
+// codecSplit 拆分区间取值的起止, 名称中可能包含-, 因此先尝试整体解析
+func codecSplit(c dtypeCodec, v string) (string, string, error) {
+	if _, err := c.enc(v); err == nil {
+		return v, v, nil
+	}
+	for i := range v {
+		if v[i] != '-' {
+			continue
+		}
+		start, err1 := c.enc(v[:i])
+		end, err2 := c.enc(v[i+1:])
+		if err1 == nil && err2 == nil && bytes.Compare(start, end) <= 0 {
+			return v[:i], v[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid element %q", v)
+}
+
+// codecRange 解析取值为闭区间的起止, 单个值的起止相同
+func codecRange(c dtypeCodec, v string) ([]byte, []byte, error) {
+	s, e, err := codecSplit(c, v)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, _ := c.enc(s)
+	end, _ := c.enc(e)
+	return start, end, nil
+}
+
+// codecRangeString 闭区间的字符串形式
+func codecRangeString(c dtypeCodec, start, end []byte) string {
+	if bytes.Equal(start, end) {
+		return c.dec(start)
+	}
+	return c.dec(start) + "-" + c.dec(end)
+}
+
+func setNElemCodec(dtype string, c dtypeCodec, interval bool, elems []string) ([]nftables.SetElement, error) {
+	var r []nftables.SetElement
+	if interval && !c.interval {
+		return nil, fmt.Errorf("%s set does not support interval flag", dtype)
+	}
+	for _, v := range elems {
+		if !interval {
+			key, err := c.enc(v)
+			if err != nil {
+				return nil, err
+			}
+			r = append([]nftables.SetElement{{Key: key}}, r...)
+			continue
+		}
+		start, end, err := codecRange(c, v)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r,
+			nftables.SetElement{Key: start, IntervalEnd: false},
+			nftables.SetElement{Key: ipAddrNext(end), IntervalEnd: true},
+		)
+	}
+	return r, nil
+}
+
+// setElemCodec 解析内核返回的元素, 区间元素按 结束, 起始 成对逆序排列
+func setElemCodec(c dtypeCodec, interval bool, nelems []nftables.SetElement) []string {
+	var r []string
+	if !interval {
+		for i := len(nelems) - 1; i >= 0; i-- {
+			if len(nelems[i].Key) == c.size {
+				r = append(r, c.dec(nelems[i].Key))
+			}
+		}
+		return r
+	}
+	for i := len(nelems) - 2; i > 0; i -= 2 {
+		if nelems[i].IntervalEnd || !nelems[i-1].IntervalEnd {
+			return nil
+		}
+		start, end := nelems[i].Key, nelems[i-1].Key
+		if len(start) != c.size || len(end) != c.size {
+			return nil
+		}
+		r = append(r, codecRangeString(c, start, ipAddrPrev(end)))
+	}
+	return r
+}
+
+// setElemRaw 不支持的数据类型的元素, 以十六进制输出键, 区间输出为闭区间
+func setElemRaw(interval bool, nelems []nftables.SetElement) []string {
+	var r []string
+	for i := len(nelems) - 1; i >= 0; i-- {
+		e := nelems[i]
+		switch {
+		case e.IntervalEnd:
+		case len(e.KeyEnd) > 0:
+			r = append(r, "0x"+hex.EncodeToString(e.Key)+"-0x"+hex.EncodeToString(e.KeyEnd))
+		case interval && i > 0 && nelems[i-1].IntervalEnd:
+			r = append(r, "0x"+hex.EncodeToString(e.Key)+"-0x"+hex.EncodeToString(ipAddrPrev(nelems[i-1].Key)))
+		default:
+			r = append(r, "0x"+hex.EncodeToString(e.Key))
+		}
+	}
+	return r
+}
+
+// errOpaqueSet 不支持的数据类型的集合只能读取、清空与删除
+var errOpaqueSet = errors.New("set of unsupported data type is read only")
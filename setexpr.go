@@ -3,14 +3,17 @@
 package nftlib
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
+	"golang.org/x/sys/unix"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ipNetNextRange 给定一个 net.IPNet 网段，如192.168.1.0/22
@@ -131,7 +134,7 @@ func setElemIp(nelems []nftables.SetElement) []string {
 
 func setElemPort(nelems []nftables.SetElement) []string {
 	var r []string
-	for i := len(nelems) - 1; i > 0; i-- {
+	for i := len(nelems) - 1; i >= 0; i-- {
 		port := binary.BigEndian.Uint16(nelems[i].Key)
 		r = append(r, fmt.Sprintf("%d", port))
 	}
@@ -238,6 +241,25 @@ func setNElemPort(elems []string) ([]nftables.SetElement, error) {
 	return r, nil
 }
 
+func setElemIfname(nelems []nftables.SetElement) []string {
+	var r []string
+	for _, v := range nelems {
+		r = append(r, ifnameString(v.Key))
+	}
+	return r
+}
+
+func setNElemIfname(elems []string) ([]nftables.SetElement, error) {
+	var r []nftables.SetElement
+	for _, v := range elems {
+		if v == "" || len(v) >= unix.IFNAMSIZ || strings.ContainsAny(v, "*\" \t/") {
+			return nil, errors.New(fmt.Sprintf("parse ifname nelem failed, wrong ifname format,ifname=%s", v))
+		}
+		r = append(r, nftables.SetElement{Key: ifnameBytes(v)})
+	}
+	return r, nil
+}
+
 func setNElemPortRange(elems []string) ([]nftables.SetElement, error) {
 	var r []nftables.SetElement
 	for _, v := range elems {
@@ -276,8 +298,31 @@ func setNElemPortRange(elems []string) ([]nftables.SetElement, error) {
 	return r, nil
 }
 
+// padIntervalElems 区间集合元素前补充从零开始的区间结束元素
+func padIntervalElems(dtype string, nelems []nftables.SetElement) []nftables.SetElement {
+	switch dtype {
+	case SetDtypeIpv4:
+		nelems = append([]nftables.SetElement{{Key: make([]byte, net.IPv4len), IntervalEnd: true}}, nelems...)
+	case SetDtypeIpv6:
+		nelems = append([]nftables.SetElement{{Key: make([]byte, net.IPv6len), IntervalEnd: true}}, nelems...)
+	case SetDtypePort:
+		nelems = append([]nftables.SetElement{{Key: make([]byte, 2), IntervalEnd: true}}, nelems...)
+	default:
+		if c, ok := dtypeCodecs[dtype]; ok {
+			nelems = append([]nftables.SetElement{{Key: make([]byte, c.size), IntervalEnd: true}}, nelems...)
+		}
+	}
+	return nelems
+}
+
 func setElemToNElem(dtype string, interval bool, elems []string) ([]nftables.SetElement, error) {
 	var nelems []nftables.SetElement
+	if dtypes := concatDtypes(dtype); dtypes != nil {
+		return setNElemConcat(dtypes, interval, elems)
+	}
+	if c, ok := dtypeCodecs[dtype]; ok {
+		return setNElemCodec(dtype, c, interval, elems)
+	}
 	if interval {
 		switch dtype {
 		case SetDtypeIpv4:
@@ -296,6 +341,8 @@ func setElemToNElem(dtype string, interval bool, elems []string) ([]nftables.Set
 				return nil, err
 			}
 			nelems = append(nelems, nems...)
+		case SetDtypeIfname:
+			return nil, errors.New("ifname set does not support interval flag")
 		}
 		return nelems, nil
 	}
@@ -318,7 +365,392 @@ func setElemToNElem(dtype string, interval bool, elems []string) ([]nftables.Set
 			}
 			nelems = append(nelems, nems...)
 			break
+		case SetDtypeIfname:
+			nems, err := setNElemIfname(elems)
+			if err != nil {
+				return nil, err
+			}
+			nelems = append(nelems, nems...)
+		}
+	}
+	return nelems, nil
+}
+
+var (
+	// protoNames 集合元素中常用四层协议的名称
+	protoNames = map[string]byte{
+		"icmp":      unix.IPPROTO_ICMP,
+		"igmp":      unix.IPPROTO_IGMP,
+		"tcp":       unix.IPPROTO_TCP,
+		"udp":       unix.IPPROTO_UDP,
+		"dccp":      unix.IPPROTO_DCCP,
+		"gre":       unix.IPPROTO_GRE,
+		"esp":       unix.IPPROTO_ESP,
+		"ah":        unix.IPPROTO_AH,
+		"ipv6-icmp": unix.IPPROTO_ICMPV6,
+		"sctp":      unix.IPPROTO_SCTP,
+		"udplite":   unix.IPPROTO_UDPLITE,
+	}
+)
+
+// concatDtypes 拆分拼接数据类型, 非拼接类型返回nil
+func concatDtypes(dtype string) []string {
+	if !strings.Contains(dtype, " . ") {
+		return nil
+	}
+	return strings.Split(dtype, " . ")
+}
+
+// concatFieldLen 拼接键中字段的长度, 字段在键中按4字节对齐
+func concatFieldLen(dtype string) int {
+	switch dtype {
+	case SetDtypeIpv4:
+		return net.IPv4len
+	case SetDtypeIpv6:
+		return net.IPv6len
+	case SetDtypePort:
+		return 2
+	case SetDtypeIfname:
+		return unix.IFNAMSIZ
+	}
+	return dtypeCodecs[dtype].size
+}
+
+// setNElemConcat 拼接元素转换为内核元素, 字段以 " . " 分隔
+// 区间集合中每个元素以Key与KeyEnd表示闭区间, 不生成单独的区间结束元素
+func setNElemConcat(dtypes []string, interval bool, elems []string) ([]nftables.SetElement, error) {
+	var r []nftables.SetElement
+	for _, v := range elems {
+		fields := strings.Split(v, " . ")
+		if len(fields) != len(dtypes) {
+			return nil, errors.New(fmt.Sprintf("parse concat nelem failed, wrong field count,elem=%s", v))
+		}
+		var key, keyEnd []byte
+		for i, f := range fields {
+			start, end, err := concatField(dtypes[i], strings.Trim(strings.TrimSpace(f), `"`))
+			if err != nil {
+				return nil, err
+			}
+			if !interval && !bytes.Equal(start, end) {
+				return nil, errors.New(fmt.Sprintf("parse concat nelem failed, range in non-interval set,elem=%s", v))
+			}
+			for len(start)%4 != 0 {
+				start, end = append(start, 0), append(end, 0)
+			}
+			key, keyEnd = append(key, start...), append(keyEnd, end...)
+		}
+		elem := nftables.SetElement{Key: key}
+		if interval {
+			elem.KeyEnd = keyEnd
+		}
+		r = append([]nftables.SetElement{elem}, r...)
+	}
+	return r, nil
+}
+
+// concatField 解析拼接元素中的单个字段, 返回闭区间的起止值, 单个值的起止相同
+func concatField(dtype, v string) ([]byte, []byte, error) {
+	switch dtype {
+	case SetDtypeIpv4, SetDtypeIpv6:
+		var start, end net.IP
+		switch {
+		case strings.Contains(v, "/"):
+			_, netw, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			start, end = netw.IP, make(net.IP, len(netw.IP))
+			for i := range netw.IP {
+				end[i] = netw.IP[i] | ^netw.Mask[i]
+			}
+		case strings.Contains(v, "-"):
+			l := strings.SplitN(v, "-", 2)
+			start, end = net.ParseIP(l[0]), net.ParseIP(l[1])
+		default:
+			start = net.ParseIP(v)
+			end = start
+		}
+		if dtype == SetDtypeIpv4 {
+			start, end = start.To4(), end.To4()
+		} else if start.To4() != nil || end.To4() != nil {
+			start, end = nil, nil
+		}
+		if start == nil || end == nil || bytes.Compare(start.To16(), end.To16()) > 0 {
+			return nil, nil, errors.New(fmt.Sprintf("parse concat nelem failed, wrong ip format,ip=%s", v))
+		}
+		return start, end, nil
+	case SetDtypePort:
+		l := strings.SplitN(v, "-", 2)
+		start, err := strconv.ParseUint(l[0], 10, 16)
+		if err != nil {
+			return nil, nil, err
+		}
+		end := start
+		if len(l) == 2 {
+			if end, err = strconv.ParseUint(l[1], 10, 16); err != nil {
+				return nil, nil, err
+			}
+		}
+		if end < start {
+			return nil, nil, errors.New(fmt.Sprintf("parse concat nelem failed, !end>=start,port=%s", v))
+		}
+		return binaryutil.BigEndian.PutUint16(uint16(start)), binaryutil.BigEndian.PutUint16(uint16(end)), nil
+	case SetDtypeIfname:
+		nelems, err := setNElemIfname([]string{v})
+		if err != nil {
+			return nil, nil, err
+		}
+		return nelems[0].Key, nelems[0].Key, nil
+	}
+	if c, ok := dtypeCodecs[dtype]; ok {
+		return codecRange(c, v)
+	}
+	return nil, nil, errors.New(fmt.Sprintf("unsupport concat data type %s", dtype))
+}
+
+// setElemConcat 解析内核返回的拼接元素, KeyEnd为空时为单个值
+func setElemConcat(dtypes []string, nelems []nftables.SetElement) ([]string, error) {
+	var r []string
+	for i := len(nelems) - 1; i >= 0; i-- {
+		key, keyEnd := nelems[i].Key, nelems[i].KeyEnd
+		if len(keyEnd) == 0 {
+			keyEnd = key
+		}
+		var (
+			fields []string
+			off    int
+		)
+		for _, dtype := range dtypes {
+			n := concatFieldLen(dtype)
+			if n == 0 || off+n > len(key) || off+n > len(keyEnd) {
+				return nil, fmt.Errorf("invalid concat element %x", key)
+			}
+			fields = append(fields, concatFieldString(dtype, key[off:off+n], keyEnd[off:off+n]))
+			off += (n + 3) &^ 3
+		}
+		r = append(r, strings.Join(fields, " . "))
+	}
+	return r, nil
+}
+
+// concatFieldString 拼接字段的字符串形式, 地址区间可表示为网段时输出网段
+func concatFieldString(dtype string, start, end []byte) string {
+	switch dtype {
+	case SetDtypeIpv4, SetDtypeIpv6:
+		if bytes.Equal(start, end) {
+			return net.IP(start).String()
+		}
+		if mlen := ipRangeMask(start, end); mlen >= 0 {
+			return fmt.Sprintf("%s/%d", net.IP(start), mlen)
+		}
+		return fmt.Sprintf("%s-%s", net.IP(start), net.IP(end))
+	case SetDtypePort:
+		s, e := binary.BigEndian.Uint16(start), binary.BigEndian.Uint16(end)
+		if s == e {
+			return fmt.Sprintf("%d", s)
+		}
+		return fmt.Sprintf("%d-%d", s, e)
+	case SetDtypeIfname:
+		return ifnameString(start)
+	}
+	return codecRangeString(dtypeCodecs[dtype], start, end)
+}
+
+// ipRangeMask 闭区间[start, end]恰好为一个网段时返回掩码长度, 否则返回-1
+func ipRangeMask(start, end []byte) int {
+	var mlen = len(start) * 8
+	for i := 0; i < len(start)*8; i++ {
+		bit := byte(0x80) >> (i % 8)
+		s, e := start[i/8]&bit != 0, end[i/8]&bit != 0
+		if mlen == len(start)*8 {
+			if s == e {
+				continue
+			}
+			mlen = i
+		}
+		if s || !e {
+			return -1
+		}
+	}
+	return mlen
+}
+
+// elemOptWords 集合元素选项的关键字, 元素取值中不会出现
+var elemOptWords = []string{" timeout ", " expires ", " comment "}
+
+// splitElemOpts 拆分集合元素的取值与选项
+func splitElemOpts(s string) (string, string) {
+	idx := len(s)
+	for _, w := range elemOptWords {
+		if i := strings.Index(s+" ", w); i >= 0 && i < idx {
+			idx = i
+		}
+	}
+	return strings.TrimSpace(s[:idx]), s[idx:]
+}
+
+// cutWord 取出s中第一个以空白分隔的词
+func cutWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// elemValues 去除集合元素的选项
+func elemValues(elems []string) []string {
+	r := make([]string, len(elems))
+	for i, v := range elems {
+		r[i], _ = splitElemOpts(v)
+	}
+	return r
+}
+
+func elemsHaveTimeout(elems []string) bool {
+	for _, v := range elems {
+		if e, err := ParseSetElem(v); err == nil && e.Timeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nelemKey 内核元素的键, 用于对应元素取值与其选项
+func nelemKey(e nftables.SetElement) string {
+	return fmt.Sprintf("%x/%x/%t", e.Key, e.KeyEnd, e.IntervalEnd)
+}
+
+// setElemsToNElems 带选项的集合元素转换为内核元素, 超时同时设置在区间结束元素上
+func setElemsToNElems(dtype string, interval bool, elems []string) ([]nftables.SetElement, error) {
+	var (
+		values = make([]string, len(elems))
+		opts   = make(map[string]SetElem)
+	)
+	for i, v := range elems {
+		e, err := ParseSetElem(v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = e.Value
+		if e.Timeout == 0 && e.Comment == "" {
+			continue
+		}
+		nelems, err := setElemToNElem(dtype, interval, []string{e.Value})
+		if err != nil {
+			return nil, err
+		}
+		for _, ne := range nelems {
+			opts[nelemKey(ne)] = e
+		}
+	}
+	nelems, err := setElemToNElem(dtype, interval, values)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nelems {
+		if e, ok := opts[nelemKey(nelems[i])]; ok {
+			nelems[i].Timeout = e.Timeout
+			if !nelems[i].IntervalEnd {
+				nelems[i].Comment = e.Comment
+			}
 		}
 	}
 	return nelems, nil
 }
+
+// setElemOpts 为读取的集合元素附加内核元素的超时、剩余时间与注释, 与集合默认值相同的超时不输出
+func setElemOpts(dtype string, interval bool, timeout time.Duration, elems []string, nelems []nftables.SetElement) []string {
+	opts := make(map[string]nftables.SetElement)
+	for _, ne := range nelems {
+		if !ne.IntervalEnd && (ne.Timeout != 0 || ne.Expires != 0 || ne.Comment != "") {
+			opts[nelemKey(ne)] = ne
+		}
+	}
+	if len(opts) == 0 {
+		return elems
+	}
+	r := make([]string, len(elems))
+	for i, v := range elems {
+		r[i] = v
+		kelems, err := setElemToNElem(dtype, interval, []string{v})
+		if err != nil {
+			continue
+		}
+		for _, ke := range kelems {
+			if ne, ok := opts[nelemKey(ke)]; ok {
+				e := SetElem{Value: v, Timeout: ne.Timeout, Expires: ne.Expires, Comment: ne.Comment}
+				if e.Timeout == timeout {
+					e.Timeout = 0
+				}
+				r[i] = e.String()
+				break
+			}
+		}
+	}
+	return r
+}
+
+// nftDurationUnits nft时长的单位, 按从大到小的顺序输出
+var nftDurationUnits = []struct {
+	unit string
+	d    time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+	{"ms", time.Millisecond},
+}
+
+// formatNftDuration 以nft格式输出时长, 如 1d2h, 10m, 1s500ms
+func formatNftDuration(d time.Duration) string {
+	var b strings.Builder
+	for _, u := range nftDurationUnits {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.unit)
+			d -= n * u.d
+		}
+	}
+	if b.Len() == 0 {
+		return "0s"
+	}
+	return b.String()
+}
+
+// parseNftDuration 解析nft格式的时长, 单位为d/h/m/s/ms, 纯数字表示秒
+func parseNftDuration(s string) (time.Duration, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	var (
+		r    time.Duration
+		rest = s
+	)
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		n, err := strconv.ParseUint(rest[:i], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		var unit time.Duration
+		for _, u := range nftDurationUnits {
+			if u.unit == rest[i:j] {
+				unit = u.d
+			}
+		}
+		if unit == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		r += time.Duration(n) * unit
+		rest = rest[j:]
+	}
+	return r, nil
+}
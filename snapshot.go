@@ -0,0 +1,84 @@
+// +build linux
+
+package nftlib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// Snapshot 某一时刻的完整规则集, 可保存到文件并通过Conn.Restore原子恢复
+type Snapshot struct {
+	Created time.Time `json:"created"`
+	Ruleset *Ruleset  `json:"ruleset"`
+}
+
+// Snapshot 读取内核中所有表、集合及元素、链、规则
+func (d *Conn) Snapshot() (*Snapshot, error) {
+	rs, err := d.ListRuleset()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Created: time.Now(), Ruleset: rs}, nil
+}
+
+// Restore 清空规则集并重建快照中的所有对象
+// 清空与重建在独立的netlink批次中提交, 不包含当前连接已加入批次的操作, 内核原子切换, 失败时原规则集保持不变
+func (d *Conn) Restore(snap *Snapshot) error {
+	rc, err := d.restoreBatch(snap)
+	if err != nil {
+		return err
+	}
+	return rc.Commit()
+}
+
+// restoreBatch 创建新连接, 在其批次中加入清空规则集与重建快照的操作
+// 先在临时批次中重建以检查快照能否恢复, 无法恢复时不加入清空操作
+func (d *Conn) restoreBatch(snap *Snapshot) (*Conn, error) {
+	if err := d.newConn().ApplyRuleset(snap.Ruleset); err != nil {
+		return nil, err
+	}
+	rc := d.newConn()
+	rc.ClearAll()
+	if err := rc.ApplyRuleset(snap.Ruleset); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Save 以JSON格式将快照保存到文件, 规则含无法解析的表达式时无法保存, 返回DecodeError
+func (d *Snapshot) Save(path string) error {
+	for _, ts := range d.Ruleset.Tables {
+		for _, cs := range ts.Chains {
+			for _, rule := range cs.Rules {
+				if !rule.FullyDecoded() {
+					return newObjErr("save", ObjRule, &DecodeError{Exprs: rule.rawExprs()}).
+						table(ts.Table.Name).chain(cs.Chain.Name).handle(rule.Handle)
+				}
+			}
+		}
+	}
+	b, err := json.MarshalIndent(d, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// LoadSnapshot 从Save保存的文件中读取快照
+func LoadSnapshot(path string) (*Snapshot, error) {
+	var snap = new(Snapshot)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, snap); err != nil {
+		return nil, err
+	}
+	if snap.Ruleset == nil {
+		snap.Ruleset = new(Ruleset)
+	}
+	snap.Ruleset.link()
+	return snap, nil
+}
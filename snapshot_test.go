@@ -0,0 +1,86 @@
+// +build linux
+
+package nftlib
+
+import (
+	"errors"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot_SaveLoad(t *testing.T) {
+	rs, err := ParseRuleset(`table inet filter {
+	set allow {
+		type ipv4_addr
+		flags interval
+		elements = { 10.0.0.0/8 }
+	}
+	chain input {
+		type filter hook input priority 0; policy drop;
+		ip saddr @allow tcp dport 22 accept
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := &Snapshot{Created: time.Now(), Ruleset: rs}
+	path := filepath.Join(t.TempDir(), "ruleset.json")
+	if err = snap.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Ruleset.String() != rs.String() {
+		t.Fatalf("got:\n%s\nwant:\n%s", loaded.Ruleset, rs)
+	}
+	ts := loaded.Ruleset.Tables[0]
+	if ts.Sets[0].Table != ts.Table || ts.Chains[0].Rules[0].Chain != ts.Chains[0].Chain {
+		t.Fatal("references not linked after load")
+	}
+	if !loaded.Created.Equal(snap.Created) {
+		t.Fatalf("created time mismatch %v %v", loaded.Created, snap.Created)
+	}
+
+	// 含无法解析的表达式的规则无法保存
+	ts.Chains[0].Rules[0].Raw = []RuleRaw{{Exprs: []expr.Any{&expr.Quota{Bytes: 1000}}}}
+	if err = loaded.Save(path); !errors.Is(err, ErrUnsupportedExpr) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestConn_RestoreBatch(t *testing.T) {
+	rs, err := ParseRuleset(`table inet filter {
+	chain input {
+		type filter hook input priority filter; policy drop;
+		tcp dport 22 accept
+	}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &Conn{Conn: &nftables.Conn{}}
+	rc, err := conn.restoreBatch(&Snapshot{Ruleset: rs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc == conn || rc.Conn == conn.Conn {
+		t.Fatal("restore must use its own batch")
+	}
+
+	// 内存中的快照可以原样写回无法解析的表达式
+	rs.Tables[0].Chains[0].Rules[0].Raw = []RuleRaw{{Exprs: []expr.Any{&expr.Quota{Bytes: 1000}}}}
+	if _, err = conn.restoreBatch(&Snapshot{Ruleset: rs}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无法重建的快照不加入任何操作
+	rs.Tables[0].Sets = []*Set{{Name: "raw", DType: "0x1", Opaque: true}}
+	if rc, err = conn.restoreBatch(&Snapshot{Ruleset: rs}); !errors.Is(err, errOpaqueSet) || rc != nil {
+		t.Fatalf("unexpected conn %v error %v", rc, err)
+	}
+}
@@ -5,7 +5,6 @@ package nftlib
 import (
 	"errors"
 	"github.com/google/nftables"
-	"net"
 )
 
 const (
@@ -13,6 +12,8 @@ const (
 	TableFamilyIpv4   tableFamily = "ipv4"
 	TableFamilyIpv6   tableFamily = "ipv6"
 	TableFamilyBridge tableFamily = "bridge"
+	TableFamilyArp    tableFamily = "arp"
+	TableFamilyNetdev tableFamily = "netdev"
 )
 
 type tableFamily string
@@ -26,51 +27,60 @@ type Table struct {
 func (d *Table) AddSet(name, dtype string, drange bool, elems ...string) (*Set, error) {
 	nset, err := d.conn.GetSetByName(d.toNTable(), name)
 	if err == nil && nset != nil {
-		return nil, errors.New("named set already exist")
+		return nil, newObjErr("add", ObjSet, ErrAlreadyExists).table(d.Name).name(name)
 	}
 	var nsrv = nftables.TypeInvalid
 	if v, ok := dtypeList[dtype]; ok {
 		nsrv = v
 	}
 	if nsrv == nftables.TypeInvalid {
-		return nil, errors.New("invalid datatype")
+		return nil, newObjErr("add", ObjSet, errors.New("invalid datatype")).table(d.Name).name(name)
 	}
 	set := &Set{Name: name, conn: d.conn, Table: d, DType: dtype, Elements: elems, ElemRange: drange}
+	if err = d.addSet(set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// addSet 将集合加入当前批次, 不检查集合是否已存在
+func (d *Table) addSet(set *Set) error {
+	set.conn = d.conn
+	set.Table = d
+	if set.Opaque {
+		return newObjErr("add", ObjSet, errOpaqueSet).table(d.Name).name(set.Name)
+	}
 	nset, nelems, err := set.toNSet()
 	if err != nil {
-		return nil, err
+		return newObjErr("add", ObjSet, err).table(d.Name).name(set.Name)
 	}
-	if len(nelems) > 0 && drange {
-		switch dtype {
-		case SetDtypeIpv4:
-			nelems = append([]nftables.SetElement{{Key: make([]byte, net.IPv4len), IntervalEnd: true}}, nelems...)
-		case SetDtypeIpv6:
-			nelems = append([]nftables.SetElement{{Key: make([]byte, net.IPv6len), IntervalEnd: true}}, nelems...)
-		case SetDtypePort:
-			nelems = append([]nftables.SetElement{{Key: make([]byte, 2), IntervalEnd: true}}, nelems...)
-		}
+	if len(nelems) > 0 && set.ElemRange {
+		nelems = padIntervalElems(set.DType, nelems)
 	}
 
 	err = d.conn.AddSet(nset, nelems)
 	if err != nil {
-		return nil, err
+		return newObjErr("add", ObjSet, err).table(d.Name).name(set.Name)
 	}
-	return set, nil
+	c := d.change(ChangeAdd, ObjSet)
+	c.Name, c.New = set.Name, set.String()
+	d.conn.record(c)
+	return nil
 }
 
 func (d *Table) GetSetByName(name string) (*Set, error) {
 	nset, err := d.conn.GetSetByName(d.toNTable(), name)
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("get", ObjSet, err).table(d.Name).name(name)
 	}
 	nelems, err := d.conn.GetSetElements(nset)
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("get", ObjSet, err).table(d.Name).name(name)
 	}
 	set := &Set{conn: d.conn, Table: d}
 	err = set.toSet(*nset, nelems...)
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("get", ObjSet, err).table(d.Name).name(name)
 	}
 	return set, nil
 }
@@ -78,9 +88,10 @@ func (d *Table) GetSetByName(name string) (*Set, error) {
 func (d *Table) DelSet(set *Set) error {
 	nset, _, err := set.toNSet()
 	if err != nil {
-		return err
+		return newObjErr("delete", ObjSet, err).table(d.Name).name(set.Name)
 	}
 	d.conn.DelSet(nset)
+	d.recordDelSet(set.Name)
 	return nil
 }
 
@@ -88,17 +99,21 @@ func (d *Table) ListSet() ([]*Set, error) {
 	var setList []*Set
 	nsets, err := d.conn.GetSets(d.toNTable())
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("list", ObjSet, err).table(d.Name)
 	}
 	for _, nset := range nsets {
+		// 匿名集合属于引用它的规则, 由规则输出, 映射由ListMap返回
+		if nset.Anonymous || nset.IsMap {
+			continue
+		}
 		nelems, err := d.conn.GetSetElements(nset)
 		if err != nil {
-			return nil, err
+			return nil, newObjErr("list", ObjSet, err).table(d.Name).name(nset.Name)
 		}
 		set := &Set{conn: d.conn, Table: d}
 		err = set.toSet(*nset, nelems...)
 		if err != nil {
-			return nil, err
+			return nil, newObjErr("list", ObjSet, err).table(d.Name).name(nset.Name)
 		}
 		setList = append(setList, set)
 	}
@@ -117,33 +132,120 @@ func (d *Table) ClearSet() error {
 			return err
 		}
 		d.conn.DelSet(nset)
+		d.recordDelSet(set.Name)
+	}
+	return nil
+}
+
+// AddMap 创建映射, keyType为集合数据类型, dataType为MapDtypeVerdict或集合数据类型
+func (d *Table) AddMap(name, keyType, dataType string, drange bool, elems ...MapElement) (*Map, error) {
+	nset, err := d.conn.GetSetByName(d.toNTable(), name)
+	if err == nil && nset != nil {
+		return nil, newObjErr("add", ObjMap, ErrAlreadyExists).table(d.Name).name(name)
+	}
+	m := &Map{Name: name, conn: d.conn, Table: d, KeyType: keyType, DataType: dataType, ElemRange: drange,
+		Elements: elems}
+	if err = d.addMap(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// addMap 将映射加入当前批次, 不检查映射是否已存在
+func (d *Table) addMap(m *Map) error {
+	m.conn = d.conn
+	m.Table = d
+	nset, nelems, err := m.toNMap()
+	if err != nil {
+		return newObjErr("add", ObjMap, err).table(d.Name).name(m.Name)
+	}
+	if len(nelems) > 0 && m.ElemRange {
+		nelems = padIntervalElems(m.KeyType, nelems)
+	}
+	if err = d.conn.AddSet(nset, nelems); err != nil {
+		return newObjErr("add", ObjMap, err).table(d.Name).name(m.Name)
+	}
+	c := d.change(ChangeAdd, ObjMap)
+	c.Name, c.New = m.Name, m.String()
+	d.conn.record(c)
+	return nil
+}
+
+func (d *Table) GetMapByName(name string) (*Map, error) {
+	nset, err := d.conn.GetSetByName(d.toNTable(), name)
+	if err != nil {
+		return nil, newObjErr("get", ObjMap, err).table(d.Name).name(name)
 	}
+	if !nset.IsMap {
+		return nil, newObjErr("get", ObjMap, ErrMapNotFound).table(d.Name).name(name)
+	}
+	nelems, err := d.conn.GetSetElements(nset)
+	if err != nil {
+		return nil, newObjErr("get", ObjMap, err).table(d.Name).name(name)
+	}
+	m := &Map{conn: d.conn, Table: d}
+	if err = m.toMap(*nset, nelems...); err != nil {
+		return nil, newObjErr("get", ObjMap, err).table(d.Name).name(name)
+	}
+	return m, nil
+}
+
+func (d *Table) DelMap(m *Map) error {
+	nset, _, err := m.toNMap()
+	if err != nil {
+		return newObjErr("delete", ObjMap, err).table(d.Name).name(m.Name)
+	}
+	d.conn.DelSet(nset)
+	d.recordDelMap(m.Name)
 	return nil
 }
 
+func (d *Table) ListMap() ([]*Map, error) {
+	var maps []*Map
+	nsets, err := d.conn.GetSets(d.toNTable())
+	if err != nil {
+		return nil, newObjErr("list", ObjMap, err).table(d.Name)
+	}
+	for _, nset := range nsets {
+		if nset.Anonymous || !nset.IsMap {
+			continue
+		}
+		nelems, err := d.conn.GetSetElements(nset)
+		if err != nil {
+			return nil, newObjErr("list", ObjMap, err).table(d.Name).name(nset.Name)
+		}
+		m := &Map{conn: d.conn, Table: d}
+		if err = m.toMap(*nset, nelems...); err != nil {
+			return nil, newObjErr("list", ObjMap, err).table(d.Name).name(nset.Name)
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
 func (d *Table) GetChainByName(name string) (*Chain, error) {
 	nch, err := d.conn.ListChains()
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("get", ObjChain, err).table(d.Name).name(name)
 	}
 	for _, nc := range nch {
-		if nc.Name == name && nc.Table.Name == d.Name {
+		if nc.Name == name && nc.Table.Name == d.Name && nc.Table.Family == d.toNTable().Family {
 			ch := &Chain{Conn: d.conn, Table: d}
 			ch.toCh(*nc)
 			return ch, nil
 		}
 	}
-	return nil, errors.New("not found")
+	return nil, newObjErr("get", ObjChain, ErrChainNotFound).table(d.Name).name(name)
 }
 
 func (d *Table) ListChain() ([]*Chain, error) {
 	var chs []*Chain
 	nchs, err := d.conn.ListChains()
 	if err != nil {
-		return nil, err
+		return nil, newObjErr("list", ObjChain, err).table(d.Name)
 	}
 	for _, nch := range nchs {
-		if nch.Table.Name == d.Name {
+		if nch.Table.Name == d.Name && nch.Table.Family == d.toNTable().Family {
 			ch := &Chain{Table: d, Conn: d.conn}
 			ch.toCh(*nch)
 			chs = append(chs, ch)
@@ -152,12 +254,17 @@ func (d *Table) ListChain() ([]*Chain, error) {
 	return chs, nil
 }
 
-func (d *Table) AddBaseChain(chain *Chain) *Chain {
-	chain.Conn = d.conn
+// AddBaseChain 添加链, 加入批次前校验链的类型、钩子与表协议族
+func (d *Table) AddBaseChain(chain *Chain) (*Chain, error) {
 	chain.Table = d
+	if err := chain.Validate(); err != nil {
+		return nil, newObjErr("add", ObjChain, err).table(d.Name).name(chain.Name)
+	}
+	chain.Conn = d.conn
 	nch := chain.toNch()
 	d.conn.AddChain(nch)
-	return chain
+	d.recordAddChain(chain)
+	return chain, nil
 }
 
 func (d *Table) AddRegularChain(name string) (*Chain, error) {
@@ -168,6 +275,7 @@ func (d *Table) AddRegularChain(name string) (*Chain, error) {
 	}
 	nch := ch.toNch()
 	d.conn.AddChain(nch)
+	d.recordAddChain(ch)
 	return ch, nil
 }
 
@@ -175,6 +283,29 @@ func (d *Table) Commit() error {
 	return d.conn.Commit()
 }
 
+// change 创建表内对象的变更记录
+func (d *Table) change(op changeOp, kind ObjKind) *Change {
+	return &Change{Op: op, Kind: kind, Family: d.Family, Table: d.Name}
+}
+
+func (d *Table) recordDelSet(name string) {
+	c := d.change(ChangeDelete, ObjSet)
+	c.Name = name
+	d.conn.record(c)
+}
+
+func (d *Table) recordDelMap(name string) {
+	c := d.change(ChangeDelete, ObjMap)
+	c.Name = name
+	d.conn.record(c)
+}
+
+func (d *Table) recordAddChain(chain *Chain) {
+	c := d.change(ChangeAdd, ObjChain)
+	c.Name, c.New = chain.Name, (&ChainSpec{Chain: chain}).String()
+	d.conn.record(c)
+}
+
 func (d *Table) toTable(nTable nftables.Table) error {
 	switch nTable.Family {
 	case nftables.TableFamilyINet:
@@ -189,6 +320,12 @@ func (d *Table) toTable(nTable nftables.Table) error {
 	case nftables.TableFamilyBridge:
 		d.Name = nTable.Name
 		d.Family = TableFamilyBridge
+	case nftables.TableFamilyARP:
+		d.Name = nTable.Name
+		d.Family = TableFamilyArp
+	case nftables.TableFamilyNetdev:
+		d.Name = nTable.Name
+		d.Family = TableFamilyNetdev
 	}
 	if d.Name == "" {
 		return errors.New("toTable failed: nil table name")
@@ -211,6 +348,10 @@ func (d *Table) toNTable() *nftables.Table {
 		ntbl.Family = nftables.TableFamilyIPv6
 	case TableFamilyBridge:
 		ntbl.Family = nftables.TableFamilyBridge
+	case TableFamilyArp:
+		ntbl.Family = nftables.TableFamilyARP
+	case TableFamilyNetdev:
+		ntbl.Family = nftables.TableFamilyNetdev
 	}
 	return ntbl
 }
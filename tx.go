@@ -0,0 +1,159 @@
+// +build linux
+
+package nftlib
+
+import (
+	"github.com/google/nftables"
+	"sync"
+	"time"
+)
+
+const (
+	txOpen txState = iota
+	txCommitted
+	txPending
+	txRolledBack
+	txExpired
+)
+
+type txState int
+
+// Tx 显式事务, 拥有独立的批次, 通过事务获取的表、链、集合、规则的修改只加入该批次
+// Commit一次性提交批次中的所有操作, Ops返回已加入批次的操作列表
+type Tx struct {
+	*Conn
+	mu    sync.Mutex
+	ops   []*Change
+	state txState
+	// restore CommitConfirmed提交前构建的恢复批次, 未确认时提交以恢复规则集
+	restore *Conn
+	timer   *time.Timer
+	err     error
+}
+
+// Begin 开启事务, 事务与当前连接位于同一网络命名空间, 但批次相互独立
+func (d *Conn) Begin() *Tx {
+	tx := &Tx{Conn: &Conn{Conn: &nftables.Conn{NetNS: d.NetNS}}}
+	tx.Conn.tx = tx
+	return tx
+}
+
+// Ops 返回已加入事务批次的操作
+func (d *Tx) Ops() []*Change {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Change{}, d.ops...)
+}
+
+// Commit 提交事务批次中的所有操作
+func (d *Tx) Commit() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != txOpen {
+		return ErrTxDone
+	}
+	if err := d.flush(); err != nil {
+		return err
+	}
+	d.state = txCommitted
+	return nil
+}
+
+// CommitConfirmed 提交事务, 提交前保存规则集快照并构建恢复批次, 快照无法恢复时不提交并返回错误
+// 若timeout内未调用Confirm, 自动恢复到提交前的规则集, 防止远程下发错误规则后失联
+func (d *Tx) CommitConfirmed(timeout time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != txOpen {
+		return ErrTxDone
+	}
+	snap, err := d.newConn().Snapshot()
+	if err != nil {
+		return err
+	}
+	restore, err := d.restoreBatch(snap)
+	if err != nil {
+		return err
+	}
+	if err = d.flush(); err != nil {
+		return err
+	}
+	d.restore = restore
+	d.state = txPending
+	d.timer = time.AfterFunc(timeout, d.expire)
+	return nil
+}
+
+// Confirm 确认CommitConfirmed提交的变更, 取消自动恢复
+// 超时已自动恢复时返回ErrConfirmTimeout, 恢复失败时返回恢复的错误
+func (d *Tx) Confirm() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.state {
+	case txPending:
+		d.timer.Stop()
+		d.state = txCommitted
+		d.restore = nil
+		return nil
+	case txExpired:
+		if d.err != nil {
+			return d.err
+		}
+		return ErrConfirmTimeout
+	}
+	return ErrTxDone
+}
+
+// Rollback 回滚事务
+// 未提交时丢弃批次中的操作, CommitConfirmed提交后未确认时立即恢复提交前的规则集
+func (d *Tx) Rollback() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch d.state {
+	case txOpen:
+		d.Conn.Conn = &nftables.Conn{NetNS: d.NetNS}
+		d.ops = nil
+		d.state = txRolledBack
+		return nil
+	case txPending:
+		d.timer.Stop()
+		d.state = txRolledBack
+		d.err = d.restore.Commit()
+		d.restore = nil
+		return d.err
+	}
+	return ErrTxDone
+}
+
+// expire 确认超时, 恢复提交前的规则集
+func (d *Tx) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state != txPending {
+		return
+	}
+	d.state = txExpired
+	d.err = d.restore.Commit()
+	d.restore = nil
+}
+
+func (d *Tx) flush() error {
+	if err := d.Conn.Flush(); err != nil {
+		d.Conn.Conn = &nftables.Conn{NetNS: d.NetNS}
+		return newObjErr("commit", ObjRuleset, err)
+	}
+	return nil
+}
+
+// discard 批次被丢弃时清空已记录的操作
+func (d *Tx) discard() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ops = nil
+}
+
+func (d *Tx) record(c *Change) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ops = append(d.ops, c)
+}
@@ -0,0 +1,53 @@
+// +build linux
+
+package nftlib
+
+import (
+	"errors"
+	"github.com/google/nftables"
+	"testing"
+)
+
+func TestTx_Ops(t *testing.T) {
+	conn := &Conn{Conn: &nftables.Conn{}}
+	tx := conn.Begin()
+	tbl := tx.ADDTable(&Table{Name: "filter", Family: TableFamilyInet})
+	ch, err := tbl.AddBaseChain(&Chain{Name: "input", Type: ChainTypeFilter, Hook: ChainHookInput, Policy: ChainPolicyAccept})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tbl.AddBaseChain(&Chain{Name: "pre", Type: ChainTypeNat, Hook: ChainHookForward}); !errors.Is(err, ErrInvalidChain) {
+		t.Fatalf("expect ErrInvalidChain, got %v", err)
+	}
+	if err = ch.AddRule(&Rule{L4Proto: "tcp", L4DstPort: "22", Action: "accept"}); err != nil {
+		t.Fatal(err)
+	}
+	ch.ClearRule()
+	want := []string{
+		"+ table inet filter",
+		"+ chain inet filter input { type filter hook input priority filter; policy accept; }",
+		"+ rule inet filter input tcp dport 22 accept",
+		"flush chain inet filter input",
+	}
+	ops := tx.Ops()
+	if len(ops) != len(want) {
+		t.Fatalf("got %d ops, want %d", len(ops), len(want))
+	}
+	for i, op := range ops {
+		if op.String() != want[i] {
+			t.Errorf("op %d: got %q, want %q", i, op, want[i])
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Ops()) != 0 {
+		t.Fatal("ops not cleared after rollback")
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("expect ErrTxDone, got %v", err)
+	}
+	if err := tx.Confirm(); !errors.Is(err, ErrTxDone) {
+		t.Fatalf("expect ErrTxDone, got %v", err)
+	}
+}